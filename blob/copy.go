@@ -0,0 +1,40 @@
+package blob
+
+import (
+	"mime"
+	"os"
+	"path/filepath"
+	"wtfTwitter/domain"
+)
+
+// CopyDir copies every file stored in dir by an FSStore into dst, under the same key, and returns the
+// number of copied files. Blobs already stored in dst are overwritten, so an interrupted copy can
+// simply be started again. The files in dir are left untouched.
+func CopyDir(dst domain.BlobStore, dir string) (int, error) {
+	keys, err := NewFSStore(dir).List("")
+	if err != nil {
+		return 0, err
+	}
+	copied := 0
+	for _, key := range keys {
+		if err := copyFile(dst, key, filepath.Join(dir, filepath.FromSlash(key))); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	return copied, nil
+}
+
+// copyFile stores the file at path in dst under the given key.
+func copyFile(dst domain.BlobStore, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return dst.Put(key, f, info.Size(), mime.TypeByExtension(filepath.Ext(path)))
+}
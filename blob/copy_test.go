@@ -0,0 +1,77 @@
+package blob
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCopyDir copies an images directory into S3, as the -migrate-images flag does.
+func TestCopyDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"tweet/2/a.png":     "png data",
+		"tweet/10/b.jpeg":   "jpeg data",
+		"user/1/avatar.gif": "gif data",
+	}
+	for key, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An upload that was interrupted is left behind.
+	if err := os.WriteFile(filepath.Join(dir, "tweet", "2", ".upload-123"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFakeS3(t)
+	s := f.store(t, true, testSecretKey)
+	n, err := CopyDir(s, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(files) || len(f.objects) != len(files) {
+		t.Fatalf("copied %d files, stored %d objects, want %d", n, len(f.objects), len(files))
+	}
+	for key, data := range files {
+		if got := get(t, s, key); got != data {
+			t.Errorf("got %q for %s, want %q", got, key, data)
+		}
+		if ct := f.objects[key].contentType; !strings.HasPrefix(ct, "image/") {
+			t.Errorf("got content type %q for %s", ct, key)
+		}
+	}
+	// The files are left in place.
+	if keys, err := NewFSStore(dir).List(""); err != nil || len(keys) != len(files) {
+		t.Errorf("got %q, %v in the directory after copying", keys, err)
+	}
+
+	// Copying again overwrites what has been copied.
+	f.objects["tweet/2/a.png"] = fakeObject{data: []byte("stale")}
+	if n, err := CopyDir(s, dir); err != nil || n != len(files) {
+		t.Fatalf("copying again: got %d, %v", n, err)
+	}
+	if got := get(t, s, "tweet/2/a.png"); got != "png data" {
+		t.Errorf("got %q after copying again", got)
+	}
+}
+
+// TestCopyDirFailure makes sure a failed upload stops the copy and is reported.
+func TestCopyDirFailure(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "tweet", "2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tweet", "2", "a.png"), []byte("png data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeS3(t)
+	if n, err := CopyDir(f.store(t, true, "wrong-secret-key"), dir); err == nil || n != 0 {
+		t.Errorf("got %d, %v, want an error", n, err)
+	}
+}
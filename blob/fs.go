@@ -0,0 +1,143 @@
+package blob
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// FSStore is a domain.BlobStore that stores blobs as files in a directory of the local filesystem.
+// The key "tweet/2/unique_name.png" is stored in the file {dir}/tweet/2/unique_name.png.
+// It's meant for development and single instance setups, since files aren't shared between hosts.
+type FSStore struct {
+	dir string
+}
+
+// NewFSStore returns an instance of FSStore, storing blobs in dir.
+func NewFSStore(dir string) *FSStore {
+	return &FSStore{dir: dir}
+}
+
+// Ensure the FSStore struct properly implements the domain.BlobStore interface.
+var _ domain.BlobStore = &FSStore{}
+
+// Put writes the blob to a temporary file first and then renames it, so that readers never see
+// a partially written file.
+func (s *FSStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Get opens the file of the blob.
+func (s *FSStore) Get(key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, errs.Errorf(errs.ENOTFOUND, "File not found.")
+	}
+	return f, err
+}
+
+// Delete removes the file of the blob, along with its directory if it's empty afterwards.
+func (s *FSStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Removing a directory fails as long as it has files left, which is fine.
+	if dir := filepath.Dir(p); dir != filepath.Clean(s.dir) {
+		_ = os.Remove(dir)
+	}
+	return nil
+}
+
+// List walks the directory the prefix points into and returns the keys of the files starting with prefix.
+// Temporary files of uploads in progress are skipped.
+func (s *FSStore) List(prefix string) ([]string, error) {
+	root := s.dir
+	if dir := path.Dir(prefix + "x"); dir != "." {
+		p, err := s.path(dir)
+		if err != nil {
+			return nil, err
+		}
+		root = p
+	}
+	keys := []string{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// SignedURL returns an empty string, since the files are served by the app itself.
+func (s *FSStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	return "", nil
+}
+
+// path returns the path of the file the blob with the given key is stored in.
+// Keys must not leave the store's directory.
+func (s *FSStore) path(key string) (string, error) {
+	if !ValidKey(key) {
+		return "", errs.Errorf(errs.EINVALID, "Invalid file name.")
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// ValidKey reports whether key is a clean, relative, slash-separated path, e.g. "tweet/2/unique_name.png".
+func ValidKey(key string) bool {
+	return key != "" && key != "." &&
+		key == path.Clean(key) &&
+		!strings.HasPrefix(key, "/") &&
+		!strings.HasPrefix(key, "../") &&
+		key != ".." &&
+		!strings.Contains(key, "\\")
+}
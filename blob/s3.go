@@ -0,0 +1,326 @@
+package blob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+const (
+	// s3Algorithm is the signing algorithm of AWS Signature Version 4.
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	// s3UnsignedPayload is sent instead of the hash of a request body, so uploads can be streamed.
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// s3EmptyPayload is the hash of an empty request body.
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// s3MaxURLLifetime is the longest lifetime of a presigned URL that S3 accepts.
+	s3MaxURLLifetime = 7 * 24 * time.Hour
+)
+
+// S3Store is a domain.BlobStore that stores blobs as objects in a bucket of an S3-compatible object
+// storage, like AWS S3 or MinIO. Requests are signed with AWS Signature Version 4. With pathStyle,
+// the bucket is addressed as {endpoint}/{bucket}/{key}, which is what MinIO and most self-hosted
+// stores expect. Otherwise, it's addressed as {bucket}.{endpoint host}/{key}, like AWS S3 prefers.
+type S3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+	now       func() time.Time
+}
+
+// NewS3Store returns an instance of S3Store. endpoint is the base URL of the storage,
+// e.g. "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000".
+// The region defaults to "us-east-1", which is also what MinIO uses unless configured otherwise.
+func NewS3Store(endpoint, region, bucket, accessKey, secretKey string, pathStyle bool) (*S3Store, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q, must be an http(s) URL", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("no s3 bucket configured")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Store{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		pathStyle: pathStyle,
+		client:    &http.Client{Timeout: time.Minute},
+		now:       time.Now,
+	}, nil
+}
+
+// Ensure the S3Store struct properly implements the domain.BlobStore interface.
+var _ domain.BlobStore = &S3Store{}
+
+// Put uploads the blob as an object. S3 needs to know the size of an upload in advance.
+func (s *S3Store) Put(key string, r io.Reader, size int64, contentType string) error {
+	if !ValidKey(key) {
+		return errs.Errorf(errs.EINVALID, "Invalid file name.")
+	}
+	if size < 0 {
+		return fmt.Errorf("s3: cannot upload %s of unknown size", key)
+	}
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key, nil).String(), r)
+	if err != nil {
+		return err
+	}
+	// A zero ContentLength with a body would make the client fall back to chunked encoding.
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req, s3UnsignedPayload)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Get downloads the object of the blob. The caller must close the returned body.
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	if !ValidKey(key) {
+		return nil, errs.Errorf(errs.EINVALID, "Invalid file name.")
+	}
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key, nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete deletes the object of the blob. Deleting an object that doesn't exist succeeds.
+func (s *S3Store) Delete(key string) error {
+	if !ValidKey(key) {
+		return errs.Errorf(errs.EINVALID, "Invalid file name.")
+	}
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key, nil).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		if errs.ErrorCode(err) == errs.ENOTFOUND {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// s3ListResult is the part of a ListObjectsV2 response that List needs.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List lists the keys of the bucket starting with prefix, a page of up to 1000 keys at a time.
+func (s *S3Store) List(prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequest(http.MethodGet, s.objectURL("", query).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, s3EmptyPayload)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// SignedURL returns a presigned URL to download the object of the blob until ttl has passed.
+// The lifetime is capped at the 7 days S3 allows.
+func (s *S3Store) SignedURL(key string, ttl time.Duration) (string, error) {
+	if !ValidKey(key) {
+		return "", errs.Errorf(errs.EINVALID, "Invalid file name.")
+	}
+	if ttl > s3MaxURLLifetime {
+		ttl = s3MaxURLLifetime
+	}
+	t := s.now().UTC()
+	amzDate, scope := s.scope(t)
+	u := s.objectURL(key, url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.accessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	})
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(t, amzDate, scope, canonical)
+	return u.String(), nil
+}
+
+// objectURL builds the URL of an object, or of the bucket itself if key is empty.
+// The path and query are encoded the way Signature Version 4 expects them in the canonical request.
+func (s *S3Store) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.pathStyle {
+		p += "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	if key != "" || !s.pathStyle {
+		p += "/" + key
+	}
+	u.Path = p
+	segments := strings.Split(p, "/")
+	for i := range segments {
+		segments[i] = s3Escape(segments[i])
+	}
+	u.RawPath = strings.Join(segments, "/")
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do signs and sends a request. Responses with an error status are turned into errors,
+// an ENOTFOUND error if the object or bucket doesn't exist.
+func (s *S3Store) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errs.Errorf(errs.ENOTFOUND, "File not found.")
+	}
+	var e struct {
+		Code    string
+		Message string
+	}
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+	return nil, fmt.Errorf("s3: %s %s: %s %s: %s", req.Method, req.URL.Path, resp.Status, e.Code, e.Message)
+}
+
+// sign adds the Signature Version 4 authorization header to a request. The host, the payload
+// hash and the date are signed.
+func (s *S3Store) sign(req *http.Request, payloadHash string) {
+	t := s.now().UTC()
+	amzDate, scope := s.scope(t)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, scope, signedHeaders, s.signature(t, amzDate, scope, canonical)))
+}
+
+// scope returns the timestamp and the credential scope of a signature made at time t.
+func (s *S3Store) scope(t time.Time) (amzDate, scope string) {
+	return t.Format("20060102T150405Z"), t.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature signs the canonical request with a key derived from the secret key, the date and the region.
+func (s *S3Store) signature(t time.Time, amzDate, scope, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{t.Format("20060102"), s.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return hex.EncodeToString(key)
+}
+
+// s3CanonicalQuery encodes a query sorted by key, as Signature Version 4 expects it.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes every byte of s except the unreserved characters of RFC 3986.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -4,17 +4,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"wtfTwitter/domain"
+	"wtfTwitter/oauth"
 )
 
 // Config represents a set of configurations needed to run the app.
 type Config struct {
-	Port      int            `json:"port"`
-	Env       string         `json:"env"`
-	ClientUrl string         `json:"client_url"`
-	Pepper    string         `json:"pepper"`
-	HMACKey   string         `json:"hmac_key"`
-	Database  PostgresConfig `json:"database"`
-	Github    OAuthConfig    `json:"github"`
+	Port          int            `json:"port"`
+	Env           string         `json:"env"`
+	ClientUrl     string         `json:"client_url"`
+	Pepper        string         `json:"pepper"`
+	HMACKey       string         `json:"hmac_key"`
+	EncryptionKey string         `json:"encryption_key"`
+	Database      PostgresConfig `json:"database"`
+	Github        OAuthConfig    `json:"github"`
+	OAuth         []oauth.Config `json:"oauth"`
+	Mailer        MailerConfig   `json:"mailer"`
+	WebAuthn      WebAuthnConfig `json:"webauthn"`
+	Storage       StorageConfig  `json:"storage"`
 }
 
 // IsProd determines if we're in a production environment or not. The resulting boolean is used
@@ -44,12 +51,20 @@ func (pc PostgresConfig) ConnectionInfo() string {
 // DefaultConfig returns a Config object populated with default dev environment configuration values.
 func DefaultConfig() Config {
 	return Config{
-		Port:      1111,
-		Env:       "dev",
-		ClientUrl: "http://localhost:4200",
-		Pepper:    "secret-random-string",
-		HMACKey:   "secret-hmac-key",
-		Database:  DefaultPostgresConfig(),
+		Port:          1111,
+		Env:           "dev",
+		ClientUrl:     "http://localhost:4200",
+		Pepper:        "secret-random-string",
+		HMACKey:       "secret-hmac-key",
+		EncryptionKey: "secret-encryption-key",
+		Database:      DefaultPostgresConfig(),
+		Mailer:        MailerConfig{Dir: "./mails/"},
+		WebAuthn: WebAuthnConfig{
+			RPID:   "localhost",
+			RPName: "Twitter Clone",
+			Origin: "http://localhost:4200",
+		},
+		Storage: StorageConfig{Type: "fs", Dir: domain.ImagesBaseDir},
 	}
 }
 
@@ -65,8 +80,53 @@ func DefaultPostgresConfig() PostgresConfig {
 	}
 }
 
+// MailerConfig represents configurations needed to send emails. If no SMTP host is configured,
+// emails aren't delivered, but written to files in Dir, or to the log if Dir is empty as well.
+type MailerConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+	Dir      string `json:"dir"`
+}
+
+// WebAuthnConfig represents configurations needed for passkeys. RPID is the domain passkeys
+// are bound to (the client's host or a parent domain of it), Origin is the client's origin
+// as seen by the browser. Changing RPID makes all registered passkeys unusable.
+type WebAuthnConfig struct {
+	RPID   string `json:"rp_id"`
+	RPName string `json:"rp_name"`
+	Origin string `json:"origin"`
+}
+
+// StorageConfig represents configurations of where uploaded images are stored. With the type "fs",
+// they are stored in the directory Dir of the local filesystem, which is the default. With the type
+// "s3", they are stored in Bucket of any S3-compatible object storage, like AWS S3 or MinIO, and
+// served from there. Most self-hosted storages, like MinIO, need PathStyle to be set.
+type StorageConfig struct {
+	Type      string `json:"type"`
+	Dir       string `json:"dir"`
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	PathStyle bool   `json:"path_style"`
+}
+
+// ImagesDir returns the directory images are stored in with the type "fs". It's also the directory
+// that existing images are copied from when they are migrated to another storage.
+func (sc StorageConfig) ImagesDir() string {
+	if sc.Dir == "" {
+		return domain.ImagesBaseDir
+	}
+	return sc.Dir
+}
+
 // OAuthConfig is a template to hold provider-specific OAuth configuration.
 // The actual credentials for each OAuth provider are in .conf.json.
+// It's the legacy format of the "github" field. New providers are listed in the "oauth" field.
 type OAuthConfig struct {
 	ID          string `json:"id"`
 	Secret      string `json:"secret"`
@@ -75,6 +135,26 @@ type OAuthConfig struct {
 	TokenURL    string `json:"token_url"`
 }
 
+// OAuthProviders returns the configurations of all OAuth providers. A Github app configured
+// in the legacy "github" field is included, unless the "oauth" field lists one as well.
+func (c Config) OAuthProviders() []oauth.Config {
+	providers := c.OAuth
+	if c.Github.ID == "" {
+		return providers
+	}
+	for _, p := range providers {
+		if p.Name == oauth.TypeGithub || (p.Name == "" && p.Type == oauth.TypeGithub) {
+			return providers
+		}
+	}
+	return append(providers, oauth.Config{
+		Type:         oauth.TypeGithub,
+		ClientID:     c.Github.ID,
+		ClientSecret: c.Github.Secret,
+		RedirectURL:  c.Github.RedirectURL,
+	})
+}
+
 // LoadConfig tries to load production configuration data from a .config.json file,
 // decode the data into a Config object and return it. If no config file is found
 // it returns the DefaultConfig data meant for dev environments.
@@ -91,6 +171,11 @@ func LoadConfig(configFileRequired bool) Config {
 	if err := json.NewDecoder(f).Decode(&c); err != nil {
 		panic(err)
 	}
+	// Secrets of two-factor authentication are encrypted with EncryptionKey. In production it must be
+	// set, and not to the dev default, which anyone can read in the source code.
+	if configFileRequired && (c.EncryptionKey == "" || c.EncryptionKey == DefaultConfig().EncryptionKey) {
+		panic("encryption_key must be set to a secret value in .config.json")
+	}
 	fmt.Println("Successfully loaded .config.json")
 	return c
 }
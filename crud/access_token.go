@@ -0,0 +1,276 @@
+package crud
+
+import (
+	"gorm.io/gorm"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// accessTokenPrefix is put in front of every personal access token, so leaked tokens are easy
+// to recognize, for example by secret scanners.
+const accessTokenPrefix = "wtt_"
+
+// maxAccessTokens limits the number of access tokens a user can have.
+const maxAccessTokens = 50
+
+// AccessTokenService manages personal access tokens.
+// It implements the domain.AccessTokenService interface.
+type AccessTokenService struct {
+	accessTokenValidator
+}
+
+// accessTokenValidator runs validations on incoming AccessToken data.
+// On success, it passes the data on to accessTokenGorm.
+// Otherwise, it returns the error of the validation that has failed.
+type accessTokenValidator struct {
+	hmac HMAC
+	accessTokenGorm
+}
+
+// accessTokenGorm runs CRUD operations on the database using incoming AccessToken data.
+// It assumes that data has been validated. On success, it returns nil.
+// Otherwise, it returns the error of the operation that has failed.
+type accessTokenGorm struct {
+	db *gorm.DB
+}
+
+// NewAccessTokenService returns an instance of AccessTokenService.
+func NewAccessTokenService(db *gorm.DB, hmacKey string) *AccessTokenService {
+	return &AccessTokenService{
+		accessTokenValidator{
+			hmac: newHMAC(hmacKey),
+			accessTokenGorm: accessTokenGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// Ensure the AccessTokenService struct properly implements the domain.AccessTokenService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.AccessTokenService = &AccessTokenService{}
+
+// ByToken hashes an access token and passes the hash on to accessTokenGorm.ByTokenHash,
+// which looks up the matching access token, unless it has expired.
+func (av *accessTokenValidator) ByToken(token string) (*domain.AccessToken, error) {
+	if !strings.HasPrefix(token, accessTokenPrefix) {
+		return nil, errs.Errorf(errs.EUNAUTHORIZED, "Invalid access token.")
+	}
+	return av.accessTokenGorm.ByTokenHash(av.hmac.hash(token))
+}
+
+// Create runs validations needed for creating new AccessToken database records.
+// It creates the token itself, which is returned to the user exactly once.
+func (av *accessTokenValidator) Create(accessToken *domain.AccessToken) error {
+	err := runAccessTokenValFns(accessToken,
+		av.userIdValid,
+		av.nameRequired,
+		av.nameMaxLength,
+		av.scopeValid,
+		av.expiryInFuture,
+		av.countBelowMax,
+		av.tokenSet)
+	if err != nil {
+		return err
+	}
+	return av.accessTokenGorm.Create(accessToken)
+}
+
+// Touch records that the access token is being used right now.
+// It only writes to the database if the last write is some time ago.
+func (av *accessTokenValidator) Touch(accessToken *domain.AccessToken) error {
+	if accessToken.LastUsedAt != nil && time.Since(*accessToken.LastUsedAt) < sessionTouchInterval {
+		return nil
+	}
+	if err := runAccessTokenValFns(accessToken, av.idValid); err != nil {
+		return err
+	}
+	now := time.Now()
+	accessToken.LastUsedAt = &now
+	return av.accessTokenGorm.Touch(accessToken)
+}
+
+// Delete runs validations needed for deleting existing AccessToken database records.
+func (av *accessTokenValidator) Delete(accessToken *domain.AccessToken) error {
+	if err := runAccessTokenValFns(accessToken, av.idValid); err != nil {
+		return err
+	}
+	return av.accessTokenGorm.Delete(accessToken)
+}
+
+// runAccessTokenValFns runs any number of functions of type accessTokenValFn on the passed in AccessToken object.
+// If none of them returns an error, it returns nil. Otherwise, it returns the respective error.
+func runAccessTokenValFns(accessToken *domain.AccessToken, fns ...accessTokenValFn) error {
+	for _, fn := range fns {
+		if err := fn(accessToken); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An accessTokenValFn is any function that takes in a pointer to a domain.AccessToken object and returns an error.
+type accessTokenValFn func(accessToken *domain.AccessToken) error
+
+// countBelowMax makes sure the user doesn't have too many personal access tokens already.
+func (av *accessTokenValidator) countBelowMax(accessToken *domain.AccessToken) error {
+	var count int64
+	err := av.db.Model(&domain.AccessToken{}).
+		Where("user_id = ? AND client_id IS NULL", accessToken.UserID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count >= maxAccessTokens {
+		return errs.Errorf(errs.EINVALID, "You can't have more than %d access tokens.", maxAccessTokens)
+	}
+	return nil
+}
+
+// expiryInFuture makes sure the access token doesn't expire right away.
+// A token without expiry never expires.
+func (av *accessTokenValidator) expiryInFuture(accessToken *domain.AccessToken) error {
+	if accessToken.ExpiresAt != nil && !accessToken.ExpiresAt.After(time.Now()) {
+		return errs.Errorf(errs.EINVALID, "The expiry date must be in the future.")
+	}
+	return nil
+}
+
+// idValid makes sure that the ID of the access token is greater than 0.
+func (av *accessTokenValidator) idValid(accessToken *domain.AccessToken) error {
+	if accessToken.ID <= 0 {
+		return errs.IdInvalid
+	}
+	return nil
+}
+
+// nameMaxLength makes sure the access token's name is not longer than 50 characters.
+func (av *accessTokenValidator) nameMaxLength(accessToken *domain.AccessToken) error {
+	if utf8.RuneCountInString(accessToken.Name) > 50 {
+		return errs.Errorf(errs.EINVALID, "The name must not be longer than 50 characters.")
+	}
+	return nil
+}
+
+// nameRequired trims the access token's name and makes sure it's not empty.
+func (av *accessTokenValidator) nameRequired(accessToken *domain.AccessToken) error {
+	accessToken.Name = strings.TrimSpace(accessToken.Name)
+	if accessToken.Name == "" {
+		return errs.Errorf(errs.EINVALID, "Please name the access token.")
+	}
+	return nil
+}
+
+// scopeValid makes sure the access token has at least one scope and only known scopes.
+func (av *accessTokenValidator) scopeValid(accessToken *domain.AccessToken) error {
+	scope, err := normalizeScope(accessToken.Scope)
+	if err != nil {
+		return err
+	}
+	accessToken.Scope = scope
+	return nil
+}
+
+// tokenSet creates the access token and its hash.
+func (av *accessTokenValidator) tokenSet(accessToken *domain.AccessToken) error {
+	token, err := bytesToString(RememberTokenBytes)
+	if err != nil {
+		return err
+	}
+	accessToken.Token = accessTokenPrefix + token
+	accessToken.TokenHash = av.hmac.hash(accessToken.Token)
+	return nil
+}
+
+// userIdValid ensures that the userId is not empty.
+func (av *accessTokenValidator) userIdValid(accessToken *domain.AccessToken) error {
+	if accessToken.UserID <= 0 {
+		return errs.UserIdValid
+	}
+	return nil
+}
+
+// normalizeScope makes sure a space separated list of scopes has at least one scope and only
+// known scopes. It removes duplicate scopes and brings them into the order of domain.Scopes.
+func normalizeScope(scope string) (string, error) {
+	requested := make(map[string]bool)
+	for _, s := range strings.Fields(scope) {
+		requested[s] = true
+	}
+	var scopes []string
+	for _, s := range domain.Scopes {
+		if requested[s] {
+			scopes = append(scopes, s)
+			delete(requested, s)
+		}
+	}
+	for s := range requested {
+		return "", errs.Errorf(errs.EINVALID, "Unknown scope %q.", s)
+	}
+	if len(scopes) == 0 {
+		return "", errs.Errorf(errs.EINVALID, "Please select at least one scope.")
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+// ByID gets an AccessToken record from the database by id.
+func (ag *accessTokenGorm) ByID(id int) (*domain.AccessToken, error) {
+	var accessToken domain.AccessToken
+	err := ag.db.First(&accessToken, "id = ?", id).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The access token does not exist.")
+		}
+		return nil, err
+	}
+	return &accessToken, nil
+}
+
+// ByTokenHash retrieves an unexpired AccessToken database record by its hashed token.
+// The checkUser middleware calls this on every request that carries an access token.
+func (ag *accessTokenGorm) ByTokenHash(tokenHash string) (*domain.AccessToken, error) {
+	var accessToken domain.AccessToken
+	err := ag.db.
+		Where("token_hash = ?", tokenHash).
+		Where("(expires_at IS NULL OR expires_at > ?)", time.Now()).
+		First(&accessToken).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.EUNAUTHORIZED, "Invalid access token.")
+		}
+		return nil, err
+	}
+	return &accessToken, nil
+}
+
+// ByUserID retrieves all personal access tokens of a user, newest first. Expired ones are
+// included, so the user sees why a script stopped working. Tokens issued to apps are left out.
+func (ag *accessTokenGorm) ByUserID(userId int) ([]domain.AccessToken, error) {
+	var accessTokens []domain.AccessToken
+	err := ag.db.
+		Where("user_id = ? AND client_id IS NULL", userId).
+		Order("created_at desc").
+		Find(&accessTokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return accessTokens, nil
+}
+
+// Create stores the data from the AccessToken object in a new database record.
+func (ag *accessTokenGorm) Create(accessToken *domain.AccessToken) error {
+	return ag.db.Create(accessToken).Error
+}
+
+// Touch saves the access token's last use.
+func (ag *accessTokenGorm) Touch(accessToken *domain.AccessToken) error {
+	return ag.db.Model(accessToken).Update("last_used_at", accessToken.LastUsedAt).Error
+}
+
+// Delete permanently deletes an AccessToken record from the database.
+func (ag *accessTokenGorm) Delete(accessToken *domain.AccessToken) error {
+	return ag.db.Delete(accessToken).Error
+}
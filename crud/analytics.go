@@ -0,0 +1,407 @@
+package crud
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+const (
+	// analyticsFlushInterval determines how often recorded events are written to the database.
+	analyticsFlushInterval = 10 * time.Second
+	// analyticsBatchSize determines how many distinct rollups are collected before
+	// they are written to the database, even if the flush interval hasn't passed yet.
+	analyticsBatchSize = 500
+	// analyticsQueueSize determines how many events can wait for the recorder. If the queue
+	// is full, further events are dropped rather than slowing down the request handlers.
+	analyticsQueueSize = 10000
+	// analyticsClickWindow determines how often the clicks of a user on the same tweet are counted.
+	// Further clicks of the same kind within the window are ignored, so repeated requests can't
+	// inflate the click counts.
+	analyticsClickWindow = time.Hour
+	// analyticsMaxClicks determines how many clicks are remembered per analyticsClickWindow, see clickWindow.
+	analyticsMaxClicks = 100000
+)
+
+// AnalyticsService manages analytics events and reports.
+// It implements the domain.AnalyticsService interface.
+type AnalyticsService struct {
+	analyticsValidator
+}
+
+// analyticsValidator runs validations on incoming analytics events.
+// On success, it passes the events on to analyticsGorm.
+// Otherwise, it returns the error of the validation that has failed.
+type analyticsValidator struct {
+	analyticsGorm
+}
+
+// analyticsGorm writes analytics events to the database through an impressionRecorder,
+// and reads analytics reports from the database. It remembers when each user's clicks
+// were last counted, see analyticsClickWindow.
+type analyticsGorm struct {
+	db       *gorm.DB
+	recorder *impressionRecorder
+	clicks   *clickWindow
+}
+
+// clickKey identifies the clicks of a user on a tweet of one kind.
+type clickKey struct {
+	userID  int
+	tweetID int
+	event   string
+}
+
+// NewAnalyticsService returns an instance of AnalyticsService.
+// It starts the background recorder, which runs until Close is called.
+func NewAnalyticsService(db *gorm.DB) *AnalyticsService {
+	return &AnalyticsService{
+		analyticsValidator{
+			analyticsGorm{
+				db:       db,
+				recorder: newImpressionRecorder(db),
+				clicks:   newClickWindow(analyticsClickWindow, analyticsMaxClicks),
+			},
+		},
+	}
+}
+
+// Ensure the AnalyticsService struct properly implements the domain.AnalyticsService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.AnalyticsService = &AnalyticsService{}
+
+// RecordEvent makes sure that the event is a click event before it gets recorded.
+// Impressions are recorded through RecordImpressions only.
+func (av *analyticsValidator) RecordEvent(userId int, tweet *domain.Tweet, event string) error {
+	if event != domain.AnalyticsProfileClick && event != domain.AnalyticsLinkClick {
+		return errs.Errorf(errs.EINVALID, "Invalid analytics event.")
+	}
+	if tweet.ID <= 0 {
+		return errs.IdInvalid
+	}
+	return av.analyticsGorm.RecordEvent(userId, tweet, event)
+}
+
+// RecordImpressions hands an impression of each Tweet over to the recorder.
+func (ag *analyticsGorm) RecordImpressions(tweets ...*domain.Tweet) {
+	now := time.Now()
+	for _, tweet := range tweets {
+		ag.recorder.record(statEvent{tweetID: tweet.ID, userID: tweet.UserID, event: domain.AnalyticsImpression, at: now})
+	}
+}
+
+// RecordEvent hands a click event of the Tweet over to the recorder, unless the user's last click
+// of that kind on the Tweet has been counted less than analyticsClickWindow ago.
+func (ag *analyticsGorm) RecordEvent(userId int, tweet *domain.Tweet, event string) error {
+	now := time.Now()
+	if !ag.clicks.count(clickKey{userID: userId, tweetID: tweet.ID, event: event}, now) {
+		return nil
+	}
+	ag.recorder.record(statEvent{tweetID: tweet.ID, userID: tweet.UserID, event: event, at: now})
+	return nil
+}
+
+// clickWindow remembers when clicks were last counted, in two buckets: the clicks counted since
+// the current bucket was started, and those of the bucket before. Once the current bucket is a
+// window old, it becomes the previous one and the old previous one is dropped as a whole, so
+// a click is remembered for at least a window, and forgetting clicks never scans them.
+// A bucket that reaches max clicks is rotated early, which keeps the memory bounded at the
+// cost of counting some clicks again.
+type clickWindow struct {
+	mu       sync.Mutex
+	window   time.Duration
+	max      int
+	started  time.Time
+	current  map[clickKey]time.Time
+	previous map[clickKey]time.Time
+}
+
+// newClickWindow returns a clickWindow that remembers clicks for the given window.
+func newClickWindow(window time.Duration, max int) *clickWindow {
+	return &clickWindow{
+		window:   window,
+		max:      max,
+		current:  make(map[clickKey]time.Time),
+		previous: make(map[clickKey]time.Time),
+	}
+}
+
+// count reports whether a click should be counted, which is the case unless the same click has been
+// counted less than a window ago. A click that should be counted is remembered from now on.
+func (cw *clickWindow) count(key clickKey, now time.Time) bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if now.Sub(cw.started) >= cw.window || len(cw.current) >= cw.max {
+		cw.previous, cw.current = cw.current, make(map[clickKey]time.Time)
+		cw.started = now
+	}
+	for _, bucket := range []map[clickKey]time.Time{cw.current, cw.previous} {
+		if last, ok := bucket[key]; ok && now.Sub(last) < cw.window {
+			return false
+		}
+	}
+	cw.current[key] = now
+	return true
+}
+
+// ByTweetID builds the analytics report of the Tweet with the given ID. It combines the
+// stored hourly rollups with the likes, retweets and replies the Tweet received since then.
+func (ag *analyticsGorm) ByTweetID(tweetId int, since time.Time) (*domain.Analytics, error) {
+	var stats []domain.TweetStat
+	err := ag.db.Where("tweet_id = ? AND hour >= ?", tweetId, since).Find(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	likes, err := ag.countHourly(ag.db.Table("likes").
+		Where("likes.tweet_id = ? AND likes.created_at >= ?", tweetId, since), "likes.created_at")
+	if err != nil {
+		return nil, err
+	}
+	retweets, err := ag.countHourly(ag.db.Table("tweets").
+		Where("tweets.retweets_id = ? AND tweets.created_at >= ? AND tweets.deleted_at IS NULL", tweetId, since), "tweets.created_at")
+	if err != nil {
+		return nil, err
+	}
+	replies, err := ag.countHourly(ag.db.Table("tweets").
+		Where("tweets.replies_to_id = ? AND tweets.created_at >= ? AND tweets.deleted_at IS NULL", tweetId, since), "tweets.created_at")
+	if err != nil {
+		return nil, err
+	}
+	return buildAnalytics(since, stats, likes, retweets, replies), nil
+}
+
+// ByUserID builds the analytics report of all Tweets of the user with the given ID.
+// The user's own likes, retweets and replies of their own Tweets are not counted.
+func (ag *analyticsGorm) ByUserID(userId int, since time.Time) (*domain.Analytics, error) {
+	var stats []domain.TweetStat
+	err := ag.db.Where("user_id = ? AND hour >= ?", userId, since).Find(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	likes, err := ag.countHourly(ag.db.Table("likes").
+		Joins("JOIN tweets ON tweets.id = likes.tweet_id").
+		Where("tweets.user_id = ? AND likes.user_id <> ? AND likes.created_at >= ?", userId, userId, since), "likes.created_at")
+	if err != nil {
+		return nil, err
+	}
+	retweets, err := ag.countHourly(ag.db.Table("tweets").
+		Joins("JOIN tweets AS originals ON originals.id = tweets.retweets_id").
+		Where("originals.user_id = ? AND tweets.user_id <> ? AND tweets.created_at >= ? AND tweets.deleted_at IS NULL", userId, userId, since), "tweets.created_at")
+	if err != nil {
+		return nil, err
+	}
+	replies, err := ag.countHourly(ag.db.Table("tweets").
+		Joins("JOIN tweets AS originals ON originals.id = tweets.replies_to_id").
+		Where("originals.user_id = ? AND tweets.user_id <> ? AND tweets.created_at >= ? AND tweets.deleted_at IS NULL", userId, userId, since), "tweets.created_at")
+	if err != nil {
+		return nil, err
+	}
+	return buildAnalytics(since, stats, likes, retweets, replies), nil
+}
+
+// Close stops the recorder after writing all pending events to the database.
+func (ag *analyticsGorm) Close() error {
+	ag.recorder.close()
+	return nil
+}
+
+// hourlyCount is the number of records created within one hour.
+type hourlyCount struct {
+	Hour  time.Time
+	Count int
+}
+
+// countHourly takes a query and the name of a timestamp column, and counts
+// the matching records grouped by the hour of that timestamp.
+func (ag *analyticsGorm) countHourly(query *gorm.DB, column string) ([]hourlyCount, error) {
+	var counts []hourlyCount
+	err := query.
+		Select("date_trunc('hour', " + column + ") AS hour, COUNT(*) AS count").
+		Group("1").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// buildAnalytics merges the hourly rollups and the hourly engagement counts
+// into an analytics report, and calculates its totals and engagement rate.
+func buildAnalytics(since time.Time, stats []domain.TweetStat, likes, retweets, replies []hourlyCount) *domain.Analytics {
+	hours := make(map[time.Time]*domain.AnalyticsHour)
+	hour := func(t time.Time) *domain.AnalyticsHour {
+		t = t.UTC().Truncate(time.Hour)
+		if _, ok := hours[t]; !ok {
+			hours[t] = &domain.AnalyticsHour{Hour: t}
+		}
+		return hours[t]
+	}
+	for _, stat := range stats {
+		h := hour(stat.Hour)
+		h.Impressions += stat.Impressions
+		h.ProfileClicks += stat.ProfileClicks
+		h.LinkClicks += stat.LinkClicks
+	}
+	for _, c := range likes {
+		hour(c.Hour).Likes += c.Count
+	}
+	for _, c := range retweets {
+		hour(c.Hour).Retweets += c.Count
+	}
+	for _, c := range replies {
+		hour(c.Hour).Replies += c.Count
+	}
+
+	report := &domain.Analytics{
+		Since:  since,
+		Hourly: make([]domain.AnalyticsHour, 0, len(hours)),
+	}
+	for _, h := range hours {
+		report.Hourly = append(report.Hourly, *h)
+		report.Totals.Impressions += h.Impressions
+		report.Totals.ProfileClicks += h.ProfileClicks
+		report.Totals.LinkClicks += h.LinkClicks
+		report.Totals.Likes += h.Likes
+		report.Totals.Retweets += h.Retweets
+		report.Totals.Replies += h.Replies
+	}
+	sort.Slice(report.Hourly, func(i, j int) bool {
+		return report.Hourly[i].Hour.Before(report.Hourly[j].Hour)
+	})
+	if report.Totals.Impressions > 0 {
+		report.EngagementRate = float64(report.Totals.Engagements()) / float64(report.Totals.Impressions)
+	}
+	return report
+}
+
+// statEvent is a single analytics event waiting to be added to its hourly rollup.
+type statEvent struct {
+	tweetID int
+	userID  int
+	event   string
+	at      time.Time
+}
+
+// statKey identifies the hourly rollup that an event belongs to.
+type statKey struct {
+	tweetID int
+	hour    time.Time
+}
+
+// impressionRecorder collects analytics events in the background. It counts them in memory,
+// grouped by their hourly rollup, and periodically adds those counts to the rollups stored
+// in the database. That way, serving a feed only costs a channel send per tweet, and the
+// database sees one upsert per tweet and hour instead of one insert per impression.
+// Events recorded after close are dropped, closed guards the events channel against them.
+type impressionRecorder struct {
+	db      *gorm.DB
+	events  chan statEvent
+	done    chan struct{}
+	mu      sync.RWMutex
+	closed  bool
+	closing sync.Once
+}
+
+// newImpressionRecorder creates an impressionRecorder and starts its background loop.
+func newImpressionRecorder(db *gorm.DB) *impressionRecorder {
+	r := &impressionRecorder{
+		db:     db,
+		events: make(chan statEvent, analyticsQueueSize),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// record queues an event without blocking. If the queue is full or the recorder
+// has been closed, the event is dropped.
+func (r *impressionRecorder) record(e statEvent) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.events <- e:
+	default:
+	}
+}
+
+// close stops accepting events and waits until the pending ones have been written.
+func (r *impressionRecorder) close() {
+	r.closing.Do(func() {
+		r.mu.Lock()
+		r.closed = true
+		close(r.events)
+		r.mu.Unlock()
+		<-r.done
+	})
+}
+
+// run is the recorder's background loop. It collects events until either the batch is full,
+// the flush interval has passed or the events channel is closed, and then writes them.
+func (r *impressionRecorder) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(analyticsFlushInterval)
+	defer ticker.Stop()
+	pending := make(map[statKey]*domain.TweetStat)
+	for {
+		select {
+		case e, ok := <-r.events:
+			if !ok {
+				r.flush(pending)
+				return
+			}
+			key := statKey{tweetID: e.tweetID, hour: e.at.UTC().Truncate(time.Hour)}
+			stat, exists := pending[key]
+			if !exists {
+				stat = &domain.TweetStat{TweetID: key.tweetID, UserID: e.userID, Hour: key.hour}
+				pending[key] = stat
+			}
+			switch e.event {
+			case domain.AnalyticsImpression:
+				stat.Impressions++
+			case domain.AnalyticsProfileClick:
+				stat.ProfileClicks++
+			case domain.AnalyticsLinkClick:
+				stat.LinkClicks++
+			}
+			if len(pending) >= analyticsBatchSize {
+				r.flush(pending)
+				pending = make(map[statKey]*domain.TweetStat)
+			}
+		case <-ticker.C:
+			r.flush(pending)
+			pending = make(map[statKey]*domain.TweetStat)
+		}
+	}
+}
+
+// flush adds the collected counts to their hourly rollups in the database, creating
+// the rollups that don't exist yet. Errors are logged, since there's no caller to return them to.
+func (r *impressionRecorder) flush(pending map[statKey]*domain.TweetStat) {
+	if len(pending) == 0 {
+		return
+	}
+	stats := make([]domain.TweetStat, 0, len(pending))
+	for _, stat := range pending {
+		stats = append(stats, *stat)
+	}
+	err := r.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "tweet_id"}, {Name: "hour"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"impressions":    gorm.Expr("tweet_stats.impressions + excluded.impressions"),
+			"profile_clicks": gorm.Expr("tweet_stats.profile_clicks + excluded.profile_clicks"),
+			"link_clicks":    gorm.Expr("tweet_stats.link_clicks + excluded.link_clicks"),
+			"updated_at":     gorm.Expr("excluded.updated_at"),
+		}),
+	}).Create(&stats).Error
+	if err != nil {
+		log.Printf("[analytics] error: cannot write %d tweet stats: %s", len(stats), err)
+	}
+}
@@ -0,0 +1,63 @@
+package crud
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClickWindow(t *testing.T) {
+	window := time.Hour
+	cw := newClickWindow(window, 100)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	click := clickKey{userID: 1, tweetID: 2, event: "link_click"}
+
+	steps := []struct {
+		key   clickKey
+		after time.Duration
+		want  bool
+	}{
+		{click, 0, true},
+		{click, time.Minute, false},
+		{clickKey{userID: 2, tweetID: 2, event: "link_click"}, time.Minute, true},
+		{clickKey{userID: 1, tweetID: 2, event: "profile_click"}, time.Minute, true},
+		{clickKey{userID: 1, tweetID: 3, event: "link_click"}, time.Minute, true},
+		// A click is remembered for a window, across bucket rotations, and counted again after it.
+		{click, window - time.Second, false},
+		{click, window, true},
+		{clickKey{userID: 3, tweetID: 2, event: "link_click"}, window + 30*time.Minute, true},
+		{click, window + 59*time.Minute, false},
+		{click, 2*window + time.Minute, true},
+	}
+	for i, step := range steps {
+		if got := cw.count(step.key, start.Add(step.after)); got != step.want {
+			t.Errorf("step %d: count(%+v) after %s = %t, want %t", i, step.key, step.after, got, step.want)
+		}
+	}
+}
+
+func TestClickWindowForgets(t *testing.T) {
+	cw := newClickWindow(time.Hour, 100)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		cw.count(clickKey{userID: i, tweetID: 1, event: "link_click"}, now)
+	}
+	// Two windows later, the old clicks are dropped along with their buckets.
+	cw.count(clickKey{userID: 1, tweetID: 2, event: "link_click"}, now.Add(time.Hour))
+	cw.count(clickKey{userID: 1, tweetID: 2, event: "link_click"}, now.Add(2*time.Hour))
+	if n := len(cw.current) + len(cw.previous); n != 2 {
+		t.Errorf("%d clicks remembered, want 2", n)
+	}
+}
+
+func TestClickWindowMax(t *testing.T) {
+	cw := newClickWindow(time.Hour, 10)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 1000; i++ {
+		if !cw.count(clickKey{userID: i, tweetID: 1, event: "link_click"}, now) {
+			t.Fatalf("click %d not counted", i)
+		}
+		if n := len(cw.current) + len(cw.previous); n > 20 {
+			t.Fatalf("%d clicks remembered, want at most 20", n)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package crud
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// webAuthnChallengeBytes is the length of a WebAuthn challenge.
+const webAuthnChallengeBytes = 32
+
+// webAuthnUserVerification is the user verification the server asks authenticators for. Passkeys
+// replace the password, so the authenticator must verify the user with a PIN or biometrics,
+// not just check that someone is present.
+const webAuthnUserVerification = "required"
+
+// webAuthnEncoding is the encoding of binary values in WebAuthn JSON.
+var webAuthnEncoding = base64.RawURLEncoding
+
+// CredentialService manages Credentials (passkeys) and the WebAuthn challenges needed to create
+// and use them. It implements the domain.CredentialService interface.
+type CredentialService struct {
+	credentialValidator
+}
+
+// credentialValidator runs validations on incoming Credential data and WebAuthn responses.
+// On success, it passes the data on to credentialGorm.
+// Otherwise, it returns the error of the validation that has failed.
+type credentialValidator struct {
+	rpId   string
+	rpName string
+	origin string
+	credentialGorm
+}
+
+// credentialGorm runs CRUD operations on the database using incoming Credential data.
+// It assumes that data has been validated. On success, it returns nil.
+// Otherwise, it returns the error of the operation that has failed.
+type credentialGorm struct {
+	db *gorm.DB
+}
+
+// NewCredentialService returns an instance of CredentialService. The relying party ID is the
+// domain passkeys are bound to, origin is the origin of the client app that uses them.
+func NewCredentialService(db *gorm.DB, rpId, rpName, origin string) *CredentialService {
+	return &CredentialService{
+		credentialValidator{
+			rpId:   rpId,
+			rpName: rpName,
+			origin: strings.TrimSuffix(origin, "/"),
+			credentialGorm: credentialGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// Ensure the CredentialService struct properly implements the domain.CredentialService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.CredentialService = &CredentialService{}
+
+// clientData is the parsed client data JSON (WebAuthn §5.8.1).
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// BeginRegistration creates a challenge for registering a new passkey for the user
+// and returns the options for navigator.credentials.create().
+func (cv *credentialValidator) BeginRegistration(user *domain.User) (*domain.CredentialCreationOptions, error) {
+	challenge, err := cv.newChallenge(domain.WebAuthnRegister, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := cv.credentialGorm.ByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var options domain.CredentialCreationOptions
+	pk := &options.PublicKey
+	pk.RP.ID = cv.rpId
+	pk.RP.Name = cv.rpName
+	pk.User.ID = userHandle(user.ID)
+	pk.User.Name = user.Email
+	pk.User.DisplayName = user.Name
+	pk.Challenge = challenge
+	pk.PubKeyCredParams = []domain.CredentialParameter{
+		{Type: "public-key", Alg: coseES256},
+		{Type: "public-key", Alg: coseEdDSA},
+		{Type: "public-key", Alg: coseRS256},
+	}
+	pk.Timeout = domain.WebAuthnTimeout.Milliseconds()
+	// Prevent registering the same authenticator twice.
+	pk.ExcludeCredentials = make([]domain.CredentialDescriptor, len(existing))
+	for i, credential := range existing {
+		pk.ExcludeCredentials[i] = domain.CredentialDescriptor{Type: "public-key", ID: credential.CredentialID}
+	}
+	// Passkeys must be discoverable, so users can sign in without entering their email address.
+	pk.AuthenticatorSelection = domain.AuthenticatorSelection{ResidentKey: "required", UserVerification: webAuthnUserVerification}
+	pk.Attestation = "none"
+	return &options, nil
+}
+
+// FinishRegistration verifies the authenticator's response to a registration challenge
+// and stores the new passkey.
+func (cv *credentialValidator) FinishRegistration(user *domain.User, name string, response *domain.AttestationResponse) (*domain.Credential, error) {
+	invalid := errs.Errorf(errs.EINVALID, "The passkey could not be registered. Please try again.")
+
+	// Check the client data: it must belong to an unused registration challenge of this user.
+	clientDataJSON, err := webAuthnEncoding.DecodeString(response.Response.ClientDataJSON)
+	if err != nil {
+		return nil, invalid
+	}
+	challenge, err := cv.checkClientData(clientDataJSON, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+	if err := cv.useChallenge(challenge, domain.WebAuthnRegister, user.ID); err != nil {
+		return nil, err
+	}
+
+	// Check the authenticator data and extract the new passkey from it.
+	attestationObject, err := webAuthnEncoding.DecodeString(response.Response.AttestationObject)
+	if err != nil {
+		return nil, invalid
+	}
+	authData, err := cv.checkAttestation(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+
+	credential := domain.Credential{
+		UserID:       user.ID,
+		CredentialID: webAuthnEncoding.EncodeToString(authData.CredentialID),
+		PublicKey:    authData.PublicKey,
+		SignCount:    int64(authData.SignCount),
+		Name:         name,
+	}
+	err = runCredentialValFns(&credential,
+		cv.userIdValid,
+		cv.nameDefault,
+		cv.nameMaxLength,
+		cv.credentialIdIsAvail)
+	if err != nil {
+		return nil, err
+	}
+	if err := cv.credentialGorm.Create(&credential); err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// BeginLogin creates a challenge for signing in with a passkey and returns the options
+// for navigator.credentials.get().
+func (cv *credentialValidator) BeginLogin() (*domain.CredentialRequestOptions, error) {
+	challenge, err := cv.newChallenge(domain.WebAuthnLogin, 0)
+	if err != nil {
+		return nil, err
+	}
+	var options domain.CredentialRequestOptions
+	options.PublicKey.Challenge = challenge
+	options.PublicKey.RPID = cv.rpId
+	options.PublicKey.Timeout = domain.WebAuthnTimeout.Milliseconds()
+	options.PublicKey.UserVerification = webAuthnUserVerification
+	options.PublicKey.AllowCredentials = []domain.CredentialDescriptor{}
+	return &options, nil
+}
+
+// FinishLogin verifies the authenticator's response to a login challenge. On success, it
+// returns the passkey that was used, whose UserID identifies the user to be signed in.
+func (cv *credentialValidator) FinishLogin(response *domain.AssertionResponse) (*domain.Credential, error) {
+	invalid := errs.Errorf(errs.EINVALID, "Signing in with the passkey failed. Please try again.")
+
+	// Check the client data: it must belong to an unused login challenge.
+	clientDataJSON, err := webAuthnEncoding.DecodeString(response.Response.ClientDataJSON)
+	if err != nil {
+		return nil, invalid
+	}
+	challenge, err := cv.checkClientData(clientDataJSON, "webauthn.get")
+	if err != nil {
+		return nil, err
+	}
+	if err := cv.useChallenge(challenge, domain.WebAuthnLogin, 0); err != nil {
+		return nil, err
+	}
+
+	// Look up the passkey. If the authenticator returned a user handle, it must match its owner.
+	rawId, err := webAuthnEncoding.DecodeString(response.RawID)
+	if err != nil {
+		return nil, invalid
+	}
+	credential, err := cv.credentialGorm.ByCredentialID(webAuthnEncoding.EncodeToString(rawId))
+	if err != nil {
+		if errs.ErrorCode(err) == errs.ENOTFOUND {
+			return nil, errs.Errorf(errs.EINVALID, "This passkey is not registered. It might have been deleted.")
+		}
+		return nil, err
+	}
+	if response.Response.UserHandle != "" && response.Response.UserHandle != userHandle(credential.UserID) {
+		return nil, invalid
+	}
+
+	// Check the authenticator data and the signature.
+	rawAuthData, err := webAuthnEncoding.DecodeString(response.Response.AuthenticatorData)
+	if err != nil {
+		return nil, invalid
+	}
+	signature, err := webAuthnEncoding.DecodeString(response.Response.Signature)
+	if err != nil {
+		return nil, invalid
+	}
+	newCount, err := cv.checkAssertion(credential, rawAuthData, clientDataJSON, signature)
+	if err != nil {
+		return nil, err
+	}
+	if err := cv.credentialGorm.MarkUsed(credential, newCount); err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// Update runs validations needed for updating a passkey. Only its name can be changed.
+func (cv *credentialValidator) Update(credential *domain.Credential) error {
+	err := runCredentialValFns(credential,
+		cv.idValid,
+		cv.nameDefault,
+		cv.nameMaxLength)
+	if err != nil {
+		return err
+	}
+	return cv.credentialGorm.Update(credential)
+}
+
+// Delete runs validations needed for deleting a passkey.
+func (cv *credentialValidator) Delete(credential *domain.Credential) error {
+	if err := runCredentialValFns(credential, cv.idValid); err != nil {
+		return err
+	}
+	return cv.credentialGorm.Delete(credential)
+}
+
+// newChallenge creates and stores a new random challenge.
+func (cv *credentialValidator) newChallenge(purpose string, userId int) (string, error) {
+	b, err := bytes(webAuthnChallengeBytes)
+	if err != nil {
+		return "", err
+	}
+	challenge := domain.WebAuthnChallenge{
+		Challenge: webAuthnEncoding.EncodeToString(b),
+		Purpose:   purpose,
+		UserID:    userId,
+		ExpiresAt: time.Now().Add(domain.WebAuthnTimeout),
+	}
+	if err := cv.credentialGorm.CreateChallenge(&challenge); err != nil {
+		return "", err
+	}
+	return challenge.Challenge, nil
+}
+
+// checkClientData checks the type and origin of the client data and returns its challenge.
+func (cv *credentialValidator) checkClientData(clientDataJSON []byte, typ string) (string, error) {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil || cd.Type != typ || cd.Challenge == "" {
+		return "", errs.Errorf(errs.EINVALID, "Invalid passkey response.")
+	}
+	if cd.Origin != cv.origin {
+		return "", errs.Errorf(errs.EINVALID, "The passkey response comes from an unknown origin.")
+	}
+	return cd.Challenge, nil
+}
+
+// useChallenge redeems a challenge, which fails if it has expired or has already been used.
+func (cv *credentialValidator) useChallenge(challenge, purpose string, userId int) error {
+	ok, err := cv.credentialGorm.UseChallenge(challenge, purpose, userId)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errs.Errorf(errs.EINVALID, "The passkey request has expired. Please try again.")
+	}
+	return nil
+}
+
+// checkAttestation checks the attestation object of a registration and returns its authenticator
+// data, which holds the new passkey. It must have been created for the relying party, and the
+// authenticator must have verified the user.
+func (cv *credentialValidator) checkAttestation(attestationObject []byte) (*authenticatorData, error) {
+	invalid := errs.Errorf(errs.EINVALID, "The passkey could not be registered. Please try again.")
+	authData, err := parseAttestationObject(attestationObject)
+	if err != nil || authData.CredentialID == nil || !authData.checkRPIDHash(cv.rpId) {
+		return nil, invalid
+	}
+	if !cv.userVerified(authData) {
+		return nil, invalid
+	}
+	if _, _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return nil, errs.Errorf(errs.EINVALID, "This type of passkey is not supported.")
+	}
+	return authData, nil
+}
+
+// checkAssertion checks the authenticator data and signature of a login with a passkey,
+// and returns the passkey's new signature counter.
+func (cv *credentialValidator) checkAssertion(credential *domain.Credential, rawAuthData, clientDataJSON, signature []byte) (int64, error) {
+	invalid := errs.Errorf(errs.EINVALID, "Signing in with the passkey failed. Please try again.")
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil || !authData.checkRPIDHash(cv.rpId) || !cv.userVerified(authData) {
+		return 0, invalid
+	}
+	if err := verifyAssertionSignature(credential.PublicKey, rawAuthData, clientDataJSON, signature); err != nil {
+		return 0, invalid
+	}
+
+	// Authenticators that keep a signature counter increase it on every use. If it didn't
+	// increase, the passkey has probably been cloned, so it must not be accepted.
+	newCount := int64(authData.SignCount)
+	if (newCount != 0 || credential.SignCount != 0) && newCount <= credential.SignCount {
+		return 0, errs.Errorf(errs.EUNAUTHORIZED, "This passkey can't be used anymore. Please sign in differently and register it again.")
+	}
+	return newCount, nil
+}
+
+// userVerified reports whether the authenticator data has the flags webAuthnUserVerification asks for.
+// The user must always be present, and verified unless verification is merely preferred.
+func (cv *credentialValidator) userVerified(authData *authenticatorData) bool {
+	if authData.Flags&authDataUserPresent == 0 {
+		return false
+	}
+	return webAuthnUserVerification != "required" || authData.Flags&authDataUserVerified != 0
+}
+
+// userHandle returns the WebAuthn user handle of a user, which the authenticator stores with
+// the passkey. It's the user's ID, base64url encoded, and doesn't contain personal data.
+func userHandle(userId int) string {
+	return webAuthnEncoding.EncodeToString([]byte(strconv.Itoa(userId)))
+}
+
+// runCredentialValFns runs any number of functions of type credentialValFn on the passed in Credential object.
+// If none of them returns an error, it returns nil. Otherwise, it returns the respective error.
+func runCredentialValFns(credential *domain.Credential, fns ...credentialValFn) error {
+	for _, fn := range fns {
+		if err := fn(credential); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A credentialValFn is any function that takes in a pointer to a domain.Credential object and returns an error.
+type credentialValFn func(credential *domain.Credential) error
+
+// credentialIdIsAvail makes sure that the passkey hasn't been registered before.
+func (cv *credentialValidator) credentialIdIsAvail(credential *domain.Credential) error {
+	var count int64
+	err := cv.db.Model(&domain.Credential{}).Where("credential_id = ?", credential.CredentialID).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errs.Errorf(errs.ECONFLICT, "This passkey is already registered.")
+	}
+	return nil
+}
+
+// idValid makes sure that the ID of the passkey is greater than 0.
+func (cv *credentialValidator) idValid(credential *domain.Credential) error {
+	if credential.ID <= 0 {
+		return errs.IdInvalid
+	}
+	return nil
+}
+
+// nameDefault trims the passkey's name and names it "Passkey" if no name is provided.
+func (cv *credentialValidator) nameDefault(credential *domain.Credential) error {
+	credential.Name = strings.TrimSpace(credential.Name)
+	if credential.Name == "" {
+		credential.Name = "Passkey"
+	}
+	return nil
+}
+
+// nameMaxLength makes sure that the passkey's name is not longer than 50 characters.
+func (cv *credentialValidator) nameMaxLength(credential *domain.Credential) error {
+	if utf8.RuneCountInString(credential.Name) > 50 {
+		return errs.Errorf(errs.EINVALID, "The name must not have more than 50 characters.")
+	}
+	return nil
+}
+
+// userIdValid ensures that the userId is not empty.
+func (cv *credentialValidator) userIdValid(credential *domain.Credential) error {
+	if credential.UserID <= 0 {
+		return errs.UserIdValid
+	}
+	return nil
+}
+
+// ByID gets a Credential record from the database by id.
+func (cg *credentialGorm) ByID(id int) (*domain.Credential, error) {
+	var credential domain.Credential
+	err := cg.db.First(&credential, "id = ?", id).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The passkey does not exist.")
+		}
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// ByCredentialID gets a Credential record from the database by its base64url encoded WebAuthn credential ID.
+func (cg *credentialGorm) ByCredentialID(credentialId string) (*domain.Credential, error) {
+	var credential domain.Credential
+	err := cg.db.First(&credential, "credential_id = ?", credentialId).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The passkey does not exist.")
+		}
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// ByUserID gets all passkeys of a user, oldest first.
+func (cg *credentialGorm) ByUserID(userId int) ([]domain.Credential, error) {
+	var credentials []domain.Credential
+	err := cg.db.Where("user_id = ?", userId).Order("created_at asc").Find(&credentials).Error
+	if err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// Create stores the data from the Credential object in a new database record.
+func (cg *credentialGorm) Create(credential *domain.Credential) error {
+	return cg.db.Create(credential).Error
+}
+
+// Update saves the passkey's name.
+func (cg *credentialGorm) Update(credential *domain.Credential) error {
+	return cg.db.Model(credential).Update("name", credential.Name).Error
+}
+
+// MarkUsed saves the passkey's new signature counter and the time of its use.
+func (cg *credentialGorm) MarkUsed(credential *domain.Credential, signCount int64) error {
+	now := time.Now()
+	credential.SignCount = signCount
+	credential.LastUsedAt = &now
+	return cg.db.Model(credential).Updates(map[string]interface{}{
+		"sign_count":   credential.SignCount,
+		"last_used_at": credential.LastUsedAt,
+	}).Error
+}
+
+// Delete permanently deletes a Credential record from the database,
+// unless it's the user's last way to sign in, see deleteLoginMethod.
+func (cg *credentialGorm) Delete(credential *domain.Credential) error {
+	return deleteLoginMethod(cg.db, credential.UserID, credential)
+}
+
+// CreateChallenge stores a new WebAuthn challenge, removing all expired ones.
+func (cg *credentialGorm) CreateChallenge(challenge *domain.WebAuthnChallenge) error {
+	err := cg.db.Where("expires_at <= ?", time.Now()).Delete(&domain.WebAuthnChallenge{}).Error
+	if err != nil {
+		return err
+	}
+	return cg.db.Create(challenge).Error
+}
+
+// UseChallenge deletes the unexpired challenge with the given value, purpose and user.
+// It reports whether there was such a challenge. Deleting it in the same statement
+// that looks it up makes sure a challenge can only be used once.
+func (cg *credentialGorm) UseChallenge(challenge, purpose string, userId int) (bool, error) {
+	result := cg.db.
+		Where("challenge = ? AND purpose = ? AND user_id = ? AND expires_at > ?", challenge, purpose, userId, time.Now()).
+		Delete(&domain.WebAuthnChallenge{})
+	return result.RowsAffected == 1, result.Error
+}
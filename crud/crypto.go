@@ -0,0 +1,62 @@
+package crud
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// encrypter encrypts and decrypts secrets that must be stored in the database, but can't be
+// hashed since the app needs their plain value later on (like TOTP secrets). It uses AES-256
+// in GCM mode, so tampered ciphertexts are detected. It's safe for concurrent use.
+type encrypter struct {
+	aead cipher.AEAD
+}
+
+// newEncrypter creates and returns a new encrypter. The AES key is derived from the
+// configured encryption key, so it can be a string of any length.
+func newEncrypter(key string) encrypter {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return encrypter{
+		aead: aead,
+	}
+}
+
+// encrypt encrypts the plaintext with a random nonce and returns the nonce
+// followed by the ciphertext as a base64 string.
+func (e encrypter) encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := e.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt reverses encrypt.
+func (e encrypter) decrypt(encoded string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < e.aead.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:e.aead.NonceSize()], sealed[e.aead.NonceSize():]
+	plaintext, err := e.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,74 @@
+package crud
+
+import (
+	"encoding/base64"
+	"testing"
+	"wtfTwitter/domain"
+)
+
+func TestEncrypterRoundTrip(t *testing.T) {
+	e := newEncrypter("test encryption key")
+	for _, plaintext := range []string{"", "JBSWY3DPEHPK3PXP", "ünïcödé"} {
+		encrypted, err := e.encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := e.encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted == again {
+			t.Errorf("%q encrypted twice to the same ciphertext", plaintext)
+		}
+		decrypted, err := e.decrypt(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decrypted != plaintext {
+			t.Errorf("decrypted %q, want %q", decrypted, plaintext)
+		}
+	}
+}
+
+func TestTwoFactorSecretTampered(t *testing.T) {
+	tv := &twoFactorValidator{encrypter: newEncrypter("test encryption key")}
+	tf := &domain.TwoFactor{Secret: "JBSWY3DPEHPK3PXP"}
+	if err := tv.secretEncrypt(tf); err != nil {
+		t.Fatal(err)
+	}
+	stored := tf.SecretEncrypted
+
+	// The stored secret decrypts to the original one.
+	tf.Secret = ""
+	if err := tv.secretDecrypt(tf); err != nil {
+		t.Fatal(err)
+	}
+	if tf.Secret != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("decrypted secret %q", tf.Secret)
+	}
+
+	// Flipping any bit of the nonce, the ciphertext or the tag is detected.
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sealed {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 0x01
+		tf.SecretEncrypted = base64.StdEncoding.EncodeToString(tampered)
+		if err := tv.secretDecrypt(tf); err == nil {
+			t.Fatalf("secret with byte %d tampered decrypted to %q", i, tf.Secret)
+		}
+	}
+
+	// So is a truncated one, or one encrypted with another key.
+	tf.SecretEncrypted = base64.StdEncoding.EncodeToString(sealed[:8])
+	if err := tv.secretDecrypt(tf); err == nil {
+		t.Error("truncated secret decrypted")
+	}
+	other := &twoFactorValidator{encrypter: newEncrypter("another key")}
+	tf.SecretEncrypted = stored
+	if err := other.secretDecrypt(tf); err == nil {
+		t.Error("secret decrypted with another key")
+	}
+}
@@ -0,0 +1,66 @@
+package crud
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+	"wtfTwitter/errs"
+)
+
+// Purposes of signed email tokens. A token issued for one purpose can't be used for another.
+const (
+	emailTokenVerify = "verify_email"
+	emailTokenChange = "change_email"
+)
+
+// emailTokenClaims is the payload of a signed email token. Unlike remember tokens and password
+// reset tokens, email tokens aren't stored in the database. They carry everything needed to
+// redeem them, and are protected against tampering by an HMAC signature.
+type emailTokenClaims struct {
+	Purpose   string `json:"purpose"`
+	UserID    int    `json:"user_id"`
+	Email     string `json:"email"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// signEmailToken creates a token for the given purpose, user and email address that expires after lifetime.
+// The token has the form "<base64 payload>.<base64 signature>".
+func (h HMAC) signEmailToken(purpose string, userId int, email string, lifetime time.Duration) (string, error) {
+	payload, err := json.Marshal(emailTokenClaims{
+		Purpose:   purpose,
+		UserID:    userId,
+		Email:     email,
+		ExpiresAt: time.Now().Add(lifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + h.hash(purpose+"."+encoded), nil
+}
+
+// parseEmailToken checks a token's signature, purpose and expiry, and returns its claims.
+func (h HMAC) parseEmailToken(token, purpose string) (*emailTokenClaims, error) {
+	invalid := errs.Errorf(errs.EINVALID, "The link is invalid or has expired.")
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, invalid
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(h.hash(purpose+"."+parts[0]))) {
+		return nil, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalid
+	}
+	var claims emailTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, invalid
+	}
+	if claims.Purpose != purpose || time.Now().Unix() > claims.ExpiresAt {
+		return nil, invalid
+	}
+	return &claims, nil
+}
@@ -0,0 +1,675 @@
+package crud
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+const (
+	// exportPollInterval determines how often the export worker looks for pending exports and
+	// expired archives, in addition to being woken up whenever an export is created.
+	exportPollInterval = time.Minute
+	// exportTokenPurpose is signed along with a download token, so it can't be confused with other signed tokens.
+	exportTokenPurpose = "download_export"
+)
+
+// Entities found in tweet contents, which are listed along with every tweet in an export.
+// Mentions are found with mentionRegex, see tweet.go.
+var (
+	hashtagRegex = regexp.MustCompile(`(?:^|[^\w#])#(\w+)`)
+	urlRegex     = regexp.MustCompile(`https?://[^\s]*[^\s.,;:!?)\]'"]`)
+)
+
+// ExportService manages Exports and builds their archives in the background.
+// It implements the domain.ExportService interface.
+type ExportService struct {
+	exportValidator
+}
+
+// exportValidator runs validations on incoming Export data.
+// On success, it passes the data on to exportGorm.
+// Otherwise, it returns the error of the validation that has failed.
+type exportValidator struct {
+	hmac HMAC
+	exportGorm
+}
+
+// exportGorm runs CRUD operations on the database using incoming Export data, and hands
+// new exports to the exportWorker.
+type exportGorm struct {
+	db     *gorm.DB
+	worker *exportWorker
+}
+
+// NewExportService returns an instance of ExportService. The images of an account are read
+// through the given ImageService. It starts the background worker, which runs until Close is called.
+func NewExportService(db *gorm.DB, hmacKey string, images domain.ImageService) *ExportService {
+	h := newHMAC(hmacKey)
+	return &ExportService{
+		exportValidator{
+			hmac: h,
+			exportGorm: exportGorm{
+				db:     db,
+				worker: newExportWorker(db, h, images),
+			},
+		},
+	}
+}
+
+// Ensure the ExportService struct properly implements the domain.ExportService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.ExportService = &ExportService{}
+
+// ByToken checks a download token's signature and expiry, and returns the export it belongs to.
+func (ev *exportValidator) ByToken(token string) (*domain.Export, error) {
+	exportId, err := ev.hmac.parseExportToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return ev.exportGorm.ReadyByID(exportId)
+}
+
+// Create runs validations needed for creating new Export database records.
+func (ev *exportValidator) Create(export *domain.Export) error {
+	err := runExportValFns(export,
+		ev.userIdValid,
+		ev.noneInProgress,
+		ev.cooldownPassed)
+	if err != nil {
+		return err
+	}
+	export.Status = domain.ExportStatusPending
+	return ev.exportGorm.Create(export)
+}
+
+// runExportValFns runs any number of functions of type exportValFn on the passed in Export object.
+// If none of them returns an error, it returns nil. Otherwise, it returns the respective error.
+func runExportValFns(export *domain.Export, fns ...exportValFn) error {
+	for _, fn := range fns {
+		if err := fn(export); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An exportValFn is any function that takes in a pointer to a domain.Export object and returns an error.
+type exportValFn func(export *domain.Export) error
+
+// cooldownPassed makes sure that the user's last successful export was requested
+// more than domain.ExportCooldown ago.
+func (ev *exportValidator) cooldownPassed(export *domain.Export) error {
+	var count int64
+	err := ev.db.Model(&domain.Export{}).
+		Where("user_id = ? AND status = ? AND created_at > ?",
+			export.UserID, domain.ExportStatusReady, time.Now().Add(-domain.ExportCooldown)).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errs.Errorf(errs.ETOOMANY, "You can request an export of your data once a day.")
+	}
+	return nil
+}
+
+// noneInProgress makes sure that the user has no export whose archive is still being built.
+func (ev *exportValidator) noneInProgress(export *domain.Export) error {
+	var count int64
+	err := ev.db.Model(&domain.Export{}).
+		Where("user_id = ? AND status = ?", export.UserID, domain.ExportStatusPending).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errs.Errorf(errs.ECONFLICT, "Your data is already being exported. You'll get an email once it's ready.")
+	}
+	return nil
+}
+
+// userIdValid ensures that the userId is not empty.
+func (ev *exportValidator) userIdValid(export *domain.Export) error {
+	if export.UserID <= 0 {
+		return errs.UserIdValid
+	}
+	return nil
+}
+
+// LatestByUserID retrieves the user's most recently requested export. If there is none, it returns an errs.ENOTFOUND.
+func (eg *exportGorm) LatestByUserID(userId int) (*domain.Export, error) {
+	var export domain.Export
+	err := first(eg.db.Where("user_id = ?", userId).Order("created_at desc"), &export)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "You haven't requested an export of your data yet.")
+		}
+		return nil, err
+	}
+	return &export, nil
+}
+
+// ReadyByID retrieves an export by ID, if its archive is ready and hasn't expired.
+func (eg *exportGorm) ReadyByID(id int) (*domain.Export, error) {
+	var export domain.Export
+	db := eg.db.Where("id = ? AND status = ? AND expires_at > ?", id, domain.ExportStatusReady, time.Now())
+	if err := first(db, &export); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.EINVALID, "The download link is invalid or has expired.")
+		}
+		return nil, err
+	}
+	return &export, nil
+}
+
+// Path returns the location of the export's archive in the filesystem.
+func (eg *exportGorm) Path(export *domain.Export) string {
+	return filepath.Join(exportDir(export.UserID), export.Filename)
+}
+
+// Create stores the data from the Export object in a new database record,
+// and wakes up the worker to build its archive.
+func (eg *exportGorm) Create(export *domain.Export) error {
+	if err := eg.db.Create(export).Error; err != nil {
+		return err
+	}
+	eg.worker.wake()
+	return nil
+}
+
+// OnFinished sets the function the worker calls whenever an export is ready or has failed.
+// A ready export is passed in with its download token set.
+func (eg *exportGorm) OnFinished(fn func(export *domain.Export)) {
+	eg.worker.onFinished(fn)
+}
+
+// Close stops the worker, waiting for the archive that's currently being built.
+func (eg *exportGorm) Close() error {
+	eg.worker.close()
+	return nil
+}
+
+// exportDir returns the directory that holds the export archives of a user.
+func exportDir(userId int) string {
+	return filepath.Join(domain.ExportsBaseDir, strconv.Itoa(userId))
+}
+
+// exportTokenClaims is the payload of a signed download token. Like email tokens, download tokens
+// aren't stored in the database. They are protected against tampering by an HMAC signature.
+type exportTokenClaims struct {
+	ExportID  int   `json:"export_id"`
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// signExportToken creates a download token for the given export, which expires along with it.
+// The token has the form "<base64 payload>.<base64 signature>".
+func (h HMAC) signExportToken(export *domain.Export) (string, error) {
+	payload, err := json.Marshal(exportTokenClaims{
+		ExportID:  export.ID,
+		ExpiresAt: export.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + h.hash(exportTokenPurpose+"."+encoded), nil
+}
+
+// parseExportToken checks a download token's signature and expiry, and returns the ID of its export.
+func (h HMAC) parseExportToken(token string) (int, error) {
+	invalid := errs.Errorf(errs.EINVALID, "The download link is invalid or has expired.")
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return 0, invalid
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(h.hash(exportTokenPurpose+"."+parts[0]))) {
+		return 0, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, invalid
+	}
+	var claims exportTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return 0, invalid
+	}
+	if time.Now().Unix() > claims.ExpiresAt {
+		return 0, invalid
+	}
+	return claims.ExportID, nil
+}
+
+// exportWorker builds the archives of pending exports in the background, one after another,
+// and deletes the archives that have expired. Pending exports are read from the database,
+// so exports requested before a restart are picked up again.
+type exportWorker struct {
+	db       *gorm.DB
+	hmac     HMAC
+	images   domain.ImageService
+	wakeup   chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	closing  sync.Once
+	mu       sync.Mutex
+	finished func(export *domain.Export)
+}
+
+// newExportWorker creates an exportWorker and starts its background loop.
+func newExportWorker(db *gorm.DB, h HMAC, images domain.ImageService) *exportWorker {
+	w := &exportWorker{
+		db:     db,
+		hmac:   h,
+		images: images,
+		wakeup: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// wake makes the worker look for pending exports right away, without blocking.
+func (w *exportWorker) wake() {
+	select {
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// onFinished sets the function called whenever an export is ready or has failed.
+func (w *exportWorker) onFinished(fn func(export *domain.Export)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.finished = fn
+}
+
+// close stops the worker and waits until the archive that's currently being built is finished.
+func (w *exportWorker) close() {
+	w.closing.Do(func() {
+		close(w.stop)
+		<-w.done
+	})
+}
+
+// run is the worker's background loop. It works whenever it's woken up and every exportPollInterval.
+func (w *exportWorker) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(exportPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.wakeup:
+		case <-ticker.C:
+			w.deleteExpired()
+		}
+		w.buildPending()
+	}
+}
+
+// buildPending builds the archives of all pending exports, oldest first. Errors are logged,
+// since there's no caller to return them to.
+func (w *exportWorker) buildPending() {
+	var exports []domain.Export
+	err := w.db.Where("status = ?", domain.ExportStatusPending).Order("created_at").Find(&exports).Error
+	if err != nil {
+		log.Printf("[export] error: %s", err)
+		return
+	}
+	for i := range exports {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		w.build(&exports[i])
+	}
+}
+
+// build builds an export's archive, updates the export's record, and calls the finished function.
+func (w *exportWorker) build(export *domain.Export) {
+	now := time.Now()
+	export.CompletedAt = &now
+	size, err := w.writeArchive(export)
+	if err == nil {
+		expiresAt := now.Add(domain.ExportLifetime)
+		export.ExpiresAt = &expiresAt
+		export.Token, err = w.hmac.signExportToken(export)
+	}
+	// A failed export must still be updated, or it would stay pending and block new ones.
+	// Its archive, if any, is deleted along with it once it expires.
+	if err != nil {
+		log.Printf("[export] error: export %d: %s", export.ID, err)
+		expiresAt := now.Add(domain.ExportCooldown)
+		export.Status = domain.ExportStatusFailed
+		export.ExpiresAt = &expiresAt
+		export.Token = ""
+	} else {
+		export.Status = domain.ExportStatusReady
+		export.Size = size
+	}
+	err = w.db.Model(export).Updates(map[string]interface{}{
+		"status":       export.Status,
+		"filename":     export.Filename,
+		"size":         export.Size,
+		"completed_at": export.CompletedAt,
+		"expires_at":   export.ExpiresAt,
+	}).Error
+	if err != nil {
+		log.Printf("[export] error: export %d: %s", export.ID, err)
+		return
+	}
+	w.mu.Lock()
+	finished := w.finished
+	w.mu.Unlock()
+	if finished != nil {
+		finished(export)
+	}
+}
+
+// deleteExpired deletes the exports that have expired, along with their archives.
+func (w *exportWorker) deleteExpired() {
+	var exports []domain.Export
+	if err := w.db.Where("expires_at <= ?", time.Now()).Find(&exports).Error; err != nil {
+		log.Printf("[export] error: %s", err)
+		return
+	}
+	for _, export := range exports {
+		if export.Filename != "" {
+			err := os.Remove(filepath.Join(exportDir(export.UserID), export.Filename))
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("[export] error: export %d: %s", export.ID, err)
+				continue
+			}
+		}
+		if err := w.db.Delete(&export).Error; err != nil {
+			log.Printf("[export] error: export %d: %s", export.ID, err)
+		}
+	}
+}
+
+// exportManifest describes the contents of an export archive. It's stored as manifest.json.
+type exportManifest struct {
+	UserID    int                  `json:"user_id"`
+	Handle    string               `json:"handle"`
+	CreatedAt time.Time            `json:"created_at"`
+	Files     []exportManifestFile `json:"files"`
+}
+
+// exportManifestFile describes one file of an export archive.
+type exportManifestFile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Count       int    `json:"count"`
+}
+
+// exportProfile is the user's profile as written to profile.json.
+type exportProfile struct {
+	ID              int        `json:"id"`
+	Email           string     `json:"email"`
+	Name            string     `json:"name"`
+	Handle          string     `json:"handle"`
+	Bio             string     `json:"bio"`
+	Avatar          string     `json:"avatar"`
+	Header          string     `json:"header"`
+	PinnedTweetID   *int       `json:"pinned_tweet_id"`
+	SensitiveMedia  string     `json:"sensitive_media"`
+	RequireAltText  bool       `json:"require_alt_text"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// exportTweet is a tweet as written to tweets.json, along with the entities found in its content.
+type exportTweet struct {
+	ID             int            `json:"id"`
+	Content        string         `json:"content"`
+	RepliesToID    *int           `json:"replies_to_id,omitempty"`
+	ReplyToDeleted bool           `json:"reply_to_deleted,omitempty"`
+	RetweetsID     *int           `json:"retweets_id,omitempty"`
+	ReplyPolicy    string         `json:"reply_policy"`
+	Sensitive      bool           `json:"sensitive"`
+	ContentWarning string         `json:"content_warning,omitempty"`
+	Entities       exportEntities `json:"entities"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+// exportEntities are the mentions, hashtags, links and images of a tweet.
+type exportEntities struct {
+	Mentions []string      `json:"mentions"`
+	Hashtags []string      `json:"hashtags"`
+	URLs     []string      `json:"urls"`
+	Images   []exportImage `json:"images"`
+}
+
+// exportImage is an image of a tweet, with its path within the archive.
+type exportImage struct {
+	Path    string `json:"path"`
+	AltText string `json:"alt_text"`
+}
+
+// exportLike is a like as written to likes.json.
+type exportLike struct {
+	TweetID   int       `json:"tweet_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// exportFollow is a followed or following user as written to following.json and followers.json.
+type exportFollow struct {
+	UserID    int       `json:"user_id"`
+	Handle    string    `json:"handle"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// writeArchive collects the user's data and writes it to a new zip archive in the user's export
+// directory. It sets the export's Filename and returns the archive's size.
+func (w *exportWorker) writeArchive(export *domain.Export) (int64, error) {
+	var user domain.User
+	if err := w.db.First(&user, "id = ?", export.UserID).Error; err != nil {
+		return 0, err
+	}
+	var tweets []domain.Tweet
+	if err := w.db.Where("user_id = ?", user.ID).Order("created_at").Find(&tweets).Error; err != nil {
+		return 0, err
+	}
+	var likes []domain.Like
+	if err := w.db.Where("user_id = ?", user.ID).Order("created_at").Find(&likes).Error; err != nil {
+		return 0, err
+	}
+	following, err := w.follows("follows.followed_id", "follows.follower_id = ?", user.ID)
+	if err != nil {
+		return 0, err
+	}
+	followers, err := w.follows("follows.follower_id", "follows.followed_id = ?", user.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Write the archive to a temporary file first, so a half-written archive is never served.
+	dir := exportDir(user.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	filename := fmt.Sprintf("wtftwitter-%s-%d.zip", user.Handle, export.ID)
+	path := filepath.Join(dir, filename)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path + ".tmp")
+	defer f.Close()
+	zw := zip.NewWriter(f)
+
+	// Copy the image files, and remember which of them belong to which tweet.
+	if _, err := w.addImages(zw, domain.OwnerTypeUser, user.ID); err != nil {
+		return 0, err
+	}
+	exportTweets := make([]exportTweet, 0, len(tweets))
+	for _, tweet := range tweets {
+		images, err := w.addImages(zw, domain.OwnerTypeTweet, tweet.ID)
+		if err != nil {
+			return 0, err
+		}
+		exportTweets = append(exportTweets, exportTweet{
+			ID:             tweet.ID,
+			Content:        tweet.Content,
+			RepliesToID:    tweet.RepliesToID,
+			ReplyToDeleted: tweet.ReplyToDeleted,
+			RetweetsID:     tweet.RetweetsID,
+			ReplyPolicy:    tweet.ReplyPolicy,
+			Sensitive:      tweet.Sensitive,
+			ContentWarning: tweet.ContentWarning,
+			Entities: exportEntities{
+				Mentions: submatches(mentionRegex, tweet.Content),
+				Hashtags: submatches(hashtagRegex, tweet.Content),
+				URLs:     append([]string{}, urlRegex.FindAllString(tweet.Content, -1)...),
+				Images:   images,
+			},
+			CreatedAt: tweet.CreatedAt,
+		})
+	}
+	exportLikes := make([]exportLike, 0, len(likes))
+	for _, like := range likes {
+		exportLikes = append(exportLikes, exportLike{TweetID: like.TweetID, CreatedAt: like.CreatedAt})
+	}
+
+	// Write the data files, followed by the manifest describing them.
+	manifest := exportManifest{UserID: user.ID, Handle: user.Handle, CreatedAt: time.Now()}
+	files := []struct {
+		exportManifestFile
+		data interface{}
+	}{
+		{exportManifestFile{"profile.json", "Your profile.", 1}, exportProfile{
+			ID:              user.ID,
+			Email:           user.Email,
+			Name:            user.Name,
+			Handle:          user.Handle,
+			Bio:             user.Bio,
+			Avatar:          user.Avatar,
+			Header:          user.Header,
+			PinnedTweetID:   user.PinnedTweetID,
+			SensitiveMedia:  user.SensitiveMedia,
+			RequireAltText:  user.RequireAltText,
+			EmailVerifiedAt: user.EmailVerifiedAt,
+			CreatedAt:       user.CreatedAt,
+		}},
+		{exportManifestFile{"tweets.json", "Your tweets, retweets and replies, with their mentions, hashtags, links and images.", len(exportTweets)}, exportTweets},
+		{exportManifestFile{"likes.json", "The tweets you like.", len(exportLikes)}, exportLikes},
+		{exportManifestFile{"following.json", "The users you follow.", len(following)}, following},
+		{exportManifestFile{"followers.json", "The users who follow you.", len(followers)}, followers},
+	}
+	for _, file := range files {
+		if err := addJSON(zw, file.Name, file.data); err != nil {
+			return 0, err
+		}
+		manifest.Files = append(manifest.Files, file.exportManifestFile)
+	}
+	manifest.Files = append(manifest.Files, exportManifestFile{
+		Name:        domain.ImagesBaseDir + "/",
+		Description: "Your avatar, header and the images attached to your tweets.",
+	})
+	if err := addJSON(zw, "manifest.json", manifest); err != nil {
+		return 0, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return 0, err
+	}
+	export.Filename = filename
+	return info.Size(), nil
+}
+
+// follows loads the users on one side of the follows matching the condition, oldest follows first.
+// Users who deactivated their account are left out.
+func (w *exportWorker) follows(userColumn, condition string, userId int) ([]exportFollow, error) {
+	follows := []exportFollow{}
+	err := w.db.Table("follows").
+		Select("users.id AS user_id, users.handle, users.name, follows.created_at").
+		Joins("JOIN users ON users.id = "+userColumn+" AND users.deleted_at IS NULL").
+		Where(condition, userId).
+		Order("follows.created_at").
+		Scan(&follows).Error
+	return follows, err
+}
+
+// addJSON writes data as indented json to a new file in the archive.
+func addJSON(zw *zip.Writer, name string, data interface{}) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+// addImages copies the images of an owner into the archive, keeping the paths they are served from,
+// e.g. images/tweet/2/unique_name.png. It returns those paths along with the alt texts.
+func (w *exportWorker) addImages(zw *zip.Writer, ownerType string, ownerId int) ([]exportImage, error) {
+	images, err := w.images.ByOwner(ownerType, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	exported := []exportImage{}
+	for i := range images {
+		if err := w.addImage(zw, &images[i]); err != nil {
+			return nil, err
+		}
+		exported = append(exported, exportImage{Path: images[i].RelativePath(), AltText: images[i].AltText})
+	}
+	return exported, nil
+}
+
+// addImage copies an image from the image store into the archive.
+func (w *exportWorker) addImage(zw *zip.Writer, img *domain.Image) error {
+	src, err := w.images.Open(img)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fw, err := zw.Create(img.RelativePath())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, src)
+	return err
+}
+
+// submatches returns the first capture group of every match of the regex in s, without duplicates.
+func submatches(re *regexp.Regexp, s string) []string {
+	found := []string{}
+	seen := map[string]bool{}
+	for _, m := range re.FindAllStringSubmatch(s, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			found = append(found, m[1])
+		}
+	}
+	return found
+}
@@ -1,49 +1,68 @@
 package crud
 
 import (
+	stdbytes "bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"image"
+	"sort"
 	"strconv"
 	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	//"image/png"
 	"wtfTwitter/errs"
 
+	_ "golang.org/x/image/webp"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strings"
 	"wtfTwitter/domain"
 )
 
-const (
-)
+// imageURLLifetime determines how long the signed URLs that images are served from remain valid.
+const imageURLLifetime = time.Hour
 
 // ImageService manages Images.
 // It implements the domain.ImageService interface.
-type ImageService struct{
+type ImageService struct {
 	imageValidator
 }
 
 // imageValidator runs validations on incoming Image data.
 // On success, it passes the data on to imageCrud.
 // Otherwise, it returns the error of the validation that has failed.
-type imageValidator struct{
+type imageValidator struct {
 	imageCrud
 }
 
-// imageCrud runs CRUD operations on the filesystem using incoming Image data.
+// imageCrud runs CRUD operations on the BlobStore and the media table using incoming Image data.
 // It assumes that data has been validated. On success, it returns nil.
 // Otherwise, it returns the error of the operation that has failed.
-type imageCrud struct{}
+type imageCrud struct {
+	db         *gorm.DB
+	store      domain.BlobStore
+	processing chan struct{}
+}
 
-// NewImageService returns an instance of ImageService.
-func NewImageService() *ImageService {
+// NewImageService returns an instance of ImageService, storing images in the given BlobStore.
+func NewImageService(db *gorm.DB, store domain.BlobStore) *ImageService {
 	return &ImageService{
 		imageValidator{
-			imageCrud{},
+			imageCrud{
+				db:         db,
+				store:      store,
+				processing: make(chan struct{}, imageProcessingSlots),
+			},
 		},
 	}
 }
@@ -52,19 +71,70 @@ func NewImageService() *ImageService {
 // If it does not, then this expression becomes invalid and won't compile.
 var _ domain.ImageService = &ImageService{}
 
-// Create runs validations needed for storing uploaded images in the filesystem.
+// Create runs validations needed for storing uploaded images in the BlobStore.
 func (iv *imageValidator) Create(img *domain.Image) error {
+	return iv.create(img, nil)
+}
+
+// create runs the validations of Create. The images with the IDs in replacing are about to be
+// replaced by the new one, so they don't count against the user's storage quota.
+func (iv *imageValidator) create(img *domain.Image, replacing []int) error {
 	err := runImageValFns(img,
 		iv.extensionValid,
 		iv.contentTypeValid,
 		iv.contentTypeExtensionMatch,
+		iv.dimensionsKnown,
+		iv.belowMaxPixels,
 		iv.belowMaxSize,
+		iv.purposeValid,
+		iv.formatAllowed,
+		iv.altTextValid,
 		iv.fileNameUnique,
 	)
 	if err != nil {
 		return err
 	}
-	return iv.imageCrud.Create(img)
+	return iv.imageCrud.create(img, replacing)
+}
+
+// Replace runs the validations of Create on each of the new images while creating them, and only
+// deletes the owner's previous images once all of them have been created. If one of them fails,
+// the ones created before it are deleted again, and the owner keeps its previous images. The same
+// happens if the previous images can't be swapped for the new ones, see imageCrud.replace.
+// The previous images don't count against the user's storage quota while the new ones are created.
+func (iv *imageValidator) Replace(ownerType string, ownerID int, images []*domain.Image) error {
+	previous, err := iv.imageCrud.ByOwner(ownerType, ownerID)
+	if err != nil {
+		return err
+	}
+	replacing := make([]int, 0, len(previous))
+	for _, img := range previous {
+		replacing = append(replacing, img.ID)
+	}
+	for i, img := range images {
+		img.OwnerType, img.OwnerID = ownerType, ownerID
+		if err := iv.create(img, replacing); err != nil {
+			for _, created := range images[:i] {
+				_ = iv.imageCrud.Delete(created)
+			}
+			return err
+		}
+	}
+	if err := iv.imageCrud.replace(ownerType, ownerID, images); err != nil {
+		for _, created := range images {
+			_ = iv.imageCrud.Delete(created)
+		}
+		return err
+	}
+	return nil
+}
+
+// UpdateAltText runs validations needed for changing an image's alt text.
+func (iv *imageValidator) UpdateAltText(img *domain.Image) error {
+	if err := runImageValFns(img, iv.altTextValid); err != nil {
+		return err
+	}
+	return iv.imageCrud.UpdateAltText(img)
 }
 
 // runImageValFns runs any number of functions of type imageValFn on the passed in Image object.
@@ -78,7 +148,7 @@ func runImageValFns(img *domain.Image, fns ...imageValFn) error {
 }
 
 // A imageValFn is any function that takes in a pointer to a domain.Image object and returns an error.
-type imageValFn func (img *domain.Image) error
+type imageValFn func(img *domain.Image) error
 
 // belowMaxSize makes sure that the image to be uploaded does not exceed MaxUploadSize.
 func (iv *imageValidator) belowMaxSize(img *domain.Image) error {
@@ -89,71 +159,144 @@ func (iv *imageValidator) belowMaxSize(img *domain.Image) error {
 	if err = resetFilePointer(img); err != nil {
 		return err
 	}
+	img.Size = size
 	if size > domain.MaxUploadSize {
 		return errs.Errorf(
 			errs.EINVALID,
-			"Image " + img.Filename + " exceeds upload size limit of " + strconv.FormatInt(domain.MaxUploadSize/1000000, 10) + "MB.",
-			)
+			"Image "+img.Filename+" exceeds upload size limit of "+strconv.FormatInt(domain.MaxUploadSize/1000000, 10)+"MB.",
+		)
 	}
 	return nil
 }
 
-// contentTypeValid makes sure that the image to be uploaded is a valid jpeg or png file.
+// contentTypeValid makes sure that the image to be uploaded is a valid jpeg, png, gif or webp file.
 func (iv *imageValidator) contentTypeValid(img *domain.Image) error {
 	buffer := make([]byte, 512)
-	_, err := img.File.Read(buffer)
+	n, err := img.File.Read(buffer)
 	if err != nil {
 		return err
 	}
 	if err = resetFilePointer(img); err != nil {
 		return err
 	}
-	contentType := http.DetectContentType(buffer)
-	if contentType != "image/jpeg" && contentType != "image/png" {
+	contentType := http.DetectContentType(buffer[:n])
+	if _, ok := domain.ImageContentTypes[contentType]; !ok {
 		return errs.Errorf(
 			errs.EINVALID,
-			"Image " + img.Filename + " invalid content-type, must be image/jpeg or image/png.",
-			)
+			"Image "+img.Filename+" invalid content-type, must be image/jpeg, image/png, image/gif or image/webp.",
+		)
 	}
 	img.ContentType = contentType
 	return nil
 }
 
+// dimensionsKnown makes sure that the image's header can be decoded, and sets its width and height.
+func (iv *imageValidator) dimensionsKnown(img *domain.Image) error {
+	cfg, _, err := image.DecodeConfig(img.File)
+	if err != nil {
+		return errs.Errorf(errs.EINVALID, "Image "+img.Filename+" cannot be read.")
+	}
+	if err = resetFilePointer(img); err != nil {
+		return err
+	}
+	img.Width, img.Height = cfg.Width, cfg.Height
+	return nil
+}
+
+// belowMaxPixels makes sure that the image to be uploaded does not exceed MaxImagePixels,
+// so decoding it can't exhaust the server's memory.
+func (iv *imageValidator) belowMaxPixels(img *domain.Image) error {
+	if img.Width <= 0 || img.Height <= 0 || img.Width > domain.MaxImagePixels/img.Height {
+		return errs.Errorf(
+			errs.EINVALID,
+			"Image "+img.Filename+" exceeds the limit of "+strconv.Itoa(domain.MaxImagePixels/1000000)+" megapixels.",
+		)
+	}
+	return nil
+}
+
+// purposeValid makes sure that the image's purpose fits its owner. Users' images are either
+// avatars or headers. Tweets' images are always attached to the tweet, which is the default.
+func (iv *imageValidator) purposeValid(img *domain.Image) error {
+	switch img.OwnerType {
+	case domain.OwnerTypeTweet:
+		if img.Purpose == "" {
+			img.Purpose = domain.ImagePurposeTweet
+		}
+		if img.Purpose == domain.ImagePurposeTweet {
+			return nil
+		}
+	case domain.OwnerTypeUser:
+		if img.Purpose == domain.ImagePurposeAvatar || img.Purpose == domain.ImagePurposeHeader {
+			return nil
+		}
+	}
+	return errs.Errorf(errs.EINVALID, "Invalid image type, must be 'avatar' or 'header' for users and 'tweet' for tweets.")
+}
+
+// formatAllowed makes sure that GIF and WebP images are only attached to tweets.
+// Avatars and headers must be jpeg or png images.
+func (iv *imageValidator) formatAllowed(img *domain.Image) error {
+	if img.Purpose != domain.ImagePurposeTweet && img.ContentType != "image/jpeg" && img.ContentType != "image/png" {
+		return errs.Errorf(
+			errs.EINVALID,
+			"Image "+img.Filename+" invalid content-type, must be image/jpeg or image/png for "+img.Purpose+" images.",
+		)
+	}
+	return nil
+}
+
 // contentTypeExtensionMatch makes sure that the image's filename extension and content type match.
 func (iv *imageValidator) contentTypeExtensionMatch(img *domain.Image) error {
-	contentType := strings.TrimPrefix(img.ContentType, "image/")
-	ext := strings.TrimPrefix(img.Extension, ".")
-	if contentType != ext {
+	if domain.ImageContentTypes[img.ContentType] != img.Extension {
 		return errs.Errorf(
 			errs.EINVALID,
-			"Image " + img.Filename + " content-type " + img.ContentType + " does not match extension " + img.Extension + ".",
-			)
+			"Image "+img.Filename+" content-type "+img.ContentType+" does not match extension "+img.Extension+".",
+		)
 	}
 	return nil
 }
 
-// extensionValid makes sure that the image to be uploaded has the extension .jpeg,
-// .jpg or .png. If the extension is .jpg it will be renamed to .jpeg for consistency.
+// extensionValid makes sure that the image to be uploaded has the extension .jpeg, .jpg, .png,
+// .gif or .webp. If the extension is .jpg it will be renamed to .jpeg for consistency.
 func (iv *imageValidator) extensionValid(img *domain.Image) error {
 	ext := filepath.Ext(img.Filename)
 	ext = strings.ToLower(ext)
-	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
-		return errs.Errorf(
-			errs.EINVALID,
-			"Image " + img.Filename + " invalid extension, must be .jpeg or .png",
-			)
-	}
 	if ext == ".jpg" {
 		ext = ".jpeg"
 	}
+	valid := false
+	for _, e := range domain.ImageContentTypes {
+		valid = valid || e == ext
+	}
+	if !valid {
+		return errs.Errorf(
+			errs.EINVALID,
+			"Image "+img.Filename+" invalid extension, must be .jpeg, .png, .gif or .webp",
+		)
+	}
 	img.Extension = ext
 	return nil
 }
 
-// fileNameUnique replaces the image's name with a unique string based on a unix timestamp.
+// altTextValid trims whitespace from the image's alt text, and makes sure that it does not
+// exceed MaxAltTextLength characters. Alt text is optional.
+func (iv *imageValidator) altTextValid(img *domain.Image) error {
+	img.AltText = strings.TrimSpace(img.AltText)
+	if utf8.RuneCountInString(img.AltText) > domain.MaxAltTextLength {
+		return errs.Errorf(errs.EINVALID, "The alt text of image %s exceeds the limit of %d characters.", img.Filename, domain.MaxAltTextLength)
+	}
+	return nil
+}
+
+// fileNameUnique replaces the image's name with a random string, so that images uploaded
+// at the same time never get the same name, and names can't be guessed.
 func (iv *imageValidator) fileNameUnique(img *domain.Image) error {
-	timestamp := time.Now().UnixMicro()
-	img.Filename = strconv.FormatInt(timestamp, 10) + img.Extension
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return err
+	}
+	img.Filename = hex.EncodeToString(name) + img.Extension
 	return nil
 }
 
@@ -167,73 +310,491 @@ func resetFilePointer(img *domain.Image) error {
 	return nil
 }
 
-// Create takes a domain.Image object, creates a path to store the image, creates a
-// destination file inside that path, and copies the file data from the domain.Image object
-// into the destination file. If the path already exists, that one will be used.
-// Images are only stored in the filesystem and have no dedicated table in the database.
-// The users table does have columns to store the paths to a user's avatar and header image though.
+// Create takes a domain.Image object and processes it: the image is re-encoded without metadata, and
+// scaled to the variants its purpose needs, see processImage. Then the image and its variants are stored
+// in the BlobStore under keys that are based on the image's owner, e.g. tweet/2/unique_name.png and
+// tweet/2/unique_name_small.png, and a media record describing them is created. The image is placed
+// after the owner's existing images. If anything fails, the stored blobs are deleted again.
+// The storage quota is checked with the size of the upload before the image is processed, and with
+// the size of the processed image and its variants before they are stored. It is checked again
+// while the image's user is locked and the record is created, see lockImageUser.
 func (ic *imageCrud) Create(img *domain.Image) error {
-	path, err := ic.mkImagePath(img.OwnerType, img.OwnerID)
+	return ic.create(img, nil)
+}
+
+// create creates an image like Create. The images with the IDs in replacing are about to be
+// replaced by the new one, so they don't count against the user's storage quota.
+func (ic *imageCrud) create(img *domain.Image, replacing []int) error {
+	userId, err := imageUser(ic.db, img.OwnerType, img.OwnerID)
+	if err != nil {
+		return err
+	}
+	if err := quotaAllows(ic.db, userId, img, img.Size, replacing); err != nil {
+		return err
+	}
+
+	// Only a few images are processed at the same time, each of them can take a lot of memory.
+	ic.processing <- struct{}{}
+	processed, err := processImage(img)
+	<-ic.processing
 	if err != nil {
 		return err
 	}
-	// Create a destination file inside the path.
-	dst, err := os.Create(path + img.Filename)
+
+	// Store the image and its variants.
+	img.StoredSize = 0
+	for _, p := range processed {
+		img.StoredSize += int64(len(p.data))
+	}
+	if err := quotaAllows(ic.db, userId, img, img.StoredSize, replacing); err != nil {
+		return err
+	}
+	img.Key = img.BlobKey()
+	if err := setVariants(img, processed); err != nil {
+		return err
+	}
+	var stored []string
+	for i, p := range processed {
+		key, contentType := img.Key, img.ContentType
+		if i > 0 {
+			key = variantKey(img, img.Variants[i-1])
+			contentType = p.contentType
+		}
+		if err := ic.store.Put(key, stdbytes.NewReader(p.data), int64(len(p.data)), contentType); err != nil {
+			ic.deleteBlobs(stored)
+			return err
+		}
+		stored = append(stored, key)
+	}
+
+	// Describe them in the media table, unless concurrent uploads took the user over their storage quota.
+	sum := sha256.Sum256(processed[0].data)
+	img.Checksum = hex.EncodeToString(sum[:])
+	img.Size = int64(len(processed[0].data))
+	img.Width, img.Height = processed[0].width, processed[0].height
+	err = ic.db.Transaction(func(tx *gorm.DB) error {
+		userId, err := lockImageUser(tx, img.OwnerType, img.OwnerID)
+		if err != nil {
+			return err
+		}
+		if err := quotaAllows(tx, userId, img, img.StoredSize, replacing); err != nil {
+			return err
+		}
+		err = tx.Model(&domain.Image{}).
+			Select("COALESCE(MAX(position) + 1, 0)").
+			Where("owner_type = ? AND owner_id = ?", img.OwnerType, img.OwnerID).
+			Scan(&img.Position).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(img).Error
+	})
 	if err != nil {
+		ic.deleteBlobs(stored)
 		return err
 	}
-	// Copy the file data from the domain.Image object into the destination path.
-	_, err = io.Copy(dst, img.File)
+	img.URL = img.RelativePath()
+	return loadVariants(img)
+}
+
+// lockImageUser locks the record of the user that images of an owner belong to until the transaction
+// ends, and returns the user's ID. The user is the owner, or the author of the tweet that owns them.
+// Creating and replacing images lock the user first, so concurrent uploads can't both pass the
+// storage quota, and concurrent replacements of an owner's images can't interleave.
+func lockImageUser(tx *gorm.DB, ownerType string, ownerID int) (int, error) {
+	userId, err := imageUser(tx, ownerType, ownerID)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id").
+		First(&domain.User{}, userId).Error
+	if err == gorm.ErrRecordNotFound {
+		return 0, errs.Errorf(errs.ENOTFOUND, "The user does not exist.")
+	}
+	return userId, err
+}
+
+// imageUser returns the ID of the user that images of an owner belong to, without locking it.
+func imageUser(db *gorm.DB, ownerType string, ownerID int) (int, error) {
+	if ownerType != domain.OwnerTypeTweet {
+		return ownerID, nil
+	}
+	var userIds []int
+	err := db.Unscoped().Model(&domain.Tweet{}).Where("id = ?", ownerID).Pluck("user_id", &userIds).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(userIds) == 0 {
+		return 0, errs.Errorf(errs.ENOTFOUND, "The tweet does not exist.")
+	}
+	return userIds[0], nil
+}
+
+// quotaAllows makes sure that storing size bytes for an image doesn't take its user over
+// domain.UserStorageQuota. The images with the IDs in replacing don't count. Only a check made
+// after locking the user with lockImageUser within the same transaction holds up against concurrent uploads.
+func quotaAllows(db *gorm.DB, userId int, img *domain.Image, size int64, replacing []int) error {
+	used, err := storageUsed(db, userId, replacing)
 	if err != nil {
 		return err
 	}
+	if used+size > domain.UserStorageQuota {
+		return errs.Errorf(errs.EINVALID, "Image %s exceeds your storage quota of %dMB.", img.Filename, domain.UserStorageQuota>>20)
+	}
 	return nil
 }
 
+// storageUsed sums up the sizes of the images of a user and of their tweets, except the ones with the
+// IDs in exclude. Images stored before StoredSize was introduced count with the size of their blob,
+// without their variants.
+func storageUsed(db *gorm.DB, userId int, exclude []int) (int64, error) {
+	var used int64
+	query := db.Model(&domain.Image{}).
+		Select("COALESCE(SUM(CASE WHEN stored_size > 0 THEN stored_size ELSE size END), 0)").
+		Where("(owner_type = ? AND owner_id = ?) OR (owner_type = ? AND owner_id IN (SELECT id FROM tweets WHERE user_id = ?))",
+			domain.OwnerTypeUser, userId, domain.OwnerTypeTweet, userId)
+	if len(exclude) > 0 {
+		query = query.Where("id NOT IN ?", exclude)
+	}
+	err := query.Scan(&used).Error
+	return used, err
+}
+
+// replace makes the given, already created images the only images of their owner, in the given order.
+// The previous records are deleted and the new ones numbered in one transaction that locks the owner's
+// user, so a failure leaves the owner with its previous images, and of two concurrent replacements,
+// the later one either wins or fails because its images have been deleted by the other one. The blobs
+// of the previous images are deleted after the transaction; blobs that are left over because that
+// fails show up as files without rows in Check.
+func (ic *imageCrud) replace(ownerType string, ownerID int, images []*domain.Image) error {
+	ids := make([]int, 0, len(images))
+	for _, img := range images {
+		ids = append(ids, img.ID)
+	}
+	var previous []domain.Image
+	err := ic.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockImageUser(tx, ownerType, ownerID); err != nil {
+			return err
+		}
+		query := tx.Where("owner_type = ? AND owner_id = ?", ownerType, ownerID)
+		if len(ids) > 0 {
+			var count int64
+			if err := tx.Model(&domain.Image{}).Where("id IN ?", ids).Count(&count).Error; err != nil {
+				return err
+			}
+			if int(count) != len(ids) {
+				return errs.Errorf(errs.ECONFLICT, "The images have been replaced in the meantime. Please try again.")
+			}
+			query = query.Where("id NOT IN ?", ids)
+		}
+		if err := query.Find(&previous).Error; err != nil {
+			return err
+		}
+		if len(previous) > 0 {
+			if err := tx.Delete(&previous).Error; err != nil {
+				return err
+			}
+		}
+		return reposition(tx, images)
+	})
+	if err != nil {
+		return err
+	}
+	for i := range previous {
+		keys, err := blobKeys(&previous[i])
+		if err != nil {
+			return err
+		}
+		ic.deleteBlobs(keys)
+	}
+	return nil
+}
+
+// reposition numbers the images of an owner in the given order, starting at 0.
+func reposition(db *gorm.DB, images []*domain.Image) error {
+	for i, img := range images {
+		err := db.Model(&domain.Image{}).Where("id = ?", img.ID).Update("position", i).Error
+		if err != nil {
+			return err
+		}
+		img.Position = i
+	}
+	return nil
+}
+
+// deleteBlobs is a little helper for cleaning up the blobs of an image that couldn't be created.
+func (ic *imageCrud) deleteBlobs(keys []string) {
+	for _, key := range keys {
+		_ = ic.store.Delete(key)
+	}
+}
+
+// ByID finds the image with the given ID.
+func (ic *imageCrud) ByID(id int) (*domain.Image, error) {
+	var img domain.Image
+	err := ic.db.First(&img, "id = ?", id).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The image does not exist.")
+		}
+		return nil, err
+	}
+	img.URL = img.RelativePath()
+	if err := loadVariants(&img); err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
 // ByOwner takes an ownerType, which as of now is either an Image or a User, and an ownerID.
-// It returns an array of domain.Image objects containing information about that owner's images.
+// It returns an array of domain.Image objects containing information about that owner's images, in order.
 func (ic *imageCrud) ByOwner(ownerType string, ownerID int) ([]domain.Image, error) {
-	path := ic.imagePath(ownerType, ownerID)
-	imgStrings, err := filepath.Glob(path + "*")
+	var images []domain.Image
+	err := ic.db.
+		Where("owner_type = ? AND owner_id = ?", ownerType, ownerID).
+		Order("position, id").
+		Find(&images).Error
 	if err != nil {
 		return nil, err
 	}
-	ret := make([]domain.Image, len(imgStrings))
-	for i := range ret {
-		imgStrings[i] = strings.Replace(imgStrings[i], path, "", 1)
-		ret[i] = domain.Image{
-			Filename: imgStrings[i],
-			OwnerType: ownerType,
-			OwnerID: ownerID,
-			URL: path + imgStrings[i],
+	for i := range images {
+		images[i].URL = images[i].RelativePath()
+		if err := loadVariants(&images[i]); err != nil {
+			return nil, err
 		}
 	}
-	return ret, nil
+	return images, nil
+}
+
+// Open returns the content of a stored image. The caller must close it.
+func (ic *imageCrud) Open(i *domain.Image) (io.ReadCloser, error) {
+	return ic.store.Get(i.BlobKey())
 }
 
-// Delete removes a specific image from the filesystem.
+// SignedURL returns a temporary URL to download an image from the BlobStore directly,
+// or an empty string if the BlobStore doesn't support that.
+func (ic *imageCrud) SignedURL(i *domain.Image) (string, error) {
+	return ic.store.SignedURL(i.BlobKey(), imageURLLifetime)
+}
+
+// UpdateAltText saves the image's alt text, leaving the rest of its media record untouched.
+func (ic *imageCrud) UpdateAltText(i *domain.Image) error {
+	return ic.db.Model(&domain.Image{}).Where("id = ?", i.ID).Update("alt_text", i.AltText).Error
+}
+
+// Delete removes a specific image and its variants from the BlobStore, and then its media record.
 func (ic *imageCrud) Delete(i *domain.Image) error {
-	return os.Remove(i.RelativePath())
+	key := i.BlobKey()
+	var stored domain.Image
+	err := ic.db.Where("key = ?", key).First(&stored).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	keys := []string{key}
+	if err == nil {
+		if keys, err = blobKeys(&stored); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if err := ic.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return ic.db.Where("key = ?", key).Delete(&domain.Image{}).Error
 }
 
-// DeleteAll removes an entire directory containing images from the filesystem.
+// blobKeys returns the keys of the blobs of a stored image: the image itself and its variants.
+func blobKeys(img *domain.Image) ([]string, error) {
+	if err := loadVariants(img); err != nil {
+		return nil, err
+	}
+	keys := []string{img.BlobKey()}
+	for _, v := range img.Variants {
+		keys = append(keys, variantKey(img, v))
+	}
+	return keys, nil
+}
+
+// DeleteAll removes all images of an owner from the BlobStore, and then their media records.
+// Blobs of the owner without a record are removed as well.
 func (ic *imageCrud) DeleteAll(ownerType string, ownerID int) error {
-	return os.RemoveAll(ic.imagePath(ownerType, ownerID))
+	keys, err := ic.store.List(ic.imagePrefix(ownerType, ownerID))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := ic.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return ic.db.Where("owner_type = ? AND owner_id = ?", ownerType, ownerID).Delete(&domain.Image{}).Error
+}
+
+// Owners returns the IDs of the owners of the given type that have images, either in the BlobStore
+// or in the media table, in ascending order.
+func (ic *imageCrud) Owners(ownerType string) ([]int, error) {
+	owners := map[int]bool{}
+	keys, err := ic.store.List(ownerType + "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if img, ok := parseImageKey(key); ok {
+			owners[img.OwnerID] = true
+		}
+	}
+	var ownerIds []int
+	if err := ic.db.Model(&domain.Image{}).Where("owner_type = ?", ownerType).Distinct().Pluck("owner_id", &ownerIds).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range ownerIds {
+		owners[id] = true
+	}
+	ownerIds = make([]int, 0, len(owners))
+	for id := range owners {
+		ownerIds = append(ownerIds, id)
+	}
+	sort.Ints(ownerIds)
+	return ownerIds, nil
+}
+
+// Check compares the blobs of all owners in the BlobStore with the media table. With fix, it creates
+// the missing records from the blobs themselves, and deletes the records whose blob is missing.
+func (ic *imageCrud) Check(fix bool) (*domain.MediaReport, error) {
+	// Collect the keys of the blobs and of the records.
+	files := map[string]bool{}
+	for _, ownerType := range []string{domain.OwnerTypeTweet, domain.OwnerTypeUser} {
+		keys, err := ic.store.List(ownerType + "/")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			files[key] = true
+		}
+	}
+	var images []domain.Image
+	if err := ic.db.Select("id, owner_type, owner_id, key, filename, variants_json").Order("key").Find(&images).Error; err != nil {
+		return nil, err
+	}
+	rows := make([]string, len(images))
+	for i := range images {
+		rows[i] = images[i].Key
+		// Variants are described by the record of their image.
+		if err := loadVariants(&images[i]); err != nil {
+			return nil, err
+		}
+		for _, v := range images[i].Variants {
+			delete(files, variantKey(&images[i], v))
+		}
+	}
+
+	// Compare them.
+	report := &domain.MediaReport{
+		Files:            len(files),
+		Rows:             len(rows),
+		FilesWithoutRows: []string{},
+		RowsWithoutFiles: []string{},
+		Fixed:            fix,
+	}
+	for _, key := range rows {
+		if files[key] {
+			delete(files, key)
+		} else {
+			report.RowsWithoutFiles = append(report.RowsWithoutFiles, key)
+		}
+	}
+	for key := range files {
+		report.FilesWithoutRows = append(report.FilesWithoutRows, key)
+	}
+	sort.Strings(report.FilesWithoutRows)
+	if !fix {
+		return report, nil
+	}
+
+	// Fix the differences.
+	for _, key := range report.FilesWithoutRows {
+		img, ok := parseImageKey(key)
+		if !ok {
+			continue
+		}
+		if err := ic.adopt(img); err != nil {
+			return nil, err
+		}
+	}
+	if len(report.RowsWithoutFiles) > 0 {
+		if err := ic.db.Where("key IN ?", report.RowsWithoutFiles).Delete(&domain.Image{}).Error; err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
 }
 
-// mkImagePath creates a filesystem path based on an image's ownerType and ownerID.
-// This results in directories like: /images/user/1/ and /images/tweet/2/.
-func (ic *imageCrud) mkImagePath(ownerType string, ownerID int) (string, error) {
-	imagePath := ic.imagePath(ownerType, ownerID)
-	err := os.MkdirAll(imagePath, 0755)
+// adopt creates the media record of a blob that has none, measuring the blob.
+// Blobs that aren't readable images are described as well, so they can be found and deleted.
+func (ic *imageCrud) adopt(img *domain.Image) error {
+	src, err := ic.store.Get(img.Key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
 	if err != nil {
-		return "", err
+		return err
+	}
+	sum := sha256.Sum256(data)
+	img.Checksum = hex.EncodeToString(sum[:])
+	img.Size = int64(len(data))
+	img.ContentType = http.DetectContentType(data)
+	img.Purpose = domain.ImagePurposeTweet
+	if img.OwnerType == domain.OwnerTypeUser {
+		var headers int64
+		err := ic.db.Model(&domain.User{}).Where("id = ? AND header = ?", img.OwnerID, img.Filename).Count(&headers).Error
+		if err != nil {
+			return err
+		}
+		img.Purpose = domain.ImagePurposeAvatar
+		if headers > 0 {
+			img.Purpose = domain.ImagePurposeHeader
+		}
+	}
+	if cfg, _, err := image.DecodeConfig(stdbytes.NewReader(data)); err == nil {
+		img.Width, img.Height = cfg.Width, cfg.Height
+	}
+	return ic.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&domain.Image{}).
+			Select("COALESCE(MAX(position) + 1, 0)").
+			Where("owner_type = ? AND owner_id = ?", img.OwnerType, img.OwnerID).
+			Scan(&img.Position).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(img).Error
+	})
+}
+
+// parseImageKey builds an Image from the key of its blob, e.g. tweet/2/unique_name.png.
+// It reports false if the key doesn't belong to an owner.
+func parseImageKey(key string) (*domain.Image, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || (parts[0] != domain.OwnerTypeTweet && parts[0] != domain.OwnerTypeUser) {
+		return nil, false
+	}
+	ownerId, err := strconv.Atoi(parts[1])
+	if err != nil || parts[2] == "" {
+		return nil, false
 	}
-	return imagePath, nil
+	return &domain.Image{
+		OwnerType: parts[0],
+		OwnerID:   ownerId,
+		Filename:  parts[2],
+		Key:       key,
+	}, true
 }
 
-// imagePath builds the name of a path based on the name of the base directory for images,
-// an image's ownerType and its ownerID.
-func (ic *imageCrud) imagePath(ownerType string, ownerID int) string {
-	return fmt.Sprintf("%v/%v/%v/", domain.ImagesBaseDir, ownerType, ownerID)
+// imagePrefix builds the key prefix of an owner's images, based on an image's ownerType and its ownerID.
+// This results in prefixes like: user/1/ and tweet/2/.
+func (ic *imageCrud) imagePrefix(ownerType string, ownerID int) string {
+	return fmt.Sprintf("%v/%v/", ownerType, ownerID)
 }
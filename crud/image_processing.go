@@ -0,0 +1,283 @@
+package crud
+
+import (
+	stdbytes "bytes"
+	"encoding/json"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+	"wtfTwitter/imaging"
+)
+
+// imageProcessingSlots determines how many images are processed at the same time. Processing an image
+// holds its decoded pixels, up to 8 bytes per pixel of domain.MaxImagePixels for 16-bit pngs (192MB),
+// an upright copy of 4 bytes per pixel if its EXIF orientation rotates or flips it (96MB), and the
+// encoded image and variants. So each slot can take about 300MB.
+const imageProcessingSlots = 2
+
+// jpegQuality determines the quality that processed jpeg images are encoded with.
+const jpegQuality = 85
+
+// imageVariantSpec describes a variant of an image. With fill, the image is scaled and cropped to
+// exactly width x height pixels. Otherwise, it's scaled down to fit into them, keeping its aspect ratio.
+type imageVariantSpec struct {
+	name   string
+	width  int
+	height int
+	fill   bool
+}
+
+// imageVariantSpecs lists the variants that are generated for images of each purpose.
+var imageVariantSpecs = map[string][]imageVariantSpec{
+	domain.ImagePurposeAvatar: {
+		{name: "48", width: 48, height: 48, fill: true},
+		{name: "128", width: 128, height: 128, fill: true},
+		{name: "400", width: 400, height: 400, fill: true},
+	},
+	domain.ImagePurposeHeader: {
+		{name: "1500x500", width: 1500, height: 500, fill: true},
+	},
+	domain.ImagePurposeTweet: {
+		{name: "small", width: 680, height: 680},
+		{name: "medium", width: 1200, height: 1200},
+		{name: "large", width: 2048, height: 2048},
+	},
+}
+
+// processedImage is an encoded image, ready to be stored. Its name is empty for the image itself,
+// and the name of the variant otherwise. Its content type is empty if it's the one of the image.
+type processedImage struct {
+	name        string
+	contentType string
+	data        []byte
+	width       int
+	height      int
+}
+
+// processImage processes an uploaded image in a way that depends on its format, see processStill,
+// processGIF and processWebP. The image itself comes first in the returned slice, then its variants.
+func processImage(img *domain.Image) ([]processedImage, error) {
+	img.Frames = 1
+	switch img.ContentType {
+	case "image/gif":
+		return processGIF(img)
+	case "image/webp":
+		return processWebP(img)
+	default:
+		return processStill(img)
+	}
+}
+
+// processStill decodes an uploaded jpeg or png image and turns it upright according to its EXIF
+// orientation. Then it re-encodes it in its format without any metadata, like the location a photo
+// was taken at, scaled down to domain.MaxImageDimension if necessary. The variants its purpose
+// needs are encoded in the same format.
+func processStill(img *domain.Image) ([]processedImage, error) {
+	orientation := imaging.Orientation(img.File)
+	if err := resetFilePointer(img); err != nil {
+		return nil, err
+	}
+	decoded, _, err := imaging.Decode(img.File, domain.MaxImagePixels)
+	if err != nil {
+		return nil, decodeError(img, err)
+	}
+	upright := imaging.Orient(decoded, orientation)
+
+	full := imaging.Fit(upright, domain.MaxImageDimension, domain.MaxImageDimension)
+	p, err := encodeImage("", full, img.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	p.contentType = ""
+	variants, err := encodeVariants(upright, img.Purpose, img.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	return append([]processedImage{p}, variants...), nil
+}
+
+// processGIF checks the number of frames, the duration and the total number of pixels of an uploaded
+// GIF before decoding it, and then re-encodes it frame by frame, which drops comments and other
+// metadata without losing quality. A still GIF gets the variants of its purpose as png images.
+// An animated GIF isn't scaled, its only variant is its first frame as a png image, the poster.
+func processGIF(img *domain.Image) ([]processedImage, error) {
+	data, err := ioutil.ReadAll(img.File)
+	if err != nil {
+		return nil, err
+	}
+	info, err := imaging.ScanGIF(data)
+	if err != nil {
+		return nil, decodeError(img, err)
+	}
+	switch {
+	case info.Width > domain.MaxImageDimension || info.Height > domain.MaxImageDimension:
+		return nil, errs.Errorf(errs.EINVALID, "Image %s exceeds the limit of %dx%d pixels.", img.Filename, domain.MaxImageDimension, domain.MaxImageDimension)
+	case info.Frames > domain.MaxAnimationFrames:
+		return nil, errs.Errorf(errs.EINVALID, "Image %s exceeds the limit of %d frames.", img.Filename, domain.MaxAnimationFrames)
+	case info.Duration > domain.MaxAnimationDuration:
+		return nil, errs.Errorf(errs.EINVALID, "Image %s exceeds the limit of %d seconds.", img.Filename, int(domain.MaxAnimationDuration.Seconds()))
+	case info.Frames > 0 && info.Width*info.Height > domain.MaxAnimationPixels/info.Frames:
+		return nil, errs.Errorf(errs.EINVALID, "Image %s has too many pixels in all its frames.", img.Filename)
+	}
+	g, err := gif.DecodeAll(stdbytes.NewReader(data))
+	if err != nil {
+		return nil, decodeError(img, err)
+	}
+	var buf stdbytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+	poster := imaging.Poster(g)
+	p := processedImage{data: buf.Bytes(), width: poster.Bounds().Dx(), height: poster.Bounds().Dy()}
+	img.Frames = len(g.Image)
+	img.Duration = int(info.Duration / time.Millisecond)
+
+	var variants []processedImage
+	if img.IsAnimated() {
+		v, err := encodeImage(domain.ImageVariantPoster, poster, "image/png")
+		if err != nil {
+			return nil, err
+		}
+		variants = []processedImage{v}
+	} else if variants, err = encodeVariants(poster, img.Purpose, "image/png"); err != nil {
+		return nil, err
+	}
+	return append([]processedImage{p}, variants...), nil
+}
+
+// processWebP removes the metadata of an uploaded WebP image, keeping its image data as it is, since
+// there's no encoder for WebP. Its variants are encoded as jpeg images, or as png images if it has
+// transparent pixels. Animated WebP images can't be decoded and are rejected.
+func processWebP(img *domain.Image) ([]processedImage, error) {
+	data, err := ioutil.ReadAll(img.File)
+	if err != nil {
+		return nil, err
+	}
+	stripped, err := imaging.StripWebPMetadata(data)
+	if err == imaging.ErrAnimatedWebP {
+		return nil, errs.Errorf(errs.EINVALID, "Image %s is an animated WebP image, which is not supported.", img.Filename)
+	}
+	if err != nil {
+		return nil, decodeError(img, err)
+	}
+	decoded, _, err := imaging.Decode(stdbytes.NewReader(stripped), domain.MaxImagePixels)
+	if err != nil {
+		return nil, decodeError(img, err)
+	}
+	b := decoded.Bounds()
+	if b.Dx() > domain.MaxImageDimension || b.Dy() > domain.MaxImageDimension {
+		return nil, errs.Errorf(errs.EINVALID, "Image %s exceeds the limit of %dx%d pixels.", img.Filename, domain.MaxImageDimension, domain.MaxImageDimension)
+	}
+	p := processedImage{data: stripped, width: b.Dx(), height: b.Dy()}
+	contentType := "image/jpeg"
+	if !imaging.Opaque(decoded) {
+		contentType = "image/png"
+	}
+	variants, err := encodeVariants(decoded, img.Purpose, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return append([]processedImage{p}, variants...), nil
+}
+
+// decodeError turns an error of decoding an image into an error that can be shown to the user.
+func decodeError(img *domain.Image, err error) error {
+	if err == imaging.ErrTooLarge {
+		return errs.Errorf(errs.EINVALID, "Image "+img.Filename+" has too many pixels.")
+	}
+	return errs.Errorf(errs.EINVALID, "Image "+img.Filename+" cannot be read.")
+}
+
+// encodeVariants scales an image to the variants its purpose needs, and encodes them as contentType.
+func encodeVariants(img image.Image, purpose, contentType string) ([]processedImage, error) {
+	var variants []processedImage
+	for _, spec := range imageVariantSpecs[purpose] {
+		var scaled image.Image
+		if spec.fill {
+			scaled = imaging.Fill(img, spec.width, spec.height)
+		} else {
+			scaled = imaging.Fit(img, spec.width, spec.height)
+		}
+		p, err := encodeImage(spec.name, scaled, contentType)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, p)
+	}
+	return variants, nil
+}
+
+// encodeImage encodes an image as jpeg or png, depending on the content type.
+func encodeImage(name string, img image.Image, contentType string) (processedImage, error) {
+	var buf stdbytes.Buffer
+	var err error
+	switch contentType {
+	case "image/png":
+		err = png.Encode(&buf, img)
+	default:
+		contentType = "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return processedImage{}, err
+	}
+	return processedImage{
+		name:        name,
+		contentType: contentType,
+		data:        buf.Bytes(),
+		width:       img.Bounds().Dx(),
+		height:      img.Bounds().Dy(),
+	}, nil
+}
+
+// setVariants sets the variants of an image from its processed versions, and encodes them as json.
+func setVariants(img *domain.Image, processed []processedImage) error {
+	img.Variants = []domain.ImageVariant{}
+	for _, p := range processed {
+		if p.name == "" {
+			continue
+		}
+		v := domain.ImageVariant{
+			Name:   p.name,
+			Width:  p.width,
+			Height: p.height,
+			Size:   int64(len(p.data)),
+		}
+		if p.contentType != img.ContentType {
+			v.ContentType = p.contentType
+		}
+		img.Variants = append(img.Variants, v)
+	}
+	data, err := json.Marshal(img.Variants)
+	if err != nil {
+		return err
+	}
+	img.VariantsJSON = string(data)
+	return nil
+}
+
+// loadVariants decodes the variants of an image loaded from the database, and sets their URLs.
+// Images stored before variants were introduced have none.
+func loadVariants(img *domain.Image) error {
+	img.Variants = []domain.ImageVariant{}
+	if img.VariantsJSON != "" {
+		if err := json.Unmarshal([]byte(img.VariantsJSON), &img.Variants); err != nil {
+			return err
+		}
+	}
+	for i := range img.Variants {
+		img.Variants[i].URL = domain.ImagesBaseDir + "/" + variantKey(img, img.Variants[i])
+	}
+	return nil
+}
+
+// variantKey returns the key a variant of an image is stored under, e.g. tweet/2/unique_name_small.png.
+func variantKey(img *domain.Image, v domain.ImageVariant) string {
+	return strings.TrimSuffix(img.BlobKey(), img.Filename) + img.VariantFilename(v)
+}
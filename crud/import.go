@@ -0,0 +1,823 @@
+package crud
+
+import (
+	"archive/zip"
+	stdbytes "bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// importPollInterval determines how often the import worker looks for pending imports,
+// in addition to being woken up whenever an archive is uploaded.
+const importPollInterval = time.Minute
+
+// Files of an official Twitter archive. Large archives split the tweets into several parts,
+// and older archives name them tweet.js instead of tweets.js.
+var (
+	archiveTweetsRegex = regexp.MustCompile(`^data/tweets?(-part[0-9]+)?\.js$`)
+	archiveMediaRegex  = regexp.MustCompile(`^data/tweets?_media/([0-9]+)-[^/]+$`)
+)
+
+const (
+	archiveAccount      = "data/account.js"
+	archiveProfile      = "data/profile.js"
+	archiveProfileMedia = "data/profile_media/"
+	// maxTweetImages is the number of images a tweet can have, see the tweet image upload.
+	maxTweetImages = 4
+)
+
+// ImportService manages Imports and imports official Twitter archives.
+// It implements the domain.ImportService interface.
+type ImportService struct {
+	importValidator
+}
+
+// importValidator runs validations on incoming Import data.
+// On success, it passes the data on to importGorm.
+// Otherwise, it returns the error of the validation that has failed.
+type importValidator struct {
+	importGorm
+}
+
+// importGorm runs CRUD operations on the database using incoming Import data, and hands
+// uploaded archives to the importWorker.
+type importGorm struct {
+	db       *gorm.DB
+	importer *archiveImporter
+	worker   *importWorker
+}
+
+// NewImportService returns an instance of ImportService. Images found in archives are
+// stored through the given ImageService, so they are validated like uploaded ones.
+// It starts the background worker, which runs until Close is called.
+func NewImportService(db *gorm.DB, images domain.ImageService) *ImportService {
+	importer := &archiveImporter{
+		db:              db,
+		images:          images,
+		maxDataFileSize: domain.MaxImportDataFileSize,
+		maxUnpackedSize: domain.MaxImportUnpackedSize,
+	}
+	return &ImportService{
+		importValidator{
+			importGorm{
+				db:       db,
+				importer: importer,
+				worker:   newImportWorker(db, importer),
+			},
+		},
+	}
+}
+
+// Ensure the ImportService struct properly implements the domain.ImportService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.ImportService = &ImportService{}
+
+// Create runs validations needed for creating new Import database records.
+func (iv *importValidator) Create(imp *domain.Import, archive io.Reader) error {
+	err := runImportValFns(imp,
+		iv.userIdValid,
+		iv.noneInProgress)
+	if err != nil {
+		return err
+	}
+	imp.Status = domain.ImportStatusPending
+	return iv.importGorm.Create(imp, archive)
+}
+
+// Run checks the user and imports the archive at the given path right away.
+func (iv *importValidator) Run(userId int, archivePath string) (*domain.ImportReport, error) {
+	if err := runImportValFns(&domain.Import{UserID: userId}, iv.userIdValid); err != nil {
+		return nil, err
+	}
+	return iv.importGorm.Run(userId, archivePath)
+}
+
+// runImportValFns runs any number of functions of type importValFn on the passed in Import object.
+// If none of them returns an error, it returns nil. Otherwise, it returns the respective error.
+func runImportValFns(imp *domain.Import, fns ...importValFn) error {
+	for _, fn := range fns {
+		if err := fn(imp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An importValFn is any function that takes in a pointer to a domain.Import object and returns an error.
+type importValFn func(imp *domain.Import) error
+
+// noneInProgress makes sure that the user has no import waiting or running.
+func (iv *importValidator) noneInProgress(imp *domain.Import) error {
+	var count int64
+	err := iv.db.Model(&domain.Import{}).
+		Where("user_id = ? AND status = ?", imp.UserID, domain.ImportStatusPending).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errs.Errorf(errs.ECONFLICT, "Your previous archive is still being imported.")
+	}
+	return nil
+}
+
+// userIdValid ensures that the userId is not empty.
+func (iv *importValidator) userIdValid(imp *domain.Import) error {
+	if imp.UserID <= 0 {
+		return errs.UserIdValid
+	}
+	return nil
+}
+
+// LatestByUserID retrieves the user's most recent import along with its report.
+// If there is none, it returns an errs.ENOTFOUND.
+func (ig *importGorm) LatestByUserID(userId int) (*domain.Import, error) {
+	var imp domain.Import
+	err := first(ig.db.Where("user_id = ?", userId).Order("created_at desc"), &imp)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "You haven't imported an archive yet.")
+		}
+		return nil, err
+	}
+	if imp.ReportJSON != "" {
+		if err := json.Unmarshal([]byte(imp.ReportJSON), &imp.Report); err != nil {
+			return nil, err
+		}
+	}
+	return &imp, nil
+}
+
+// Create stores the uploaded archive next to the other pending ones, stores the data from the Import
+// object in a new database record, and wakes up the worker to import it. The archive is written
+// before the record is created, so the worker never finds an import whose archive is incomplete.
+func (ig *importGorm) Create(imp *domain.Import, archive io.Reader) error {
+	tmp, err := storeArchive(importDir(imp.UserID), archive)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := ig.db.Create(imp).Error; err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, importPath(imp)); err != nil {
+		ig.db.Delete(imp)
+		return err
+	}
+	ig.worker.wake()
+	return nil
+}
+
+// Run imports the archive at the given path for the user right away.
+func (ig *importGorm) Run(userId int, archivePath string) (*domain.ImportReport, error) {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, errs.Errorf(errs.EINVALID, "The archive is no valid zip file.")
+	}
+	defer zr.Close()
+	return ig.importer.run(userId, &zr.Reader)
+}
+
+// Close stops the worker, waiting for the import that's currently running.
+func (ig *importGorm) Close() error {
+	ig.worker.close()
+	return nil
+}
+
+// importDir returns the directory that holds the uploaded archives of a user.
+func importDir(userId int) string {
+	return filepath.Join(domain.ImportsBaseDir, strconv.Itoa(userId))
+}
+
+// importPath returns the location of an import's uploaded archive in the filesystem.
+func importPath(imp *domain.Import) string {
+	return filepath.Join(importDir(imp.UserID), strconv.Itoa(imp.ID)+".zip")
+}
+
+// storeArchive writes an uploaded archive to a temporary file in the given directory, and returns its path.
+func storeArchive(dir string, archive io.Reader) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, "upload-*.zip")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, archive); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// importWorker imports uploaded archives in the background, one after another. Pending imports
+// are read from the database, so archives uploaded before a restart are picked up again.
+type importWorker struct {
+	db       *gorm.DB
+	importer *archiveImporter
+	wakeup   chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	closing  sync.Once
+}
+
+// newImportWorker creates an importWorker and starts its background loop.
+func newImportWorker(db *gorm.DB, importer *archiveImporter) *importWorker {
+	w := &importWorker{
+		db:       db,
+		importer: importer,
+		wakeup:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// wake makes the worker look for pending imports right away, without blocking.
+func (w *importWorker) wake() {
+	select {
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the worker and waits until the import that's currently running is finished.
+func (w *importWorker) close() {
+	w.closing.Do(func() {
+		close(w.stop)
+		<-w.done
+	})
+}
+
+// run is the worker's background loop. It works right away, whenever it's woken up and every importPollInterval.
+func (w *importWorker) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(importPollInterval)
+	defer ticker.Stop()
+	for {
+		w.importPending()
+		select {
+		case <-w.stop:
+			return
+		case <-w.wakeup:
+		case <-ticker.C:
+		}
+	}
+}
+
+// importPending imports the archives of all pending imports, oldest first. Errors are logged,
+// since there's no caller to return them to.
+func (w *importWorker) importPending() {
+	var imports []domain.Import
+	err := w.db.Where("status = ?", domain.ImportStatusPending).Order("created_at").Find(&imports).Error
+	if err != nil {
+		log.Printf("[import] error: %s", err)
+		return
+	}
+	for i := range imports {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		w.importArchive(&imports[i])
+	}
+}
+
+// importArchive imports an uploaded archive, stores the import's outcome and deletes the archive.
+// App errors, like an archive that's no zip file, are shown to the user. Others are only logged.
+func (w *importWorker) importArchive(imp *domain.Import) {
+	report, err := func() (*domain.ImportReport, error) {
+		zr, err := zip.OpenReader(importPath(imp))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, errs.Errorf(errs.EINVALID, "The uploaded archive has gone missing. Please upload it again.")
+			}
+			return nil, errs.Errorf(errs.EINVALID, "The archive is no valid zip file.")
+		}
+		defer zr.Close()
+		return w.importer.run(imp.UserID, &zr.Reader)
+	}()
+	now := time.Now()
+	imp.CompletedAt = &now
+	if err != nil {
+		log.Printf("[import] error: import %d: %s", imp.ID, err)
+		imp.Status = domain.ImportStatusFailed
+		imp.Error = errs.ErrorMessage(err)
+	} else {
+		reportJSON, err := json.Marshal(report)
+		if err != nil {
+			log.Printf("[import] error: import %d: %s", imp.ID, err)
+			return
+		}
+		imp.Status = domain.ImportStatusDone
+		imp.ReportJSON = string(reportJSON)
+	}
+	err = w.db.Model(imp).Updates(map[string]interface{}{
+		"status":       imp.Status,
+		"error":        imp.Error,
+		"report_json":  imp.ReportJSON,
+		"completed_at": imp.CompletedAt,
+	}).Error
+	if err != nil {
+		log.Printf("[import] error: import %d: %s", imp.ID, err)
+		return
+	}
+	if err := os.Remove(importPath(imp)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[import] error: import %d: %s", imp.ID, err)
+	}
+}
+
+// archiveTweet is a tweet as found in the tweets.js of a Twitter archive. Retweets only have
+// retweeted_status in some archives. In the others, they are recognized by their "RT @handle: " prefix.
+type archiveTweet struct {
+	IDStr                string `json:"id_str"`
+	FullText             string `json:"full_text"`
+	CreatedAt            string `json:"created_at"`
+	InReplyToStatusIDStr string `json:"in_reply_to_status_id_str"`
+	PossiblySensitive    bool   `json:"possibly_sensitive"`
+	RetweetedStatus      *struct {
+		IDStr string `json:"id_str"`
+	} `json:"retweeted_status"`
+
+	createdAt time.Time
+	content   string
+}
+
+// isRetweet reports whether the tweet is a retweet. Quote tweets are not, they only link the quoted tweet.
+func (at *archiveTweet) isRetweet() bool {
+	return at.RetweetedStatus != nil || strings.HasPrefix(at.content, "RT @")
+}
+
+// archiveProfileData is the profile as found in the profile.js of a Twitter archive.
+type archiveProfileData struct {
+	Description struct {
+		Bio string `json:"bio"`
+	} `json:"description"`
+	AvatarMediaURL string `json:"avatarMediaUrl"`
+	HeaderMediaURL string `json:"headerMediaUrl"`
+}
+
+// archiveImporter imports the tweets, their images and the profile of a Twitter archive for a user.
+// Archives whose files unpack to more than maxUnpackedSize, or whose data files are larger than
+// maxDataFileSize, are rejected, see domain.MaxImportUnpackedSize.
+type archiveImporter struct {
+	db              *gorm.DB
+	images          domain.ImageService
+	maxDataFileSize int64
+	maxUnpackedSize int64
+}
+
+// archiveImport holds the state of a single run of the archiveImporter.
+type archiveImport struct {
+	*archiveImporter
+	userId int
+	handle string
+	files  map[string]*zip.File
+	media  map[string][]*zip.File
+	// imported maps the IDs of archive tweets imported before or during this run to the IDs of
+	// their tweets. Tweets that have been deleted since are included, live only has the others.
+	imported map[string]int
+	live     map[string]int
+	report   *domain.ImportReport
+}
+
+// run imports an archive for a user. Tweets that have been imported before are left alone,
+// and items that can't be imported are listed in the report. An error is only returned if the
+// archive can't be imported at all.
+func (ai *archiveImporter) run(userId int, zr *zip.Reader) (*domain.ImportReport, error) {
+	var user domain.User
+	if err := ai.db.First(&user, "id = ?", userId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The user does not exist")
+		}
+		return nil, err
+	}
+	run := archiveImport{
+		archiveImporter: ai,
+		userId:          userId,
+		files:           map[string]*zip.File{},
+		media:           map[string][]*zip.File{},
+		imported:        map[string]int{},
+		live:            map[string]int{},
+		report:          &domain.ImportReport{Profile: []string{}, Skipped: []domain.ImportSkip{}},
+	}
+
+	// Index the archive's files, along with the media of every tweet.
+	if err := run.index(zr); err != nil {
+		return nil, err
+	}
+
+	// The account's handle is needed to recognize retweets of the user's own tweets.
+	var accounts []struct {
+		Account struct {
+			Username string `json:"username"`
+		} `json:"account"`
+	}
+	if f, ok := run.files[archiveAccount]; ok {
+		if err := readArchiveJS(f, ai.maxDataFileSize, &accounts); err != nil {
+			return nil, err
+		}
+		if len(accounts) > 0 {
+			run.handle = accounts[0].Account.Username
+		}
+	}
+
+	// Read the tweets of all parts and import them oldest first, so replies come after the tweets they reply to.
+	tweets, err := run.readTweets()
+	if err != nil {
+		return nil, err
+	}
+	if err := run.loadImported(); err != nil {
+		return nil, err
+	}
+	for i := range tweets {
+		if err := run.importTweet(tweets, &tweets[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := run.importProfile(&user); err != nil {
+		return nil, err
+	}
+	return run.report, nil
+}
+
+// index indexes the archive's files by name, and the media of every tweet by the tweet's ID.
+// It rejects archives that unpack to more than maxUnpackedSize. The sizes are taken from the
+// archive's directory, and reading a file fails once it gets larger than its listed size.
+func (run *archiveImport) index(zr *zip.Reader) error {
+	var unpacked uint64
+	for _, f := range zr.File {
+		unpacked += f.UncompressedSize64
+		if unpacked > uint64(run.maxUnpackedSize) {
+			return errs.Errorf(errs.EINVALID, "The archive must not unpack to more than %dGB.", run.maxUnpackedSize>>30)
+		}
+		run.files[f.Name] = f
+		if m := archiveMediaRegex.FindStringSubmatch(f.Name); m != nil {
+			run.media[m[1]] = append(run.media[m[1]], f)
+		}
+	}
+	return nil
+}
+
+// readTweets reads and parses the tweets of all parts of the archive, sorted by their creation time.
+// Tweets with a malformed creation time are skipped.
+func (run *archiveImport) readTweets() ([]archiveTweet, error) {
+	var names []string
+	for name := range run.files {
+		if archiveTweetsRegex.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errs.Errorf(errs.EINVALID, "The archive contains no tweets. Please upload the zip file of your Twitter archive.")
+	}
+	sort.Strings(names)
+	var tweets []archiveTweet
+	for _, name := range names {
+		// Tweets are either wrapped in an object like {"tweet": {...}}, or not at all.
+		var items []struct {
+			Tweet *archiveTweet `json:"tweet"`
+			archiveTweet
+		}
+		if err := readArchiveJS(run.files[name], run.maxDataFileSize, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			tweet := item.archiveTweet
+			if item.Tweet != nil {
+				tweet = *item.Tweet
+			}
+			createdAt, err := time.Parse(time.RubyDate, tweet.CreatedAt)
+			if err != nil || tweet.IDStr == "" {
+				run.skip(tweet.IDStr, "The tweet has no valid id or creation time.")
+				continue
+			}
+			tweet.createdAt = createdAt
+			tweet.content = html.UnescapeString(tweet.FullText)
+			tweets = append(tweets, tweet)
+		}
+	}
+	sort.SliceStable(tweets, func(i, j int) bool {
+		return tweets[i].createdAt.Before(tweets[j].createdAt)
+	})
+	return tweets, nil
+}
+
+// loadImported loads the archive tweets the user has imported before, and which of their tweets still exist.
+func (run *archiveImport) loadImported() error {
+	var mappings []domain.ImportedTweet
+	if err := run.db.Where("user_id = ?", run.userId).Find(&mappings).Error; err != nil {
+		return err
+	}
+	tweetIds := make([]int, 0, len(mappings))
+	for _, m := range mappings {
+		run.imported[m.SourceID] = m.TweetID
+		tweetIds = append(tweetIds, m.TweetID)
+	}
+	var liveIds []int
+	if err := run.db.Model(&domain.Tweet{}).Where("id IN ?", tweetIds).Pluck("id", &liveIds).Error; err != nil {
+		return err
+	}
+	isLive := make(map[int]bool, len(liveIds))
+	for _, id := range liveIds {
+		isLive[id] = true
+	}
+	for sourceId, tweetId := range run.imported {
+		if isLive[tweetId] {
+			run.live[sourceId] = tweetId
+		}
+	}
+	return nil
+}
+
+// importTweet imports a single tweet of the archive along with its images, unless it has been
+// imported before. Replies and retweets are linked to the tweets they reply to or retweet, if those
+// have been imported. Replies to other tweets are imported as originals, retweets of other tweets are skipped.
+func (run *archiveImport) importTweet(all []archiveTweet, at *archiveTweet) error {
+	if _, ok := run.imported[at.IDStr]; ok {
+		run.report.AlreadyImported++
+		return nil
+	}
+
+	tweet := domain.Tweet{
+		UserID:    run.userId,
+		CreatedAt: at.createdAt,
+	}
+	if at.isRetweet() {
+		retweetsId, ok := run.live[run.retweetedSourceID(all, at)]
+		if !ok {
+			run.skip(at.IDStr, "The tweet is a retweet of a tweet that isn't part of the archive.")
+			return nil
+		}
+		tweet.RetweetsID = &retweetsId
+	} else {
+		tweet.Content = at.content
+		if repliesToId, ok := run.live[at.InReplyToStatusIDStr]; ok && at.InReplyToStatusIDStr != "" {
+			tweet.RepliesToID = &repliesToId
+		}
+		tweet.Sensitive = at.PossiblySensitive && len(run.media[at.IDStr]) > 0
+	}
+
+	// Create the tweet and remember where it came from at once, so it's never imported twice.
+	err := run.db.Transaction(func(tx *gorm.DB) error {
+		if err := NewTweetService(tx).Create(&tweet); err != nil {
+			return err
+		}
+		return tx.Create(&domain.ImportedTweet{UserID: run.userId, SourceID: at.IDStr, TweetID: tweet.ID}).Error
+	})
+	if isUniqueViolation(err) {
+		// Another import of the same archive, e.g. from the command line, got to the tweet first.
+		var imported domain.ImportedTweet
+		if err := run.db.First(&imported, "user_id = ? AND source_id = ?", run.userId, at.IDStr).Error; err != nil {
+			return err
+		}
+		run.imported[at.IDStr] = imported.TweetID
+		run.live[at.IDStr] = imported.TweetID
+		run.report.AlreadyImported++
+		return nil
+	}
+	if err != nil {
+		// A user who may not tweet can't import tweets either. Other app errors only concern this tweet.
+		switch errs.ErrorCode(err) {
+		case errs.EINTERNAL, errs.EUNAUTHORIZED:
+			return err
+		}
+		run.skip(at.IDStr, errs.ErrorMessage(err))
+		return nil
+	}
+	run.imported[at.IDStr] = tweet.ID
+	run.live[at.IDStr] = tweet.ID
+	run.report.Tweets++
+	if tweet.RepliesToID != nil {
+		run.report.Replies++
+	}
+	if tweet.RetweetsID != nil {
+		run.report.Retweets++
+		return nil
+	}
+
+	// Attach the tweet's images. Videos and GIFs are skipped by the image validations.
+	for i, f := range run.media[at.IDStr] {
+		if i >= maxTweetImages {
+			run.skip(f.Name, fmt.Sprintf("A tweet can have %d images at most.", maxTweetImages))
+			continue
+		}
+		if _, err := run.importImage(f, domain.OwnerTypeTweet, domain.ImagePurposeTweet, tweet.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a Postgres error caused by a duplicate key of a unique index.
+func isUniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == "23505"
+}
+
+// retweetedSourceID returns the archive ID of the tweet that a retweet retweets. If the archive
+// doesn't tell, the retweet is matched by content against the user's own tweets, since retweets
+// read "RT @handle: <content>", with long content cut off by an ellipsis.
+func (run *archiveImport) retweetedSourceID(all []archiveTweet, at *archiveTweet) string {
+	if at.RetweetedStatus != nil {
+		return at.RetweetedStatus.IDStr
+	}
+	prefix := "RT @" + run.handle + ": "
+	if run.handle == "" || !strings.HasPrefix(strings.ToLower(at.content), strings.ToLower(prefix)) {
+		return ""
+	}
+	content := strings.TrimSuffix(at.content[len(prefix):], "…")
+	if content == "" {
+		return ""
+	}
+	for i := range all {
+		candidate := &all[i]
+		if candidate != at && !candidate.isRetweet() && strings.HasPrefix(candidate.content, content) {
+			return candidate.IDStr
+		}
+	}
+	return ""
+}
+
+// importProfile fills in the bio, avatar and header of the user from the archive's profile,
+// unless the user has set them already.
+func (run *archiveImport) importProfile(user *domain.User) error {
+	f, ok := run.files[archiveProfile]
+	if !ok {
+		return nil
+	}
+	var profiles []struct {
+		Profile archiveProfileData `json:"profile"`
+	}
+	if err := readArchiveJS(f, run.maxDataFileSize, &profiles); err != nil {
+		return err
+	}
+	if len(profiles) == 0 {
+		return nil
+	}
+	profile := profiles[0].Profile
+	updates := map[string]interface{}{}
+
+	if bio := html.UnescapeString(profile.Description.Bio); user.Bio == "" && bio != "" {
+		if utf8.RuneCountInString(bio) > 160 {
+			run.skip(archiveProfile, "The bio must not have more than 160 characters.")
+		} else {
+			updates["bio"] = bio
+			run.report.Profile = append(run.report.Profile, "bio")
+		}
+	}
+	for _, image := range []struct {
+		field    string
+		current  string
+		mediaURL string
+	}{
+		{"avatar", user.Avatar, profile.AvatarMediaURL},
+		{"header", user.Header, profile.HeaderMediaURL},
+	} {
+		if image.current != "" || image.mediaURL == "" {
+			continue
+		}
+		f := run.profileMedia(image.mediaURL)
+		if f == nil {
+			run.skip(image.mediaURL, "The image isn't part of the archive.")
+			continue
+		}
+		filename, err := run.importImage(f, domain.OwnerTypeUser, image.field, user.ID)
+		if err != nil {
+			return err
+		}
+		if filename != "" {
+			updates[image.field] = filename
+			run.report.Profile = append(run.report.Profile, image.field)
+		}
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+	return run.db.Model(user).Updates(updates).Error
+}
+
+// profileMedia finds the file of a profile image in the archive. Its name is the account's ID,
+// followed by the last segment of the image's url.
+func (run *archiveImport) profileMedia(mediaURL string) *zip.File {
+	base := path.Base(strings.SplitN(mediaURL, "?", 2)[0])
+	for name, f := range run.files {
+		if strings.HasPrefix(name, archiveProfileMedia) && strings.Contains(path.Base(name), "-"+base) {
+			return f
+		}
+	}
+	return nil
+}
+
+// importImage stores an image of the archive through the ImageService, so it's validated like an
+// uploaded image. It returns the stored image's filename. If the image isn't valid, it's skipped
+// and the empty string is returned.
+func (run *archiveImport) importImage(f *zip.File, ownerType, purpose string, ownerId int) (string, error) {
+	if f.UncompressedSize64 > uint64(domain.MaxUploadSize) {
+		run.skip(f.Name, fmt.Sprintf("The image exceeds the upload size limit of %dMB.", domain.MaxUploadSize/1000000))
+		return "", nil
+	}
+	data, err := readArchiveFile(f, domain.MaxUploadSize)
+	if err != nil {
+		return "", err
+	}
+	img := domain.Image{
+		OwnerType: ownerType,
+		OwnerID:   ownerId,
+		Purpose:   purpose,
+		File:      archiveFile{stdbytes.NewReader(data)},
+		Filename:  path.Base(f.Name),
+	}
+	if err := run.images.Create(&img); err != nil {
+		if errs.ErrorCode(err) == errs.EINTERNAL {
+			return "", err
+		}
+		run.skip(f.Name, errs.ErrorMessage(err))
+		return "", nil
+	}
+	if ownerType == domain.OwnerTypeTweet {
+		run.report.Images++
+	}
+	return img.Filename, nil
+}
+
+// skip lists an item of the archive in the report as not imported.
+func (run *archiveImport) skip(source, reason string) {
+	run.report.Skipped = append(run.report.Skipped, domain.ImportSkip{Source: source, Reason: reason})
+}
+
+// readArchiveJS parses a data file of a Twitter archive. Those are javascript files like
+// "window.YTD.tweets.part0 = [...]", so everything before the json array is dropped.
+// Files larger than maxSize are rejected.
+func readArchiveJS(f *zip.File, maxSize int64, dst interface{}) error {
+	if f.UncompressedSize64 > uint64(maxSize) {
+		return errs.Errorf(errs.EINVALID, "The archive's file %s must not be larger than %dMB.", f.Name, maxSize>>20)
+	}
+	data, err := readArchiveFile(f, maxSize)
+	if err != nil {
+		return err
+	}
+	if i := stdbytes.IndexByte(data, '='); i >= 0 && i < stdbytes.IndexByte(data, '[') {
+		data = data[i+1:]
+	}
+	if err := json.Unmarshal(data, dst); err != nil {
+		return errs.Errorf(errs.EINVALID, "The archive's file %s can't be read.", f.Name)
+	}
+	return nil
+}
+
+// readArchiveFile reads a file of the archive that's no larger than maxSize. It reads no more
+// than the file's listed size, so a file that unpacks to more than that is rejected as well.
+func readArchiveFile(f *zip.File, maxSize int64) ([]byte, error) {
+	size := f.UncompressedSize64
+	if size > uint64(maxSize) {
+		return nil, errs.Errorf(errs.EINVALID, "The archive's file %s is too large.", f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, errs.Errorf(errs.EINVALID, "The archive's file %s can't be read.", f.Name)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(rc, int64(size)+1))
+	if err != nil || uint64(len(data)) > size {
+		return nil, errs.Errorf(errs.EINVALID, "The archive's file %s can't be read.", f.Name)
+	}
+	return data, nil
+}
+
+// archiveFile makes an image read from an archive usable as a multipart.File.
+type archiveFile struct {
+	*stdbytes.Reader
+}
+
+// Close implements the io.Closer interface. There's nothing to close.
+func (archiveFile) Close() error {
+	return nil
+}
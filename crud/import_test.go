@@ -0,0 +1,257 @@
+package crud
+
+import (
+	"archive/zip"
+	stdbytes "bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// sqlStateError is an error with a Postgres error code, like the errors of the Postgres driver.
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "sql error " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestIsUniqueViolation(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{sqlStateError("23505"), true},
+		{fmt.Errorf("cannot import: %w", sqlStateError("23505")), true},
+		{sqlStateError("23503"), false},
+		{errors.New("duplicate key value violates unique constraint"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isUniqueViolation(tt.err); got != tt.want {
+			t.Errorf("isUniqueViolation(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+// newTestArchive builds a zip archive from file names and contents.
+func newTestArchive(t *testing.T, files map[string]string) *zip.Reader {
+	t.Helper()
+	var buf stdbytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(fw, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(stdbytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+// newTestImport returns an archiveImport of the archive for user 1, without a database.
+func newTestImport(t *testing.T, zr *zip.Reader) *archiveImport {
+	t.Helper()
+	run := &archiveImport{
+		archiveImporter: &archiveImporter{maxDataFileSize: 1 << 20, maxUnpackedSize: 4 << 20},
+		userId:          1,
+		handle:          "alice",
+		files:           map[string]*zip.File{},
+		media:           map[string][]*zip.File{},
+		imported:        map[string]int{},
+		live:            map[string]int{},
+		report:          &domain.ImportReport{Profile: []string{}, Skipped: []domain.ImportSkip{}},
+	}
+	if err := run.index(zr); err != nil {
+		t.Fatal(err)
+	}
+	return run
+}
+
+func TestReadTweets(t *testing.T) {
+	zr := newTestArchive(t, map[string]string{
+		"data/tweets.js": `window.YTD.tweets.part0 = [
+			{"tweet": {"id_str": "2", "full_text": "Second &amp; last", "created_at": "Tue Mar 02 10:00:00 +0000 2021"}},
+			{"tweet": {"id_str": "3", "full_text": "No date", "created_at": "yesterday"}}
+		]`,
+		"data/tweets-part1.js": `window.YTD.tweets.part1 = [
+			{"id_str": "1", "full_text": "First", "created_at": "Mon Mar 01 10:00:00 +0000 2021"}
+		]`,
+		"data/tweets_media/2-photo.jpg": "",
+		"data/like.js":                  `window.YTD.like.part0 = []`,
+	})
+	run := newTestImport(t, zr)
+	tweets, err := run.readTweets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tweets) != 2 {
+		t.Fatalf("read %d tweets, want 2", len(tweets))
+	}
+	if tweets[0].IDStr != "1" || tweets[1].IDStr != "2" {
+		t.Errorf("tweets %s, %s are not sorted by creation time", tweets[0].IDStr, tweets[1].IDStr)
+	}
+	if tweets[1].content != "Second & last" {
+		t.Errorf("content %q is not unescaped", tweets[1].content)
+	}
+	if len(run.report.Skipped) != 1 || run.report.Skipped[0].Source != "3" {
+		t.Errorf("skipped %+v, want tweet 3", run.report.Skipped)
+	}
+	if len(run.media["2"]) != 1 {
+		t.Errorf("found %d images of tweet 2, want 1", len(run.media["2"]))
+	}
+}
+
+func TestReadTweetsWithoutTweets(t *testing.T) {
+	run := newTestImport(t, newTestArchive(t, map[string]string{"data/account.js": "[]"}))
+	if _, err := run.readTweets(); errs.ErrorCode(err) != errs.EINVALID {
+		t.Errorf("error %v, want an errs.EINVALID", err)
+	}
+	run = newTestImport(t, newTestArchive(t, map[string]string{"data/tweets.js": "window.YTD.tweets.part0 = [{"}))
+	if _, err := run.readTweets(); errs.ErrorCode(err) != errs.EINVALID {
+		t.Errorf("error %v, want an errs.EINVALID", err)
+	}
+}
+
+func TestArchiveSizeLimits(t *testing.T) {
+	// A data file that's compressed well, but too large once unpacked.
+	zeros := strings.Repeat("0", 2<<20)
+	zr := newTestArchive(t, map[string]string{"data/tweets.js": "[" + zeros + "]"})
+	run := newTestImport(t, zr)
+	if _, err := run.readTweets(); errs.ErrorCode(err) != errs.EINVALID {
+		t.Errorf("large data file: error %v, want an errs.EINVALID", err)
+	}
+
+	// Files that are fine on their own, but too large together.
+	zr = newTestArchive(t, map[string]string{
+		"data/tweets_media/1-a.jpg": zeros,
+		"data/tweets_media/1-b.jpg": zeros,
+		"data/tweets_media/1-c.jpg": zeros,
+	})
+	run = &archiveImport{
+		archiveImporter: &archiveImporter{maxDataFileSize: 1 << 20, maxUnpackedSize: 4 << 20},
+		files:           map[string]*zip.File{},
+		media:           map[string][]*zip.File{},
+	}
+	if err := run.index(zr); errs.ErrorCode(err) != errs.EINVALID {
+		t.Errorf("large archive: error %v, want an errs.EINVALID", err)
+	}
+}
+
+// TestReadArchiveFileLyingSize reads a file whose listed size is smaller than its content.
+func TestReadArchiveFileLyingSize(t *testing.T) {
+	content := "[" + strings.Repeat("0", 1<<20) + "]"
+	var compressed stdbytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, content)
+	fw.Close()
+
+	var buf stdbytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "data/tweets.js",
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE([]byte(content)),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(compressed.Bytes())
+	zw.Close()
+	zr, err := zip.NewReader(stdbytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := readArchiveFile(zr.File[0], 1<<10)
+	if errs.ErrorCode(err) != errs.EINVALID {
+		t.Errorf("read %d bytes with error %v, want an errs.EINVALID", len(data), err)
+	}
+}
+
+func TestRetweetedSourceID(t *testing.T) {
+	all := []archiveTweet{
+		{IDStr: "1", content: "Hello world, this is a rather long tweet about nothing"},
+		{IDStr: "2", content: "RT @alice: Hello world, this is a rather…"},
+		{IDStr: "3", content: "RT @ALICE: Hello world"},
+		{IDStr: "4", content: "RT @bob: Hello world, this is a rather long tweet"},
+		{IDStr: "5", content: "RT @alice: Something that isn't in the archive"},
+		{IDStr: "6", content: "RT @bob: whatever", RetweetedStatus: &struct {
+			IDStr string `json:"id_str"`
+		}{IDStr: "99"}},
+		{IDStr: "7", content: "Look at this https://twitter.com/alice/status/1"},
+	}
+	run := &archiveImport{handle: "alice"}
+	tests := []struct {
+		index     int
+		isRetweet bool
+		want      string
+	}{
+		{1, true, "1"},
+		{2, true, "1"},
+		{3, true, ""},
+		{4, true, ""},
+		{5, true, "99"},
+		// Quote tweets are no retweets, they are imported as originals.
+		{6, false, ""},
+	}
+	for _, tt := range tests {
+		at := &all[tt.index]
+		if got := at.isRetweet(); got != tt.isRetweet {
+			t.Errorf("tweet %s: isRetweet = %t, want %t", at.IDStr, got, tt.isRetweet)
+		}
+		if got := run.retweetedSourceID(all, at); got != tt.want {
+			t.Errorf("tweet %s: retweets %q, want %q", at.IDStr, got, tt.want)
+		}
+	}
+
+	// Without the handle, retweets can only be matched if the archive tells.
+	run.handle = ""
+	if got := run.retweetedSourceID(all, &all[1]); got != "" {
+		t.Errorf("matched %q without a handle", got)
+	}
+}
+
+// TestReimport imports an archive whose tweets have all been imported before. Nothing is written,
+// which the missing database would tell.
+func TestReimport(t *testing.T) {
+	zr := newTestArchive(t, map[string]string{
+		"data/tweets.js": `[
+			{"tweet": {"id_str": "1", "full_text": "First", "created_at": "Mon Mar 01 10:00:00 +0000 2021"}},
+			{"tweet": {"id_str": "2", "full_text": "RT @alice: First", "created_at": "Tue Mar 02 10:00:00 +0000 2021"}},
+			{"tweet": {"id_str": "3", "full_text": "@alice Reply", "created_at": "Wed Mar 03 10:00:00 +0000 2021", "in_reply_to_status_id_str": "1"}}
+		]`,
+	})
+	run := newTestImport(t, zr)
+	run.imported = map[string]int{"1": 10, "2": 11, "3": 12}
+	run.live = map[string]int{"1": 10, "3": 12}
+	tweets, err := run.readTweets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range tweets {
+		if err := run.importTweet(tweets, &tweets[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if run.report.AlreadyImported != 3 || run.report.Tweets != 0 || len(run.report.Skipped) != 0 {
+		t.Errorf("report %+v, want 3 tweets already imported", run.report)
+	}
+}
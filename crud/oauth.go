@@ -66,6 +66,17 @@ func (ov *oauthValidator) Update(oauth *domain.OAuth) error {
 	return ov.oauthGorm.Update(oauth)
 }
 
+// Delete runs validations needed for deleting an OAuth record.
+func (ov *oauthValidator) Delete(oauth *domain.OAuth) error {
+	err := runOAuthValFns(oauth,
+		ov.idValid,
+		ov.userIdValid)
+	if err != nil {
+		return err
+	}
+	return ov.oauthGorm.Delete(oauth)
+}
+
 // runOAuthValFns runs any number of functions of type oauthValFn on the passed in OAuth object.
 // If none of them returns an error, it returns nil. Otherwise, it returns the respective error.
 func runOAuthValFns(oauth *domain.OAuth, fns ...oauthValFn) error {
@@ -131,6 +142,19 @@ func (og *oauthGorm) ByProviderUserId(provider, providerUserId string) (*domain.
 	return &oauth, nil
 }
 
+// ByUserID retrieves all oauth records of a user, ordered by provider.
+func (og *oauthGorm) ByUserID(userId int) ([]domain.OAuth, error) {
+	var oauths []domain.OAuth
+	err := og.db.
+		Where("user_id = ?", userId).
+		Order("provider").
+		Find(&oauths).Error
+	if err != nil {
+		return nil, err
+	}
+	return oauths, nil
+}
+
 // Create stores the data from the OAuth object in a new database record.
 func (og *oauthGorm) Create(oauth *domain.OAuth) error {
 	return og.db.Create(oauth).Error
@@ -143,3 +167,9 @@ func (og *oauthGorm) Create(oauth *domain.OAuth) error {
 func (og *oauthGorm) Update(oauth *domain.OAuth) error {
 	return og.db.Save(oauth).Error
 }
+
+// Delete permanently deletes an oauth record from the database,
+// unless it's the user's last way to sign in, see deleteLoginMethod.
+func (og *oauthGorm) Delete(oauth *domain.OAuth) error {
+	return deleteLoginMethod(og.db, oauth.UserID, oauth)
+}
@@ -0,0 +1,664 @@
+package crud
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"gorm.io/gorm"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// Prefixes of the secrets handed out by the OAuth2 authorization server, so leaked ones are easy
+// to recognize. Access tokens issued to apps use accessTokenPrefix, like personal access tokens.
+const (
+	clientSecretPrefix = "wts_"
+	refreshTokenPrefix = "wtr_"
+)
+
+// maxRedirectURIs limits the number of redirect urls an app can register.
+const maxRedirectURIs = 10
+
+// pkceVerifierRegex matches a valid PKCE code verifier (RFC 7636 §4.1).
+var pkceVerifierRegex = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// pkceChallengeRegex matches a valid S256 code challenge, the base64url encoded SHA-256 hash of a verifier.
+var pkceChallengeRegex = regexp.MustCompile(`^[A-Za-z0-9\-_]{43}$`)
+
+// OAuthServerService is the OAuth2 authorization server, which lets third-party apps act on behalf
+// of users. It implements the domain.OAuthServerService interface.
+type OAuthServerService struct {
+	oauthServerValidator
+}
+
+// oauthServerValidator runs validations on incoming apps, authorization requests and tokens.
+// On success, it passes the data on to oauthServerGorm.
+// Otherwise, it returns the error of the validation that has failed.
+type oauthServerValidator struct {
+	hmac HMAC
+	oauthServerGorm
+}
+
+// oauthServerGorm runs CRUD operations on the database using incoming OAuth2 data.
+// It assumes that data has been validated. On success, it returns nil.
+// Otherwise, it returns the error of the operation that has failed.
+type oauthServerGorm struct {
+	db *gorm.DB
+}
+
+// NewOAuthServerService returns an instance of OAuthServerService. It must use the same hmacKey
+// as the AccessTokenService, since the access tokens it issues are looked up by that service.
+func NewOAuthServerService(db *gorm.DB, hmacKey string) *OAuthServerService {
+	return &OAuthServerService{
+		oauthServerValidator{
+			hmac: newHMAC(hmacKey),
+			oauthServerGorm: oauthServerGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// Ensure the OAuthServerService struct properly implements the domain.OAuthServerService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.OAuthServerService = &OAuthServerService{}
+
+// oauth2Error returns a domain.OAuth2Error with the given code and description.
+func oauth2Error(code, description string) error {
+	return &domain.OAuth2Error{Code: code, Description: description}
+}
+
+// CreateClient runs validations needed for registering a new app.
+// It creates the app's client ID, and its secret if it's a confidential app.
+func (ov *oauthServerValidator) CreateClient(client *domain.OAuthClient) error {
+	err := runOAuthClientValFns(client,
+		ov.ownerIdValid,
+		ov.clientNameRequired,
+		ov.clientNameMaxLength,
+		ov.redirectURIsValid,
+		ov.clientCredentialsSet)
+	if err != nil {
+		return err
+	}
+	return ov.oauthServerGorm.CreateClient(client)
+}
+
+// AuthenticateClient checks the credentials an app sends to the token, revocation and introspection
+// endpoints. Confidential apps must send their secret, public apps only send their client ID.
+func (ov *oauthServerValidator) AuthenticateClient(clientId, secret string) (*domain.OAuthClient, error) {
+	client, err := ov.oauthServerGorm.ClientByClientID(clientId)
+	if err != nil {
+		if errs.ErrorCode(err) == errs.ENOTFOUND {
+			return nil, oauth2Error(domain.OAuth2InvalidClient, "Unknown client.")
+		}
+		return nil, err
+	}
+	if client.Confidential {
+		hash := ov.hmac.hash(secret)
+		if secret == "" || subtle.ConstantTimeCompare([]byte(hash), []byte(client.SecretHash)) != 1 {
+			return nil, oauth2Error(domain.OAuth2InvalidClient, "Invalid client credentials.")
+		}
+	}
+	return client, nil
+}
+
+// ValidateAuthorization checks the parameters an app sends the user to the consent screen with.
+// It normalizes the requested scope, and fills in the redirect url if the app has only one and
+// didn't send it. It returns the app, so the consent screen can show its name.
+// Errors are meant for the user, since the app can't be trusted with them before its redirect
+// url has been checked.
+func (ov *oauthServerValidator) ValidateAuthorization(req *domain.AuthorizationRequest) (*domain.OAuthClient, error) {
+	client, err := ov.oauthServerGorm.ClientByClientID(req.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if req.RedirectURI == "" && len(client.RedirectURIList()) == 1 {
+		req.RedirectURI = client.RedirectURIList()[0]
+	}
+	if !client.HasRedirectURI(req.RedirectURI) {
+		return nil, errs.Errorf(errs.EINVALID, "The app sent an invalid redirect url.")
+	}
+	if req.ResponseType != "code" {
+		return nil, errs.Errorf(errs.EINVALID, "The app sent an unsupported response type.")
+	}
+	if req.CodeChallengeMethod != "S256" || !pkceChallengeRegex.MatchString(req.CodeChallenge) {
+		return nil, errs.Errorf(errs.EINVALID, "The app must use PKCE with the code challenge method S256.")
+	}
+	scope, err := normalizeScope(req.Scope)
+	if err != nil {
+		return nil, err
+	}
+	req.Scope = scope
+	return client, nil
+}
+
+// CreateCode records the user's consent to the authorization request and issues an authorization
+// code, which the app exchanges for tokens.
+func (ov *oauthServerValidator) CreateCode(userId int, req *domain.AuthorizationRequest) (*domain.OAuthCode, error) {
+	if userId <= 0 {
+		return nil, errs.UserIdValid
+	}
+	client, err := ov.ValidateAuthorization(req)
+	if err != nil {
+		return nil, err
+	}
+	token, err := bytesToString(RememberTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	code := domain.OAuthCode{
+		Code:          token,
+		CodeHash:      ov.hmac.hash(token),
+		ClientID:      client.ID,
+		UserID:        userId,
+		RedirectURI:   req.RedirectURI,
+		Scope:         req.Scope,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(domain.AuthorizationCodeLifetime),
+	}
+	if err := ov.oauthServerGorm.CreateCode(&code); err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+// ExchangeCode exchanges an authorization code for tokens (RFC 6749 §4.1.3). The app must send the
+// PKCE code verifier matching the code challenge it started the flow with. A code can only be
+// exchanged once. If it's exchanged a second time, it has been intercepted, so all tokens of the
+// app for the user are revoked.
+func (ov *oauthServerValidator) ExchangeCode(client *domain.OAuthClient, code, redirectUri, codeVerifier string) (*domain.OAuthTokens, error) {
+	invalid := oauth2Error(domain.OAuth2InvalidGrant, "The authorization code is invalid or has expired.")
+	oauthCode, err := ov.oauthServerGorm.CodeByHash(ov.hmac.hash(code))
+	if err != nil {
+		if errs.ErrorCode(err) == errs.ENOTFOUND {
+			return nil, invalid
+		}
+		return nil, err
+	}
+	if oauthCode.ClientID != client.ID || oauthCode.RedirectURI != redirectUri || time.Now().After(oauthCode.ExpiresAt) {
+		return nil, invalid
+	}
+	if !pkceVerifierRegex.MatchString(codeVerifier) {
+		return nil, oauth2Error(domain.OAuth2InvalidGrant, "The code verifier is invalid.")
+	}
+	sum := sha256.Sum256([]byte(codeVerifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(oauthCode.CodeChallenge)) != 1 {
+		return nil, oauth2Error(domain.OAuth2InvalidGrant, "The code verifier doesn't match the code challenge.")
+	}
+	used, err := ov.oauthServerGorm.UseCode(oauthCode)
+	if err != nil {
+		return nil, err
+	}
+	if !used {
+		if err := ov.oauthServerGorm.RevokeTokens(oauthCode.UserID, client.ID); err != nil {
+			return nil, err
+		}
+		return nil, invalid
+	}
+	return ov.issueTokens(client, oauthCode.UserID, oauthCode.Scope)
+}
+
+// Refresh exchanges a refresh token for new tokens (RFC 6749 §6). The scope can be narrowed, but
+// not widened. The refresh token is rotated: it's marked as used and a new one is issued. If a used
+// refresh token is exchanged again, it has been stolen, so all tokens of the app for the user are revoked.
+func (ov *oauthServerValidator) Refresh(client *domain.OAuthClient, refreshToken, scope string) (*domain.OAuthTokens, error) {
+	invalid := oauth2Error(domain.OAuth2InvalidGrant, "The refresh token is invalid or has expired.")
+	if !strings.HasPrefix(refreshToken, refreshTokenPrefix) {
+		return nil, invalid
+	}
+	token, err := ov.oauthServerGorm.RefreshTokenByHash(ov.hmac.hash(refreshToken))
+	if err != nil {
+		if errs.ErrorCode(err) == errs.ENOTFOUND {
+			return nil, invalid
+		}
+		return nil, err
+	}
+	if token.ClientID != client.ID || time.Now().After(token.ExpiresAt) {
+		return nil, invalid
+	}
+	if scope == "" {
+		scope = token.Scope
+	}
+	scope, err = normalizeScope(scope)
+	if err != nil || !domain.ScopeIncludes(token.Scope, scope) {
+		return nil, oauth2Error(domain.OAuth2InvalidScope, "The scope exceeds the scope granted before.")
+	}
+	used, err := ov.oauthServerGorm.UseRefreshToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if !used {
+		if err := ov.oauthServerGorm.RevokeTokens(token.UserID, client.ID); err != nil {
+			return nil, err
+		}
+		return nil, invalid
+	}
+	return ov.issueTokens(client, token.UserID, scope)
+}
+
+// Revoke revokes an access token or a refresh token of the app (RFC 7009). Revoking a refresh token
+// revokes all tokens of the app for the user, since the app is signing the user out. Unknown tokens
+// and tokens of other apps are ignored, as the RFC requires.
+func (ov *oauthServerValidator) Revoke(client *domain.OAuthClient, token string) error {
+	hash := ov.hmac.hash(token)
+	switch {
+	case strings.HasPrefix(token, accessTokenPrefix):
+		return ov.oauthServerGorm.DeleteAccessToken(hash, client.ID)
+	case strings.HasPrefix(token, refreshTokenPrefix):
+		refreshToken, err := ov.oauthServerGorm.RefreshTokenByHash(hash)
+		if err != nil {
+			if errs.ErrorCode(err) == errs.ENOTFOUND {
+				return nil
+			}
+			return err
+		}
+		if refreshToken.ClientID != client.ID {
+			return nil
+		}
+		return ov.oauthServerGorm.RevokeTokens(refreshToken.UserID, client.ID)
+	}
+	return nil
+}
+
+// Introspect returns the state of an access token or a refresh token of the app (RFC 7662).
+// Tokens of other apps and personal access tokens are reported as inactive.
+func (ov *oauthServerValidator) Introspect(client *domain.OAuthClient, token string) (*domain.TokenIntrospection, error) {
+	inactive := &domain.TokenIntrospection{Active: false}
+	hash := ov.hmac.hash(token)
+	var userId int
+	introspection := domain.TokenIntrospection{
+		Active:   true,
+		ClientID: client.ClientID,
+	}
+	switch {
+	case strings.HasPrefix(token, accessTokenPrefix):
+		accessToken, err := ov.oauthServerGorm.AccessTokenByHash(hash)
+		if err != nil || accessToken.ClientID == nil || *accessToken.ClientID != client.ID {
+			return inactive, nil
+		}
+		if accessToken.ExpiresAt == nil || time.Now().After(*accessToken.ExpiresAt) {
+			return inactive, nil
+		}
+		userId = accessToken.UserID
+		introspection.Scope = accessToken.Scope
+		introspection.TokenType = "Bearer"
+		introspection.ExpiresAt = accessToken.ExpiresAt.Unix()
+		introspection.IssuedAt = accessToken.CreatedAt.Unix()
+	case strings.HasPrefix(token, refreshTokenPrefix):
+		refreshToken, err := ov.oauthServerGorm.RefreshTokenByHash(hash)
+		if err != nil || refreshToken.ClientID != client.ID || refreshToken.UsedAt != nil || time.Now().After(refreshToken.ExpiresAt) {
+			return inactive, nil
+		}
+		userId = refreshToken.UserID
+		introspection.Scope = refreshToken.Scope
+		introspection.TokenType = "refresh_token"
+		introspection.ExpiresAt = refreshToken.ExpiresAt.Unix()
+		introspection.IssuedAt = refreshToken.CreatedAt.Unix()
+	default:
+		return inactive, nil
+	}
+	var user domain.User
+	if err := ov.db.Select("id", "handle").First(&user, userId).Error; err != nil {
+		return inactive, nil
+	}
+	introspection.Subject = strconv.Itoa(user.ID)
+	introspection.Username = user.Handle
+	return &introspection, nil
+}
+
+// issueTokens creates a new access token and a new refresh token for the app to act on behalf
+// of the user. The access token is an AccessToken with ClientID set, so it's accepted by the
+// checkUser middleware just like a personal access token.
+func (ov *oauthServerValidator) issueTokens(client *domain.OAuthClient, userId int, scope string) (*domain.OAuthTokens, error) {
+	token, err := bytesToString(RememberTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(domain.AppAccessTokenLifetime)
+	accessToken := domain.AccessToken{
+		UserID:    userId,
+		ClientID:  &client.ID,
+		Name:      client.Name,
+		Token:     accessTokenPrefix + token,
+		Scope:     scope,
+		ExpiresAt: &expiresAt,
+	}
+	accessToken.TokenHash = ov.hmac.hash(accessToken.Token)
+
+	token, err = bytesToString(RememberTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken := domain.OAuthRefreshToken{
+		Token:     refreshTokenPrefix + token,
+		ClientID:  client.ID,
+		UserID:    userId,
+		Scope:     scope,
+		ExpiresAt: time.Now().Add(domain.RefreshTokenLifetime),
+	}
+	refreshToken.TokenHash = ov.hmac.hash(refreshToken.Token)
+
+	if err := ov.oauthServerGorm.CreateTokens(&accessToken, &refreshToken); err != nil {
+		return nil, err
+	}
+	return &domain.OAuthTokens{
+		AccessToken:  accessToken.Token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(domain.AppAccessTokenLifetime.Seconds()),
+		RefreshToken: refreshToken.Token,
+		Scope:        scope,
+	}, nil
+}
+
+// runOAuthClientValFns runs any number of functions of type oauthClientValFn on the passed in OAuthClient object.
+// If none of them returns an error, it returns nil. Otherwise, it returns the respective error.
+func runOAuthClientValFns(client *domain.OAuthClient, fns ...oauthClientValFn) error {
+	for _, fn := range fns {
+		if err := fn(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An oauthClientValFn is any function that takes in a pointer to a domain.OAuthClient object and returns an error.
+type oauthClientValFn func(client *domain.OAuthClient) error
+
+// clientCredentialsSet creates the app's client ID, and the secret and its hash for confidential apps.
+func (ov *oauthServerValidator) clientCredentialsSet(client *domain.OAuthClient) error {
+	clientId, err := bytes(16)
+	if err != nil {
+		return err
+	}
+	client.ClientID = base64.RawURLEncoding.EncodeToString(clientId)
+	client.Secret, client.SecretHash = "", ""
+	if client.Confidential {
+		secret, err := bytesToString(RememberTokenBytes)
+		if err != nil {
+			return err
+		}
+		client.Secret = clientSecretPrefix + secret
+		client.SecretHash = ov.hmac.hash(client.Secret)
+	}
+	return nil
+}
+
+// clientNameMaxLength makes sure the app's name is not longer than 50 characters.
+func (ov *oauthServerValidator) clientNameMaxLength(client *domain.OAuthClient) error {
+	if utf8.RuneCountInString(client.Name) > 50 {
+		return errs.Errorf(errs.EINVALID, "The name must not be longer than 50 characters.")
+	}
+	return nil
+}
+
+// clientNameRequired trims the app's name and makes sure it's not empty.
+func (ov *oauthServerValidator) clientNameRequired(client *domain.OAuthClient) error {
+	client.Name = strings.TrimSpace(client.Name)
+	if client.Name == "" {
+		return errs.Errorf(errs.EINVALID, "Please name the app.")
+	}
+	return nil
+}
+
+// ownerIdValid ensures that the ID of the user registering the app is not empty.
+func (ov *oauthServerValidator) ownerIdValid(client *domain.OAuthClient) error {
+	if client.OwnerID <= 0 {
+		return errs.UserIdValid
+	}
+	return nil
+}
+
+// redirectURIsValid makes sure the app has at least one and not too many redirect urls, and that
+// they are absolute urls without fragment. They must use https, or http on the loopback interface
+// for apps in development. Native apps can use a private-use scheme in reverse domain notation,
+// like "com.example.app:/callback" (RFC 8252 §7.1).
+func (ov *oauthServerValidator) redirectURIsValid(client *domain.OAuthClient) error {
+	uris := client.RedirectURIList()
+	if len(uris) == 0 {
+		return errs.Errorf(errs.EINVALID, "Please add at least one redirect url.")
+	}
+	if len(uris) > maxRedirectURIs {
+		return errs.Errorf(errs.EINVALID, "An app can't have more than %d redirect urls.", maxRedirectURIs)
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" || strings.Contains(uri, "#") {
+			return errs.Errorf(errs.EINVALID, "The redirect url %q is invalid.", uri)
+		}
+		switch {
+		case u.Scheme == "https" && u.Host != "":
+		case u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1" || u.Hostname() == "::1"):
+		case u.Scheme != "http" && u.Scheme != "https" && strings.Contains(u.Scheme, "."):
+		default:
+			return errs.Errorf(errs.EINVALID, "The redirect url %q must use https.", uri)
+		}
+	}
+	client.RedirectURIs = strings.Join(uris, " ")
+	return nil
+}
+
+// ClientByClientID gets an OAuthClient record from the database by its public client ID.
+func (og *oauthServerGorm) ClientByClientID(clientId string) (*domain.OAuthClient, error) {
+	var client domain.OAuthClient
+	err := og.db.First(&client, "client_id = ?", clientId).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The app does not exist.")
+		}
+		return nil, err
+	}
+	return &client, nil
+}
+
+// ClientsByOwnerID retrieves all apps registered by a user, newest first.
+func (og *oauthServerGorm) ClientsByOwnerID(ownerId int) ([]domain.OAuthClient, error) {
+	var clients []domain.OAuthClient
+	err := og.db.
+		Where("owner_id = ?", ownerId).
+		Order("created_at desc").
+		Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// CreateClient stores the data from the OAuthClient object in a new database record.
+func (og *oauthServerGorm) CreateClient(client *domain.OAuthClient) error {
+	return og.db.Create(client).Error
+}
+
+// DeleteClient permanently deletes an app, along with all grants and tokens users have given it.
+func (og *oauthServerGorm) DeleteClient(client *domain.OAuthClient) error {
+	return og.db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{
+			&domain.AccessToken{},
+			&domain.OAuthRefreshToken{},
+			&domain.OAuthCode{},
+			&domain.OAuthGrant{},
+		} {
+			if err := tx.Where("client_id = ?", client.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(client).Error
+	})
+}
+
+// CreateCode stores a new authorization code, removing all expired ones. It also records the
+// user's consent: the grant of the app is created, or extended by the newly granted scopes.
+func (og *oauthServerGorm) CreateCode(code *domain.OAuthCode) error {
+	return og.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("expires_at <= ?", time.Now()).Delete(&domain.OAuthCode{}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(code).Error; err != nil {
+			return err
+		}
+		var grant domain.OAuthGrant
+		err = tx.Where("user_id = ? AND client_id = ?", code.UserID, code.ClientID).First(&grant).Error
+		if err == gorm.ErrRecordNotFound {
+			grant = domain.OAuthGrant{UserID: code.UserID, ClientID: code.ClientID, Scope: code.Scope}
+			return tx.Create(&grant).Error
+		} else if err != nil {
+			return err
+		}
+		grant.Scope, _ = normalizeScope(grant.Scope + " " + code.Scope)
+		return tx.Model(&grant).Update("scope", grant.Scope).Error
+	})
+}
+
+// CodeByHash retrieves an OAuthCode database record by its hashed code.
+func (og *oauthServerGorm) CodeByHash(codeHash string) (*domain.OAuthCode, error) {
+	var code domain.OAuthCode
+	err := og.db.First(&code, "code_hash = ?", codeHash).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The authorization code does not exist.")
+		}
+		return nil, err
+	}
+	return &code, nil
+}
+
+// UseCode marks an authorization code as used. It reports whether this call marked it, which is
+// false if it has been used before. The update is atomic, so a code can't be used twice concurrently.
+func (og *oauthServerGorm) UseCode(code *domain.OAuthCode) (bool, error) {
+	result := og.db.Model(&domain.OAuthCode{}).
+		Where("id = ? AND used_at IS NULL", code.ID).
+		Update("used_at", time.Now())
+	return result.RowsAffected == 1, result.Error
+}
+
+// RefreshTokenByHash retrieves an OAuthRefreshToken database record by its hashed token.
+func (og *oauthServerGorm) RefreshTokenByHash(tokenHash string) (*domain.OAuthRefreshToken, error) {
+	var token domain.OAuthRefreshToken
+	err := og.db.First(&token, "token_hash = ?", tokenHash).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The refresh token does not exist.")
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// UseRefreshToken marks a refresh token as used. It reports whether this call marked it, which is
+// false if it has been used before. The update is atomic, so a token can't be used twice concurrently.
+func (og *oauthServerGorm) UseRefreshToken(token *domain.OAuthRefreshToken) (bool, error) {
+	result := og.db.Model(&domain.OAuthRefreshToken{}).
+		Where("id = ? AND used_at IS NULL", token.ID).
+		Update("used_at", time.Now())
+	return result.RowsAffected == 1, result.Error
+}
+
+// AccessTokenByHash retrieves an AccessToken database record by its hashed token.
+func (og *oauthServerGorm) AccessTokenByHash(tokenHash string) (*domain.AccessToken, error) {
+	var accessToken domain.AccessToken
+	err := og.db.First(&accessToken, "token_hash = ?", tokenHash).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The access token does not exist.")
+		}
+		return nil, err
+	}
+	return &accessToken, nil
+}
+
+// CreateTokens stores a new access token and a new refresh token issued to an app. It also removes
+// the expired tokens of the app for the user, so they don't pile up. Used refresh tokens are kept
+// until they expire, to be able to detect their reuse.
+func (og *oauthServerGorm) CreateTokens(accessToken *domain.AccessToken, refreshToken *domain.OAuthRefreshToken) error {
+	return og.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Where("user_id = ? AND client_id = ? AND expires_at <= ?", accessToken.UserID, accessToken.ClientID, now).
+			Delete(&domain.AccessToken{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ? AND client_id = ? AND expires_at <= ?", refreshToken.UserID, refreshToken.ClientID, now).
+			Delete(&domain.OAuthRefreshToken{}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(accessToken).Error; err != nil {
+			return err
+		}
+		return tx.Create(refreshToken).Error
+	})
+}
+
+// DeleteAccessToken permanently deletes an access token issued to an app.
+func (og *oauthServerGorm) DeleteAccessToken(tokenHash string, clientId int) error {
+	return og.db.
+		Where("token_hash = ? AND client_id = ?", tokenHash, clientId).
+		Delete(&domain.AccessToken{}).Error
+}
+
+// RevokeTokens permanently deletes all tokens and authorization codes of an app for a user.
+// The user's grant is kept, so the app can ask the user to sign in again without consent.
+func (og *oauthServerGorm) RevokeTokens(userId, clientId int) error {
+	return og.db.Transaction(func(tx *gorm.DB) error {
+		return revokeTokens(tx, userId, clientId)
+	})
+}
+
+// GrantByUserAndClient retrieves the grant a user has given an app.
+func (og *oauthServerGorm) GrantByUserAndClient(userId, clientId int) (*domain.OAuthGrant, error) {
+	var grant domain.OAuthGrant
+	err := og.db.First(&grant, "user_id = ? AND client_id = ?", userId, clientId).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The app is not authorized.")
+		}
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// GrantsByUserID retrieves all grants a user has given, along with their apps, most recent first.
+func (og *oauthServerGorm) GrantsByUserID(userId int) ([]domain.OAuthGrant, error) {
+	var grants []domain.OAuthGrant
+	err := og.db.
+		Preload("Client").
+		Where("user_id = ?", userId).
+		Order("updated_at desc").
+		Find(&grants).Error
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// RevokeGrant permanently deletes the grant a user has given an app, along with all tokens
+// and authorization codes of the app for the user.
+func (og *oauthServerGorm) RevokeGrant(userId, clientId int) error {
+	return og.db.Transaction(func(tx *gorm.DB) error {
+		if err := revokeTokens(tx, userId, clientId); err != nil {
+			return err
+		}
+		return tx.Where("user_id = ? AND client_id = ?", userId, clientId).Delete(&domain.OAuthGrant{}).Error
+	})
+}
+
+// revokeTokens deletes all tokens and authorization codes of an app for a user within a transaction.
+func revokeTokens(tx *gorm.DB, userId, clientId int) error {
+	for _, model := range []interface{}{
+		&domain.AccessToken{},
+		&domain.OAuthRefreshToken{},
+		&domain.OAuthCode{},
+	} {
+		if err := tx.Where("user_id = ? AND client_id = ?", userId, clientId).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package crud
+
+import (
+	"gorm.io/gorm"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// PasswordResetService manages PasswordResets. It implements the domain.PasswordResetService interface.
+type PasswordResetService struct {
+	passwordResetValidator
+}
+
+// passwordResetValidator runs validations on incoming PasswordReset data.
+// On success, it passes the data on to passwordResetGorm.
+// Otherwise, it returns the error of the validation that has failed.
+type passwordResetValidator struct {
+	hmac HMAC
+	passwordResetGorm
+}
+
+// passwordResetGorm runs CRUD operations on the database using incoming PasswordReset data.
+// It assumes that data has been validated. On success, it returns nil.
+// Otherwise, it returns the error of the operation that has failed.
+type passwordResetGorm struct {
+	db *gorm.DB
+}
+
+// NewPasswordResetService returns an instance of PasswordResetService.
+func NewPasswordResetService(db *gorm.DB, hmacKey string) *PasswordResetService {
+	return &PasswordResetService{
+		passwordResetValidator{
+			hmac: newHMAC(hmacKey),
+			passwordResetGorm: passwordResetGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// Ensure the PasswordResetService struct properly implements the domain.PasswordResetService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.PasswordResetService = &PasswordResetService{}
+
+// ByToken hashes a reset token and passes the hash on to passwordResetGorm.ByTokenHash,
+// which looks up the matching reset, unless it has been used or has expired.
+func (pv *passwordResetValidator) ByToken(token string) (*domain.PasswordReset, error) {
+	reset := domain.PasswordReset{
+		Token: token,
+	}
+	if err := runPasswordResetValFns(&reset, pv.tokenRequired, pv.tokenHmac); err != nil {
+		return nil, err
+	}
+	return pv.passwordResetGorm.ByTokenHash(reset.TokenHash)
+}
+
+// Create runs validations needed for creating new PasswordReset database records.
+// It creates the reset token and sets its expiry.
+func (pv *passwordResetValidator) Create(reset *domain.PasswordReset) error {
+	err := runPasswordResetValFns(reset,
+		pv.userIdValid,
+		pv.tokenSet,
+		pv.tokenHmac,
+		pv.expirySet)
+	if err != nil {
+		return err
+	}
+	return pv.passwordResetGorm.Create(reset)
+}
+
+// runPasswordResetValFns runs any number of functions of type passwordResetValFn on the passed in PasswordReset object.
+// If none of them returns an error, it returns nil. Otherwise, it returns the respective error.
+func runPasswordResetValFns(reset *domain.PasswordReset, fns ...passwordResetValFn) error {
+	for _, fn := range fns {
+		if err := fn(reset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A passwordResetValFn is any function that takes in a pointer to a domain.PasswordReset object and returns an error.
+type passwordResetValFn func(reset *domain.PasswordReset) error
+
+// expirySet sets the reset's expiry.
+func (pv *passwordResetValidator) expirySet(reset *domain.PasswordReset) error {
+	reset.ExpiresAt = time.Now().Add(domain.PasswordResetLifetime)
+	return nil
+}
+
+// tokenHmac creates the reset token's hash.
+func (pv *passwordResetValidator) tokenHmac(reset *domain.PasswordReset) error {
+	reset.TokenHash = pv.hmac.hash(reset.Token)
+	return nil
+}
+
+// tokenRequired makes sure that a reset token has been provided.
+func (pv *passwordResetValidator) tokenRequired(reset *domain.PasswordReset) error {
+	if reset.Token == "" {
+		return errs.Errorf(errs.EINVALID, "The password reset link is invalid or has expired.")
+	}
+	return nil
+}
+
+// tokenSet creates a new random reset token.
+func (pv *passwordResetValidator) tokenSet(reset *domain.PasswordReset) error {
+	token, err := bytesToString(RememberTokenBytes)
+	if err != nil {
+		return err
+	}
+	reset.Token = token
+	return nil
+}
+
+// userIdValid ensures that the userId is not empty.
+func (pv *passwordResetValidator) userIdValid(reset *domain.PasswordReset) error {
+	if reset.UserID <= 0 {
+		return errs.UserIdValid
+	}
+	return nil
+}
+
+// ByTokenHash retrieves an unused, unexpired PasswordReset database record by its hashed token.
+func (pg *passwordResetGorm) ByTokenHash(tokenHash string) (*domain.PasswordReset, error) {
+	var reset domain.PasswordReset
+	db := pg.db.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, time.Now())
+	err := first(db, &reset)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.EINVALID, "The password reset link is invalid or has expired.")
+		}
+		return nil, err
+	}
+	return &reset, nil
+}
+
+// Create stores the data from the PasswordReset object in a new database record.
+// Only the most recently requested reset of a user can be redeemed, so it deletes
+// all the user's previous resets first.
+func (pg *passwordResetGorm) Create(reset *domain.PasswordReset) error {
+	return pg.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", reset.UserID).Delete(&domain.PasswordReset{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(reset).Error
+	})
+}
+
+// claimPasswordReset sets the reset's UsedAt, unless it has been set before or the reset has expired.
+// If it has been set, the reset has already been redeemed by a concurrent request, and an errs.EINVALID
+// is returned. It's meant to run in the transaction that sets the new password, see UserService.RedeemPasswordReset,
+// so the claim is released again if setting the password fails.
+func claimPasswordReset(db *gorm.DB, reset *domain.PasswordReset) error {
+	if reset.ID <= 0 {
+		return errs.IdInvalid
+	}
+	now := time.Now()
+	result := db.Model(&domain.PasswordReset{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", reset.ID, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errs.Errorf(errs.EINVALID, "The password reset link has already been used.")
+	}
+	reset.UsedAt = &now
+	return nil
+}
@@ -0,0 +1,280 @@
+package crud
+
+import (
+	"gorm.io/gorm"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"wtfTwitter/domain"
+)
+
+// purgeInterval determines how often the purger looks for accounts whose grace period has passed.
+const purgeInterval = time.Hour
+
+// PurgeService permanently deletes deactivated accounts once their grace period has passed,
+// and the images of tweets and users that are gone.
+// It implements the domain.PurgeService interface.
+type PurgeService struct {
+	purgeGorm
+}
+
+// purgeGorm deletes the database records of purged accounts, and their images through the ImageService.
+// It runs periodically in the background until Close is called.
+type purgeGorm struct {
+	db      *gorm.DB
+	images  domain.ImageService
+	stop    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+}
+
+// NewPurgeService returns an instance of PurgeService.
+// It starts the background purger, which runs until Close is called.
+func NewPurgeService(db *gorm.DB, images domain.ImageService) *PurgeService {
+	ps := &PurgeService{
+		purgeGorm{
+			db:     db,
+			images: images,
+			stop:   make(chan struct{}),
+			done:   make(chan struct{}),
+		},
+	}
+	go ps.run()
+	return ps
+}
+
+// Ensure the PurgeService struct properly implements the domain.PurgeService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.PurgeService = &PurgeService{}
+
+// PurgeDeactivated purges every account that was deactivated more than domain.DeactivationGracePeriod
+// ago, and returns the number of purged accounts. A failure to purge one account doesn't stop
+// the others from being purged, the first error is returned after all of them have been tried.
+func (pg *purgeGorm) PurgeDeactivated() (int, error) {
+	var userIds []int
+	err := pg.db.Unscoped().Model(&domain.User{}).
+		Where("deleted_at <= ?", time.Now().Add(-domain.DeactivationGracePeriod)).
+		Pluck("id", &userIds).Error
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	var firstErr error
+	for _, userId := range userIds {
+		if err := pg.purgeUser(userId); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		purged++
+	}
+	return purged, firstErr
+}
+
+// PurgeOrphanedImages deletes the images of tweets and users that are gone, and returns the number
+// of owners whose images were deleted. A tweet is gone once it's deleted, unless it was deleted along
+// with its deactivated user, who may still restore it. A user is gone once they have been purged.
+// Like PurgeDeactivated, it tries all owners before returning the first error.
+func (pg *purgeGorm) PurgeOrphanedImages() (int, error) {
+	purged := 0
+	var firstErr error
+	for _, ownerType := range []string{domain.OwnerTypeTweet, domain.OwnerTypeUser} {
+		ownerIds, err := pg.images.Owners(ownerType)
+		if err != nil {
+			return purged, err
+		}
+		if len(ownerIds) == 0 {
+			continue
+		}
+		var existing []int
+		if ownerType == domain.OwnerTypeTweet {
+			err = pg.db.Unscoped().Model(&domain.Tweet{}).
+				Where("id IN ?", ownerIds).
+				Where("deleted_at IS NULL OR EXISTS (SELECT 1 FROM users WHERE users.id = tweets.user_id AND users.deleted_at = tweets.deleted_at)").
+				Pluck("id", &existing).Error
+		} else {
+			err = pg.db.Unscoped().Model(&domain.User{}).Where("id IN ?", ownerIds).Pluck("id", &existing).Error
+		}
+		if err != nil {
+			return purged, err
+		}
+		exists := make(map[int]bool, len(existing))
+		for _, id := range existing {
+			exists[id] = true
+		}
+		for _, id := range ownerIds {
+			if exists[id] {
+				continue
+			}
+			if err := pg.images.DeleteAll(ownerType, id); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			purged++
+		}
+	}
+	return purged, firstErr
+}
+
+// PurgeExpiredThrottles deletes the throttles whose key isn't locked and whose last failure is more than
+// domain.ThrottleRetention ago, and returns the number of deleted throttles. Without them, the table would
+// keep a row for every client IP and email address that has ever failed to log in.
+func (pg *purgeGorm) PurgeExpiredThrottles() (int, error) {
+	now := time.Now()
+	result := pg.db.
+		Where("(locked_until IS NULL OR locked_until <= ?) AND last_failure_at <= ?", now, now.Add(-domain.ThrottleRetention)).
+		Delete(&domain.Throttle{})
+	return int(result.RowsAffected), result.Error
+}
+
+// Close stops the purger, waiting for a purge that's currently running to finish.
+func (pg *purgeGorm) Close() error {
+	pg.closing.Do(func() {
+		close(pg.stop)
+		<-pg.done
+	})
+	return nil
+}
+
+// run is the purger's background loop. It purges deactivated accounts, orphaned images and expired throttles once
+// right away, and then every purgeInterval. Errors are logged, since there's no caller to return them to.
+func (pg *purgeGorm) run() {
+	defer close(pg.done)
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := pg.PurgeDeactivated(); err != nil {
+			log.Printf("[purge] error: %s", err)
+		} else if n > 0 {
+			log.Printf("[purge] purged %d deactivated accounts", n)
+		}
+		if n, err := pg.PurgeOrphanedImages(); err != nil {
+			log.Printf("[purge] error: %s", err)
+		} else if n > 0 {
+			log.Printf("[purge] deleted the images of %d tweets and users that are gone", n)
+		}
+		if n, err := pg.PurgeExpiredThrottles(); err != nil {
+			log.Printf("[purge] error: %s", err)
+		} else if n > 0 {
+			log.Printf("[purge] deleted %d expired throttles", n)
+		}
+		select {
+		case <-pg.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeUser hard-deletes a user along with their tweets, likes, follows, sessions, login methods, tokens,
+// exports, imports and the apps they registered, and then deletes their files and those of their tweets.
+// Other users' retweets of their tweets are deleted too. Other users' replies to their tweets are
+// kept, but no longer reference the deleted tweets. They are marked as replies to a deleted tweet,
+// so they aren't mistaken for originals.
+func (pg *purgeGorm) purgeUser(userId int) error {
+	var tweetIds []int
+	err := pg.db.Transaction(func(tx *gorm.DB) error {
+		// Tweets and users are soft-deleted by default. Here, every record must go for good.
+		tx = tx.Unscoped().Session(&gorm.Session{})
+
+		// Collect the user's tweets, and the retweets that would be left without them.
+		if err := tx.Model(&domain.Tweet{}).Where("user_id = ?", userId).Pluck("id", &tweetIds).Error; err != nil {
+			return err
+		}
+		var retweetIds []int
+		err := tx.Model(&domain.Tweet{}).
+			Where("retweets_id IN ? AND user_id <> ?", tweetIds, userId).
+			Pluck("id", &retweetIds).Error
+		if err != nil {
+			return err
+		}
+		allTweetIds := append(append([]int{}, tweetIds...), retweetIds...)
+
+		// Detach other users' replies, then delete the tweets with their likes and analytics.
+		err = tx.Model(&domain.Tweet{}).
+			Where("replies_to_id IN ? AND user_id <> ?", tweetIds, userId).
+			Updates(map[string]interface{}{"replies_to_id": nil, "reply_to_deleted": true}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ? OR tweet_id IN ?", userId, allTweetIds).Delete(&domain.Like{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ? OR tweet_id IN ?", userId, allTweetIds).Delete(&domain.TweetStat{}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("id IN ?", allTweetIds).Delete(&domain.Tweet{}).Error; err != nil {
+			return err
+		}
+		err = tx.Where("follower_id = ? OR followed_id = ?", userId, userId).Delete(&domain.Follow{}).Error
+		if err != nil {
+			return err
+		}
+
+		// Delete the apps the user has registered, along with everything other users have granted them.
+		var clientIds []int
+		if err := tx.Model(&domain.OAuthClient{}).Where("owner_id = ?", userId).Pluck("id", &clientIds).Error; err != nil {
+			return err
+		}
+		for _, model := range []interface{}{
+			&domain.AccessToken{},
+			&domain.OAuthRefreshToken{},
+			&domain.OAuthCode{},
+			&domain.OAuthGrant{},
+		} {
+			if err := tx.Where("user_id = ? OR client_id IN ?", userId, clientIds).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("id IN ?", clientIds).Delete(&domain.OAuthClient{}).Error; err != nil {
+			return err
+		}
+
+		// Delete the user's login methods, sessions, pending tokens, exports and imports.
+		for _, model := range []interface{}{
+			&domain.OAuth{},
+			&domain.Session{},
+			&domain.PasswordReset{},
+			&domain.TwoFactor{},
+			&domain.RecoveryCode{},
+			&domain.LoginChallenge{},
+			&domain.Credential{},
+			&domain.WebAuthnChallenge{},
+			&domain.Export{},
+			&domain.Import{},
+			&domain.ImportedTweet{},
+		} {
+			if err := tx.Where("user_id = ?", userId).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(&domain.User{}, "id = ?", userId).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// The files are only deleted once the records are gone for good.
+	if err := os.RemoveAll(exportDir(userId)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(importDir(userId)); err != nil {
+		return err
+	}
+	if err := pg.images.DeleteAll(domain.OwnerTypeUser, userId); err != nil {
+		return err
+	}
+	for _, tweetId := range tweetIds {
+		if err := pg.images.DeleteAll(domain.OwnerTypeTweet, tweetId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package crud
 
-import "gorm.io/gorm"
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"wtfTwitter/domain"
+)
 
 // A ServicesConfig is any function that takes in a pointer to a Services
 // object and returns an error. It's basically just wrapping the constructor
@@ -18,6 +22,17 @@ type Services struct {
 	Like *LikeService
 	Image *ImageService
 	OAuth *OAuthService
+	Analytics *AnalyticsService
+	Session *SessionService
+	PasswordReset *PasswordResetService
+	TwoFactor *TwoFactorService
+	Credential *CredentialService
+	Throttle *ThrottleService
+	AccessToken *AccessTokenService
+	OAuthServer *OAuthServerService
+	Purge *PurgeService
+	Export *ExportService
+	Import *ImportService
 }
 
 // NewServices returns a new Services object, containing any crud services
@@ -76,9 +91,109 @@ func WithLike() ServicesConfig {
 }
 
 // WithImage wraps the constructor of ImageService, NewImageService.
-func WithImage() ServicesConfig {
+func WithImage(store domain.BlobStore) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.Image = NewImageService(s.db, store)
+		return nil
+	}
+}
+
+// WithAnalytics wraps the constructor of AnalyticsService, NewAnalyticsService.
+func WithAnalytics() ServicesConfig {
+	return func(s *Services) error {
+		s.Analytics = NewAnalyticsService(s.db)
+		return nil
+	}
+}
+
+// WithSession wraps the constructor of SessionService, NewSessionService.
+func WithSession(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithPasswordReset wraps the constructor of PasswordResetService, NewPasswordResetService.
+func WithPasswordReset(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.PasswordReset = NewPasswordResetService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithTwoFactor wraps the constructor of TwoFactorService, NewTwoFactorService.
+func WithTwoFactor(hmacKey, encryptionKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.TwoFactor = NewTwoFactorService(s.db, hmacKey, encryptionKey)
+		return nil
+	}
+}
+
+// WithCredential wraps the constructor of CredentialService, NewCredentialService.
+func WithCredential(rpId, rpName, origin string) ServicesConfig {
+	return func(s *Services) error {
+		s.Credential = NewCredentialService(s.db, rpId, rpName, origin)
+		return nil
+	}
+}
+
+// WithThrottle wraps the constructor of ThrottleService, NewThrottleService.
+func WithThrottle() ServicesConfig {
+	return func(s *Services) error {
+		s.Throttle = NewThrottleService(s.db)
+		return nil
+	}
+}
+
+// WithAccessToken wraps the constructor of AccessTokenService, NewAccessTokenService.
+func WithAccessToken(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.AccessToken = NewAccessTokenService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithOAuthServer wraps the constructor of OAuthServerService, NewOAuthServerService.
+func WithOAuthServer(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.OAuthServer = NewOAuthServerService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithExport wraps the constructor of ExportService, NewExportService.
+// It must come after WithImage, since the images of an account are exported through the image service.
+func WithExport(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		if s.Image == nil {
+			return fmt.Errorf("the export service requires the image service")
+		}
+		s.Export = NewExportService(s.db, hmacKey, s.Image)
+		return nil
+	}
+}
+
+// WithImport wraps the constructor of ImportService, NewImportService.
+// It must come after WithImage, since imported images are stored through the image service.
+func WithImport() ServicesConfig {
+	return func(s *Services) error {
+		if s.Image == nil {
+			return fmt.Errorf("the import service requires the image service")
+		}
+		s.Import = NewImportService(s.db, s.Image)
+		return nil
+	}
+}
+
+// WithPurge wraps the constructor of PurgeService, NewPurgeService.
+// It must come after WithImage, since purging an account deletes its images.
+func WithPurge() ServicesConfig {
+	return func(s *Services) error {
+		if s.Image == nil {
+			return fmt.Errorf("the purge service requires the image service")
+		}
+		s.Purge = NewPurgeService(s.db, s.Image)
 		return nil
 	}
 }
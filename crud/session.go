@@ -0,0 +1,249 @@
+package crud
+
+import (
+	"gorm.io/gorm"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// sessionTouchInterval determines how often the last use of a session is written to the
+// database. Without it, every single request would cause an update of the session record.
+const sessionTouchInterval = time.Minute
+
+// SessionService manages Sessions. Together with UserService it makes up the "backend"
+// of the auth system. It implements the domain.SessionService interface.
+type SessionService struct {
+	sessionValidator
+}
+
+// sessionValidator runs validations on incoming Session data.
+// On success, it passes the data on to sessionGorm.
+// Otherwise, it returns the error of the validation that has failed.
+type sessionValidator struct {
+	hmac HMAC
+	sessionGorm
+}
+
+// sessionGorm runs CRUD operations on the database using incoming Session data.
+// It assumes that data has been validated. On success, it returns nil.
+// Otherwise, it returns the error of the operation that has failed.
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+// NewSessionService returns an instance of SessionService.
+func NewSessionService(db *gorm.DB, hmacKey string) *SessionService {
+	return &SessionService{
+		sessionValidator{
+			hmac: newHMAC(hmacKey),
+			sessionGorm: sessionGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// Ensure the SessionService struct properly implements the domain.SessionService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.SessionService = &SessionService{}
+
+// ByToken hashes a remember token and passes the hash on to sessionGorm.ByTokenHash,
+// which looks up the matching session, unless it has expired.
+func (sv *sessionValidator) ByToken(token string) (*domain.Session, error) {
+	session := domain.Session{
+		Token: token,
+	}
+	if err := runSessionValFns(&session, sv.tokenHmac); err != nil {
+		return nil, err
+	}
+	return sv.sessionGorm.ByTokenHash(session.TokenHash)
+}
+
+// Create runs validations needed for creating new Session database records.
+// It creates the session's remember token and sets its expiry.
+func (sv *sessionValidator) Create(session *domain.Session) error {
+	err := runSessionValFns(session,
+		sv.userIdValid,
+		sv.tokenSetIfUnset,
+		sv.tokenMinBytes,
+		sv.tokenHmac,
+		sv.tokenHashRequired,
+		sv.expirySet)
+	if err != nil {
+		return err
+	}
+	return sv.sessionGorm.Create(session)
+}
+
+// Touch extends the session's expiry, since it's being used right now.
+// It only writes to the database if the last write is some time ago.
+func (sv *sessionValidator) Touch(session *domain.Session) error {
+	if time.Since(session.LastSeenAt) < sessionTouchInterval {
+		return nil
+	}
+	err := runSessionValFns(session, sv.idValid, sv.expirySet)
+	if err != nil {
+		return err
+	}
+	return sv.sessionGorm.Touch(session)
+}
+
+// Delete runs validations needed for deleting existing Session database records.
+func (sv *sessionValidator) Delete(session *domain.Session) error {
+	err := runSessionValFns(session, sv.idValid)
+	if err != nil {
+		return err
+	}
+	return sv.sessionGorm.Delete(session)
+}
+
+// runSessionValFns runs any number of functions of type sessionValFn on the passed in Session object.
+// If none of them returns an error, it returns nil. Otherwise, it returns the respective error.
+func runSessionValFns(session *domain.Session, fns ...sessionValFn) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A sessionValFn is any function that takes in a pointer to a domain.Session object and returns an error.
+type sessionValFn func(session *domain.Session) error
+
+// expirySet marks the session as seen right now and sets its expiry accordingly.
+func (sv *sessionValidator) expirySet(session *domain.Session) error {
+	session.LastSeenAt = time.Now()
+	session.ExpiresAt = session.LastSeenAt.Add(domain.SessionLifetime)
+	return nil
+}
+
+// idValid makes sure that the ID of the session is greater than 0.
+func (sv *sessionValidator) idValid(session *domain.Session) error {
+	if session.ID <= 0 {
+		return errs.IdInvalid
+	}
+	return nil
+}
+
+// tokenHashRequired makes sure the session's remember token hash is not the empty string.
+func (sv *sessionValidator) tokenHashRequired(session *domain.Session) error {
+	if session.TokenHash == "" {
+		return errs.RememberHashEmpty
+	}
+	return nil
+}
+
+// tokenHmac creates the session's remember token hash, if a remember token has been provided.
+func (sv *sessionValidator) tokenHmac(session *domain.Session) error {
+	if session.Token == "" {
+		return nil
+	}
+	session.TokenHash = sv.hmac.hash(session.Token)
+	return nil
+}
+
+// tokenMinBytes makes sure that the session's remember token is not too short.
+func (sv *sessionValidator) tokenMinBytes(session *domain.Session) error {
+	if session.Token == "" {
+		return nil
+	}
+	n, err := nBytes(session.Token)
+	if err != nil {
+		return err
+	}
+	if n < RememberTokenBytes {
+		return errs.RememberTooShort
+	}
+	return nil
+}
+
+// tokenSetIfUnset creates the session's remember token if none is provided.
+func (sv *sessionValidator) tokenSetIfUnset(session *domain.Session) error {
+	if session.Token != "" {
+		return nil
+	}
+	token, err := bytesToString(RememberTokenBytes)
+	if err != nil {
+		return err
+	}
+	session.Token = token
+	return nil
+}
+
+// userIdValid ensures that the userId is not empty.
+func (sv *sessionValidator) userIdValid(session *domain.Session) error {
+	if session.UserID <= 0 {
+		return errs.UserIdValid
+	}
+	return nil
+}
+
+// ByID gets a Session record from the database by id.
+func (sg *sessionGorm) ByID(id int) (*domain.Session, error) {
+	var session domain.Session
+	err := sg.db.First(&session, "id = ?", id).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The session does not exist.")
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ByTokenHash retrieves a Session database record by its hashed remember token.
+// The checkUser middleware calls this on every request, trying to identify a user by
+// matching a request cookie's remember token to an unexpired session in the database.
+func (sg *sessionGorm) ByTokenHash(tokenHash string) (*domain.Session, error) {
+	var session domain.Session
+	db := sg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now())
+	err := first(db, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ByUserID retrieves all unexpired sessions of a user, most recently used first.
+func (sg *sessionGorm) ByUserID(userId int) ([]domain.Session, error) {
+	var sessions []domain.Session
+	err := sg.db.
+		Where("user_id = ? AND expires_at > ?", userId, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Create stores the data from the Session object in a new database record.
+// It also removes the user's expired sessions, so they don't pile up.
+func (sg *sessionGorm) Create(session *domain.Session) error {
+	err := sg.db.Where("user_id = ? AND expires_at <= ?", session.UserID, time.Now()).Delete(&domain.Session{}).Error
+	if err != nil {
+		return err
+	}
+	return sg.db.Create(session).Error
+}
+
+// Touch saves the session's last use and its extended expiry.
+func (sg *sessionGorm) Touch(session *domain.Session) error {
+	return sg.db.Model(session).Updates(map[string]interface{}{
+		"last_seen_at": session.LastSeenAt,
+		"expires_at":   session.ExpiresAt,
+	}).Error
+}
+
+// Delete permanently deletes a Session record from the database.
+func (sg *sessionGorm) Delete(session *domain.Session) error {
+	return sg.db.Delete(session).Error
+}
+
+// DeleteByUserID permanently deletes all sessions of a user, except for the one with the
+// ID exceptId. Passing 0 as exceptId deletes all of them.
+func (sg *sessionGorm) DeleteByUserID(userId, exceptId int) error {
+	return sg.db.Where("user_id = ? AND id <> ?", userId, exceptId).Delete(&domain.Session{}).Error
+}
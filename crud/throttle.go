@@ -0,0 +1,110 @@
+package crud
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"math"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// ThrottleService manages Throttles. It protects logins and other sensitive actions against
+// brute-force attacks. It implements the domain.ThrottleService interface.
+type ThrottleService struct {
+	throttleGorm
+}
+
+// throttleGorm runs CRUD operations on the database using incoming Throttle data.
+type throttleGorm struct {
+	db *gorm.DB
+}
+
+// NewThrottleService returns an instance of ThrottleService.
+func NewThrottleService(db *gorm.DB) *ThrottleService {
+	return &ThrottleService{
+		throttleGorm{
+			db: db,
+		},
+	}
+}
+
+// Ensure the ThrottleService struct properly implements the domain.ThrottleService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.ThrottleService = &ThrottleService{}
+
+// Check returns an errs.ETOOMANY if any of the keys is currently locked.
+func (tg *throttleGorm) Check(keys ...string) error {
+	var throttle domain.Throttle
+	err := tg.db.
+		Where("key IN ? AND locked_until > ?", keys, time.Now()).
+		Order("locked_until desc").
+		First(&throttle).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tooManyAttempts(time.Until(*throttle.LockedUntil))
+}
+
+// Hit records a failure for the key. Once the failures exceed the policy's threshold, the key
+// is locked, and every further failure doubles the lockout. Failures are counted inside a
+// transaction that locks the key's row, so concurrent requests can't slip past the threshold.
+func (tg *throttleGorm) Hit(key string, policy domain.ThrottlePolicy) error {
+	return tg.db.Transaction(func(tx *gorm.DB) error {
+		// Make sure the row exists, then lock it.
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&domain.Throttle{Key: key}).Error
+		if err != nil {
+			return err
+		}
+		var throttle domain.Throttle
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&throttle, "key = ?", key).Error
+		if err != nil {
+			return err
+		}
+
+		// Forget failures outside the policy's window.
+		now := time.Now()
+		if now.Sub(throttle.LastFailureAt) > policy.Window {
+			throttle.Failures = 0
+		}
+		throttle.Failures++
+		throttle.LastFailureAt = now
+
+		// Lock the key if the threshold has been exceeded.
+		if excess := throttle.Failures - policy.Threshold; excess > 0 {
+			lockout := lockoutDuration(policy, excess)
+			lockedUntil := now.Add(lockout)
+			throttle.LockedUntil = &lockedUntil
+			log.Printf("[throttle] locked %q for %s after %d failures", key, lockout, throttle.Failures)
+		}
+		return tx.Save(&throttle).Error
+	})
+}
+
+// Reset forgets the key's failures, for example after a successful login.
+func (tg *throttleGorm) Reset(key string) error {
+	return tg.db.Where("key = ?", key).Delete(&domain.Throttle{}).Error
+}
+
+// lockoutDuration computes the lockout for the nth failure beyond the policy's threshold.
+func lockoutDuration(policy domain.ThrottlePolicy, excess int) time.Duration {
+	factor := math.Pow(2, float64(excess-1))
+	lockout := time.Duration(float64(policy.BaseLockout) * factor)
+	if lockout > policy.MaxLockout || lockout <= 0 {
+		return policy.MaxLockout
+	}
+	return lockout
+}
+
+// tooManyAttempts returns the error shown to the user while a key is locked.
+func tooManyAttempts(remaining time.Duration) error {
+	minutes := int(math.Ceil(remaining.Minutes()))
+	if minutes <= 1 {
+		return errs.Errorf(errs.ETOOMANY, "Too many attempts. Please try again in a minute.")
+	}
+	return errs.Errorf(errs.ETOOMANY, "Too many attempts. Please try again in %d minutes.", minutes)
+}
@@ -0,0 +1,103 @@
+package crud
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults every authenticator app supports.
+const (
+	totpIssuer = "Twitter Clone"
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of time steps a code may be off, to allow for clock drift.
+	totpSkew = 1
+	// totpSecretBytes is the length of a TOTP secret, as recommended by RFC 4226.
+	totpSecretBytes = 20
+)
+
+// totpModulus returns 10^totpDigits, which reduces a truncated HOTP value to a code of totpDigits digits.
+func totpModulus() uint32 {
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return modulus
+}
+
+// totpEncoding is the encoding of TOTP secrets expected by authenticator apps.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret generates a new random, base32 encoded TOTP secret.
+func newTOTPSecret() (string, error) {
+	b, err := bytes(totpSecretBytes)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpStep returns the time step a point in time falls into.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode computes the code of a secret for a time step (HOTP, RFC 4226, with HMAC-SHA1).
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus()), nil
+}
+
+// totpMatch checks a code against the secret at the current time, allowing for totpSkew.
+// Steps up to and including lastStep are skipped, so an accepted code can't be used twice.
+// On success it returns the matching step, which must be stored as the new lastStep.
+func totpMatch(secret, code string, lastStep int64) (int64, bool, error) {
+	return totpMatchAt(secret, code, lastStep, time.Now())
+}
+
+// totpMatchAt does the work for totpMatch at the given point in time.
+func totpMatchAt(secret, code string, lastStep int64, now time.Time) (int64, bool, error) {
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// totpURI builds the provisioning URI that authenticator apps read from a QR code.
+func totpURI(account, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
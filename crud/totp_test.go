@@ -0,0 +1,103 @@
+package crud
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 seed of the test vectors in RFC 6238, Appendix B.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes, these are their last totpDigits digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestTOTPMatchSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+	tests := []struct {
+		step int64
+		want bool
+	}{
+		{current - 2, false},
+		{current - 1, true},
+		{current, true},
+		{current + 1, true},
+		{current + 2, false},
+	}
+	for _, tt := range tests {
+		code, err := totpCode(rfc6238Secret, tt.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok, err := totpMatchAt(rfc6238Secret, code, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want {
+			t.Errorf("code of step %+d matched = %t, want %t", tt.step-current, ok, tt.want)
+		}
+		if ok && step != tt.step {
+			t.Errorf("code of step %+d matched step %+d", tt.step-current, step-current)
+		}
+	}
+}
+
+func TestTOTPMatchRejectsUsedSteps(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+	code, err := totpCode(rfc6238Secret, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step, ok, err := totpMatchAt(rfc6238Secret, code, 0, now)
+	if err != nil || !ok {
+		t.Fatalf("fresh code rejected: %t, %v", ok, err)
+	}
+
+	// The same code can't be used again, not even in the next time step.
+	if _, ok, _ := totpMatchAt(rfc6238Secret, code, step, now); ok {
+		t.Error("reused code accepted")
+	}
+	if _, ok, _ := totpMatchAt(rfc6238Secret, code, step, now.Add(totpPeriod*time.Second)); ok {
+		t.Error("reused code accepted in the next step")
+	}
+
+	// Neither can the code of an earlier step, once a later one has been used.
+	previous, err := totpCode(rfc6238Secret, current-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := totpMatchAt(rfc6238Secret, previous, step, now); ok {
+		t.Error("code of an earlier step accepted")
+	}
+
+	// The code of the next step is still fine.
+	next, err := totpCode(rfc6238Secret, current+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := totpMatchAt(rfc6238Secret, next, step, now); !ok {
+		t.Error("code of the next step rejected")
+	}
+}
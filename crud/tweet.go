@@ -2,9 +2,9 @@ package crud
 
 import (
 	"gorm.io/gorm"
-	"io/ioutil"
-	"strconv"
+	"regexp"
 	"strings"
+	"time"
 	"unicode/utf8"
 	"wtfTwitter/domain"
 	"wtfTwitter/errs"
@@ -49,7 +49,12 @@ var _ domain.TweetService = &TweetService{}
 func (tv *tweetValidator) Create(tweet *domain.Tweet) error {
 	err := runTweetValFns(tweet,
 		tv.userIdValid,
+		tv.authorMayTweet,
 		tv.repliedToTweetExists,
+		tv.replyPolicyAllowsReply,
+		tv.replyPolicyValid,
+		tv.replyHiddenUnset,
+		tv.contentWarningValid,
 		tv.retweetedTweetExists,
 		tv.retweetedTweetIsNoRetweet,
 		tv.notAlreadyRetweeted,
@@ -61,6 +66,24 @@ func (tv *tweetValidator) Create(tweet *domain.Tweet) error {
 	return tv.tweetGorm.Create(tweet)
 }
 
+// SetReplyHidden runs validations needed for hiding or un-hiding a reply.
+func (tv *tweetValidator) SetReplyHidden(reply *domain.Tweet, hidden bool) error {
+	err := runTweetValFns(reply, tv.idValid, tv.isReply)
+	if err != nil {
+		return err
+	}
+	return tv.tweetGorm.SetReplyHidden(reply, hidden)
+}
+
+// SetSensitive runs validations needed for updating whether a Tweet's media is sensitive.
+func (tv *tweetValidator) SetSensitive(tweet *domain.Tweet) error {
+	err := runTweetValFns(tweet, tv.idValid, tv.contentWarningValid)
+	if err != nil {
+		return err
+	}
+	return tv.tweetGorm.SetSensitive(tweet)
+}
+
 // Delete runs validations needed for deleting existing Tweet database records.
 func (tv *tweetValidator) Delete(tweet *domain.Tweet) error {
 	err := runTweetValFns(tweet, tv.idValid)
@@ -84,6 +107,24 @@ func runTweetValFns(tweet *domain.Tweet, fns ...tweetValFn) error {
 // A tweetValFn is any function that takes in a pointer to a domain.Tweet object and returns an error.
 type tweetValFn = func(tweet *domain.Tweet) error
 
+// contentWarningValid makes sure that the content warning of a Tweet with sensitive media is
+// one of the known labels, defaulting to domain.ContentWarningSensitive. If the Tweet's media
+// is not sensitive, the content warning is cleared.
+func (tv *tweetValidator) contentWarningValid(tweet *domain.Tweet) error {
+	if !tweet.Sensitive {
+		tweet.ContentWarning = ""
+		return nil
+	}
+	switch tweet.ContentWarning {
+	case "":
+		tweet.ContentWarning = domain.ContentWarningSensitive
+	case domain.ContentWarningSensitive, domain.ContentWarningNudity, domain.ContentWarningViolence:
+	default:
+		return errs.Errorf(errs.EINVALID, "Invalid content warning.")
+	}
+	return nil
+}
+
 // contentMinLength makes sure that the Tweet's content is not empty...
 // ...unless it's a Retweet, in which case empty content is expected.
 func (tv *tweetValidator) contentMinLength(tweet *domain.Tweet) error {
@@ -112,6 +153,14 @@ func (tv *tweetValidator) idValid(tweet *domain.Tweet) error {
 	return nil
 }
 
+// isReply makes sure that the Tweet is a reply to another tweet.
+func (tv *tweetValidator) isReply(tweet *domain.Tweet) error {
+	if tweet.RepliesToID == nil {
+		return errs.Errorf(errs.EINVALID, "Only replies can be hidden.")
+	}
+	return nil
+}
+
 // notAlreadyRetweeted makes sure that the tweet to be retweeted has not yet been
 // retweeted by the user already. A user can must only retweet a tweet once.
 func (tv *tweetValidator) notAlreadyRetweeted(tweet *domain.Tweet) error {
@@ -124,6 +173,23 @@ func (tv *tweetValidator) notAlreadyRetweeted(tweet *domain.Tweet) error {
 	return nil
 }
 
+// authorMayTweet makes sure that the author has verified their email address. Users with
+// unverified addresses can only tweet during the domain.UnverifiedGracePeriod after signing up.
+func (tv *tweetValidator) authorMayTweet(tweet *domain.Tweet) error {
+	var author domain.User
+	err := tv.db.Select("id", "email_verified_at", "created_at").First(&author, "id = ?", tweet.UserID).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return errs.Errorf(errs.ENOTFOUND, "The user does not exist")
+		}
+		return err
+	}
+	if !author.IsVerified() && time.Since(author.CreatedAt) > domain.UnverifiedGracePeriod {
+		return errs.Errorf(errs.EUNAUTHORIZED, "Please verify your email address to keep tweeting.")
+	}
+	return nil
+}
+
 // repliedToTweetExists makes sure that the Tweet to be replied to actually exists.
 // This check only runs if the incoming Tweet object has a valid ID in its RepliesToID field.
 func (tv *tweetValidator) repliedToTweetExists(tweet *domain.Tweet) error {
@@ -140,6 +206,59 @@ func (tv *tweetValidator) repliedToTweetExists(tweet *domain.Tweet) error {
 	return nil
 }
 
+// replyHiddenUnset makes sure that new tweets are never created as hidden replies.
+// Only the author of the replied-to tweet gets to hide a reply after it's created.
+func (tv *tweetValidator) replyHiddenUnset(tweet *domain.Tweet) error {
+	tweet.ReplyHidden = false
+	return nil
+}
+
+// replyPolicyAllowsReply makes sure that the reply policy of the Tweet to be replied to
+// allows the author of the incoming Tweet to reply. Authors can always reply to themselves.
+// This check only runs if the incoming Tweet object has a valid ID in its RepliesToID field.
+func (tv *tweetValidator) replyPolicyAllowsReply(tweet *domain.Tweet) error {
+	if tweet.RepliesToID == nil {
+		return nil
+	}
+	var repliedTo domain.Tweet
+	if err := tv.db.First(&repliedTo, "id = ?", tweet.RepliesToID).Error; err != nil {
+		return err
+	}
+	if repliedTo.UserID == tweet.UserID {
+		return nil
+	}
+	switch repliedTo.ReplyPolicy {
+	case domain.ReplyPolicyFollowing:
+		err := tv.db.First(&domain.Follow{}, "follower_id = ? AND followed_id = ?", repliedTo.UserID, tweet.UserID).Error
+		if err == gorm.ErrRecordNotFound {
+			return errs.Errorf(errs.EUNAUTHORIZED, "Only people followed by the author can reply to this tweet.")
+		}
+		return err
+	case domain.ReplyPolicyMentioned:
+		var replier domain.User
+		if err := tv.db.First(&replier, "id = ?", tweet.UserID).Error; err != nil {
+			return err
+		}
+		if !mentions(repliedTo.Content, replier.Handle) {
+			return errs.Errorf(errs.EUNAUTHORIZED, "Only people mentioned by the author can reply to this tweet.")
+		}
+	}
+	return nil
+}
+
+// replyPolicyValid makes sure that the Tweet's reply policy is one of the known policies.
+// If no policy is provided, it defaults to ReplyPolicyEveryone.
+func (tv *tweetValidator) replyPolicyValid(tweet *domain.Tweet) error {
+	switch tweet.ReplyPolicy {
+	case "":
+		tweet.ReplyPolicy = domain.ReplyPolicyEveryone
+	case domain.ReplyPolicyEveryone, domain.ReplyPolicyFollowing, domain.ReplyPolicyMentioned:
+	default:
+		return errs.Errorf(errs.EINVALID, "Invalid reply policy.")
+	}
+	return nil
+}
+
 // retweetedTweetExists makes sure that the Tweet to be retweeted actually exists.
 // This check only runs if the incoming Tweet object has a valid ID in its RetweetsID field.
 func (tv *tweetValidator) retweetedTweetExists(tweet *domain.Tweet) error {
@@ -184,6 +303,7 @@ func (tv *tweetValidator) userIdValid(tweet *domain.Tweet) error {
 func (tg *tweetGorm) GetFeed(offset int) ([]domain.Tweet, error) {
 	var feed []domain.Tweet
 	err := tg.db.
+		Scopes(withoutOrphanedRetweets).
 		Preload("User").
 		Preload("RepliesTo.User").
 		Preload("RetweetsTweet.User").
@@ -199,11 +319,13 @@ func (tg *tweetGorm) GetFeed(offset int) ([]domain.Tweet, error) {
 }
 
 // ByID retrieves a single Tweet by ID, along with its associated Replies and Retweets.
+// Replies hidden by the tweet's author are not included, see HiddenRepliesByID.
 // If the record doesn't exist, it returns errs.ENOTFOUND. Otherwise, it returns nil.
 func (tg *tweetGorm) ByID(id int) (*domain.Tweet, error) {
 	var tweet domain.Tweet
 	err := tg.db.
 		Preload("User").
+		Preload("Replies", "reply_hidden = ?", false).
 		Preload("Replies.User").
 		First(&tweet, "id = ?", id).
 		Error
@@ -217,12 +339,28 @@ func (tg *tweetGorm) ByID(id int) (*domain.Tweet, error) {
 	return &tweet, nil
 }
 
+// HiddenRepliesByID finds the replies to the tweet with the given ID that have been
+// hidden by the tweet's author, along with their users.
+func (tg *tweetGorm) HiddenRepliesByID(id int) ([]domain.Tweet, error) {
+	var replies []domain.Tweet
+	err := tg.db.
+		Where("replies_to_id = ? AND reply_hidden = ?", id, true).
+		Preload("User").
+		Order("created_at desc").
+		Find(&replies).Error
+	if err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
 // ByUserID finds the specified user's tweets, retweets and replies.
 // It also takes an offset and uses a limit, because these tweets are loaded and
 // displayed incrementally as people scroll further down the user's profile.
 func (tg *tweetGorm) ByUserID(userId, offset int) ([]domain.Tweet, error) {
 	var tweets []domain.Tweet
 	err := tg.db.
+		Scopes(withoutOrphanedRetweets).
 		Where("user_id = ?", userId).
 		Preload("User").
 		Preload("RepliesTo.User").
@@ -238,14 +376,35 @@ func (tg *tweetGorm) ByUserID(userId, offset int) ([]domain.Tweet, error) {
 	return tweets, nil
 }
 
+// PinnedByUserID finds the tweet that the specified user has pinned to their profile.
+// It returns nil and a nil error if the user hasn't pinned a tweet.
+func (tg *tweetGorm) PinnedByUserID(userId int) (*domain.Tweet, error) {
+	var tweet domain.Tweet
+	err := tg.db.
+		Joins("JOIN users ON users.pinned_tweet_id = tweets.id").
+		Where("users.id = ?", userId).
+		Preload("User").
+		First(&tweet).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &tweet, nil
+}
+
 // OriginalsByUserID finds the specified user's tweets and retweets.
 // It also takes an offset and uses a limit, because these tweets are loaded and
 // displayed incrementally as people scroll further down the user's profile.
+// The user's pinned tweet is excluded, since it's displayed on top of the list.
 func (tg *tweetGorm) OriginalsByUserID(userId, offset int) ([]domain.Tweet, error) {
 	var tweets []domain.Tweet
 	err := tg.db.
+		Scopes(withoutOrphanedRetweets).
 		Where("user_id = ?", userId).
-		Where("replies_to_id IS NULL").
+		Where("replies_to_id IS NULL AND reply_to_deleted = ?", false).
+		Where("tweets.id NOT IN (SELECT pinned_tweet_id FROM users WHERE id = ? AND pinned_tweet_id IS NOT NULL)", userId).
 		Preload("User").
 		Preload("RetweetsTweet.User").
 		Preload("RetweetsTweet.RepliesTo.User").
@@ -263,25 +422,33 @@ func (tg *tweetGorm) OriginalsByUserID(userId, offset int) ([]domain.Tweet, erro
 // It also takes an offset and uses a limit, because these tweets are loaded and
 // displayed incrementally as people scroll further down the user's profile.
 func (tg *tweetGorm) ImageTweetsByUserID(userId, offset int) ([]domain.Tweet, error) {
-	files, err := ioutil.ReadDir(domain.ImagesBaseDir + "/" + domain.OwnerTypeTweet + "/")
+	var tweets []domain.Tweet
+	err := tg.db.
+		Where("user_id = ?", userId).
+		Where("EXISTS (SELECT 1 FROM media WHERE media.owner_type = ? AND media.owner_id = tweets.id)", domain.OwnerTypeTweet).
+		Preload("User").
+		Order("created_at desc").
+		Offset(offset).
+		Limit(10).
+		Find(&tweets).Error
 	if err != nil {
 		return nil, err
 	}
-	var imageTweetIds []int
-	for _, f := range files {
-		if f.IsDir() {
-			id, err := strconv.Atoi(f.Name())
-			if err != nil {
-				return nil, err
-			}
-			imageTweetIds = append(imageTweetIds, id)
-		}
-	}
+	return tweets, nil
+}
+
+// SearchByAltText finds the tweets with images whose alt text contains the search term, most recent first.
+// Replies hidden by the author of the tweet they reply to are left out, like in the tweet's replies.
+// It also takes an offset and uses a limit, because search results are loaded and
+// displayed incrementally as people scroll further down the list.
+func (tg *tweetGorm) SearchByAltText(searchTerm string, offset int) ([]domain.Tweet, error) {
 	var tweets []domain.Tweet
-	err = tg.db.
-		Where("user_id = ?", userId).
-		Where("id IN ?", imageTweetIds).
+	err := tg.db.
+		Where("EXISTS (SELECT 1 FROM media WHERE media.owner_type = ? AND media.owner_id = tweets.id "+
+			"AND media.alt_text ILIKE ?)", domain.OwnerTypeTweet, "%"+escapeLike(searchTerm)+"%").
+		Where("reply_hidden = ?", false).
 		Preload("User").
+		Preload("RepliesTo.User").
 		Order("created_at desc").
 		Offset(offset).
 		Limit(10).
@@ -292,6 +459,11 @@ func (tg *tweetGorm) ImageTweetsByUserID(userId, offset int) ([]domain.Tweet, er
 	return tweets, nil
 }
 
+// escapeLike escapes the wildcards of LIKE patterns in a search term, so that they match literally.
+func escapeLike(searchTerm string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(searchTerm)
+}
+
 // LikedTweetsByUserID finds all tweets that the user with the specified id likes.
 // It also takes an offset and uses a limit, because these tweets are loaded and
 // displayed incrementally as people scroll further down the user's profile.
@@ -314,9 +486,10 @@ func (tg *tweetGorm) LikedTweetsByUserID(userId, offset int) ([]domain.Tweet, er
 
 // CountReplies takes a tweet ID, counts that tweet's Replies and returns the
 // integer result and a nil error. If there is an error, it returns 0 and the error.
+// Hidden replies are not counted, just like they're not listed along with the tweet.
 func (tg *tweetGorm) CountReplies(id int) (int, error) {
 	var count int64
-	err := tg.db.Model(&domain.Tweet{}).Where("replies_to_id = ?", id).Count(&count).Error
+	err := tg.db.Model(&domain.Tweet{}).Where("replies_to_id = ? AND reply_hidden = ?", id, false).Count(&count).Error
 	if err != nil {
 		return 0, err
 	}
@@ -336,9 +509,13 @@ func (tg *tweetGorm) CountRetweets(id int) (int, error) {
 
 // CountLikes takes a tweet ID, counts that tweet's Likes and returns the
 // integer result and a nil error. If there is an error, it returns 0 and the error.
+// Likes of users who deactivated their account are not counted.
 func (tg *tweetGorm) CountLikes(id int) (int, error) {
 	var count int64
-	err := tg.db.Model(&domain.Like{}).Where("tweet_id = ?", id).Count(&count).Error
+	err := tg.db.Model(&domain.Like{}).
+		Joins("JOIN users ON users.id = likes.user_id AND users.deleted_at IS NULL").
+		Where("tweet_id = ?", id).
+		Count(&count).Error
 	if err != nil {
 		return 0, err
 	}
@@ -400,12 +577,56 @@ func (tg *tweetGorm) Create(tweet *domain.Tweet) error {
 	return nil
 }
 
+// SetReplyHidden updates the reply_hidden column of a reply.
+func (tg *tweetGorm) SetReplyHidden(reply *domain.Tweet, hidden bool) error {
+	return tg.db.Model(reply).Update("reply_hidden", hidden).Error
+}
+
+// SetSensitive updates the sensitive and content_warning columns of a Tweet.
+func (tg *tweetGorm) SetSensitive(tweet *domain.Tweet) error {
+	return tg.db.Model(tweet).
+		Select("sensitive", "content_warning").
+		Updates(map[string]interface{}{"sensitive": tweet.Sensitive, "content_warning": tweet.ContentWarning}).Error
+}
+
 // Delete soft-deletes a Tweet record from the database, along with its associated
 // Replies, Retweets (not cascading to delete their Replies / Retweets) and Likes.
+// If the tweet is pinned to its author's profile, the pin is removed as well.
 func (tg *tweetGorm) Delete(tweet *domain.Tweet) error {
-	err := tg.db.Select("Replies", "Retweets", "Likes").Delete(tweet).Error
-	if err != nil {
-		return err
+	return tg.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&domain.User{}).
+			Where("pinned_tweet_id = ?", tweet.ID).
+			Update("pinned_tweet_id", nil).Error
+		if err != nil {
+			return err
+		}
+		return tx.Select("Replies", "Retweets", "Likes").Delete(tweet).Error
+	})
+}
+
+// withoutOrphanedRetweets excludes retweets of tweets that are gone, because their author
+// has deactivated their account. Deleting a tweet deletes its retweets along with it, but
+// deactivating an account leaves other users' retweets in place, in case it's restored.
+func withoutOrphanedRetweets(db *gorm.DB) *gorm.DB {
+	return db.Where("(tweets.retweets_id IS NULL OR EXISTS " +
+		"(SELECT 1 FROM tweets AS originals WHERE originals.id = tweets.retweets_id AND originals.deleted_at IS NULL))")
+}
+
+// mentionRegex finds mentions like "@handle" in tweet contents, and captures the handle.
+// A mention must not be preceded or followed by further handle characters, so "@bob"
+// doesn't mention "@bo", and neither does "me@bo.com".
+var mentionRegex = regexp.MustCompile(`(?:^|[^\w@])@(\w{1,15})\b`)
+
+// mentions reports whether the content mentions the given handle, like "@handle".
+// The comparison is case-insensitive.
+func mentions(content, handle string) bool {
+	if handle == "" {
+		return false
 	}
-	return nil
+	for _, match := range mentionRegex.FindAllStringSubmatch(content, -1) {
+		if strings.EqualFold(match[1], handle) {
+			return true
+		}
+	}
+	return false
 }
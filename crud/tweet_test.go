@@ -0,0 +1,37 @@
+package crud
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		content string
+		handle  string
+		want    bool
+	}{
+		{"@bob hi", "bob", true},
+		{"hi @Bob!", "bob", true},
+		{"hi @bob, @alice", "alice", true},
+		{"hi @bobby", "bob", false},
+		{"mail me@bob.com", "bob", false},
+		{"@@bob", "bob", false},
+		{"@abcdefghijklmnop", "abcdefghijklmno", false},
+		{"@abcdefghijklmno", "abcdefghijklmno", true},
+		{"hi @bob", "", false},
+	}
+	for _, tt := range tests {
+		if got := mentions(tt.content, tt.handle); got != tt.want {
+			t.Errorf("mentions(%q, %q) = %t, want %t", tt.content, tt.handle, got, tt.want)
+		}
+	}
+}
+
+func TestMentionEntities(t *testing.T) {
+	got := submatches(mentionRegex, "@bob and @alice, not me@carol.com or @bob again")
+	want := []string{"bob", "alice"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mentions = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,406 @@
+package crud
+
+import (
+	"encoding/hex"
+	"gorm.io/gorm"
+	"regexp"
+	"strings"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// recoveryCodeBytes is the number of random bytes a recovery code consists of.
+const recoveryCodeBytes = 6
+
+// totpCodeRegex matches codes that are TOTP codes. Anything else is treated as a recovery code.
+var totpCodeRegex = regexp.MustCompile(`^[0-9]{6}$`)
+
+// TwoFactorService manages TwoFactors, RecoveryCodes and LoginChallenges.
+// It implements the domain.TwoFactorService interface.
+type TwoFactorService struct {
+	twoFactorValidator
+}
+
+// twoFactorValidator runs validations on incoming TwoFactor data and codes.
+// On success, it passes the data on to twoFactorGorm.
+// Otherwise, it returns the error of the validation that has failed.
+type twoFactorValidator struct {
+	hmac      HMAC
+	encrypter encrypter
+	twoFactorGorm
+}
+
+// twoFactorGorm runs CRUD operations on the database using incoming TwoFactor data.
+// It assumes that data has been validated. On success, it returns nil.
+// Otherwise, it returns the error of the operation that has failed.
+type twoFactorGorm struct {
+	db *gorm.DB
+}
+
+// NewTwoFactorService returns an instance of TwoFactorService.
+func NewTwoFactorService(db *gorm.DB, hmacKey, encryptionKey string) *TwoFactorService {
+	return &TwoFactorService{
+		twoFactorValidator{
+			hmac:      newHMAC(hmacKey),
+			encrypter: newEncrypter(encryptionKey),
+			twoFactorGorm: twoFactorGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// Ensure the TwoFactorService struct properly implements the domain.TwoFactorService interface.
+// If it does not, then this expression becomes invalid and won't compile.
+var _ domain.TwoFactorService = &TwoFactorService{}
+
+// ByUserID gets the user's TwoFactor and decrypts its secret.
+// It returns nil and no error if the user has never enrolled.
+func (tv *twoFactorValidator) ByUserID(userId int) (*domain.TwoFactor, error) {
+	tf, err := tv.twoFactorGorm.ByUserID(userId)
+	if err != nil || tf == nil {
+		return nil, err
+	}
+	if err := runTwoFactorValFns(tf, tv.secretDecrypt); err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// Enroll creates a new, unconfirmed TwoFactor with a random secret for the user, replacing any
+// previous unconfirmed one. It returns the TwoFactor and the provisioning URI for authenticator apps.
+func (tv *twoFactorValidator) Enroll(user *domain.User) (*domain.TwoFactor, string, error) {
+	existing, err := tv.twoFactorGorm.ByUserID(user.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	if existing.Enabled() {
+		return nil, "", errs.Errorf(errs.ECONFLICT, "Two-factor authentication is already enabled.")
+	}
+	tf := domain.TwoFactor{
+		UserID: user.ID,
+	}
+	err = runTwoFactorValFns(&tf,
+		tv.userIdValid,
+		tv.secretSet,
+		tv.secretEncrypt)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := tv.twoFactorGorm.Create(&tf); err != nil {
+		return nil, "", err
+	}
+	return &tf, totpURI(user.Email, tf.Secret), nil
+}
+
+// Confirm completes enrollment with a first valid TOTP code, which proves that the user's
+// authenticator has been set up correctly. From now on the second factor is required.
+// It returns the user's first set of recovery codes.
+func (tv *twoFactorValidator) Confirm(userId int, code string) ([]string, error) {
+	tf, err := tv.ByUserID(userId)
+	if err != nil {
+		return nil, err
+	}
+	if tf == nil {
+		return nil, errs.Errorf(errs.EINVALID, "Please set up two-factor authentication first.")
+	}
+	if tf.Enabled() {
+		return nil, errs.Errorf(errs.ECONFLICT, "Two-factor authentication is already enabled.")
+	}
+	step, ok, err := totpMatch(tf.Secret, normalizeCode(code), 0)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errs.Errorf(errs.EINVALID, "The code is invalid.")
+	}
+	if err := tv.twoFactorGorm.Confirm(tf, step); err != nil {
+		return nil, err
+	}
+	return tv.RegenerateRecoveryCodes(userId)
+}
+
+// Verify checks a TOTP code or a recovery code of a user who has two-factor authentication enabled.
+// Accepted codes are used up: a TOTP code can't be used again, and neither can a recovery code.
+func (tv *twoFactorValidator) Verify(userId int, code string) error {
+	tf, err := tv.ByUserID(userId)
+	if err != nil {
+		return err
+	}
+	if !tf.Enabled() {
+		return errs.Errorf(errs.EINVALID, "Two-factor authentication is not enabled.")
+	}
+	code = normalizeCode(code)
+	var ok bool
+	if totpCodeRegex.MatchString(code) {
+		var step int64
+		step, ok, err = totpMatch(tf.Secret, code, tf.LastUsedStep)
+		if err != nil {
+			return err
+		}
+		if ok {
+			ok, err = tv.twoFactorGorm.UseStep(tf, step)
+		}
+	} else if code != "" {
+		ok, err = tv.twoFactorGorm.UseRecoveryCode(userId, tv.hmac.hash(code))
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errs.Errorf(errs.EINVALID, "The code is invalid.")
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces all of the user's recovery codes with new ones and returns them.
+// This is the only time the plain codes are available, since only their hashes are stored.
+func (tv *twoFactorValidator) RegenerateRecoveryCodes(userId int) ([]string, error) {
+	codes := make([]string, domain.RecoveryCodeCount)
+	records := make([]domain.RecoveryCode, domain.RecoveryCodeCount)
+	for i := range codes {
+		b, err := bytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:len(code)/2] + "-" + code[len(code)/2:]
+		records[i] = domain.RecoveryCode{
+			UserID:   userId,
+			CodeHash: tv.hmac.hash(code),
+		}
+	}
+	if err := tv.twoFactorGorm.ReplaceRecoveryCodes(userId, records); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// CreateChallenge creates a login challenge for a user who has entered the correct password.
+func (tv *twoFactorValidator) CreateChallenge(userId int) (*domain.LoginChallenge, error) {
+	if userId <= 0 {
+		return nil, errs.UserIdValid
+	}
+	token, err := bytesToString(RememberTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	challenge := domain.LoginChallenge{
+		UserID:    userId,
+		Token:     token,
+		TokenHash: tv.hmac.hash(token),
+		ExpiresAt: time.Now().Add(domain.LoginChallengeLifetime),
+	}
+	if err := tv.twoFactorGorm.CreateChallenge(&challenge); err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// ChallengeByToken looks up an unexpired login challenge by its token, so the caller knows whose
+// sign-in it is before a code is checked.
+func (tv *twoFactorValidator) ChallengeByToken(token string) (*domain.LoginChallenge, error) {
+	if token == "" {
+		return nil, errChallengeInvalid
+	}
+	challenge, err := tv.twoFactorGorm.ChallengeByTokenHash(tv.hmac.hash(token))
+	if err == gorm.ErrRecordNotFound {
+		return nil, errChallengeInvalid
+	}
+	return challenge, err
+}
+
+// CompleteChallenge checks the code submitted for a login challenge. On success, the challenge
+// is deleted and the challenge's user can be signed in. Every attempt counts against
+// domain.LoginChallengeMaxAttempts, after which the user has to enter their password again.
+func (tv *twoFactorValidator) CompleteChallenge(challenge *domain.LoginChallenge, code string) error {
+	ok, err := tv.twoFactorGorm.CountAttempt(challenge)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errChallengeInvalid
+	}
+	if err := tv.Verify(challenge.UserID, code); err != nil {
+		return err
+	}
+	return tv.twoFactorGorm.DeleteChallenge(challenge)
+}
+
+// errChallengeInvalid is returned for login challenges that don't exist, have expired or have
+// run out of attempts.
+var errChallengeInvalid = errs.Errorf(errs.EINVALID, "The sign-in attempt has expired. Please sign in again.")
+
+// runTwoFactorValFns runs any number of functions of type twoFactorValFn on the passed in TwoFactor object.
+// If none of them returns an error, it returns nil. Otherwise, it returns the respective error.
+func runTwoFactorValFns(tf *domain.TwoFactor, fns ...twoFactorValFn) error {
+	for _, fn := range fns {
+		if err := fn(tf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A twoFactorValFn is any function that takes in a pointer to a domain.TwoFactor object and returns an error.
+type twoFactorValFn func(tf *domain.TwoFactor) error
+
+// secretDecrypt decrypts the stored secret.
+func (tv *twoFactorValidator) secretDecrypt(tf *domain.TwoFactor) error {
+	secret, err := tv.encrypter.decrypt(tf.SecretEncrypted)
+	if err != nil {
+		return err
+	}
+	tf.Secret = secret
+	return nil
+}
+
+// secretEncrypt encrypts the secret, so it can be stored.
+func (tv *twoFactorValidator) secretEncrypt(tf *domain.TwoFactor) error {
+	encrypted, err := tv.encrypter.encrypt(tf.Secret)
+	if err != nil {
+		return err
+	}
+	tf.SecretEncrypted = encrypted
+	return nil
+}
+
+// secretSet generates a new random secret.
+func (tv *twoFactorValidator) secretSet(tf *domain.TwoFactor) error {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return err
+	}
+	tf.Secret = secret
+	return nil
+}
+
+// userIdValid ensures that the userId is not empty.
+func (tv *twoFactorValidator) userIdValid(tf *domain.TwoFactor) error {
+	if tf.UserID <= 0 {
+		return errs.UserIdValid
+	}
+	return nil
+}
+
+// normalizeCode makes codes comparable, no matter how they have been typed in.
+// Recovery codes are displayed with a dash, and users might add spaces to TOTP codes.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// ByUserID gets the user's TwoFactor record. It returns nil and no error if there is none.
+func (tg *twoFactorGorm) ByUserID(userId int) (*domain.TwoFactor, error) {
+	var tf domain.TwoFactor
+	err := tg.db.First(&tf, "user_id = ?", userId).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &tf, nil
+}
+
+// CountRecoveryCodes counts the user's unused recovery codes.
+func (tg *twoFactorGorm) CountRecoveryCodes(userId int) (int, error) {
+	var count int64
+	err := tg.db.Model(&domain.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userId).Count(&count).Error
+	return int(count), err
+}
+
+// Create stores a new TwoFactor, replacing the user's previous (unconfirmed) one.
+func (tg *twoFactorGorm) Create(tf *domain.TwoFactor) error {
+	return tg.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", tf.UserID).Delete(&domain.TwoFactor{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(tf).Error
+	})
+}
+
+// Confirm marks the TwoFactor as confirmed and stores the step of the code that confirmed it.
+func (tg *twoFactorGorm) Confirm(tf *domain.TwoFactor, step int64) error {
+	now := time.Now()
+	tf.ConfirmedAt = &now
+	tf.LastUsedStep = step
+	return tg.db.Model(tf).Updates(map[string]interface{}{
+		"confirmed_at":   tf.ConfirmedAt,
+		"last_used_step": tf.LastUsedStep,
+	}).Error
+}
+
+// UseStep stores the step of an accepted TOTP code, unless a concurrent request
+// has used that step (or a later one) already. It reports whether it succeeded.
+func (tg *twoFactorGorm) UseStep(tf *domain.TwoFactor, step int64) (bool, error) {
+	result := tg.db.Model(&domain.TwoFactor{}).
+		Where("id = ? AND last_used_step < ?", tf.ID, step).
+		Update("last_used_step", step)
+	return result.RowsAffected == 1, result.Error
+}
+
+// UseRecoveryCode marks the user's unused recovery code with the given hash as used.
+// It reports whether there was such a code.
+func (tg *twoFactorGorm) UseRecoveryCode(userId int, codeHash string) (bool, error) {
+	result := tg.db.Model(&domain.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userId, codeHash).
+		Update("used_at", time.Now())
+	return result.RowsAffected == 1, result.Error
+}
+
+// ReplaceRecoveryCodes deletes all of the user's recovery codes and stores the new ones.
+func (tg *twoFactorGorm) ReplaceRecoveryCodes(userId int, codes []domain.RecoveryCode) error {
+	return tg.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userId).Delete(&domain.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+// Disable deletes the user's TwoFactor, recovery codes and pending login challenges.
+func (tg *twoFactorGorm) Disable(userId int) error {
+	return tg.db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&domain.TwoFactor{}, &domain.RecoveryCode{}, &domain.LoginChallenge{}} {
+			if err := tx.Where("user_id = ?", userId).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ChallengeByTokenHash retrieves an unexpired LoginChallenge by its hashed token.
+func (tg *twoFactorGorm) ChallengeByTokenHash(tokenHash string) (*domain.LoginChallenge, error) {
+	var challenge domain.LoginChallenge
+	db := tg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now())
+	if err := first(db, &challenge); err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// CreateChallenge stores a new LoginChallenge, removing the user's expired ones.
+func (tg *twoFactorGorm) CreateChallenge(challenge *domain.LoginChallenge) error {
+	err := tg.db.Where("user_id = ? AND expires_at <= ?", challenge.UserID, time.Now()).Delete(&domain.LoginChallenge{}).Error
+	if err != nil {
+		return err
+	}
+	return tg.db.Create(challenge).Error
+}
+
+// CountAttempt increments the challenge's attempts, unless the maximum has been reached.
+// It reports whether another attempt was allowed. Counting happens before the code is
+// checked, so concurrent requests can't exceed the maximum.
+func (tg *twoFactorGorm) CountAttempt(challenge *domain.LoginChallenge) (bool, error) {
+	result := tg.db.Model(&domain.LoginChallenge{}).
+		Where("id = ? AND attempts < ?", challenge.ID, domain.LoginChallengeMaxAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	return result.RowsAffected == 1, result.Error
+}
+
+// DeleteChallenge permanently deletes a LoginChallenge.
+func (tg *twoFactorGorm) DeleteChallenge(challenge *domain.LoginChallenge) error {
+	return tg.db.Delete(challenge).Error
+}
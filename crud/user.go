@@ -7,9 +7,10 @@ import (
 	"encoding/base64"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
-	"hash"
+	"gorm.io/gorm/clause"
 	"regexp"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"wtfTwitter/domain"
@@ -31,6 +32,9 @@ type userValidator struct {
 	hmac       HMAC
 	pepper     string
 	emailRegex *regexp.Regexp
+	// dummyHash is compared against when a login attempt can't be checked against a real
+	// password hash, so those attempts take as long as the ones that can.
+	dummyHash []byte
 	userGorm
 }
 
@@ -43,11 +47,16 @@ type userGorm struct {
 
 // NewUserService returns an instance of UserService.
 func NewUserService(db *gorm.DB, hmacKey, pepper string) *UserService {
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
 	return &UserService{
 		userValidator{
 			hmac:       newHMAC(hmacKey),
 			pepper:     pepper,
 			emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+			dummyHash:  dummyHash,
 			userGorm: userGorm{
 				db: db,
 			},
@@ -60,15 +69,23 @@ func NewUserService(db *gorm.DB, hmacKey, pepper string) *UserService {
 var _ domain.UserService = &UserService{}
 
 // Authenticate checks a submitted email address and password for existence and correctness.
+// Whether the email address is unknown or the password is wrong, it returns the same error
+// after roughly the same time, so it can't be used to find out who has an account.
 func (uv *userValidator) Authenticate(email, password string) (*domain.User, error) {
+	incorrect := errs.Errorf(errs.EINVALID, "The email address or password is incorrect.")
+
 	// Look for a user database record containing the submitted email address.
-	found, err := uv.userGorm.ByEmail(email)
-	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, errs.Errorf(errs.EINVALID, "The email address does not exist in our database.")
-		} else {
-			return nil, err
-		}
+	// Users who deactivated their account are found too, as long as they can still restore it.
+	found, err := uv.userGorm.ByEmailForSignIn(strings.TrimSpace(strings.ToLower(email)))
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	// If there's no such user, or they don't have a password (since they signed up with oauth),
+	// spend the time of a password check anyway.
+	if err == gorm.ErrRecordNotFound || found.PasswordHash == "" {
+		bcrypt.CompareHashAndPassword(uv.dummyHash, []byte(password+uv.pepper))
+		return nil, incorrect
 	}
 
 	// Append a predefined pepper to the submitted password, hash it, and compare the result to the
@@ -76,7 +93,7 @@ func (uv *userValidator) Authenticate(email, password string) (*domain.User, err
 	err = bcrypt.CompareHashAndPassword([]byte(found.PasswordHash), []byte(password+uv.pepper))
 	if err != nil {
 		if err == bcrypt.ErrMismatchedHashAndPassword {
-			return nil, errs.Errorf(errs.EINVALID, "The password is incorrect.")
+			return nil, incorrect
 		} else {
 			return nil, err
 		}
@@ -86,35 +103,13 @@ func (uv *userValidator) Authenticate(email, password string) (*domain.User, err
 	return found, nil
 }
 
-// MakeRememberToken is helper to generate remember tokens of a predetermined byte size.
-func (uv *userValidator) MakeRememberToken() (string, error) {
-	return bytesToString(RememberTokenBytes)
-}
-
-// ByRemember runs validations / normalizations on a user's remember token. It then passes
-// the HASHED remember token on to userGorm.ByRemember, will look it up in the database.
-func (uv *userValidator) ByRemember(token string) (*domain.User, error) {
-	user := domain.User{
-		Remember: token,
-	}
-	if err := runUserValFns(&user, uv.rememberHmac); err != nil {
-		return nil, err
-	}
-	return uv.userGorm.ByRemember(user.RememberHash)
-}
-
 // Create runs validations needed for creating new User database records.
-// It will create a remember token if none is provided.
 func (uv *userValidator) Create(user *domain.User) error {
 	err := runUserValFns(user,
 		uv.passwordRequired,
 		uv.passwordMinLength,
 		uv.passwordBcrypt,
 		uv.passwordHashRequired,
-		uv.rememberSetIfUnset,
-		uv.rememberMinBytes,
-		uv.rememberHmac,
-		uv.rememberHashRequired,
 		uv.emailNormalize,
 		uv.emailRequired,
 		uv.emailFormat,
@@ -124,7 +119,8 @@ func (uv *userValidator) Create(user *domain.User) error {
 		uv.handleRequired,
 		uv.handleNormalize,
 		uv.handleMaxLength,
-		uv.bioMaxLength)
+		uv.bioMaxLength,
+		uv.sensitiveMediaValid)
 	if err != nil {
 		return err
 	}
@@ -132,16 +128,12 @@ func (uv *userValidator) Create(user *domain.User) error {
 }
 
 // Update runs validations needed for updating a User record in the database.
-// It will hash a remember token if it is provided (and will not return an error if it's not).
 func (uv *userValidator) Update(user *domain.User) error {
 	err := runUserValFns(user,
 		uv.passwordHashOrOAuthRequired,
 		uv.passwordMinLength,
 		uv.passwordBcrypt,
 		uv.passwordHashRequired,
-		uv.rememberMinBytes,
-		uv.rememberHmac,
-		uv.rememberHashRequired,
 		uv.emailNormalize,
 		uv.emailRequired,
 		uv.emailFormat,
@@ -151,13 +143,175 @@ func (uv *userValidator) Update(user *domain.User) error {
 		uv.handleRequired,
 		uv.handleNormalize,
 		uv.handleMaxLength,
-		uv.bioMaxLength)
+		uv.bioMaxLength,
+		uv.sensitiveMediaValid,
+		uv.pinnedTweetValid)
 	if err != nil {
 		return err
 	}
 	return uv.userGorm.Update(user)
 }
 
+// ChangePassword checks the user's current password and replaces it with a new one.
+// Users that signed up with oauth don't have a password yet. They can set one through a password reset.
+func (uv *userValidator) ChangePassword(user *domain.User, currentPassword, newPassword string) error {
+	if user.PasswordHash == "" {
+		return errs.Errorf(errs.EINVALID, "Your account doesn't have a password yet. Please request a password reset to set one.")
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(currentPassword+uv.pepper))
+	if err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return errs.Errorf(errs.EINVALID, "The current password is incorrect.")
+		}
+		return err
+	}
+	return uv.ResetPassword(user, newPassword)
+}
+
+// ResetPassword replaces the user's password with a new one, without checking the current one.
+// It's used to redeem password resets, where the user has proven access to their email address instead.
+func (uv *userValidator) ResetPassword(user *domain.User, newPassword string) error {
+	user.Password = newPassword
+	err := runUserValFns(user,
+		uv.passwordRequired,
+		uv.passwordMinLength,
+		uv.passwordBcrypt,
+		uv.passwordHashRequired)
+	if err != nil {
+		return err
+	}
+	return uv.userGorm.UpdatePasswordHash(user)
+}
+
+// RedeemPasswordReset redeems a password reset of the user and replaces their password with a new one.
+// The reset is claimed first, and the password is set in the same transaction, so concurrent requests
+// can't redeem the same reset twice. If the new password is invalid, the claim is released again,
+// and the reset can still be used for another attempt.
+func (uv *userValidator) RedeemPasswordReset(user *domain.User, reset *domain.PasswordReset, newPassword string) error {
+	if reset.UserID != user.ID {
+		return errs.Errorf(errs.EINVALID, "The password reset link is invalid or has expired.")
+	}
+	return uv.db.Transaction(func(tx *gorm.DB) error {
+		if err := claimPasswordReset(tx, reset); err != nil {
+			return err
+		}
+		user.Password = newPassword
+		err := runUserValFns(user,
+			uv.passwordRequired,
+			uv.passwordMinLength,
+			uv.passwordBcrypt,
+			uv.passwordHashRequired)
+		if err != nil {
+			return err
+		}
+		return (&userGorm{db: tx}).UpdatePasswordHash(user)
+	})
+}
+
+// Deactivate checks the user's password, if they have one, and deactivates their account.
+// Users that signed up with oauth and never set a password only need to be signed in.
+func (uv *userValidator) Deactivate(user *domain.User, password string) error {
+	if user.PasswordHash != "" {
+		err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password+uv.pepper))
+		if err != nil {
+			if err == bcrypt.ErrMismatchedHashAndPassword {
+				return errs.Errorf(errs.EINVALID, "The password is incorrect.")
+			}
+			return err
+		}
+	}
+	return uv.userGorm.Deactivate(user)
+}
+
+// MakeEmailVerificationToken creates the signed token sent to a user to verify their email address.
+func (uv *userValidator) MakeEmailVerificationToken(user *domain.User) (string, error) {
+	if user.IsVerified() {
+		return "", errs.Errorf(errs.EINVALID, "Your email address is already verified.")
+	}
+	return uv.hmac.signEmailToken(emailTokenVerify, user.ID, user.Email, domain.EmailVerificationLifetime)
+}
+
+// VerifyEmail checks a verification token and marks the email address it was issued for as verified.
+// If the user has changed their address since the token was issued, the token is invalid.
+func (uv *userValidator) VerifyEmail(token string) (*domain.User, error) {
+	claims, err := uv.hmac.parseEmailToken(token, emailTokenVerify)
+	if err != nil {
+		return nil, err
+	}
+	user, err := uv.userGorm.ByID(claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != claims.Email {
+		return nil, errs.Errorf(errs.EINVALID, "The verification link is invalid or has expired.")
+	}
+	if user.IsVerified() {
+		return user, nil
+	}
+	return user, uv.userGorm.SetEmailVerified(user)
+}
+
+// UpdateProfile updates the user's record like Update. If a new email address is passed in, it's stored
+// as the user's pending email along with the rest of the record, and the signed token that confirms it
+// is returned. The user's actual email address only changes once that token is redeemed through
+// ConfirmEmailChange. The new address is validated before anything is saved, so a rejected email
+// change leaves the record untouched. If there's no new address, or it equals the current one,
+// the empty string is returned.
+func (uv *userValidator) UpdateProfile(user *domain.User, email *string) (string, error) {
+	if email != nil {
+		pending := domain.User{
+			ID:    user.ID,
+			Email: *email,
+		}
+		err := runUserValFns(&pending,
+			uv.emailNormalize,
+			uv.emailRequired,
+			uv.emailFormat,
+			uv.emailIsAvail)
+		if err != nil {
+			return "", err
+		}
+		if pending.Email == user.Email {
+			email = nil
+		} else {
+			user.PendingEmail = pending.Email
+		}
+	}
+	if err := uv.Update(user); err != nil {
+		return "", err
+	}
+	if email == nil {
+		return "", nil
+	}
+	return uv.hmac.signEmailToken(emailTokenChange, user.ID, user.PendingEmail, domain.EmailChangeLifetime)
+}
+
+// ConfirmEmailChange checks an email change token and replaces the user's email address with
+// their pending one. Since the user has proven access to it, the new address counts as verified.
+func (uv *userValidator) ConfirmEmailChange(token string) (*domain.User, error) {
+	claims, err := uv.hmac.parseEmailToken(token, emailTokenChange)
+	if err != nil {
+		return nil, err
+	}
+	user, err := uv.userGorm.ByID(claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.PendingEmail == "" || user.PendingEmail != claims.Email {
+		return nil, errs.Errorf(errs.EINVALID, "The confirmation link is invalid or has expired.")
+	}
+
+	// Someone else might have registered the address in the meantime.
+	user.Email = user.PendingEmail
+	if err := runUserValFns(user, uv.emailIsAvail); err != nil {
+		return nil, err
+	}
+	if err := uv.userGorm.ConfirmPendingEmail(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
 // runUserValFns runs any number of functions of type userValFn on the passed in User object.
 // If none of them returns an error, it returns nil. Otherwise, it returns the respective error.
 func runUserValFns(user *domain.User, fns ...userValFn) error {
@@ -192,8 +346,10 @@ func (uv *userValidator) emailFormat(user *domain.User) error {
 }
 
 // emailIsAvail makes sure that a provided email address is not yet taken.
+// Addresses of deactivated accounts stay taken until those accounts are purged.
 func (uv *userValidator) emailIsAvail(user *domain.User) error {
-	existing, err := uv.userGorm.ByEmail(user.Email)
+	var existing domain.User
+	err := first(uv.db.Unscoped().Where("email = ?", user.Email), &existing)
 	if err == gorm.ErrRecordNotFound {
 		// Address is not taken.
 		return nil
@@ -267,6 +423,29 @@ func (uv *userValidator) nameRequired(user *domain.User) error {
 	return nil
 }
 
+// pinnedTweetValid makes sure that a pinned tweet exists, belongs to the user and is an
+// original tweet. Replies and retweets cannot be pinned. It only runs if PinnedTweetID is set.
+func (uv *userValidator) pinnedTweetValid(user *domain.User) error {
+	if user.PinnedTweetID == nil {
+		return nil
+	}
+	var tweet domain.Tweet
+	err := uv.db.First(&tweet, "id = ?", *user.PinnedTweetID).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return errs.Errorf(errs.ENOTFOUND, "The tweet to be pinned does not exist.")
+		}
+		return err
+	}
+	if tweet.UserID != user.ID {
+		return errs.Errorf(errs.EUNAUTHORIZED, "You can only pin your own tweets.")
+	}
+	if tweet.RepliesToID != nil || tweet.ReplyToDeleted || tweet.RetweetsID != nil {
+		return errs.Errorf(errs.EINVALID, "Only original tweets can be pinned.")
+	}
+	return nil
+}
+
 // passwordBcrypt hashes a user's password with a predefined pepper.
 // It bcrypts it, if the Password field is not the empty string.
 // It then clears the password on the user object in memory for security reasons.
@@ -317,62 +496,32 @@ func (uv *userValidator) passwordRequired(user *domain.User) error {
 	return nil
 }
 
-// rememberHashRequired makes sure the user's remember token hash is not the empty string.
-func (uv *userValidator) rememberHashRequired(user *domain.User) error {
-	if user.RememberHash == "" {
-		return errs.RememberHashEmpty
-	}
-	return nil
-}
-
-// rememberHmac creates the user's remember token hash, if a remember token has been provided.
-func (uv *userValidator) rememberHmac(user *domain.User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	user.RememberHash = uv.hmac.hash(user.Remember)
-	return nil
-}
-
-// rememberMinBytes makes sure that the user's remember token is not too short.
-func (uv *userValidator) rememberMinBytes(user *domain.User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	n, err := nBytes(user.Remember)
-	if err != nil {
-		return err
-	}
-	if n < 32 {
-		return errs.RememberTooShort
-	}
-	return nil
-}
-
-// rememberSetIfUnset creates the user's remember token if none is provided.
-func (uv *userValidator) rememberSetIfUnset(user *domain.User) error {
-	if user.Remember != "" {
-		return nil
+// sensitiveMediaValid makes sure that the user's sensitive media setting is one of the known
+// settings. If no setting is provided, it defaults to domain.MediaBlur.
+func (uv *userValidator) sensitiveMediaValid(user *domain.User) error {
+	switch user.SensitiveMedia {
+	case "":
+		user.SensitiveMedia = domain.MediaBlur
+	case domain.MediaShow, domain.MediaBlur, domain.MediaHide:
+	default:
+		return errs.Errorf(errs.EINVALID, "Invalid sensitive media setting.")
 	}
-	token, err := uv.MakeRememberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = token
 	return nil
 }
 
 // passwordHashOrOAuthRequired checks if the user's PasswordHash is empty and NoPasswordNeeded
 // is set to false. In that case no update should be possible and subsequent password
 // hash validations will fail. However, before passing on it checks if there is an
-// oauth record associated with that user. If there is one, that means the user is signed
-// in with oauth and does not need a password. It then sets user's NoPasswordNeeded
-// field to true, to make subsequent password validations pass.
+// oauth record or a passkey associated with that user. If there is one, that means the user
+// signs in with oauth or a passkey and does not need a password. It then sets user's
+// NoPasswordNeeded field to true, to make subsequent password validations pass.
 func (uv *userValidator) passwordHashOrOAuthRequired(user *domain.User) error {
 	if user.PasswordHash == "" && user.NoPasswordNeeded == false {
-		var oauth *domain.OAuth
-		uv.db.Where("user_id = ?", user.ID).First(&oauth)
-		if oauth != nil {
+		count, err := countPasswordlessLogins(uv.db, user.ID)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
 			user.NoPasswordNeeded = true
 			return nil
 		}
@@ -381,6 +530,45 @@ func (uv *userValidator) passwordHashOrOAuthRequired(user *domain.User) error {
 	return nil
 }
 
+// countPasswordlessLogins counts the ways a user can sign in without a password,
+// which are their oauth records and their passkeys.
+func countPasswordlessLogins(db *gorm.DB, userId int) (int64, error) {
+	var oauths, credentials int64
+	if err := db.Model(&domain.OAuth{}).Where("user_id = ?", userId).Count(&oauths).Error; err != nil {
+		return 0, err
+	}
+	if err := db.Model(&domain.Credential{}).Where("user_id = ?", userId).Count(&credentials).Error; err != nil {
+		return 0, err
+	}
+	return oauths + credentials, nil
+}
+
+// deleteLoginMethod deletes one of the user's oauth records or passkeys, unless it's their last way
+// to sign in. It's the counterpart of passwordHashOrOAuthRequired: a user without a password must
+// keep at least one oauth record or passkey. The user's record is locked while counting, so two
+// concurrent deletions can't both pass the check.
+func deleteLoginMethod(db *gorm.DB, userId int, value interface{}) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var user domain.User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "password_hash").
+			First(&user, userId).Error
+		if err != nil {
+			return err
+		}
+		if user.PasswordHash == "" {
+			count, err := countPasswordlessLogins(tx, userId)
+			if err != nil {
+				return err
+			}
+			if count <= 1 {
+				return errs.Errorf(errs.EINVALID, "This is your only way to sign in. Set a password or add another sign-in method first.")
+			}
+		}
+		return tx.Delete(value).Error
+	})
+}
+
 // ByID retrieves a User database record by ID, along with its associated Tweets, Likes, Followers
 // and "Followeds" (users whom the user is following), along with their most relevant associations.
 func (ug *userGorm) ByID(id int) (*domain.User, error) {
@@ -404,16 +592,37 @@ func (ug *userGorm) ByEmail(email string) (*domain.User, error) {
 	return &user, err
 }
 
-// ByRemember retrieves a User database record by its hashed remember token.
-// The checkUser middleware calls this on every request, trying to identify a user
-// by matching a request cookie's remember token to a hashed remember token in the database.
-func (ug *userGorm) ByRemember(rememberHash string) (*domain.User, error) {
+// ByIDForSignIn retrieves a User database record by ID like ByID does, but it also finds users
+// who deactivated their account less than domain.DeactivationGracePeriod ago, since signing in
+// restores their account.
+func (ug *userGorm) ByIDForSignIn(id int) (*domain.User, error) {
 	var user domain.User
-	db := ug.db.Where("remember_hash = ?", rememberHash)
-	err := first(db, &user)
+	err := first(ug.signInable().Where("id = ?", id), &user)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errs.Errorf(errs.ENOTFOUND, "The user does not exist")
+		} else {
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// ByEmailForSignIn retrieves a User database record by Email like ByEmail does, but it also
+// finds users whose deactivated account can still be restored, see ByIDForSignIn.
+func (ug *userGorm) ByEmailForSignIn(email string) (*domain.User, error) {
+	var user domain.User
+	err := first(ug.signInable().Where("email = ?", email), &user)
 	return &user, err
 }
 
+// signInable returns a query on users who are either active, or have deactivated their account
+// within the grace period.
+func (ug *userGorm) signInable() *gorm.DB {
+	return ug.db.Unscoped().
+		Where("(deleted_at IS NULL OR deleted_at > ?)", time.Now().Add(-domain.DeactivationGracePeriod))
+}
+
 // Search takes a search term, looks for users whose name or handle are similar to the term,
 // and returns those users, populating only the fields needed for proper search results display.
 func (ug *userGorm) Search(searchTerm string) []domain.User {
@@ -426,6 +635,45 @@ func (ug *userGorm) Search(searchTerm string) []domain.User {
 	return users
 }
 
+// LikersByTweetID finds the users who like the tweet with the given ID, most recent likes first.
+// It also takes an offset and uses a limit, because the users are loaded and displayed
+// incrementally as people scroll further down the list. Only the fields needed to display
+// the list are populated. Deleted users are excluded.
+func (ug *userGorm) LikersByTweetID(tweetId, offset int) ([]domain.User, error) {
+	var users []domain.User
+	err := ug.db.
+		Select("users.id, users.name, users.handle, users.bio, users.avatar").
+		Joins("JOIN likes ON likes.user_id = users.id").
+		Where("likes.tweet_id = ?", tweetId).
+		Order("likes.created_at desc").
+		Offset(offset).
+		Limit(10).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// RetweetersByTweetID finds the users who retweeted the tweet with the given ID, most recent
+// retweets first. Like LikersByTweetID, it uses an offset and a limit, only populates the fields
+// needed to display the list, and excludes deleted users as well as deleted retweets.
+func (ug *userGorm) RetweetersByTweetID(tweetId, offset int) ([]domain.User, error) {
+	var users []domain.User
+	err := ug.db.
+		Select("users.id, users.name, users.handle, users.bio, users.avatar").
+		Joins("JOIN tweets ON tweets.user_id = users.id").
+		Where("tweets.retweets_id = ? AND tweets.deleted_at IS NULL", tweetId).
+		Order("tweets.created_at desc").
+		Offset(offset).
+		Limit(10).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 // CountTweets takes a user ID, counts that user's Tweets and returns the integer
 // result and a nil error. If there is an error, it returns 0 and the error.
 func (ug *userGorm) CountTweets(userId int) (int, error) {
@@ -439,9 +687,13 @@ func (ug *userGorm) CountTweets(userId int) (int, error) {
 
 // CountFollowers takes a user ID and returns the number of users
 // who are following the user with the given ID, or an error.
+// Followers who deactivated their account are not counted.
 func (ug *userGorm) CountFollowers(userId int) (int, error) {
 	var count int64
-	err := ug.db.Model(&domain.Follow{}).Where("followed_id = ?", userId).Count(&count).Error
+	err := ug.db.Model(&domain.Follow{}).
+		Joins("JOIN users ON users.id = follows.follower_id AND users.deleted_at IS NULL").
+		Where("followed_id = ?", userId).
+		Count(&count).Error
 	if err != nil {
 		return 0, err
 	}
@@ -450,9 +702,13 @@ func (ug *userGorm) CountFollowers(userId int) (int, error) {
 
 // CountFolloweds takes a user ID and returns the number of users
 // who are being followed by the user with the given ID, or an error.
+// Followed users who deactivated their account are not counted.
 func (ug *userGorm) CountFolloweds(userId int) (int, error) {
 	var count int64
-	err := ug.db.Model(&domain.Follow{}).Where("follower_id = ?", userId).Count(&count).Error
+	err := ug.db.Model(&domain.Follow{}).
+		Joins("JOIN users ON users.id = follows.followed_id AND users.deleted_at IS NULL").
+		Where("follower_id = ?", userId).
+		Count(&count).Error
 	if err != nil {
 		return 0, err
 	}
@@ -489,30 +745,100 @@ func (ug *userGorm) Update(user *domain.User) error {
 	return ug.db.Save(user).Error
 }
 
+// UpdatePasswordHash saves the user's password hash, leaving the rest of their record untouched.
+// Deactivated users are updated too, since they can reset their password within the grace period.
+func (ug *userGorm) UpdatePasswordHash(user *domain.User) error {
+	return ug.db.Unscoped().Model(user).Update("password_hash", user.PasswordHash).Error
+}
+
+// SetEmailVerified marks the user's email address as verified.
+func (ug *userGorm) SetEmailVerified(user *domain.User) error {
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	return ug.db.Model(user).Update("email_verified_at", user.EmailVerifiedAt).Error
+}
+
+// ConfirmPendingEmail makes the user's pending email address their actual, verified one.
+func (ug *userGorm) ConfirmPendingEmail(user *domain.User) error {
+	now := time.Now()
+	user.Email = user.PendingEmail
+	user.PendingEmail = ""
+	user.EmailVerifiedAt = &now
+	return ug.db.Model(user).Updates(map[string]interface{}{
+		"email":             user.Email,
+		"pending_email":     user.PendingEmail,
+		"email_verified_at": user.EmailVerifiedAt,
+	}).Error
+}
+
+// Deactivate soft-deletes the user along with their tweets, and signs them out everywhere.
+// The tweets get the same deletion timestamp as the user, so Restore can tell them apart
+// from tweets the user had deleted themselves.
+func (ug *userGorm) Deactivate(user *domain.User) error {
+	// Postgres stores microseconds, so the timestamp is truncated to compare equal once it's read back.
+	now := time.Now().Truncate(time.Microsecond)
+	return ug.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&domain.Tweet{}).
+			Where("user_id = ?", user.ID).
+			Update("deleted_at", now).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&domain.Session{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(user).Update("deleted_at", now).Error; err != nil {
+			return err
+		}
+		user.DeletedAt = gorm.DeletedAt{Time: now, Valid: true}
+		return nil
+	})
+}
+
+// Restore undoes Deactivate, bringing back the user and the tweets deleted along with them.
+func (ug *userGorm) Restore(user *domain.User) error {
+	if !user.IsDeactivated() {
+		return nil
+	}
+	return ug.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(&domain.Tweet{}).
+			Where("user_id = ? AND deleted_at = ?", user.ID, user.DeletedAt.Time).
+			Update("deleted_at", nil).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Model(user).Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		user.DeletedAt = gorm.DeletedAt{}
+		return nil
+	})
+}
+
 // first is a helper for getting the first database record that matches a given query.
 func first(db *gorm.DB, dst interface{}) error {
 	return db.First(dst).Error
 }
 
 // HMAC is a wrapper around the crypto/hmac package making it easier to use.
+// It's safe for concurrent use, since every call to hash uses its own hash.Hash.
 type HMAC struct {
-	hmac hash.Hash
+	key []byte
 }
 
 // newHMAC creates and returns a new HMAC object.
 func newHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
 	return HMAC{
-		hmac: h,
+		key: []byte(key),
 	}
 }
 
 // hash hashes an input string using HMAC with the secret key
-// provided when the HMAC object was created in NewUserService.
+// provided when the HMAC object was created.
 func (h HMAC) hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
 	return base64.URLEncoding.EncodeToString(b)
 }
 
@@ -0,0 +1,276 @@
+package crud
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/big"
+)
+
+// This file contains the parts of the WebAuthn protocol (https://www.w3.org/TR/webauthn-2/)
+// the server needs: a minimal CBOR decoder, parsing of authenticator data and COSE keys, and
+// signature verification. They are plain functions working on bytes, so they can be checked
+// against the output of a software authenticator without a database.
+
+// COSE algorithm identifiers of the supported public key algorithms.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// Flags of the authenticator data.
+const (
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+)
+
+// errCBOR is returned for malformed or unsupported CBOR data.
+var errCBOR = errors.New("webauthn: malformed cbor")
+
+// cborDecode decodes the first CBOR data item in b (RFC 8949) and returns it along with the
+// number of bytes it occupied. It only supports what CTAP2 authenticators produce: definite
+// lengths, integers, byte and text strings, arrays, maps and the simple values false, true
+// and null. Integers are returned as int64, maps as map[interface{}]interface{}.
+func cborDecode(b []byte) (interface{}, int, error) {
+	return cborDecodeDepth(b, 0)
+}
+
+// cborDecodeDepth decodes a data item, limiting the nesting depth of arrays and maps.
+func cborDecodeDepth(b []byte, depth int) (interface{}, int, error) {
+	if len(b) == 0 || depth > 16 {
+		return nil, 0, errCBOR
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	n := 1
+	// Read the argument: the value itself for integers, otherwise a length or count.
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(b) < 1+size {
+			return nil, 0, errCBOR
+		}
+		for _, c := range b[1 : 1+size] {
+			arg = arg<<8 | uint64(c)
+		}
+		n += size
+	default:
+		return nil, 0, errCBOR
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, 0, errCBOR
+		}
+		return int64(arg), n, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, 0, errCBOR
+		}
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if arg > uint64(len(b)-n) {
+			return nil, 0, errCBOR
+		}
+		data := b[n : n+int(arg)]
+		n += int(arg)
+		if major == 3 {
+			return string(data), n, nil
+		}
+		return data, n, nil
+	case 4:
+		if arg > uint64(len(b)) {
+			return nil, 0, errCBOR
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, size, err := cborDecodeDepth(b[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			n += size
+		}
+		return items, n, nil
+	case 5:
+		if arg > uint64(len(b)) {
+			return nil, 0, errCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, size, err := cborDecodeDepth(b[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += size
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, errCBOR
+			}
+			value, size, err := cborDecodeDepth(b[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += size
+			m[key] = value
+		}
+		return m, n, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		case 22:
+			return nil, n, nil
+		}
+	}
+	return nil, 0, errCBOR
+}
+
+// authenticatorData is the parsed authenticator data (WebAuthn §6.1).
+// CredentialID and PublicKey are only present in registrations.
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// parseAuthenticatorData parses raw authenticator data.
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, errors.New("webauthn: authenticator data too short")
+	}
+	ad := authenticatorData{
+		RPIDHash:  b[:32],
+		Flags:     b[32],
+		SignCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.Flags&authDataAttested == 0 {
+		return &ad, nil
+	}
+	// Attested credential data: AAGUID (16 bytes), credential ID length (2 bytes),
+	// credential ID, and the credential's public key as a COSE_Key.
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("webauthn: attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+		return nil, errors.New("webauthn: invalid credential id")
+	}
+	ad.CredentialID = rest[:idLen]
+	_, keyLen, err := cborDecode(rest[idLen:])
+	if err != nil {
+		return nil, err
+	}
+	ad.PublicKey = rest[idLen : idLen+keyLen]
+	return &ad, nil
+}
+
+// checkRPIDHash makes sure the authenticator data was created for the relying party.
+func (ad *authenticatorData) checkRPIDHash(rpId string) bool {
+	sum := sha256.Sum256([]byte(rpId))
+	return subtle.ConstantTimeCompare(ad.RPIDHash, sum[:]) == 1
+}
+
+// parseAttestationObject extracts the authenticator data from an attestation object.
+// The attestation statement isn't verified: the server requests "none" attestation,
+// since it doesn't restrict which authenticators can be used.
+func parseAttestationObject(b []byte) (*authenticatorData, error) {
+	decoded, _, err := cborDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errCBOR
+	}
+	raw, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("webauthn: attestation object without authenticator data")
+	}
+	return parseAuthenticatorData(raw)
+}
+
+// parseCOSEKey decodes a COSE_Key (RFC 8152) into a public key of one of the supported algorithms.
+func parseCOSEKey(b []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := cborDecode(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errCBOR
+	}
+	alg, _ := m[int64(3)].(int64)
+	unsupported := errors.New("webauthn: unsupported public key")
+	switch alg {
+	case coseES256:
+		x, xOk := m[int64(-2)].([]byte)
+		y, yOk := m[int64(-3)].([]byte)
+		if m[int64(1)] != int64(2) || m[int64(-1)] != int64(1) || !xOk || !yOk {
+			return nil, 0, unsupported
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, 0, unsupported
+		}
+		return key, alg, nil
+	case coseRS256:
+		n, nOk := m[int64(-1)].([]byte)
+		e, eOk := m[int64(-2)].([]byte)
+		if m[int64(1)] != int64(3) || !nOk || !eOk || len(e) > 4 || len(n) < 256 {
+			return nil, 0, unsupported
+		}
+		exponent := new(big.Int).SetBytes(e)
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, alg, nil
+	case coseEdDSA:
+		x, xOk := m[int64(-2)].([]byte)
+		if m[int64(1)] != int64(1) || m[int64(-1)] != int64(6) || !xOk || len(x) != ed25519.PublicKeySize {
+			return nil, 0, unsupported
+		}
+		return ed25519.PublicKey(x), alg, nil
+	}
+	return nil, 0, unsupported
+}
+
+// verifyAssertionSignature checks the signature of an assertion. The authenticator signs
+// its authenticator data followed by the SHA-256 hash of the client data JSON.
+func verifyAssertionSignature(coseKey, authData, clientDataJSON, signature []byte) error {
+	key, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	message := append(append([]byte{}, authData...), clientDataHash[:]...)
+	digest := sha256.Sum256(message)
+	valid := false
+	switch alg {
+	case coseES256:
+		valid = ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], signature)
+	case coseRS256:
+		valid = rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	case coseEdDSA:
+		valid = ed25519.Verify(key.(ed25519.PublicKey), message, signature)
+	}
+	if !valid {
+		return errors.New("webauthn: invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,451 @@
+package crud
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"testing"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// The tests in this file run registrations and logins against softAuthenticator, a software
+// authenticator that produces the same bytes a real one would.
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:4200"
+)
+
+// testValidator returns a credentialValidator for testRPID and testOrigin. It has no database,
+// so only the checks that don't look anything up can be run with it.
+func testValidator() *credentialValidator {
+	return &credentialValidator{rpId: testRPID, rpName: "Twitter Clone", origin: testOrigin}
+}
+
+// cborPair is a key and value of a CBOR map. Maps are encoded from pairs to keep their order.
+type cborPair struct {
+	key   interface{}
+	value interface{}
+}
+
+// cborEncode encodes the values cborDecode supports.
+func cborEncode(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []interface{}:
+		b := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			b = append(b, cborEncode(item)...)
+		}
+		return b
+	case []cborPair:
+		b := cborHead(5, uint64(len(v)))
+		for _, pair := range v {
+			b = append(b, cborEncode(pair.key)...)
+			b = append(b, cborEncode(pair.value)...)
+		}
+		return b
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	}
+	panic("cborEncode: unsupported type")
+}
+
+// cborHead encodes the initial byte and argument of a data item.
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return []byte{major<<5 | 25, byte(arg >> 8), byte(arg)}
+	case arg <= 0xffffffff:
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(arg))
+		return b
+	}
+	b := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], arg)
+	return b
+}
+
+// softAuthenticator is a software authenticator holding a single passkey.
+type softAuthenticator struct {
+	alg       int
+	key       crypto.Signer
+	id        []byte
+	rpId      string
+	flags     byte
+	signCount uint32
+}
+
+// newSoftAuthenticator returns an authenticator with a new key of the algorithm, bound to testRPID,
+// that verifies the user.
+func newSoftAuthenticator(t *testing.T, alg int) *softAuthenticator {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case coseES256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case coseEdDSA:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case coseRS256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{
+		alg:   alg,
+		key:   key,
+		id:    []byte("credential-" + strconv.Itoa(alg)),
+		rpId:  testRPID,
+		flags: authDataUserPresent | authDataUserVerified,
+	}
+}
+
+// coseKey returns the authenticator's public key as a COSE_Key.
+func (a *softAuthenticator) coseKey() []byte {
+	switch key := a.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		return cborEncode([]cborPair{
+			{1, 2}, {3, coseES256}, {-1, 1},
+			{-2, key.X.FillBytes(make([]byte, 32))},
+			{-3, key.Y.FillBytes(make([]byte, 32))},
+		})
+	case ed25519.PublicKey:
+		return cborEncode([]cborPair{{1, 1}, {3, coseEdDSA}, {-1, 6}, {-2, []byte(key)}})
+	case *rsa.PublicKey:
+		return cborEncode([]cborPair{{1, 3}, {3, coseRS256}, {-1, key.N.Bytes()}, {-2, big.NewInt(int64(key.E)).Bytes()}})
+	}
+	panic("coseKey: unsupported key")
+}
+
+// authData returns authenticator data. With attested set, it includes the passkey.
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rpId))
+	b := append([]byte{}, rpIdHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= authDataAttested
+	}
+	b = append(b, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], a.signCount)
+	if attested {
+		b = append(b, make([]byte, 16)...)
+		b = append(b, byte(len(a.id)>>8), byte(len(a.id)))
+		b = append(b, a.id...)
+		b = append(b, a.coseKey()...)
+	}
+	return b
+}
+
+// register returns the attestation object of navigator.credentials.create().
+func (a *softAuthenticator) register() []byte {
+	return cborEncode([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(true)},
+	})
+}
+
+// login increases the signature counter and returns the authenticator data and signature
+// of navigator.credentials.get().
+func (a *softAuthenticator) login(clientDataJSON []byte) ([]byte, []byte) {
+	a.signCount++
+	authData := a.authData(false)
+	return authData, a.sign(authData, clientDataJSON)
+}
+
+// sign signs authenticator data followed by the hash of the client data, as authenticators do.
+func (a *softAuthenticator) sign(authData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	message := append(append([]byte{}, authData...), clientDataHash[:]...)
+	var signature []byte
+	var err error
+	if a.alg == coseEdDSA {
+		signature, err = a.key.Sign(rand.Reader, message, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(message)
+		signature, err = a.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return signature
+}
+
+// credential returns the passkey as it's stored after a registration.
+func (a *softAuthenticator) credential(t *testing.T) *domain.Credential {
+	authData, err := testValidator().checkAttestation(a.register())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &domain.Credential{
+		UserID:       1,
+		CredentialID: webAuthnEncoding.EncodeToString(authData.CredentialID),
+		PublicKey:    authData.PublicKey,
+		SignCount:    int64(authData.SignCount),
+	}
+}
+
+// testClientData returns client data JSON as the browser creates it.
+func testClientData(typ, origin string) []byte {
+	b, _ := json.Marshal(clientData{Type: typ, Challenge: "challenge", Origin: origin})
+	return b
+}
+
+func TestCheckClientData(t *testing.T) {
+	tests := []struct {
+		name       string
+		clientData []byte
+		typ        string
+		valid      bool
+	}{
+		{"create", testClientData("webauthn.create", testOrigin), "webauthn.create", true},
+		{"get", testClientData("webauthn.get", testOrigin), "webauthn.get", true},
+		{"wrong type", testClientData("webauthn.get", testOrigin), "webauthn.create", false},
+		{"wrong origin", testClientData("webauthn.get", "https://evil.example.com"), "webauthn.get", false},
+		{"origin with path", testClientData("webauthn.get", testOrigin+"/login"), "webauthn.get", false},
+		{"no challenge", []byte(`{"type":"webauthn.get","origin":"` + testOrigin + `"}`), "webauthn.get", false},
+		{"not json", []byte("{"), "webauthn.get", false},
+	}
+	for _, tt := range tests {
+		challenge, err := testValidator().checkClientData(tt.clientData, tt.typ)
+		if tt.valid && (err != nil || challenge != "challenge") {
+			t.Errorf("%s: got %q, %v", tt.name, challenge, err)
+		}
+		if !tt.valid && errs.ErrorCode(err) != errs.EINVALID {
+			t.Errorf("%s: got %v, want EINVALID", tt.name, err)
+		}
+	}
+}
+
+func TestCheckAttestation(t *testing.T) {
+	for _, alg := range []int{coseES256, coseEdDSA, coseRS256} {
+		a := newSoftAuthenticator(t, alg)
+		authData, err := testValidator().checkAttestation(a.register())
+		if err != nil {
+			t.Fatalf("alg %d: %s", alg, err)
+		}
+		if string(authData.CredentialID) != string(a.id) || string(authData.PublicKey) != string(a.coseKey()) {
+			t.Errorf("alg %d: got credential %q and key %x", alg, authData.CredentialID, authData.PublicKey)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(a *softAuthenticator) []byte
+	}{
+		{"wrong rp id", func(a *softAuthenticator) []byte {
+			a.rpId = "evil.example.com"
+			return a.register()
+		}},
+		{"user not present", func(a *softAuthenticator) []byte {
+			a.flags = authDataUserVerified
+			return a.register()
+		}},
+		{"user not verified", func(a *softAuthenticator) []byte {
+			a.flags = authDataUserPresent
+			return a.register()
+		}},
+		{"no attested credential", func(a *softAuthenticator) []byte {
+			return cborEncode([]cborPair{{"fmt", "none"}, {"attStmt", []cborPair{}}, {"authData", a.authData(false)}})
+		}},
+		{"no authenticator data", func(a *softAuthenticator) []byte {
+			return cborEncode([]cborPair{{"fmt", "none"}, {"attStmt", []cborPair{}}})
+		}},
+		{"truncated", func(a *softAuthenticator) []byte {
+			b := a.register()
+			return b[:len(b)-10]
+		}},
+		{"unsupported key", func(a *softAuthenticator) []byte {
+			// Replace the COSE_Key at the end of the authenticator data with one of ES384 (-35).
+			b := a.authData(true)
+			b = b[:len(b)-len(a.coseKey())]
+			key := cborEncode([]cborPair{{1, 2}, {3, -35}, {-1, 2}, {-2, []byte{1}}, {-3, []byte{1}}})
+			return cborEncode([]cborPair{{"fmt", "none"}, {"attStmt", []cborPair{}}, {"authData", append(b, key...)}})
+		}},
+	}
+	for _, tt := range tests {
+		a := newSoftAuthenticator(t, coseES256)
+		if _, err := testValidator().checkAttestation(tt.modify(a)); errs.ErrorCode(err) != errs.EINVALID {
+			t.Errorf("%s: got %v, want EINVALID", tt.name, err)
+		}
+	}
+}
+
+func TestCheckAssertion(t *testing.T) {
+	clientDataJSON := testClientData("webauthn.get", testOrigin)
+	for _, alg := range []int{coseES256, coseEdDSA, coseRS256} {
+		a := newSoftAuthenticator(t, alg)
+		credential := a.credential(t)
+		for i := 1; i <= 2; i++ {
+			authData, signature := a.login(clientDataJSON)
+			count, err := testValidator().checkAssertion(credential, authData, clientDataJSON, signature)
+			if err != nil {
+				t.Fatalf("alg %d: %s", alg, err)
+			}
+			if count != int64(i) {
+				t.Errorf("alg %d: got sign count %d, want %d", alg, count, i)
+			}
+			credential.SignCount = count
+		}
+	}
+
+	tests := []struct {
+		name string
+		code string
+		// login signs in with the authenticator, which holds credential, and returns the response.
+		login func(a *softAuthenticator, credential *domain.Credential) (authData, clientDataJSON, signature []byte)
+	}{
+		{"bad signature", errs.EINVALID, func(a *softAuthenticator, _ *domain.Credential) ([]byte, []byte, []byte) {
+			authData, signature := a.login(clientDataJSON)
+			signature[len(signature)-1] ^= 0xff
+			return authData, clientDataJSON, signature
+		}},
+		{"signature over other client data", errs.EINVALID, func(a *softAuthenticator, _ *domain.Credential) ([]byte, []byte, []byte) {
+			authData, signature := a.login(testClientData("webauthn.get", "https://evil.example.com"))
+			return authData, clientDataJSON, signature
+		}},
+		{"modified authenticator data", errs.EINVALID, func(a *softAuthenticator, _ *domain.Credential) ([]byte, []byte, []byte) {
+			authData, signature := a.login(clientDataJSON)
+			authData[36]++
+			return authData, clientDataJSON, signature
+		}},
+		{"other passkey", errs.EINVALID, func(_ *softAuthenticator, _ *domain.Credential) ([]byte, []byte, []byte) {
+			authData, signature := newSoftAuthenticator(t, coseES256).login(clientDataJSON)
+			return authData, clientDataJSON, signature
+		}},
+		{"wrong rp id", errs.EINVALID, func(a *softAuthenticator, _ *domain.Credential) ([]byte, []byte, []byte) {
+			a.rpId = "evil.example.com"
+			authData, signature := a.login(clientDataJSON)
+			return authData, clientDataJSON, signature
+		}},
+		{"user not present", errs.EINVALID, func(a *softAuthenticator, _ *domain.Credential) ([]byte, []byte, []byte) {
+			a.flags = 0
+			authData, signature := a.login(clientDataJSON)
+			return authData, clientDataJSON, signature
+		}},
+		{"user not verified", errs.EINVALID, func(a *softAuthenticator, _ *domain.Credential) ([]byte, []byte, []byte) {
+			a.flags = authDataUserPresent
+			authData, signature := a.login(clientDataJSON)
+			return authData, clientDataJSON, signature
+		}},
+		{"counter not increased", errs.EUNAUTHORIZED, func(a *softAuthenticator, credential *domain.Credential) ([]byte, []byte, []byte) {
+			credential.SignCount = 5
+			a.signCount = 4
+			authData, signature := a.login(clientDataJSON)
+			return authData, clientDataJSON, signature
+		}},
+		{"counter decreased", errs.EUNAUTHORIZED, func(a *softAuthenticator, credential *domain.Credential) ([]byte, []byte, []byte) {
+			credential.SignCount = 5
+			a.signCount = 1
+			authData, signature := a.login(clientDataJSON)
+			return authData, clientDataJSON, signature
+		}},
+		{"counter reset to zero", errs.EUNAUTHORIZED, func(a *softAuthenticator, credential *domain.Credential) ([]byte, []byte, []byte) {
+			credential.SignCount = 5
+			authData := a.authData(false)
+			return authData, clientDataJSON, a.sign(authData, clientDataJSON)
+		}},
+		{"truncated authenticator data", errs.EINVALID, func(a *softAuthenticator, _ *domain.Credential) ([]byte, []byte, []byte) {
+			authData, signature := a.login(clientDataJSON)
+			return authData[:36], clientDataJSON, signature
+		}},
+	}
+	for _, tt := range tests {
+		a := newSoftAuthenticator(t, coseES256)
+		credential := a.credential(t)
+		authData, clientData, signature := tt.login(a, credential)
+		if _, err := testValidator().checkAssertion(credential, authData, clientData, signature); errs.ErrorCode(err) != tt.code {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.code)
+		}
+	}
+}
+
+// TestCheckAssertionWithoutCounter makes sure authenticators that don't keep a signature
+// counter, and always send 0, can be used more than once.
+func TestCheckAssertionWithoutCounter(t *testing.T) {
+	clientDataJSON := testClientData("webauthn.get", testOrigin)
+	a := newSoftAuthenticator(t, coseES256)
+	credential := a.credential(t)
+	for i := 0; i < 2; i++ {
+		authData := a.authData(false)
+		signature := a.sign(authData, clientDataJSON)
+		if count, err := testValidator().checkAssertion(credential, authData, clientDataJSON, signature); err != nil || count != 0 {
+			t.Fatalf("got %d, %v", count, err)
+		}
+	}
+}
+
+func TestCBORDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  interface{}
+	}{
+		{"small int", []byte{0x17}, int64(23)},
+		{"uint8", []byte{0x18, 0xff}, int64(255)},
+		{"uint32", []byte{0x1a, 0, 1, 0, 0}, int64(65536)},
+		{"negative", []byte{0x38, 0x63}, int64(-100)},
+		{"text", append([]byte{0x63}, "abc"...), "abc"},
+		{"true", []byte{0xf5}, true},
+		{"null", []byte{0xf6}, nil},
+	}
+	for _, tt := range tests {
+		got, n, err := cborDecode(tt.input)
+		if err != nil || got != tt.want || n != len(tt.input) {
+			t.Errorf("%s: got %v, %d, %v, want %v", tt.name, got, n, err, tt.want)
+		}
+	}
+
+	deep := make([]byte, 20)
+	for i := range deep {
+		deep[i] = 0x81
+	}
+	malformed := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"truncated argument", []byte{0x19, 0x01}},
+		{"truncated string", []byte{0x45, 'a', 'b'}},
+		{"huge string", []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"huge array", []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"indefinite length", []byte{0x5f, 0x41, 'a', 0xff}},
+		{"integer overflow", []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"array key", []byte{0xa1, 0x80, 0x01}},
+		{"truncated map", []byte{0xa2, 0x01, 0x02}},
+		{"float", []byte{0xf9, 0x3c, 0x00}},
+		{"too deep", deep},
+	}
+	for _, tt := range malformed {
+		if _, _, err := cborDecode(tt.input); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
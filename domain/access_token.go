@@ -0,0 +1,81 @@
+package domain
+
+import (
+	"strings"
+	"time"
+)
+
+// Scopes of personal access tokens. A token can only be used for routes requiring one of its scopes.
+// Routes managing the account itself (profile, password, sessions, tokens etc.) can't be used with
+// a token at all, they require the user to be signed in.
+// There's no scope for direct messages, since the app has none. Once they exist, their scope belongs here.
+const (
+	// ScopeRead allows reading tweets, profiles, the feed and analytics.
+	ScopeRead = "read"
+	// ScopeTweetsWrite allows creating, deleting, pinning and liking tweets, moderating replies
+	// and recording clicks on tweets.
+	ScopeTweetsWrite = "tweets:write"
+	// ScopeFollowsWrite allows following and unfollowing users.
+	ScopeFollowsWrite = "follows:write"
+)
+
+// Scopes holds all scopes an access token can be granted.
+var Scopes = []string{ScopeRead, ScopeTweetsWrite, ScopeFollowsWrite}
+
+// AccessToken represents a personal access token, which scripts and bots use to access the API
+// on behalf of a User. It's sent in the header "Authorization: Bearer <token>".
+// Token only exists in memory right after the access token has been created. The database only
+// stores its hash, TokenHash. Scope holds the token's scopes separated by spaces. ExpiresAt is nil
+// if the token never expires.
+// Access tokens issued to third-party apps by the OAuth2 authorization server have ClientID set
+// to the ID of the OAuthClient. They aren't listed among the user's personal access tokens.
+type AccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id" gorm:"notNull;index"`
+	ClientID   *int       `json:"client_id" gorm:"index;default:null"`
+	Name       string     `json:"name" gorm:"notNull"`
+	Token      string     `json:"token" gorm:"-"`
+	TokenHash  string     `json:"token_hash" gorm:"notNull;uniqueIndex"`
+	Scope      string     `json:"scope" gorm:"notNull"`
+	ExpiresAt  *time.Time `json:"expires_at" gorm:"default:null"`
+	LastUsedAt *time.Time `json:"last_used_at" gorm:"default:null"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// AccessTokenService is a set of methods to manipulate and work with the AccessToken model.
+type AccessTokenService interface {
+	ByID(id int) (*AccessToken, error)
+	ByToken(token string) (*AccessToken, error)
+	ByUserID(userId int) ([]AccessToken, error)
+
+	Create(accessToken *AccessToken) error
+	Touch(accessToken *AccessToken) error
+	Delete(accessToken *AccessToken) error
+}
+
+// Scopes returns the token's scopes.
+func (t *AccessToken) Scopes() []string {
+	return strings.Fields(t.Scope)
+}
+
+// HasScope reports whether the token has been granted the scope.
+func (t *AccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopeIncludes reports whether every scope of the space separated list scope
+// is in the space separated list granted.
+func ScopeIncludes(granted, scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if !(&AccessToken{Scope: granted}).HasScope(s) {
+			return false
+		}
+	}
+	return true
+}
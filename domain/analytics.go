@@ -0,0 +1,74 @@
+package domain
+
+import "time"
+
+const (
+	// AnalyticsImpression is recorded whenever a Tweet is served in a feed, profile or detail response.
+	AnalyticsImpression = "impression"
+	// AnalyticsProfileClick is recorded when someone clicks on the author's profile from a Tweet.
+	AnalyticsProfileClick = "profile_click"
+	// AnalyticsLinkClick is recorded when someone clicks on a link contained in a Tweet.
+	AnalyticsLinkClick = "link_click"
+)
+
+// TweetStat is an hourly rollup of the analytics events recorded for a Tweet.
+// There is at most one TweetStat per Tweet and hour. Events are not stored one by one,
+// instead they are counted in memory and added to the respective rollup in batches.
+// UserID is the ID of the Tweet's author. It's stored with the rollup, so that
+// account-level summaries don't need to join the tweets table.
+type TweetStat struct {
+	ID            int       `json:"id"`
+	TweetID       int       `json:"tweet_id" gorm:"notNull;uniqueIndex:tweet_id_hour"`
+	UserID        int       `json:"user_id" gorm:"notNull;index"`
+	Hour          time.Time `json:"hour" gorm:"notNull;uniqueIndex:tweet_id_hour;index"`
+	Impressions   int       `json:"impressions" gorm:"notNull;default:0"`
+	ProfileClicks int       `json:"profile_clicks" gorm:"notNull;default:0"`
+	LinkClicks    int       `json:"link_clicks" gorm:"notNull;default:0"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// AnalyticsCounts holds the number of impressions, clicks and engagements (likes,
+// retweets and replies) of a Tweet or an account within some period of time.
+type AnalyticsCounts struct {
+	Impressions   int `json:"impressions"`
+	ProfileClicks int `json:"profile_clicks"`
+	LinkClicks    int `json:"link_clicks"`
+	Likes         int `json:"likes"`
+	Retweets      int `json:"retweets"`
+	Replies       int `json:"replies"`
+}
+
+// Engagements returns the total number of interactions, which is everything but impressions.
+func (c AnalyticsCounts) Engagements() int {
+	return c.ProfileClicks + c.LinkClicks + c.Likes + c.Retweets + c.Replies
+}
+
+// AnalyticsHour holds the AnalyticsCounts of a single hour.
+type AnalyticsHour struct {
+	Hour time.Time `json:"hour"`
+	AnalyticsCounts
+}
+
+// Analytics is the analytics report of a Tweet or an account since a given point in time.
+// Hourly only contains the hours in which anything happened, in chronological order.
+type Analytics struct {
+	Since          time.Time       `json:"since"`
+	Totals         AnalyticsCounts `json:"totals"`
+	EngagementRate float64         `json:"engagement_rate"`
+	Hourly         []AnalyticsHour `json:"hourly"`
+}
+
+// AnalyticsService is a set of methods to record analytics events and to read the resulting reports.
+// Recording is asynchronous, so the Record methods return immediately. RecordEvent takes the ID
+// of the user who clicked, and counts a user's clicks on a Tweet only once in a while. Close flushes any
+// events that haven't been written to the database yet.
+type AnalyticsService interface {
+	RecordImpressions(tweets ...*Tweet)
+	RecordEvent(userId int, tweet *Tweet, event string) error
+
+	ByTweetID(tweetId int, since time.Time) (*Analytics, error)
+	ByUserID(userId int, since time.Time) (*Analytics, error)
+
+	Close() error
+}
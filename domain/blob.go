@@ -0,0 +1,20 @@
+package domain
+
+import (
+	"io"
+	"time"
+)
+
+// BlobStore is a set of methods to store and retrieve files (blobs) by key. Keys are slash-separated
+// paths like "tweet/2/unique_name.png". Get returns an ENOTFOUND error if no blob is stored under
+// the key, Delete doesn't. List returns the keys starting with prefix in lexical order.
+// SignedURL returns a URL the blob can be downloaded from without credentials until ttl has
+// passed, or an empty string if the store can't hand out such URLs and the app has to serve
+// the blob itself.
+type BlobStore interface {
+	Put(key string, r io.Reader, size int64, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	List(prefix string) ([]string, error)
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
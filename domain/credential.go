@@ -0,0 +1,134 @@
+package domain
+
+import "time"
+
+const (
+	// WebAuthnTimeout determines how long a passkey registration or login may take,
+	// from requesting the options until sending back the authenticator's response.
+	WebAuthnTimeout = 5 * time.Minute
+	// Purposes of a WebAuthnChallenge.
+	WebAuthnRegister = "register"
+	WebAuthnLogin    = "login"
+)
+
+// Credential represents a passkey (a WebAuthn public key credential) a User can sign in with
+// instead of a password. The private key never leaves the user's authenticator. The server
+// stores the public key as a COSE_Key and checks the signatures the authenticator creates.
+// SignCount is the authenticator's signature counter, used to detect cloned authenticators.
+type Credential struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id" gorm:"notNull;index"`
+	CredentialID string     `json:"credential_id" gorm:"notNull;uniqueIndex"`
+	PublicKey    []byte     `json:"public_key" gorm:"notNull"`
+	SignCount    int64      `json:"sign_count"`
+	Name         string     `json:"name" gorm:"notNull"`
+	LastUsedAt   *time.Time `json:"last_used_at" gorm:"default:null"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// WebAuthnChallenge is a random challenge the authenticator has to sign during a registration
+// or login. It can only be used once and only until it expires. UserID is 0 for logins, since
+// the user is only known once the authenticator has picked one of its passkeys.
+type WebAuthnChallenge struct {
+	ID        int       `json:"id"`
+	Challenge string    `json:"challenge" gorm:"notNull;uniqueIndex"`
+	Purpose   string    `json:"purpose" gorm:"notNull"`
+	UserID    int       `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"notNull;index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CredentialCreationOptions is passed to navigator.credentials.create() by the client
+// to register a new passkey. Binary values are base64url encoded.
+type CredentialCreationOptions struct {
+	PublicKey struct {
+		RP struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"rp"`
+		User struct {
+			ID          string `json:"id"`
+			Name        string `json:"name"`
+			DisplayName string `json:"displayName"`
+		} `json:"user"`
+		Challenge              string                 `json:"challenge"`
+		PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+		Timeout                int64                  `json:"timeout"`
+		ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+		AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+		Attestation            string                 `json:"attestation"`
+	} `json:"publicKey"`
+}
+
+// CredentialRequestOptions is passed to navigator.credentials.get() by the client to sign in
+// with a passkey. AllowCredentials is empty, so the authenticator offers all of its passkeys
+// for the site, and the user doesn't have to enter their email address first.
+type CredentialRequestOptions struct {
+	PublicKey struct {
+		Challenge        string                 `json:"challenge"`
+		RPID             string                 `json:"rpId"`
+		Timeout          int64                  `json:"timeout"`
+		UserVerification string                 `json:"userVerification"`
+		AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	} `json:"publicKey"`
+}
+
+// CredentialParameter names a public key algorithm (COSE algorithm identifier) the server supports.
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CredentialDescriptor identifies an existing passkey.
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// AuthenticatorSelection states the requirements for the authenticator creating a passkey.
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// AttestationResponse is the JSON form of the PublicKeyCredential returned by
+// navigator.credentials.create(). Binary values are base64url encoded.
+type AttestationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the JSON form of the PublicKeyCredential returned by
+// navigator.credentials.get(). Binary values are base64url encoded.
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// CredentialService is a set of methods to manipulate and work with the Credential model.
+// It implements the server side of the WebAuthn registration and authentication ceremonies.
+type CredentialService interface {
+	ByID(id int) (*Credential, error)
+	ByUserID(userId int) ([]Credential, error)
+
+	BeginRegistration(user *User) (*CredentialCreationOptions, error)
+	FinishRegistration(user *User, name string, response *AttestationResponse) (*Credential, error)
+	BeginLogin() (*CredentialRequestOptions, error)
+	FinishLogin(response *AssertionResponse) (*Credential, error)
+
+	Update(credential *Credential) error
+	Delete(credential *Credential) error
+}
@@ -0,0 +1,52 @@
+package domain
+
+import "time"
+
+const (
+	// ExportStatusPending means that the export's archive is still being built.
+	ExportStatusPending = "pending"
+	// ExportStatusReady means that the export's archive can be downloaded.
+	ExportStatusReady = "ready"
+	// ExportStatusFailed means that the export's archive could not be built.
+	ExportStatusFailed = "failed"
+)
+
+const (
+	// ExportsBaseDir determines the storage location of export archives.
+	ExportsBaseDir = "exports"
+	// ExportLifetime determines how long an export archive can be downloaded once it's ready.
+	// After that, the archive is deleted.
+	ExportLifetime = 7 * 24 * time.Hour
+	// ExportCooldown determines how often a user can request an export of their data.
+	ExportCooldown = 24 * time.Hour
+)
+
+// Export represents a user's request for an archive of their data. The archive is built in the
+// background and stored as a zip file in ExportsBaseDir. Once it's ready, the user gets a link
+// containing Token, which is signed and expires along with the export. Like a session's remember
+// token, Token only exists in memory, it's set when the archive is ready and never stored.
+type Export struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id" gorm:"notNull;index"`
+	Status      string     `json:"status" gorm:"notNull;default:pending"`
+	Filename    string     `json:"-"`
+	Size        int64      `json:"size"`
+	Token       string     `json:"-" gorm:"-"`
+	CompletedAt *time.Time `json:"completed_at" gorm:"default:null"`
+	ExpiresAt   *time.Time `json:"expires_at" gorm:"default:null"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// ExportService is a set of methods to manipulate and work with the Export model. Archives are built
+// one after another by a background worker, which calls the function passed to OnFinished whenever
+// an export is ready or has failed. Close stops the worker after the current archive is finished.
+type ExportService interface {
+	LatestByUserID(userId int) (*Export, error)
+	ByToken(token string) (*Export, error)
+	Path(export *Export) string
+
+	Create(export *Export) error
+	OnFinished(fn func(export *Export))
+	Close() error
+}
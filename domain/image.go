@@ -2,8 +2,12 @@ package domain
 
 import (
 	"fmt"
+	"io"
 	"mime/multipart"
 	"net/url"
+	"path"
+	"strings"
+	"time"
 )
 
 const (
@@ -11,43 +15,143 @@ const (
 	OwnerTypeTweet = "tweet"
 	// OwnerTypeUser expresses that an Image belongs to a User.
 	OwnerTypeUser = "user"
-	// ImagesBaseDir determines the general storage location of uploaded images.
+	// ImagesBaseDir determines the path images are served from, and the storage location
+	// of uploaded images if they are stored in the filesystem.
 	ImagesBaseDir = "images"
 	// MaxUploadSize determines the maximum filesize of an image to be uploaded.
 	MaxUploadSize int64 = 5 << 20 // 5 Megabyte
+	// MaxImagePixels determines the maximum number of pixels of an image to be uploaded. Decoding
+	// an image takes 4 bytes of memory per pixel, no matter how small the file is.
+	MaxImagePixels = 24000000 // 24 Megapixels
+	// MaxImageDimension determines the maximum width and height of a stored image.
+	// Larger images are scaled down when they are uploaded, GIF and WebP images are rejected.
+	MaxImageDimension = 4096
+	// MaxAnimationFrames determines the maximum number of frames of an animated GIF to be uploaded.
+	MaxAnimationFrames = 500
+	// MaxAnimationDuration determines the maximum duration of an animated GIF to be uploaded.
+	MaxAnimationDuration = time.Minute
+	// MaxAnimationPixels determines the maximum number of pixels of all frames of an animated GIF
+	// to be uploaded together. Decoding an animation takes 1 byte of memory per pixel.
+	MaxAnimationPixels = 64000000 // 64 Megapixels
+	// UserStorageQuota determines how many bytes of images a user can store, counting their avatar,
+	// their header and the images of their tweets, along with the variants of all of them.
+	UserStorageQuota int64 = 1 << 30 // 1 Gigabyte
+	// MaxAltTextLength determines the maximum number of characters of an image's alt text.
+	MaxAltTextLength = 1000
 )
 
-// Image represents an image to be uploaded. Images are only stored as files in the filesystem
-// and have no dedicated table in the database. Images always have a polymorphic one-to-many
+// ImageContentTypes maps the content types of images that can be uploaded to their file extensions.
+// GIF and WebP images can only be attached to tweets.
+var ImageContentTypes = map[string]string{
+	"image/jpeg": ".jpeg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+const (
+	// ImagePurposeTweet expresses that an Image is attached to a Tweet.
+	ImagePurposeTweet = "tweet"
+	// ImagePurposeAvatar expresses that an Image is a User's avatar.
+	ImagePurposeAvatar = "avatar"
+	// ImagePurposeHeader expresses that an Image is a User's header.
+	ImagePurposeHeader = "header"
+)
+
+// Image represents an uploaded image. The image itself is stored as a blob in a BlobStore, and
+// described by a record in the media table. Images always have a polymorphic one-to-many
 // relationship with an owner. The owner is the entity that the Image belongs to. As of now,
 // that's either a Tweet or a User, depending on the Image's OwnerType. The exact record that
-// the Image belongs to is determined by the OwnerID. Since Images are not stored in the database,
-// the relationship must be created (and resolved) through the location of the stored image file
-// in the filesystem:
-// An Image belonging to the User with ID 1 will be stored in: images/user/1/unique_name.jpeg.
-// An Image belonging to the Tweet with ID 2 will be stored in: images/tweet/2/unique_name.png.
-// URL contains the relative path to an image stored in the filesystem, starting in ImagesBaseDir.
-// File contains the actual image file that will be stored in the filesystem.
+// the Image belongs to is determined by the OwnerID. The key of the stored blob is based on the owner:
+// An Image belonging to the User with ID 1 will be stored under the key: user/1/unique_name.jpeg.
+// An Image belonging to the Tweet with ID 2 will be stored under the key: tweet/2/unique_name.png.
+// Checksum is the hex encoded sha256 hash of the blob. Position is the Image's place among
+// the images of its owner, starting at 0. Width and Height are measured in pixels. Size is the size
+// of the blob in bytes, StoredSize the size of the blob and its variants together.
+// AltText describes the image for people who can't see it, e.g. users of screen readers.
+// Uploaded images are re-encoded without their metadata, and scaled to the Variants their
+// Purpose needs, which are stored as json in VariantsJSON. Animated GIFs have more than one
+// frame, counted in Frames, and a Duration in milliseconds. Their only variant is a still "poster" frame.
+// URL contains the path the image is served from, starting in ImagesBaseDir.
+// File contains the actual image file that will be stored in the BlobStore.
 type Image struct {
-	URL string `json:"url"`
-	OwnerType string `json:"-"`
-	OwnerID   int `json:"-"`
-	File multipart.File `json:"-"`
-	Filename string `json:"-"`
-	Extension string `json:"-"`
-	ContentType string `json:"-"`
-	Size int64 `json:"-"`
+	ID           int            `json:"id"`
+	OwnerType    string         `json:"-" gorm:"notNull;index:media_owner"`
+	OwnerID      int            `json:"-" gorm:"notNull;index:media_owner"`
+	Key          string         `json:"-" gorm:"notNull;uniqueIndex"`
+	Filename     string         `json:"-" gorm:"notNull"`
+	ContentType  string         `json:"-" gorm:"notNull"`
+	Purpose      string         `json:"-" gorm:"notNull;default:tweet"`
+	Width        int            `json:"width"`
+	Height       int            `json:"height"`
+	Size         int64          `json:"-"`
+	StoredSize   int64          `json:"-"`
+	Checksum     string         `json:"-"`
+	AltText      string         `json:"alt_text"`
+	Frames       int            `json:"frames" gorm:"notNull;default:1"`
+	Duration     int            `json:"duration"`
+	Position     int            `json:"-" gorm:"notNull;default:0"`
+	Variants     []ImageVariant `json:"variants" gorm:"-"`
+	VariantsJSON string         `json:"-"`
+	URL          string         `json:"url" gorm:"-"`
+	File         multipart.File `json:"-" gorm:"-"`
+	Extension    string         `json:"-" gorm:"-"`
+	CreatedAt    time.Time      `json:"created_at"`
+}
+
+// ImageVariantPoster is the name of the variant of an animated image that shows its first frame.
+const ImageVariantPoster = "poster"
+
+// ImageVariant is a scaled version of an Image, stored next to it. Its Name says what it's meant
+// for, e.g. "small" for tweet images in the feed, or "48" for avatars of 48x48 pixels.
+// ContentType is empty for variants in the same format as their image.
+type ImageVariant struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type,omitempty"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// TableName makes gorm store Images in the media table.
+func (Image) TableName() string {
+	return "media"
+}
+
+// MediaReport is the result of a consistency check between the media table and the BlobStore.
+// FilesWithoutRows lists the keys of blobs that no Image describes, RowsWithoutFiles the keys
+// of Images whose blob is missing. If the check was told to fix them, Fixed is true: rows are
+// created for the blobs (unless their key doesn't belong to an owner), and rows without blobs are deleted.
+type MediaReport struct {
+	Files            int      `json:"files"`
+	Rows             int      `json:"rows"`
+	FilesWithoutRows []string `json:"files_without_rows"`
+	RowsWithoutFiles []string `json:"rows_without_files"`
+	Fixed            bool     `json:"fixed"`
 }
 
 // ImageService is a set of methods to manipulate and work with the Image model and respective image files.
+// Open returns the content of a stored image. SignedURL returns a temporary URL to download an image
+// from directly, or an empty string if the app has to serve it itself. UpdateAltText changes nothing
+// but the AltText of an image. Replace creates new images for an owner before deleting its previous
+// ones, so the owner keeps them if any of the new ones is rejected. Owners returns the IDs of
+// the owners of a type that have images. Check compares the media table with the BlobStore, see MediaReport.
 type ImageService interface {
 	Create(image *Image) error
+	Replace(ownerType string, ownerID int, images []*Image) error
+	ByID(id int) (*Image, error)
 	ByOwner(ownerType string, ownerID int) ([]Image, error)
+	Open(i *Image) (io.ReadCloser, error)
+	SignedURL(i *Image) (string, error)
+	UpdateAltText(i *Image) error
 	Delete(i *Image) error
 	DeleteAll(ownerType string, ownerID int) error
+	Owners(ownerType string) ([]int, error)
+	Check(fix bool) (*MediaReport, error)
 }
 
-// Path returns the path of an image stored in the filesystem.
+// Path returns the absolute path an image is served from.
 func (i *Image) Path() string {
 	temp := url.URL{
 		Path: "/" + i.RelativePath(),
@@ -55,7 +159,27 @@ func (i *Image) Path() string {
 	return temp.String()
 }
 
-// RelativePath returns the relative path to an image stored in the filesystem.
+// RelativePath returns the relative path an image is served from, e.g. images/tweet/2/unique_name.png.
 func (i *Image) RelativePath() string {
-	return fmt.Sprintf("%v/%v/%v/%v", ImagesBaseDir, i.OwnerType, i.OwnerID, i.Filename)
+	return ImagesBaseDir + "/" + i.BlobKey()
+}
+
+// VariantFilename returns the filename of one of the image's variants, e.g. unique_name_small.png.
+func (i *Image) VariantFilename(v ImageVariant) string {
+	ext := path.Ext(i.Filename)
+	variantExt := ext
+	if e, ok := ImageContentTypes[v.ContentType]; ok {
+		variantExt = e
+	}
+	return strings.TrimSuffix(i.Filename, ext) + "_" + v.Name + variantExt
+}
+
+// IsAnimated reports whether the image is an animation.
+func (i *Image) IsAnimated() bool {
+	return i.Frames > 1
+}
+
+// BlobKey returns the key an image is stored under in the BlobStore, e.g. tweet/2/unique_name.png.
+func (i *Image) BlobKey() string {
+	return fmt.Sprintf("%v/%v/%v", i.OwnerType, i.OwnerID, i.Filename)
 }
@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	// ImportStatusPending means that the uploaded archive is waiting to be imported, or being imported.
+	ImportStatusPending = "pending"
+	// ImportStatusDone means that the archive has been imported. The report lists what was skipped.
+	ImportStatusDone = "done"
+	// ImportStatusFailed means that the archive could not be imported at all, for example since it's no zip file.
+	ImportStatusFailed = "failed"
+)
+
+const (
+	// ImportsBaseDir determines the storage location of uploaded archives until they are imported.
+	ImportsBaseDir = "imports"
+	// MaxImportSize determines the maximum filesize of an uploaded archive.
+	MaxImportSize int64 = 1 << 30 // 1 Gigabyte
+	// MaxImportDataFileSize determines the maximum size of a data file of an archive, like a part
+	// of tweets.js, once it's unpacked. Data files are read into memory as a whole.
+	MaxImportDataFileSize int64 = 256 << 20 // 256 Megabyte
+	// MaxImportUnpackedSize determines the maximum size of all files of an archive once they're
+	// unpacked, so a small archive can't unpack to more than the server can handle.
+	MaxImportUnpackedSize int64 = 4 << 30 // 4 Gigabyte
+)
+
+// Import represents a user's upload of an official Twitter archive, which is imported in the background.
+// The archive is deleted once it has been imported. Report is stored as json in ReportJSON.
+type Import struct {
+	ID          int           `json:"id"`
+	UserID      int           `json:"user_id" gorm:"notNull;index"`
+	Status      string        `json:"status" gorm:"notNull;default:pending"`
+	Error       string        `json:"error"`
+	Report      *ImportReport `json:"report" gorm:"-"`
+	ReportJSON  string        `json:"-"`
+	CompletedAt *time.Time    `json:"completed_at" gorm:"default:null"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+// ImportedTweet maps a tweet of a Twitter archive (SourceID) to the Tweet it was imported as.
+// Tweets that have been imported before are skipped, so importing an archive twice is harmless.
+type ImportedTweet struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id" gorm:"notNull;uniqueIndex:imported_tweet_user_source"`
+	SourceID  string    `json:"source_id" gorm:"notNull;uniqueIndex:imported_tweet_user_source"`
+	TweetID   int       `json:"tweet_id" gorm:"notNull;index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ImportReport sums up what an import did. Tweets counts all tweets created, Replies and Retweets
+// count those of them that are linked to another imported tweet. Profile lists the profile fields
+// that were filled in. Everything that couldn't be imported is listed in Skipped.
+type ImportReport struct {
+	Tweets          int          `json:"tweets"`
+	Replies         int          `json:"replies"`
+	Retweets        int          `json:"retweets"`
+	Images          int          `json:"images"`
+	AlreadyImported int          `json:"already_imported"`
+	Profile         []string     `json:"profile"`
+	Skipped         []ImportSkip `json:"skipped"`
+}
+
+// ImportSkip is an item of an archive that wasn't imported, and why. Source is the ID of the skipped
+// tweet in the archive, or the path of the skipped file.
+type ImportSkip struct {
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+// ImportService is a set of methods to manipulate and work with the Import model. Uploaded archives
+// are imported one after another by a background worker. Run imports an archive right away, which
+// is what the command line importer does. Close stops the worker after the current import is finished.
+type ImportService interface {
+	LatestByUserID(userId int) (*Import, error)
+
+	Create(imp *Import, archive io.Reader) error
+	Run(userId int, archivePath string) (*ImportReport, error)
+	Close() error
+}
@@ -10,7 +10,7 @@ import (
 type Like struct {
 	ID      int   `json:"id"`
 	UserID  int   `json:"user_id" gorm:"notNull;index"`
-	TweetID int   `json:"tweet_id"`
+	TweetID int   `json:"tweet_id" gorm:"notNull;index"`
 	Tweet   Tweet `json:"tweet"`
 
 	CreatedAt time.Time `json:"created_at"`
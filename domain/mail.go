@@ -0,0 +1,14 @@
+package domain
+
+// Email represents a plain text email sent by the app, for example a password reset link.
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails. The app doesn't care how they're delivered, so the
+// implementation can be swapped depending on the environment (see package mail).
+type Mailer interface {
+	Send(email Email) error
+}
@@ -31,6 +31,8 @@ type OAuth struct {
 
 type OAuthService interface {
 	ByProviderUserId(provider, providerUserId string) (*OAuth, error)
+	ByUserID(userId int) ([]OAuth, error)
 	Create(oauth *OAuth) error
 	Update(oauth *OAuth) error
+	Delete(oauth *OAuth) error
 }
@@ -0,0 +1,183 @@
+package domain
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// AuthorizationCodeLifetime determines how long an app has to exchange an authorization code for tokens.
+	AuthorizationCodeLifetime = 5 * time.Minute
+	// AppAccessTokenLifetime determines how long an access token issued to an app stays valid.
+	AppAccessTokenLifetime = time.Hour
+	// RefreshTokenLifetime determines how long a refresh token issued to an app stays valid.
+	// Every refresh issues a new refresh token, so an app in regular use stays authorized.
+	RefreshTokenLifetime = 30 * 24 * time.Hour
+)
+
+// OAuthClient represents a third-party app that users can sign in to with their account here
+// ("Log in with wtfTwitter"), and that can act on their behalf. This app is the OAuth2
+// authorization server, the OAuthClient is the OAuth2 client.
+// ClientID is the app's public identifier. Confidential apps (those running on a server) also
+// get a secret, which only exists in memory right after the app has been registered. The database
+// only stores its hash, SecretHash. Public apps (mobile and single-page apps) can't keep a secret.
+// RedirectURIs holds the urls, separated by spaces, that users may be sent back to after consenting.
+// OwnerID is the ID of the user who registered the app.
+type OAuthClient struct {
+	ID           int       `json:"id"`
+	ClientID     string    `json:"client_id" gorm:"notNull;uniqueIndex"`
+	Secret       string    `json:"secret" gorm:"-"`
+	SecretHash   string    `json:"secret_hash"`
+	Confidential bool      `json:"confidential" gorm:"notNull"`
+	Name         string    `json:"name" gorm:"notNull"`
+	RedirectURIs string    `json:"redirect_uris" gorm:"notNull"`
+	OwnerID      int       `json:"owner_id" gorm:"notNull;index"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// OAuthGrant represents a user's consent to let an app act on their behalf within the granted scopes.
+// It's created the first time the user consents and extended whenever they consent to more scopes.
+// Revoking it revokes all tokens the app holds for the user.
+type OAuthGrant struct {
+	ID        int          `json:"id"`
+	UserID    int          `json:"user_id" gorm:"notNull;uniqueIndex:oauth_grant_user_client"`
+	ClientID  int          `json:"client_id" gorm:"notNull;uniqueIndex:oauth_grant_user_client"`
+	Client    *OAuthClient `json:"client,omitempty" gorm:"foreignKey:ClientID"`
+	Scope     string       `json:"scope" gorm:"notNull"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// OAuthCode represents an authorization code, which an app exchanges for tokens after the user
+// has consented. The code is bound to the PKCE code challenge sent by the app, so only the app
+// that started the flow can exchange it. It's used once. UsedAt is set when it's exchanged, so a
+// second exchange can be detected.
+type OAuthCode struct {
+	ID            int        `json:"id"`
+	Code          string     `json:"code" gorm:"-"`
+	CodeHash      string     `json:"code_hash" gorm:"notNull;uniqueIndex"`
+	ClientID      int        `json:"client_id" gorm:"notNull;index"`
+	UserID        int        `json:"user_id" gorm:"notNull"`
+	RedirectURI   string     `json:"redirect_uri" gorm:"notNull"`
+	Scope         string     `json:"scope" gorm:"notNull"`
+	CodeChallenge string     `json:"code_challenge" gorm:"notNull"`
+	ExpiresAt     time.Time  `json:"expires_at" gorm:"notNull;index"`
+	UsedAt        *time.Time `json:"used_at" gorm:"default:null"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// OAuthRefreshToken represents a refresh token, which an app exchanges for a new access token.
+// Refresh tokens are rotated: every exchange marks the refresh token as used by setting UsedAt,
+// and issues a new one. A used refresh token being exchanged again means it has been stolen,
+// so all tokens of that app for that user are revoked.
+type OAuthRefreshToken struct {
+	ID        int        `json:"id"`
+	Token     string     `json:"token" gorm:"-"`
+	TokenHash string     `json:"token_hash" gorm:"notNull;uniqueIndex"`
+	ClientID  int        `json:"client_id" gorm:"notNull;index"`
+	UserID    int        `json:"user_id" gorm:"notNull;index"`
+	Scope     string     `json:"scope" gorm:"notNull"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"notNull;index"`
+	UsedAt    *time.Time `json:"used_at" gorm:"default:null"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// AuthorizationRequest holds the parameters an app sends the user to the consent screen with
+// (RFC 6749 §4.1.1 and RFC 7636 §4.3). Only the code challenge method "S256" is supported.
+type AuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// OAuthTokens is the response of the token endpoint (RFC 6749 §5.1).
+type OAuthTokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// TokenIntrospection is the response of the introspection endpoint (RFC 7662 §2.2).
+// Inactive tokens only have Active set to false.
+type TokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// OAuth2 error codes of the token, revocation and introspection endpoints (RFC 6749 §5.2).
+const (
+	OAuth2InvalidRequest       = "invalid_request"
+	OAuth2InvalidClient        = "invalid_client"
+	OAuth2InvalidGrant         = "invalid_grant"
+	OAuth2InvalidScope         = "invalid_scope"
+	OAuth2UnsupportedGrantType = "unsupported_grant_type"
+)
+
+// OAuth2Error is an error of the token, revocation and introspection endpoints. Apps expect those
+// endpoints to respond with the error format of RFC 6749 §5.2, instead of the usual errs.Error.
+type OAuth2Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Error implements the error interface.
+func (e *OAuth2Error) Error() string {
+	return "oauth2 error: " + e.Code + ": " + e.Description
+}
+
+// OAuthServerService is a set of methods of the OAuth2 authorization server.
+// Clients: apps are registered and deleted by their owners. AuthenticateClient checks the
+// credentials an app sends to the token, revocation and introspection endpoints.
+// Authorization: ValidateAuthorization checks the parameters an app sends the user to the consent
+// screen with, CreateCode records the user's consent and issues an authorization code.
+// Tokens: ExchangeCode and Refresh issue tokens, Revoke and Introspect work with access tokens and
+// refresh tokens alike.
+// Grants: users see and revoke the apps they have authorized.
+type OAuthServerService interface {
+	ClientByClientID(clientId string) (*OAuthClient, error)
+	ClientsByOwnerID(ownerId int) ([]OAuthClient, error)
+	CreateClient(client *OAuthClient) error
+	DeleteClient(client *OAuthClient) error
+	AuthenticateClient(clientId, secret string) (*OAuthClient, error)
+
+	ValidateAuthorization(req *AuthorizationRequest) (*OAuthClient, error)
+	CreateCode(userId int, req *AuthorizationRequest) (*OAuthCode, error)
+
+	ExchangeCode(client *OAuthClient, code, redirectUri, codeVerifier string) (*OAuthTokens, error)
+	Refresh(client *OAuthClient, refreshToken, scope string) (*OAuthTokens, error)
+	Revoke(client *OAuthClient, token string) error
+	Introspect(client *OAuthClient, token string) (*TokenIntrospection, error)
+
+	GrantByUserAndClient(userId, clientId int) (*OAuthGrant, error)
+	GrantsByUserID(userId int) ([]OAuthGrant, error)
+	RevokeGrant(userId, clientId int) error
+}
+
+// RedirectURIList returns the app's redirect urls.
+func (c *OAuthClient) RedirectURIList() []string {
+	return strings.Fields(c.RedirectURIs)
+}
+
+// HasRedirectURI reports whether the url is one of the app's redirect urls. Redirect urls are
+// compared exactly, so users can't be sent anywhere else (OAuth 2.1 §4.1.1).
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIList() {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
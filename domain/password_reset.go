@@ -0,0 +1,29 @@
+package domain
+
+import "time"
+
+const (
+	// PasswordResetLifetime determines how long a password reset link stays valid.
+	PasswordResetLifetime = time.Hour
+)
+
+// PasswordReset represents a request of a User to reset their forgotten password.
+// Token is sent to the user's email address as part of a link. Like a session's remember
+// token, it only exists in memory right after creation, the database only stores its hash.
+// A reset can only be redeemed once (UsedAt gets set) and only before it expires.
+type PasswordReset struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id" gorm:"notNull;index"`
+	Token     string     `json:"token" gorm:"-"`
+	TokenHash string     `json:"token_hash" gorm:"notNull;uniqueIndex"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"notNull"`
+	UsedAt    *time.Time `json:"used_at" gorm:"default:null"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// PasswordResetService is a set of methods to manipulate and work with the PasswordReset model.
+type PasswordResetService interface {
+	ByToken(token string) (*PasswordReset, error)
+
+	Create(reset *PasswordReset) error
+}
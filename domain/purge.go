@@ -0,0 +1,13 @@
+package domain
+
+// PurgeService permanently deletes the accounts whose DeactivationGracePeriod has passed,
+// along with everything their users have created. PurgeOrphanedImages deletes the images whose
+// owner is gone, e.g. because a tweet was deleted while its images were being uploaded.
+// PurgeExpiredThrottles deletes the Throttles that neither lock their key nor count failures anymore.
+// It runs periodically in the background, until Close is called.
+type PurgeService interface {
+	PurgeDeactivated() (int, error)
+	PurgeOrphanedImages() (int, error)
+	PurgeExpiredThrottles() (int, error)
+	Close() error
+}
@@ -0,0 +1,39 @@
+package domain
+
+import "time"
+
+const (
+	// SessionLifetime determines how long a session stays valid without being used.
+	// Every use of the session extends its expiry by that duration (sliding expiry).
+	SessionLifetime = 30 * 24 * time.Hour
+)
+
+// Session represents a signed-in device or browser of a User. A user can have any number
+// of sessions, so signing in on one device doesn't sign them out on another.
+// Token is the remember token handed to the client in the remember_token cookie.
+// It only exists in memory right after the session has been created. The database
+// only stores its hash, TokenHash, which is used to look the session up on every request.
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id" gorm:"notNull;index"`
+	Token      string    `json:"token" gorm:"-"`
+	TokenHash  string    `json:"token_hash" gorm:"notNull;uniqueIndex"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at" gorm:"notNull;index"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// SessionService is a set of methods to manipulate and work with the Session model.
+type SessionService interface {
+	ByID(id int) (*Session, error)
+	ByToken(token string) (*Session, error)
+	ByUserID(userId int) ([]Session, error)
+
+	Create(session *Session) error
+	Touch(session *Session) error
+	Delete(session *Session) error
+	DeleteByUserID(userId, exceptId int) error
+}
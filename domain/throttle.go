@@ -0,0 +1,54 @@
+package domain
+
+import "time"
+
+// ThrottlePolicy determines how many failures are tolerated for a throttle key, and how long
+// the key is locked once there are more. Every failure beyond Threshold doubles the lockout,
+// starting at BaseLockout, up to MaxLockout. Failures older than Window are forgotten.
+type ThrottlePolicy struct {
+	Threshold   int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	Window      time.Duration
+}
+
+// Policies for the actions that are protected against brute-force attacks.
+var (
+	// LoginAccountPolicy limits failed logins per account (the submitted email address).
+	LoginAccountPolicy = ThrottlePolicy{Threshold: 5, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour}
+	// LoginIPPolicy limits failed logins per client IP, no matter which accounts they target.
+	LoginIPPolicy = ThrottlePolicy{Threshold: 20, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour}
+	// TwoFactorAccountPolicy limits wrong second factor codes per account, no matter which clients
+	// or login challenges they are submitted with. Each challenge allows only a few attempts, but
+	// whoever knows the password can create new challenges from ever new clients.
+	TwoFactorAccountPolicy = ThrottlePolicy{Threshold: 10, BaseLockout: 5 * time.Minute, MaxLockout: 24 * time.Hour, Window: 24 * time.Hour}
+	// RegisterIPPolicy limits registrations per client IP.
+	RegisterIPPolicy = ThrottlePolicy{Threshold: 10, BaseLockout: 10 * time.Minute, MaxLockout: 24 * time.Hour, Window: 24 * time.Hour}
+	// PasswordResetIPPolicy limits password reset requests and attempts per client IP.
+	PasswordResetIPPolicy = ThrottlePolicy{Threshold: 10, BaseLockout: 10 * time.Minute, MaxLockout: 24 * time.Hour, Window: time.Hour}
+)
+
+// ThrottleRetention is how long a Throttle is kept after its last failure, unless its key is still
+// locked. It must not be shorter than the Window of any policy, or failures would be forgotten early.
+const ThrottleRetention = 24 * time.Hour
+
+// Throttle records the recent failures for a key, like "login:ip:203.0.113.7", and whether
+// the key is locked. While a key is locked, the action it protects is refused.
+type Throttle struct {
+	ID            int        `json:"id"`
+	Key           string     `json:"key" gorm:"notNull;uniqueIndex"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until" gorm:"default:null;index"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// ThrottleService is a set of methods to manipulate and work with the Throttle model.
+// Check returns an errs.ETOOMANY if any of the keys is locked. Hit records a failure
+// for a key and locks it if the policy says so. Reset forgets a key's failures.
+type ThrottleService interface {
+	Check(keys ...string) error
+	Hit(key string, policy ThrottlePolicy) error
+	Reset(key string) error
+}
@@ -5,6 +5,34 @@ import (
 	"time"
 )
 
+const (
+	// ReplyPolicyEveryone allows everyone to reply to a Tweet. It's the default.
+	ReplyPolicyEveryone = "everyone"
+	// ReplyPolicyFollowing allows only users followed by the Tweet's author to reply.
+	ReplyPolicyFollowing = "following"
+	// ReplyPolicyMentioned allows only users mentioned in the Tweet's content to reply.
+	ReplyPolicyMentioned = "mentioned"
+)
+
+const (
+	// ContentWarningSensitive is the generic label for sensitive media. It's the default.
+	ContentWarningSensitive = "sensitive"
+	// ContentWarningNudity labels media containing nudity.
+	ContentWarningNudity = "nudity"
+	// ContentWarningViolence labels media containing violence.
+	ContentWarningViolence = "violence"
+)
+
+const (
+	// MediaShow means that sensitive media is displayed like any other media.
+	MediaShow = "show"
+	// MediaBlur means that sensitive media is blurred until the viewer decides to look at it.
+	// It's the default. Blurring is done by the frontend, the images are still returned.
+	MediaBlur = "blur"
+	// MediaHide means that sensitive media is not displayed at all. Its images are not returned.
+	MediaHide = "hide"
+)
+
 // Tweet represents a tweet. It always has a one-to-many relationship with
 // the User who created it. It can also have the following relationships:
 // - A many-to-many rel. with Likes (which in a sense is a "pivot" to users).
@@ -12,7 +40,8 @@ import (
 // if the Tweet gets retweeted or replied to, or if the Tweet itself is a reply
 // or a retweet of an existing tweet. In that case the rel. is determined by
 // the RepliesToID / RetweetsID, which hold the ID of the existing "parent" tweet.
-// If both are null, the Tweet is an "original" Tweet (neither a reply nor a retweet).
+// If both are null, the Tweet is an "original" Tweet (neither a reply nor a retweet),
+// unless ReplyToDeleted is set: then it's a reply whose parent was purged with its author.
 // Originals can have both Replies and Retweets. Same goes for Replies. Retweets can
 // have none. If a Retweet gets Replies or Retweets, those will reference the "parent"
 // of the Retweet.
@@ -27,13 +56,20 @@ type Tweet struct {
 	User    User   `json:"user"`
 	Content string `json:"content"`
 
-	RepliesToID  *int    `json:"replies_to_id,omitempty" gorm:"default:null"`
-	RepliesTo    *Tweet  `json:"replies_to,omitempty" gorm:"foreignKey:RepliesToID;references:ID"`
-	Replies      []Tweet `json:"replies" gorm:"foreignKey:RepliesToID"`
-	RepliesCount int     `json:"replies_count" gorm:"-"`
-	AuthReplied  bool    `json:"auth_replied" gorm:"-"`
+	RepliesToID    *int    `json:"replies_to_id,omitempty" gorm:"default:null"`
+	RepliesTo      *Tweet  `json:"replies_to,omitempty" gorm:"foreignKey:RepliesToID;references:ID"`
+	Replies        []Tweet `json:"replies" gorm:"foreignKey:RepliesToID"`
+	RepliesCount   int     `json:"replies_count" gorm:"-"`
+	AuthReplied    bool    `json:"auth_replied" gorm:"-"`
+	ReplyToDeleted bool    `json:"reply_to_deleted" gorm:"notNull;default:false"`
 
-	RetweetsID    *int    `json:"retweets_id,omitempty" gorm:"default:null"`
+	// ReplyPolicy determines who is allowed to reply to the Tweet. See the ReplyPolicy
+	// constants above. ReplyHidden is set on a reply if the author of the replied-to
+	// tweet decided to hide it. Hidden replies are not listed with the other replies.
+	ReplyPolicy string `json:"reply_policy" gorm:"notNull;default:everyone"`
+	ReplyHidden bool   `json:"reply_hidden" gorm:"notNull;default:false"`
+
+	RetweetsID    *int    `json:"retweets_id,omitempty" gorm:"default:null;index"`
 	RetweetsTweet *Tweet  `json:"retweets_tweet,omitempty" gorm:"foreignKey:RetweetsID;references:ID"`
 	Retweets      []Tweet `json:"retweets" gorm:"foreignKey:RetweetsID"`
 	RetweetsCount int     `json:"retweets_count" gorm:"-"`
@@ -45,6 +81,14 @@ type Tweet struct {
 
 	Images []Image `json:"images" gorm:"-"`
 
+	// Sensitive is set if the author marked the Tweet's media as sensitive. ContentWarning is
+	// the label displayed along with it, see the ContentWarning constants above.
+	// MediaVisibility tells the frontend how to display the media to the requesting user,
+	// according to their SensitiveMedia setting. See the Media constants above.
+	Sensitive       bool   `json:"sensitive" gorm:"notNull;default:false"`
+	ContentWarning  string `json:"content_warning"`
+	MediaVisibility string `json:"media_visibility" gorm:"-"`
+
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `json:"deleted_at" gorm:"index"`
@@ -53,12 +97,15 @@ type Tweet struct {
 // TweetService is a set of methods to manipulate and work with the Tweet model.
 type TweetService interface {
 	ByID(id int) (*Tweet, error)
+	HiddenRepliesByID(id int) ([]Tweet, error)
 	ByUserID(userId, offset int) ([]Tweet, error)
+	PinnedByUserID(userId int) (*Tweet, error)
 
 	GetFeed(offset int) ([]Tweet, error)
 	OriginalsByUserID(userId, offset int) ([]Tweet, error)
 	ImageTweetsByUserID(userId, offset int) ([]Tweet, error)
 	LikedTweetsByUserID(userId, offset int) ([]Tweet, error)
+	SearchByAltText(searchTerm string, offset int) ([]Tweet, error)
 
 	CountReplies(id int) (int, error)
 	CountRetweets(id int) (int, error)
@@ -69,5 +116,7 @@ type TweetService interface {
 	GetAuthLike(authUserId, tweetId int) (*Like, error)
 
 	Create(tweet *Tweet) error
+	SetReplyHidden(reply *Tweet, hidden bool) error
+	SetSensitive(tweet *Tweet) error
 	Delete(tweet *Tweet) error
 }
@@ -0,0 +1,72 @@
+package domain
+
+import "time"
+
+const (
+	// RecoveryCodeCount is the number of recovery codes generated for a user at once.
+	RecoveryCodeCount = 10
+	// LoginChallengeLifetime determines how long a user has to enter their second factor
+	// after they've entered the correct password.
+	LoginChallengeLifetime = 5 * time.Minute
+	// LoginChallengeMaxAttempts is the number of wrong codes after which a challenge is void.
+	LoginChallengeMaxAttempts = 5
+)
+
+// TwoFactor represents the TOTP (RFC 6238) second factor of a User. Secret only exists
+// in memory, the database stores it encrypted. Until the user has confirmed enrollment
+// with a first valid code, ConfirmedAt is nil and the second factor isn't required.
+// LastUsedStep holds the time step of the last accepted code, so a code can't be replayed.
+type TwoFactor struct {
+	ID              int        `json:"id"`
+	UserID          int        `json:"user_id" gorm:"notNull;uniqueIndex"`
+	Secret          string     `json:"secret" gorm:"-"`
+	SecretEncrypted string     `json:"secret_encrypted" gorm:"notNull"`
+	LastUsedStep    int64      `json:"last_used_step"`
+	ConfirmedAt     *time.Time `json:"confirmed_at" gorm:"default:null"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// Enabled reports whether the second factor is required when the user signs in.
+func (tf *TwoFactor) Enabled() bool {
+	return tf != nil && tf.ConfirmedAt != nil
+}
+
+// RecoveryCode is a one-time code a User can sign in with instead of a TOTP code,
+// if they've lost access to their authenticator. Only the code's hash is stored.
+type RecoveryCode struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id" gorm:"notNull;index"`
+	CodeHash  string     `json:"code_hash" gorm:"notNull"`
+	UsedAt    *time.Time `json:"used_at" gorm:"default:null"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// LoginChallenge is created when a user with two-factor authentication enabled has entered
+// the correct password. They are only signed in once they complete the challenge with a
+// valid code. Token is handed to the client, the database only stores its hash.
+type LoginChallenge struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id" gorm:"notNull;index"`
+	Token     string    `json:"token" gorm:"-"`
+	TokenHash string    `json:"token_hash" gorm:"notNull;uniqueIndex"`
+	Attempts  int       `json:"attempts"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"notNull"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TwoFactorService is a set of methods to manipulate and work with the TwoFactor, RecoveryCode
+// and LoginChallenge models. Codes passed to it are either 6-digit TOTP codes or recovery codes.
+type TwoFactorService interface {
+	ByUserID(userId int) (*TwoFactor, error)
+	Enroll(user *User) (*TwoFactor, string, error)
+	Confirm(userId int, code string) ([]string, error)
+	Verify(userId int, code string) error
+	RegenerateRecoveryCodes(userId int) ([]string, error)
+	CountRecoveryCodes(userId int) (int, error)
+	Disable(userId int) error
+
+	CreateChallenge(userId int) (*LoginChallenge, error)
+	ChallengeByToken(token string) (*LoginChallenge, error)
+	CompleteChallenge(challenge *LoginChallenge, code string) error
+}
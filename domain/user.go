@@ -5,6 +5,18 @@ import (
 	"time"
 )
 
+const (
+	// EmailVerificationLifetime determines how long the link in a verification email stays valid.
+	EmailVerificationLifetime = 48 * time.Hour
+	// EmailChangeLifetime determines how long the link confirming a new email address stays valid.
+	EmailChangeLifetime = 24 * time.Hour
+	// UnverifiedGracePeriod determines how long a user can tweet without having verified their email address.
+	UnverifiedGracePeriod = 7 * 24 * time.Hour
+	// DeactivationGracePeriod determines how long a deactivated account can be restored by signing
+	// in again. After that, it's purged along with everything the user has created.
+	DeactivationGracePeriod = 30 * 24 * time.Hour
+)
+
 // User represents a user account. It stores an email address and a password,
 // so people can log in and access their content.
 // It can have the following relationships:
@@ -26,10 +38,27 @@ type User struct {
 	Header     string  `json:"header"`
 	AuthFollow *Follow `json:"auth_follow,omitempty" gorm:"foreignKey:FollowedID;references:ID"`
 
+	// PinnedTweetID holds the ID of one of the user's original tweets, which is displayed
+	// at the top of their profile. PinnedTweet is not a database relation, it's loaded
+	// separately whenever the profile or the user's original tweets are requested.
+	PinnedTweetID *int   `json:"pinned_tweet_id" gorm:"default:null"`
+	PinnedTweet   *Tweet `json:"pinned_tweet,omitempty" gorm:"-"`
+
+	// EmailVerifiedAt is set once the user has followed the link in the verification email.
+	// PendingEmail holds a new email address the user wants to switch to. Email is only
+	// replaced by it once the user has confirmed it through the link sent to that address.
+	EmailVerifiedAt *time.Time `json:"email_verified_at" gorm:"default:null"`
+	PendingEmail    string     `json:"pending_email"`
+
+	// SensitiveMedia determines how tweet media marked as sensitive is displayed to the user.
+	// It's one of MediaShow, MediaBlur (the default) or MediaHide.
+	SensitiveMedia string `json:"sensitive_media" gorm:"notNull;default:blur"`
+
+	// RequireAltText keeps the user from attaching images to their tweets without alt text.
+	RequireAltText bool `json:"require_alt_text" gorm:"notNull;default:false"`
+
 	Password     string `json:"password" gorm:"-"`
 	PasswordHash string `json:"password_hash"`
-	Remember     string `json:"remember" gorm:"-"`
-	RememberHash string `json:"remember_hash" gorm:"notNull;uniqueIndex"`
 
 	// If NoPasswordNeeded ist true on a User object, the database record
 	// can be created / updated without a password or password hash.
@@ -53,7 +82,8 @@ type User struct {
 // UserService is a set of methods to manipulate and work with the User model.
 // It also contains the bulk of the authentication system. Specifically it contains
 // that part of the auth-system that needs to interact with the database (hashing
-// and storing remember tokens and passwords, updating those values etc.).
+// and storing passwords, updating those values etc.). Remember tokens are managed
+// by the SessionService.
 // It does not contain the part of the auth-system that handles cookies, middleware
 // redirects etc. - this is done by auth.go in the http package.
 // Errors returned by UserService are usually errs.EINVALID or errs.ENOTFOUND and contain
@@ -61,12 +91,14 @@ type User struct {
 // just displaying code 500 with no message.
 type UserService interface {
 	Authenticate(email, password string) (*User, error)
-	MakeRememberToken() (string, error)
 	ByID(id int) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
+	ByIDForSignIn(id int) (*User, error)
+	ByEmailForSignIn(email string) (*User, error)
 
 	Search(searchTerm string) []User
+	LikersByTweetID(tweetId, offset int) ([]User, error)
+	RetweetersByTweetID(tweetId, offset int) ([]User, error)
 	CountTweets(userId int) (int, error)
 	CountFollowers(userId int) (int, error)
 	CountFolloweds(userId int) (int, error)
@@ -74,4 +106,25 @@ type UserService interface {
 
 	Create(user *User) error
 	Update(user *User) error
+	ChangePassword(user *User, currentPassword, newPassword string) error
+	ResetPassword(user *User, newPassword string) error
+	RedeemPasswordReset(user *User, reset *PasswordReset, newPassword string) error
+	Deactivate(user *User, password string) error
+	Restore(user *User) error
+
+	MakeEmailVerificationToken(user *User) (string, error)
+	VerifyEmail(token string) (*User, error)
+	UpdateProfile(user *User, email *string) (string, error)
+	ConfirmEmailChange(token string) (*User, error)
+}
+
+// IsVerified reports whether the user has verified their email address.
+func (u *User) IsVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// IsDeactivated reports whether the user has deactivated their account. Deactivated accounts
+// are soft-deleted, so they're only ever loaded by the lookups used for signing in.
+func (u *User) IsDeactivated() bool {
+	return u.DeletedAt.Valid
 }
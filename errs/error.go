@@ -17,6 +17,7 @@ const (
 	EINVALID      = "invalid"
 	ENOTFOUND     = "not_found"
 	EUNAUTHORIZED = "unauthorized"
+	ETOOMANY      = "too_many_requests"
 )
 
 // Mapping of error codes to HTTP status codes.
@@ -25,6 +26,7 @@ var codes = map[string]int{
 	EINVALID:      http.StatusBadRequest,
 	ENOTFOUND:     http.StatusNotFound,
 	EUNAUTHORIZED: http.StatusUnauthorized,
+	ETOOMANY:      http.StatusTooManyRequests,
 	EINTERNAL:     http.StatusInternalServerError,
 }
 
@@ -125,11 +127,11 @@ const (
 	// ProviderUserIdRequired is returned if the oauth provider did not return id of the user
 	// in their system, after the user granted account access.
 	ProviderUserIdRequired privateError = "OAUTH: the id of the user in the provider's system is required."
-	// RememberHashEmpty is returned when a user-create or -update is attempted without a remember token hash.
-	RememberHashEmpty privateError = "AUTH: the user's remember hash is an empty string."
+	// RememberHashEmpty is returned when a session-create is attempted without a remember token hash.
+	RememberHashEmpty privateError = "AUTH: the session's remember hash is an empty string."
 	// RememberTooShort is returned when a remember token is shorter than 32 bytes.
-	RememberTooShort privateError = "AUTH: the user's remember token must be at least 32 bytes."
-	// NoOAuthOrPassword is returned when a user has neither a password nor an oauth record.
+	RememberTooShort privateError = "AUTH: the session's remember token must be at least 32 bytes."
+	// NoOAuthOrPassword is returned when a user has neither a password nor an oauth record or passkey.
 	NoOAuthOrPassword privateError = "AUTH: the user has no password and not oauth record."
 )
 
@@ -1,12 +1,13 @@
 module wtfTwitter
 
-go 1.17
+go 1.18
 
 require (
 	github.com/google/go-github/v32 v32.1.0
 	github.com/gorilla/csrf v1.7.1
 	github.com/gorilla/mux v1.8.0
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/image v0.18.0
 	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
 	gorm.io/driver/postgres v1.2.3
 	gorm.io/gorm v1.22.4
@@ -28,7 +29,7 @@ require (
 	github.com/jinzhu/now v1.1.3 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
-	golang.org/x/text v0.3.7 // indirect
+	golang.org/x/text v0.16.0 // indirect
 	google.golang.org/appengine v1.6.6 // indirect
 	google.golang.org/protobuf v1.25.0 // indirect
 )
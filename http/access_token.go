@@ -0,0 +1,110 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// registerAccessTokenRoutes is a helper for registering all routes of personal access tokens.
+// Access tokens can't be managed with an access token, so all routes use requireAuth.
+func (s *Server) registerAccessTokenRoutes(r *mux.Router) {
+	// Get the authed user's access tokens.
+	r.HandleFunc("/account/tokens", s.requireAuth(s.handleGetAccessTokens)).Methods("GET")
+
+	// Create a new access token for the authed user.
+	r.HandleFunc("/account/tokens", s.requireAuth(s.handleCreateAccessToken)).Methods("POST")
+
+	// Revoke one of the authed user's access tokens.
+	r.HandleFunc("/account/tokens/{id:[0-9]+}", s.requireAuth(s.handleDeleteAccessToken)).Methods("DELETE")
+}
+
+// handleGetAccessTokens handles the route "GET /account/tokens".
+func (s *Server) handleGetAccessTokens(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+	accessTokens, err := s.at.ByUserID(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newAccessTokenViews(accessTokens)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleCreateAccessToken handles the route "POST /account/tokens".
+// It returns the new access token including the token itself, which is never shown again.
+// If expires_in_days is 0, the token never expires.
+func (s *Server) handleCreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body.
+	var body struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+	if body.ExpiresInDays < 0 || body.ExpiresInDays > 366 {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Access tokens can expire in one year at most."))
+		return
+	}
+
+	// Create the access token.
+	user := s.getUserFromContext(r.Context())
+	accessToken := domain.AccessToken{
+		UserID: user.ID,
+		Name:   body.Name,
+		Scope:  strings.Join(body.Scopes, " "),
+	}
+	if body.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, body.ExpiresInDays)
+		accessToken.ExpiresAt = &expiresAt
+	}
+	if err := s.at.Create(&accessToken); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(newAccessTokenView(&accessToken)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleDeleteAccessToken handles the route "DELETE /account/tokens/{id}".
+func (s *Server) handleDeleteAccessToken(w http.ResponseWriter, r *http.Request) {
+	// Fetch the access token and make sure it belongs to the authed user.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+	accessToken, err := s.at.ByID(id)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	user := s.getUserFromContext(r.Context())
+	if accessToken.UserID != user.ID || accessToken.ClientID != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.ENOTFOUND, "The access token does not exist."))
+		return
+	}
+
+	// Delete it.
+	if err := s.at.Delete(accessToken); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"net/http"
+	"wtfTwitter/errs"
+)
+
+// registerAccountRoutes is a helper for registering the routes managing the authed user's account itself.
+func (s *Server) registerAccountRoutes(r *mux.Router) {
+	// Deactivate the authed user's account. Signing in again within the grace period restores it.
+	r.HandleFunc("/account/deactivate", s.requireAuth(s.handleDeactivateAccount)).Methods("POST")
+}
+
+// handleDeactivateAccount handles the route "POST /account/deactivate".
+// It checks the authed user's password, hides their profile and tweets, and signs them out everywhere.
+// Unless they sign in again within domain.DeactivationGracePeriod, their account is purged for good.
+func (s *Server) handleDeactivateAccount(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body.
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Deactivate the authed user's account. This deletes all of their sessions.
+	user := s.getUserFromContext(r.Context())
+	if err := s.us.Deactivate(user, body.Password); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Invalidate the client's cookie and regenerate its CSRF token, like logging out does.
+	s.clearRememberCookie(w)
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,180 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+const (
+	// analyticsDefaultDays is the period covered by analytics reports if none is requested.
+	analyticsDefaultDays = 28
+	// analyticsMaxDays is the longest period that an analytics report can cover.
+	analyticsMaxDays = 90
+)
+
+// registerAnalyticsRoutes is a helper for registering all analytics routes.
+func (s *Server) registerAnalyticsRoutes(r *mux.Router) {
+	// Get the analytics report of one of the authed user's tweets.
+	r.HandleFunc("/tweet/{id:[0-9]+}/analytics", s.requireScope(domain.ScopeRead, s.handleGetTweetAnalytics)).Methods("GET")
+
+	// Record a click on a tweet. The event is either "profile_click" or "link_click".
+	r.HandleFunc("/tweet/{id:[0-9]+}/analytics/{event}", s.requireScope(domain.ScopeTweetsWrite, s.handleRecordTweetEvent)).Methods("POST")
+
+	// Get the analytics summary of the authed user's account.
+	r.HandleFunc("/profile/{user_id:[0-9]+}/analytics", s.requireScope(domain.ScopeRead, s.handleGetAccountAnalytics)).Methods("GET")
+}
+
+// handleGetTweetAnalytics handles the route "GET /tweet/:id/analytics".
+// It returns the impressions, clicks and engagements of the tweet over time.
+// Only the author of the tweet is allowed to see them. The optional query parameter
+// "days" determines how many days the report covers.
+func (s *Server) handleGetTweetAnalytics(w http.ResponseWriter, r *http.Request) {
+	// Parse the tweet ID from the url.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Parse the period of the report from the url query.
+	since, err := querySince(r)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Fetch the tweet from the database.
+	tweet, err := s.ts.ByID(id)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Check if the tweet belongs to the authed user.
+	user := s.getUserFromContext(r.Context())
+	if tweet.UserID != user.ID {
+		errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "You are not allowed to see the analytics of this tweet."))
+		return
+	}
+
+	// Build the report.
+	report, err := s.as.ByTweetID(tweet.ID, since)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return the report.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleRecordTweetEvent handles the route "POST /tweet/:id/analytics/:event".
+// The frontend calls it when someone clicks on the author's profile or on a link in a tweet.
+// The event is recorded asynchronously, so the response doesn't wait for the database.
+func (s *Server) handleRecordTweetEvent(w http.ResponseWriter, r *http.Request) {
+	// Parse the tweet ID from the url.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Fetch the tweet from the database.
+	tweet, err := s.ts.ByID(id)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Record the event (includes validation of the event type). Repeated clicks of the
+	// authed user on the tweet are only counted once in a while.
+	authedUser := s.getUserFromContext(r.Context())
+	if err = s.as.RecordEvent(authedUser.ID, tweet, mux.Vars(r)["event"]); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return Http Status 202, since the event will be written to the database later.
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleGetAccountAnalytics handles the route "GET /profile/:user_id/analytics".
+// It returns the impressions, clicks and engagements of all tweets of the user over time.
+// Only the owner of the profile is allowed to see them. The optional query parameter
+// "days" determines how many days the report covers.
+func (s *Server) handleGetAccountAnalytics(w http.ResponseWriter, r *http.Request) {
+	// Parse the User ID from the url.
+	userId, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if userId <= 0 || err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Check if the profile belongs to the authed user.
+	user := s.getUserFromContext(r.Context())
+	if user.ID != userId {
+		errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "You are not allowed to see the analytics of this account."))
+		return
+	}
+
+	// Parse the period of the report from the url query.
+	since, err := querySince(r)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Build the report.
+	report, err := s.as.ByUserID(user.ID, since)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return the report.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// RecordTweetImpressions takes the ID of the authenticated user and any number of tweets that
+// are about to be served to them, and records an impression for each of them. For retweets,
+// the impression is recorded for the retweeted tweet, since that's the content being displayed.
+// Users viewing their own tweets don't count.
+func (s *Server) RecordTweetImpressions(authUserId int, tweets ...*domain.Tweet) {
+	seen := make([]*domain.Tweet, 0, len(tweets))
+	for _, tweet := range tweets {
+		if tweet.RetweetsTweet != nil {
+			tweet = tweet.RetweetsTweet
+		}
+		if tweet.UserID != authUserId {
+			seen = append(seen, tweet)
+		}
+	}
+	s.as.RecordImpressions(seen...)
+}
+
+// querySince parses the optional "days" query parameter of analytics reports
+// and returns the point in time that the report starts at.
+func querySince(r *http.Request) (time.Time, error) {
+	days := analyticsDefaultDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		var err error
+		days, err = strconv.Atoi(value)
+		if err != nil || days <= 0 || days > analyticsMaxDays {
+			return time.Time{}, errs.Errorf(errs.EINVALID, "Invalid days value, must be between 1 and %d.", analyticsMaxDays)
+		}
+	}
+	return time.Now().UTC().Truncate(time.Hour).AddDate(0, 0, -days), nil
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 	"wtfTwitter/domain"
 	"wtfTwitter/errs"
@@ -14,6 +17,13 @@ import (
 // ctxUserKey is the key that allows to retrieve the authed user from the request's context.
 const ctxUserKey = "user"
 
+// ctxSessionKey is the key that allows to retrieve the authed user's current session from the request's context.
+const ctxSessionKey = "session"
+
+// ctxAccessTokenKey is the key that allows to retrieve the access token a request has been
+// authenticated with from the request's context. It's only set for requests sent by scripts and bots.
+const ctxAccessTokenKey = "access_token"
+
 // registerAuthRoutes is a helper for registering all authentication routes.
 func (s *Server) registerAuthRoutes(r *mux.Router) {
 	// Get a new CSRF-Token.
@@ -32,7 +42,7 @@ func (s *Server) registerAuthRoutes(r *mux.Router) {
 	r.HandleFunc("/logout", s.requireAuth(s.handleLogout)).Methods("POST")
 
 	// Get basic data of the authenticated user.
-	r.HandleFunc("/user", s.requireAuth(s.handleUserInfo)).Methods("GET")
+	r.HandleFunc("/user", s.requireScope(domain.ScopeRead, s.handleUserInfo)).Methods("GET")
 }
 
 // handleIsLoggedIn returns a boolean indicating whether the user making the
@@ -63,12 +73,26 @@ func (s *Server) handleProvideCsrfToken(w http.ResponseWriter, r *http.Request)
 
 // handleRegister creates a new user record in the database and signs the user in.
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
-	// Parse the request's json body into a User object.
-	var user domain.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	// Parse the request's json body into a User object. Only the fields a user fills in when
+	// registering are taken over, so nobody can register without a password or as verified.
+	var body domain.User
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
 		return
 	}
+	user := domain.User{
+		Email:    body.Email,
+		Name:     body.Name,
+		Handle:   body.Handle,
+		Password: body.Password,
+	}
+
+	// Refuse the registration if this client has registered too many accounts recently.
+	registerKey := "register:ip:" + clientIP(r)
+	if err := s.th.Check(registerKey); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
 
 	// Create a new user record in the database.
 	err := s.us.Create(&user)
@@ -77,8 +101,16 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Count the registration against the client.
+	s.throttleHit(r, registerKey, domain.RegisterIPPolicy)
+
+	// Send the new user a link to verify their email address.
+	if err := s.sendVerificationEmail(&user); err != nil {
+		errs.LogError(r, err)
+	}
+
 	// Sign the new user in (through a remember token and a cookie).
-	err = s.signIn(w, r.Context(), &user)
+	err = s.signIn(w, r, &user)
 	if err != nil {
 		errs.ReturnError(w, r, err)
 		return
@@ -86,7 +118,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 
 	// Return the created user.
 	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(&user); err != nil {
+	if err := json.NewEncoder(w).Encode(newMeView(&user)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
@@ -101,56 +133,66 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Authenticate the user.
+	// Refuse the login if the account or the client are locked after too many failed attempts.
+	// The account is identified by the submitted email address, whether it exists or not.
+	accountKey := "login:account:" + strings.ToLower(strings.TrimSpace(user.Email))
+	ipKey := "login:ip:" + clientIP(r)
+	if err := s.th.Check(accountKey, ipKey); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Authenticate the user. Count wrong credentials against the account and the client.
 	authedUser, err := s.us.Authenticate(user.Email, user.Password)
 	if err != nil {
+		if errs.ErrorCode(err) == errs.EINVALID {
+			s.throttleHit(r, accountKey, domain.LoginAccountPolicy)
+			s.throttleHit(r, ipKey, domain.LoginIPPolicy)
+		}
 		errs.ReturnError(w, r, err)
 		return
 	}
 
-	// Sign the user in (through a remember token and a cookie).
-	err = s.signIn(w, r.Context(), authedUser)
+	// If the user has two-factor authentication enabled, the password isn't enough.
+	// Instead of signing them in, return a challenge that must be completed with a code.
+	challenge, err := s.signInOrChallenge(w, r, authedUser)
 	if err != nil {
 		errs.ReturnError(w, r, err)
 		return
 	}
+	if challenge != "" {
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(newTwoFactorChallengeView(challenge)); err != nil {
+			errs.LogError(r, err)
+		}
+		return
+	}
 
-	// Clear the user object's Remember field, so the remember token doesn't show in the json response.
-	authedUser.Remember = ""
+	// The user is signed in, so the account's failures are forgotten.
+	s.resetLoginFailures(r, authedUser)
 
 	// Return the logged-in user.
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(&authedUser); err != nil {
+	if err := json.NewEncoder(w).Encode(newMeView(authedUser)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
 }
 
-// handleLogout logs a user out by updating their remember token and invalidating their cookie.
+// handleLogout logs a user out by deleting their current session and invalidating their cookie.
+// The user's sessions on other devices stay signed in.
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	// Get the authed user from the request's context.
-	user := s.getUserFromContext(r.Context())
+	// Get the authed user's current session from the request's context.
+	session := s.getSessionFromContext(r.Context())
 
-	// Create a new remember token and replace the user's current one with it.
-	token, _ := s.us.MakeRememberToken()
-	user.Remember = token
-
-	// Update the user's record in the database.
-	if err := s.us.Update(user); err != nil {
+	// Delete the session, so its remember token can't be used anymore.
+	if err := s.ss.Delete(session); err != nil {
 		errs.ReturnError(w, r, err)
 		return
 	}
 
-	// Create a new http.Cookie that has an empty remember_token and expires immediately.
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    "",
-		Expires:  time.Now(),
-		HttpOnly: true,
-	}
-
-	// Add the new cookie to the response.
-	http.SetCookie(w, &cookie)
+	// Replace the client's cookie with one that has an empty remember_token and expires immediately.
+	s.clearRememberCookie(w)
 
 	// Regenerate the client's CSRF token (kill the old one).
 	w.Header().Set("X-CSRF-Token", csrf.Token(r))
@@ -168,32 +210,36 @@ func (s *Server) handleUserInfo(w http.ResponseWriter, r *http.Request) {
 
 	// Return the user.
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(&user); err != nil {
+	if err := json.NewEncoder(w).Encode(newMeView(user)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
 }
 
-// signIn signs a given user in through a cookie and a remember token.
-func (s *Server) signIn(w http.ResponseWriter, ctx context.Context, user *domain.User) error {
-	// If the user doesn't have a remember token, create a new one,
-	// assign it to them and update their database record.
-	if user.Remember == "" {
-		token, err := s.us.MakeRememberToken()
-		if err != nil {
-			return err
-		}
-		user.Remember = token
-		err = s.us.Update(user)
-		if err != nil {
-			return err
-		}
+// signIn signs a given user in through a new session and a cookie containing its remember token.
+// Every sign-in creates its own session, so signing in on one device leaves the others signed in.
+// Signing in to a deactivated account restores it.
+func (s *Server) signIn(w http.ResponseWriter, r *http.Request, user *domain.User) error {
+	// Restore the user's account, in case they have deactivated it.
+	if err := s.us.Restore(user); err != nil {
+		return err
+	}
+
+	// Create a new session for the device the request comes from.
+	session := domain.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+	if err := s.ss.Create(&session); err != nil {
+		return err
 	}
 
-	// Create a new http.Cookie containing the user's (updated) remember token.
+	// Create a new http.Cookie containing the session's remember token.
 	cookie := http.Cookie{
 		Name:     "remember_token",
-		Value:    user.Remember,
+		Value:    session.Token,
+		Expires:  session.ExpiresAt,
 		HttpOnly: true,
 		Path:     "/",
 	}
@@ -202,20 +248,92 @@ func (s *Server) signIn(w http.ResponseWriter, ctx context.Context, user *domain
 	// the remember token sent back by their browser.
 	http.SetCookie(w, &cookie)
 
-	// Clear the remember token from the user object in memory for security reasons.
-	// Only the remember token in the cookie and the hashed remember token in the database are left.
-	//user.Remember = ""
-
 	return nil
 }
 
+// signInOrChallenge signs a user in who has proven their identity with a first factor (password
+// or oauth). If the user has two-factor authentication enabled, they are not signed in yet.
+// Instead, a login challenge is created and its token returned, which the client must
+// complete through "POST /login/2fa". Otherwise, the empty string is returned.
+// No challenges are created while the account is locked after too many wrong codes.
+func (s *Server) signInOrChallenge(w http.ResponseWriter, r *http.Request, user *domain.User) (string, error) {
+	tf, err := s.tf.ByUserID(user.ID)
+	if err != nil {
+		return "", err
+	}
+	if tf.Enabled() {
+		if err := s.th.Check(twoFactorAccountKey(user.ID)); err != nil {
+			return "", err
+		}
+		challenge, err := s.tf.CreateChallenge(user.ID)
+		if err != nil {
+			return "", err
+		}
+		return challenge.Token, nil
+	}
+	return "", s.signIn(w, r, user)
+}
+
+// twoFactorAccountKey returns the throttle key that wrong second factor codes of a user count against.
+func twoFactorAccountKey(userId int) string {
+	return "2fa:user:" + strconv.Itoa(userId)
+}
+
+// resetLoginFailures forgets the failed logins of a user who has just been signed in. It's only
+// called once the second factor has been checked too, so a correct password alone doesn't
+// unlock an account that is being brute-forced.
+func (s *Server) resetLoginFailures(r *http.Request, user *domain.User) {
+	for _, key := range []string{"login:account:" + user.Email, twoFactorAccountKey(user.ID)} {
+		if err := s.th.Reset(key); err != nil {
+			errs.LogError(r, err)
+		}
+	}
+}
+
+// throttleHit records a failure for a throttle key. A failure to record it is only logged,
+// since the user's request has failed already for a different reason.
+func (s *Server) throttleHit(r *http.Request, key string, policy domain.ThrottlePolicy) {
+	if err := s.th.Hit(key, policy); err != nil {
+		errs.LogError(r, err)
+	}
+}
+
+// clearRememberCookie replaces the client's remember_token cookie with an empty one that expires immediately.
+func (s *Server) clearRememberCookie(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     "remember_token",
+		Value:    "",
+		Expires:  time.Now(),
+		HttpOnly: true,
+		Path:     "/",
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// clientIP returns the IP address of the client that sent the request. If the server runs
+// behind a reverse proxy, that's the proxy's address, unless the proxy rewrites RemoteAddr.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // The checkUser middleware reads an incoming request's cookie, checks if its remember token
-// matches a user database record, and on success attaches that user to the request context.
+// matches an unexpired session, and on success attaches that session and its user to the request context.
 // Subsequent request handlers can read the current user from the request's context. If the
 // cookie's remember token did not match a user record, the request's context does not change.
 // checkUser always returns the next request handler (usually that's the requireAuth middleware).
+// Requests carrying an access token are handled by checkAccessToken instead.
 func (s *Server) checkUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// If the request carries an access token, ignore its cookies.
+		if token, ok := bearerToken(r); ok {
+			s.checkAccessToken(w, r, next, token)
+			return
+		}
+
 		// Read the request's cookie named remember_token.
 		cookie, err := r.Cookie("remember_token")
 		// If the cookie can't be read / does not exist, return the subsequent request handler.
@@ -224,19 +342,32 @@ func (s *Server) checkUser(next http.Handler) http.Handler {
 			return
 		}
 
-		// Look for a user database record matching the cookie's remember token value.
-		user, err := s.us.ByRemember(cookie.Value)
-		// If such a record does not exist, return the subsequent request handler.
+		// Look for a session matching the cookie's remember token value.
+		session, err := s.ss.ByToken(cookie.Value)
+		// If such a session does not exist or has expired, return the subsequent request handler.
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Look up the session's user.
+		user, err := s.us.ByID(session.UserID)
 		if err != nil {
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		// Extend the session's expiry, since it's being used.
+		if err := s.ss.Touch(session); err != nil {
+			errs.LogError(r, err)
+		}
+
 		// Create a context.Context for the request.
 		ctx := r.Context()
 
-		// Put the found user into the request's context.
+		// Put the found user and their current session into the request's context.
 		ctx = s.setUserInContext(ctx, user)
+		ctx = context.WithValue(ctx, ctxSessionKey, session)
 
 		// Attach the context to the request.
 		r = r.WithContext(ctx)
@@ -246,10 +377,63 @@ func (s *Server) checkUser(next http.Handler) http.Handler {
 	})
 }
 
+// checkAccessToken looks for an unexpired access token matching the one the request carries,
+// and on success attaches that access token and its user to the request context. Unlike a
+// missing or expired session, an invalid access token ends the request with an error, since
+// a script or bot sending one wants to be authenticated.
+func (s *Server) checkAccessToken(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	// Look for the access token and its user.
+	accessToken, err := s.at.ByToken(token)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	user, err := s.us.ByID(accessToken.UserID)
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "Invalid access token."))
+		return
+	}
+
+	// Record that the access token is being used.
+	if err := s.at.Touch(accessToken); err != nil {
+		errs.LogError(r, err)
+	}
+
+	// Put the found user and the access token into the request's context.
+	ctx := s.setUserInContext(r.Context(), user)
+	ctx = context.WithValue(ctx, ctxAccessTokenKey, accessToken)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// bearerToken returns the token of the request's "Authorization: Bearer <token>" header, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// The skipCSRF middleware exempts requests carrying an access token from CSRF protection.
+// Browsers never attach an Authorization header on their own, so such a request can't be forged
+// by another site. checkUser makes sure it's only authenticated through its access token.
+// The OAuth2 endpoints called by third-party apps are exempt as well, since they never
+// authenticate a user, only the app. It must run before the CSRF middleware.
+func skipCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); ok || oauth2AppPaths[r.URL.Path] {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // The requireAuth middleware prevents unauthenticated users from accessing things
 // that require authentication. It does that by trying to read the authenticated user
 // from the request's context. If it fails, it redirects to the login page.
 // Otherwise, it returns the subsequent authed-users-only handler.
+// Requests authenticated with an access token are refused, so routes managing the account
+// itself can only be used by signed-in users. Routes open to access tokens use requireScope.
 func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the authed user from the request's context.
@@ -257,6 +441,30 @@ func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 			http.Redirect(w, r, "/api/login", http.StatusUnauthorized)
 			return
 		}
+		// Refuse access tokens.
+		if s.getAccessTokenFromContext(r.Context()) != nil {
+			errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "This can't be done with an access token."))
+			return
+		}
+		// Return the subsequent request handler.
+		next.ServeHTTP(w, r)
+	}
+}
+
+// The requireScope middleware works like requireAuth, but also lets requests through that
+// are authenticated with an access token, if the access token has the scope.
+func (s *Server) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get the authed user from the request's context.
+		if user := s.getUserFromContext(r.Context()); user == nil {
+			http.Redirect(w, r, "/api/login", http.StatusUnauthorized)
+			return
+		}
+		// Check the access token's scopes, if the request carries one.
+		if accessToken := s.getAccessTokenFromContext(r.Context()); accessToken != nil && !accessToken.HasScope(scope) {
+			errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "The access token lacks the scope %q.", scope))
+			return
+		}
 		// Return the subsequent request handler.
 		next.ServeHTTP(w, r)
 	}
@@ -280,3 +488,24 @@ func (s *Server) getUserFromContext(ctx context.Context) *domain.User {
 	}
 	return nil
 }
+
+// getSessionFromContext takes a context, reads the authed user's current session from it, and returns the session.
+func (s *Server) getSessionFromContext(ctx context.Context) *domain.Session {
+	if temp := ctx.Value(ctxSessionKey); temp != nil {
+		if session, ok := temp.(*domain.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
+
+// getAccessTokenFromContext takes a context, reads the access token the request has been
+// authenticated with from it, and returns the access token. It returns nil for signed-in users.
+func (s *Server) getAccessTokenFromContext(ctx context.Context) *domain.AccessToken {
+	if temp := ctx.Value(ctxAccessTokenKey); temp != nil {
+		if accessToken, ok := temp.(*domain.AccessToken); ok {
+			return accessToken
+		}
+	}
+	return nil
+}
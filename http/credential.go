@@ -0,0 +1,214 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// registerCredentialRoutes is a helper for registering all passkey routes.
+func (s *Server) registerCredentialRoutes(r *mux.Router) {
+	// Get the options for registering a new passkey for the authed user.
+	r.HandleFunc("/webauthn/register/begin", s.requireAuth(s.handleBeginPasskeyRegistration)).Methods("POST")
+
+	// Store the new passkey created by the user's authenticator.
+	r.HandleFunc("/webauthn/register/finish", s.requireAuth(s.handleFinishPasskeyRegistration)).Methods("POST")
+
+	// Get the options for signing in with a passkey.
+	r.HandleFunc("/webauthn/login/begin", s.handleBeginPasskeyLogin).Methods("POST")
+
+	// Check the authenticator's signature and sign the user in.
+	r.HandleFunc("/webauthn/login/finish", s.handleFinishPasskeyLogin).Methods("POST")
+
+	// Get the authed user's passkeys.
+	r.HandleFunc("/account/passkeys", s.requireAuth(s.handleGetPasskeys)).Methods("GET")
+
+	// Rename one of the authed user's passkeys.
+	r.HandleFunc("/account/passkeys/{id:[0-9]+}", s.requireAuth(s.handleRenamePasskey)).Methods("PUT")
+
+	// Delete one of the authed user's passkeys.
+	r.HandleFunc("/account/passkeys/{id:[0-9]+}", s.requireAuth(s.handleDeletePasskey)).Methods("DELETE")
+}
+
+// handleBeginPasskeyRegistration handles the route "POST /webauthn/register/begin".
+// It returns the options the client passes to navigator.credentials.create().
+func (s *Server) handleBeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+	options, err := s.cs.BeginRegistration(user)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(options); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleFinishPasskeyRegistration handles the route "POST /webauthn/register/finish".
+// The json body contains an optional name for the passkey and the authenticator's response.
+func (s *Server) handleFinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body.
+	var body struct {
+		Name       string                     `json:"name"`
+		Credential domain.AttestationResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Verify the response and store the passkey.
+	user := s.getUserFromContext(r.Context())
+	credential, err := s.cs.FinishRegistration(user, body.Name, &body.Credential)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return the new passkey.
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(newCredentialView(credential)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleBeginPasskeyLogin handles the route "POST /webauthn/login/begin".
+// It returns the options the client passes to navigator.credentials.get().
+func (s *Server) handleBeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	options, err := s.cs.BeginLogin()
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(options); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleFinishPasskeyLogin handles the route "POST /webauthn/login/finish".
+// It verifies the authenticator's response and signs the passkey's owner in. A passkey
+// proves possession of the authenticator and (usually) the user's PIN or biometrics,
+// so no second factor is asked for.
+func (s *Server) handleFinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body (the authenticator's response).
+	var response domain.AssertionResponse
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Verify the response.
+	credential, err := s.cs.FinishLogin(&response)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Fetch the passkey's owner and sign them in.
+	user, err := s.us.ByIDForSignIn(credential.UserID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	if err := s.signIn(w, r, user); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return the logged-in user.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newMeView(user)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleGetPasskeys handles the route "GET /account/passkeys".
+func (s *Server) handleGetPasskeys(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+	credentials, err := s.cs.ByUserID(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newCredentialViews(credentials)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleRenamePasskey handles the route "PUT /account/passkeys/{id}".
+func (s *Server) handleRenamePasskey(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body (the new name).
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Fetch the passkey and make sure it belongs to the authed user.
+	credential, err := s.getOwnPasskey(r)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Rename it.
+	credential.Name = body.Name
+	if err := s.cs.Update(credential); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newCredentialView(credential)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleDeletePasskey handles the route "DELETE /account/passkeys/{id}".
+func (s *Server) handleDeletePasskey(w http.ResponseWriter, r *http.Request) {
+	// Fetch the passkey and make sure it belongs to the authed user.
+	credential, err := s.getOwnPasskey(r)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Delete it.
+	if err := s.cs.Delete(credential); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// getOwnPasskey fetches the passkey with the ID from the url, if it belongs to the authed user.
+func (s *Server) getOwnPasskey(r *http.Request) (*domain.Credential, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, errs.Errorf(errs.EINVALID, "Invalid Id format.")
+	}
+	credential, err := s.cs.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	user := s.getUserFromContext(r.Context())
+	if credential.UserID != user.ID {
+		return nil, errs.Errorf(errs.EUNAUTHORIZED, "You are not allowed to change this passkey.")
+	}
+	return credential, nil
+}
@@ -0,0 +1,123 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"net/url"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// registerEmailRoutes is a helper for registering all email verification routes.
+func (s *Server) registerEmailRoutes(r *mux.Router) {
+	// Verify a user's email address using the token from a verification email.
+	r.HandleFunc("/account/email/verify", s.handleVerifyEmail).Methods("POST")
+
+	// Send the authed user a new verification email.
+	r.HandleFunc("/account/email/resend", s.requireAuth(s.handleResendVerification)).Methods("POST")
+
+	// Confirm a new email address using the token from a confirmation email.
+	r.HandleFunc("/account/email/confirm", s.handleConfirmEmailChange).Methods("POST")
+}
+
+// handleVerifyEmail handles the route "POST /account/email/verify".
+// It doesn't require the user to be signed in, since the link in the email might be
+// opened in a different browser. The token itself identifies the user.
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body (the token).
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Verify the email address the token was issued for.
+	if _, err := s.us.VerifyEmail(body.Token); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleResendVerification handles the route "POST /account/email/resend".
+func (s *Server) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+	if err := s.sendVerificationEmail(user); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleConfirmEmailChange handles the route "POST /account/email/confirm".
+// It switches the user's email address to their pending one. Like handleVerifyEmail,
+// it doesn't require the user to be signed in.
+func (s *Server) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body (the token).
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Replace the user's email address with the confirmed one.
+	if _, err := s.us.ConfirmEmailChange(body.Token); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// sendVerificationEmail emails the user a link to verify their email address.
+func (s *Server) sendVerificationEmail(user *domain.User) error {
+	token, err := s.us.MakeEmailVerificationToken(user)
+	if err != nil {
+		return err
+	}
+	s.sendEmail(domain.Email{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nplease follow the link below to verify your email address. It's valid for 48 hours.\n\n%s\n",
+			user.Name, s.clientUrl+"/email/verify?token="+url.QueryEscape(token)),
+	})
+	return nil
+}
+
+// sendEmailChangeEmails emails the user's new address a link to confirm it, and notifies
+// the old address, so the owner notices if someone else took over their account.
+func (s *Server) sendEmailChangeEmails(user *domain.User, token string) {
+	s.sendEmail(domain.Email{
+		To:      user.PendingEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\nplease follow the link below to confirm %s as the new email address of your account. "+
+			"It's valid for 24 hours.\n\n%s\n",
+			user.Name, user.PendingEmail, s.clientUrl+"/email/confirm?token="+url.QueryEscape(token)),
+	})
+	s.sendEmail(domain.Email{
+		To:      user.Email,
+		Subject: "Your email address is being changed",
+		Body: fmt.Sprintf("Hi %s,\n\nsomeone requested to change the email address of your account to %s. "+
+			"It will only be changed once the new address has been confirmed.\n\n"+
+			"If that wasn't you, please change your password right away.\n",
+			user.Name, user.PendingEmail),
+	})
+}
+
+// sendEmail sends an email in the background, so requests don't wait for the mail server.
+// Failures are logged, since the response has usually been sent by then.
+func (s *Server) sendEmail(email domain.Email) {
+	go func() {
+		if err := s.mailer.Send(email); err != nil {
+			log.Printf("[mail] error: cannot send %q: %s", email.Subject, err)
+		}
+	}()
+}
@@ -0,0 +1,112 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// registerExportRoutes is a helper for registering all routes of personal data exports.
+func (s *Server) registerExportRoutes(r *mux.Router) {
+	// Get the status of the authed user's latest export.
+	r.HandleFunc("/account/export", s.requireAuth(s.handleGetExport)).Methods("GET")
+
+	// Request an export of the authed user's data.
+	r.HandleFunc("/account/export", s.requireAuth(s.handleCreateExport)).Methods("POST")
+
+	// Download an export's archive through the signed link sent by email.
+	r.HandleFunc("/account/export/download", s.handleDownloadExport).Methods("GET")
+}
+
+// handleGetExport handles the route "GET /account/export".
+func (s *Server) handleGetExport(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+	export, err := s.es.LatestByUserID(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newExportView(export)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleCreateExport handles the route "POST /account/export".
+// The archive is built in the background. Once it's ready, the user gets an email with a download link.
+func (s *Server) handleCreateExport(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+	export := domain.Export{
+		UserID: user.ID,
+	}
+	if err := s.es.Create(&export); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(newExportView(&export)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleDownloadExport handles the route "GET /account/export/download".
+// The signed token in the link is all that's needed, so the archive can be downloaded in any browser.
+func (s *Server) handleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	// Find the export the token belongs to.
+	export, err := s.es.ByToken(r.URL.Query().Get("token"))
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Open its archive.
+	f, err := os.Open(s.es.Path(export))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = errs.Errorf(errs.ENOTFOUND, "The export does not exist anymore.")
+		}
+		errs.ReturnError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	// Serve it as a download.
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", export.Filename))
+	http.ServeContent(w, r, export.Filename, *export.CompletedAt, f)
+}
+
+// notifyExportFinished emails the owner of an export once its archive is ready, or once it has failed.
+// It's called by the export service's background worker. Like the links of the other emails, the download
+// link leads to the client, whose page downloads the archive through "GET /account/export/download".
+func (s *Server) notifyExportFinished(export *domain.Export) {
+	user, err := s.us.ByID(export.UserID)
+	if err != nil {
+		log.Printf("[export] error: cannot notify about export %d: %s", export.ID, err)
+		return
+	}
+	if export.Status != domain.ExportStatusReady {
+		s.sendEmail(domain.Email{
+			To:      user.Email,
+			Subject: "Your data export failed",
+			Body: fmt.Sprintf("Hi %s,\n\nunfortunately, we couldn't export your data. Please try again later.\n",
+				user.Name),
+		})
+		return
+	}
+	s.sendEmail(domain.Email{
+		To:      user.Email,
+		Subject: "Your data export is ready",
+		Body: fmt.Sprintf("Hi %s,\n\nthe export of your data you requested is ready. Please follow the link below "+
+			"to download it. It's valid for 7 days.\n\n%s\n",
+			user.Name, s.clientUrl+"/export/download?token="+url.QueryEscape(export.Token)),
+	})
+}
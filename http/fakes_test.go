@@ -0,0 +1,182 @@
+package http
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"strings"
+	"sync"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// The fakes below stand in for the crud services in handler tests. They embed the service
+// interfaces, so calling a method that a fake doesn't implement panics and fails the test.
+
+// fakeUserService finds users among its users.
+type fakeUserService struct {
+	domain.UserService
+	users []domain.User
+}
+
+func (us *fakeUserService) ByIDForSignIn(id int) (*domain.User, error) {
+	for i := range us.users {
+		if us.users[i].ID == id {
+			return &us.users[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (us *fakeUserService) ByEmailForSignIn(email string) (*domain.User, error) {
+	for i := range us.users {
+		if us.users[i].Email == email {
+			return &us.users[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// Authenticate compares the password with the user's Password field, which holds the plain password.
+func (us *fakeUserService) Authenticate(email, password string) (*domain.User, error) {
+	user, err := us.ByEmailForSignIn(strings.ToLower(strings.TrimSpace(email)))
+	if err != nil || user.Password != password {
+		return nil, errs.Errorf(errs.EINVALID, "Incorrect email address or password.")
+	}
+	return user, nil
+}
+
+func (us *fakeUserService) Restore(user *domain.User) error {
+	return nil
+}
+
+// fakeSessionService creates sessions without storing them.
+type fakeSessionService struct {
+	domain.SessionService
+}
+
+func (ss *fakeSessionService) Create(session *domain.Session) error {
+	session.Token = fmt.Sprintf("session-%d", session.UserID)
+	session.ExpiresAt = time.Now().Add(time.Hour)
+	return nil
+}
+
+// fakeTwoFactorService has two-factor authentication enabled for every user, and accepts
+// code as their only valid code.
+type fakeTwoFactorService struct {
+	domain.TwoFactorService
+	code       string
+	mu         sync.Mutex
+	challenges map[string]*domain.LoginChallenge
+}
+
+func newFakeTwoFactorService(code string) *fakeTwoFactorService {
+	return &fakeTwoFactorService{code: code, challenges: map[string]*domain.LoginChallenge{}}
+}
+
+func (tf *fakeTwoFactorService) ByUserID(userId int) (*domain.TwoFactor, error) {
+	confirmedAt := time.Now()
+	return &domain.TwoFactor{UserID: userId, ConfirmedAt: &confirmedAt}, nil
+}
+
+func (tf *fakeTwoFactorService) CreateChallenge(userId int) (*domain.LoginChallenge, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	challenge := &domain.LoginChallenge{UserID: userId, Token: fmt.Sprintf("challenge-%d", len(tf.challenges))}
+	tf.challenges[challenge.Token] = challenge
+	return challenge, nil
+}
+
+func (tf *fakeTwoFactorService) ChallengeByToken(token string) (*domain.LoginChallenge, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	if challenge, ok := tf.challenges[token]; ok {
+		return challenge, nil
+	}
+	return nil, errs.Errorf(errs.EINVALID, "The sign-in attempt has expired.")
+}
+
+func (tf *fakeTwoFactorService) CompleteChallenge(challenge *domain.LoginChallenge, code string) error {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	if challenge.Attempts >= domain.LoginChallengeMaxAttempts {
+		return errs.Errorf(errs.EINVALID, "The sign-in attempt has expired.")
+	}
+	challenge.Attempts++
+	if code != tf.code {
+		return errs.Errorf(errs.EINVALID, "The code is incorrect.")
+	}
+	delete(tf.challenges, challenge.Token)
+	return nil
+}
+
+// fakeThrottleService locks a key once its failures exceed the policy's threshold, and keeps
+// it locked until it's reset.
+type fakeThrottleService struct {
+	mu       sync.Mutex
+	failures map[string]int
+	locked   map[string]bool
+}
+
+func newFakeThrottleService() *fakeThrottleService {
+	return &fakeThrottleService{failures: map[string]int{}, locked: map[string]bool{}}
+}
+
+// count returns the failures recorded for a key.
+func (th *fakeThrottleService) count(key string) int {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return th.failures[key]
+}
+
+func (th *fakeThrottleService) Check(keys ...string) error {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	for _, key := range keys {
+		if th.locked[key] {
+			return errs.Errorf(errs.ETOOMANY, "Too many attempts.")
+		}
+	}
+	return nil
+}
+
+func (th *fakeThrottleService) Hit(key string, policy domain.ThrottlePolicy) error {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.failures[key]++
+	if th.failures[key] > policy.Threshold {
+		th.locked[key] = true
+	}
+	return nil
+}
+
+func (th *fakeThrottleService) Reset(key string) error {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	delete(th.failures, key)
+	delete(th.locked, key)
+	return nil
+}
+
+// fakePasswordResetService remembers the password resets it has created.
+type fakePasswordResetService struct {
+	domain.PasswordResetService
+	mu      sync.Mutex
+	created []domain.PasswordReset
+}
+
+func (ps *fakePasswordResetService) Create(reset *domain.PasswordReset) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	reset.Token = "reset-token"
+	ps.created = append(ps.created, *reset)
+	return nil
+}
+
+// fakeMailer hands the emails it sends over to a channel.
+type fakeMailer chan domain.Email
+
+func (m fakeMailer) Send(email domain.Email) error {
+	m <- email
+	return nil
+}
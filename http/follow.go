@@ -12,13 +12,13 @@ import (
 // registerFollowRoutes is a helper for registering all Follow routes.
 func (s *Server) registerFollowRoutes(r *mux.Router) {
 	// Get ten users to be suggested to the authed user as potential follows.
-	r.HandleFunc("/follow/suggestions/{user_id:[0-9]+}", s.requireAuth(s.handleGetSuggestions)).Methods("GET")
+	r.HandleFunc("/follow/suggestions/{user_id:[0-9]+}", s.requireScope(domain.ScopeRead, s.handleGetSuggestions)).Methods("GET")
 
 	// Create a new Follow.
-	r.HandleFunc("/follow", s.requireAuth(s.handleCreateFollow)).Methods("POST")
+	r.HandleFunc("/follow", s.requireScope(domain.ScopeFollowsWrite, s.handleCreateFollow)).Methods("POST")
 
 	// Delete an existing Follow.
-	r.HandleFunc("/follow/delete/{id:[0-9]+}", s.requireAuth(s.handleDeleteFollow)).Methods("DELETE")
+	r.HandleFunc("/follow/delete/{id:[0-9]+}", s.requireScope(domain.ScopeFollowsWrite, s.handleDeleteFollow)).Methods("DELETE")
 }
 
 func (s *Server) handleGetSuggestions(w http.ResponseWriter, r *http.Request) {
@@ -30,7 +30,7 @@ func (s *Server) handleGetSuggestions(w http.ResponseWriter, r *http.Request) {
 	}
 	suggestions := s.fs.SuggestFollows(userId)
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(suggestions); err != nil {
+	if err := json.NewEncoder(w).Encode(newUserViews(suggestions)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
@@ -60,7 +60,7 @@ func (s *Server) handleCreateFollow(w http.ResponseWriter, r *http.Request) {
 
 	// Return the created Follow.
 	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(follow); err != nil {
+	if err := json.NewEncoder(w).Encode(newFollowView(&follow)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
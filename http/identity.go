@@ -0,0 +1,60 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"wtfTwitter/errs"
+)
+
+// registerIdentityRoutes is a helper for registering all routes of linked oauth accounts.
+// Linking an account happens through "GET /oauth/{provider}/link", see oauth.go.
+func (s *Server) registerIdentityRoutes(r *mux.Router) {
+	// Get the accounts at oauth providers linked to the authed user.
+	r.HandleFunc("/account/identities", s.requireAuth(s.handleGetIdentities)).Methods("GET")
+
+	// Unlink the authed user's account at a provider.
+	r.HandleFunc("/account/identities/{provider}", s.requireAuth(s.handleUnlinkIdentity)).Methods("DELETE")
+}
+
+// handleGetIdentities handles the route "GET /account/identities".
+func (s *Server) handleGetIdentities(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+	oauths, err := s.os.ByUserID(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newIdentityViews(oauths)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleUnlinkIdentity handles the route "DELETE /account/identities/{provider}".
+// The authed user can't unlink their last way to sign in, if they have no password.
+func (s *Server) handleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	// Find the authed user's oauth record of that provider.
+	user := s.getUserFromContext(r.Context())
+	oauths, err := s.os.ByUserID(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	provider := mux.Vars(r)["provider"]
+	for i := range oauths {
+		if oauths[i].Provider != provider {
+			continue
+		}
+
+		// Delete it.
+		if err := s.os.Delete(&oauths[i]); err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	errs.ReturnError(w, r, errs.Errorf(errs.ENOTFOUND, "No %s account is linked.", provider))
+}
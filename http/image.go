@@ -3,8 +3,12 @@ package http
 import (
 	"encoding/json"
 	"github.com/gorilla/mux"
+	"io"
+	"mime"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
 	"wtfTwitter/domain"
 	"wtfTwitter/errs"
 )
@@ -18,7 +22,10 @@ func (s *Server) registerImageRoutes(r *mux.Router) {
 	r.HandleFunc("/delete/user/{image_type}", s.requireAuth(s.handleDeleteUserImages)).Methods("DELETE")
 
 	// Upload images for an existing tweet.
-	r.HandleFunc("/upload/tweet/{id:[0-9]+}", s.requireAuth(s.handleUploadTweetImages)).Methods("POST")
+	r.HandleFunc("/upload/tweet/{id:[0-9]+}", s.requireScope(domain.ScopeTweetsWrite, s.handleUploadTweetImages)).Methods("POST")
+
+	// Change the alt text of an image of one of the authed user's tweets.
+	r.HandleFunc("/image/{id:[0-9]+}/alt_text", s.requireScope(domain.ScopeTweetsWrite, s.handleUpdateImageAltText)).Methods("PUT")
 }
 
 // handleUploadUserImages handles the route "POST /user/:image_type/upload".
@@ -56,6 +63,7 @@ func (s *Server) handleUploadUserImages(w http.ResponseWriter, r *http.Request)
 	img := &domain.Image{
 		OwnerType: domain.OwnerTypeUser,
 		OwnerID:   user.ID,
+		Purpose:   imgType,
 		File:      image,
 		Filename:  imageHeader.Filename,
 	}
@@ -105,7 +113,7 @@ func (s *Server) handleUploadUserImages(w http.ResponseWriter, r *http.Request)
 
 	// Return the user.
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(&user); err != nil {
+	if err := json.NewEncoder(w).Encode(newMeView(user)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
@@ -164,15 +172,16 @@ func (s *Server) handleDeleteUserImages(w http.ResponseWriter, r *http.Request)
 
 	// Return the user.
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(&user); err != nil {
+	if err := json.NewEncoder(w).Encode(newMeView(user)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
 }
 
 // handleUploadTweetImages handles the route "POST /tweet/images/upload/:id"
-// It reads up to 4 uploaded images for a tweet and stores them on disk.
-// Their storage location determines which tweet they belong to. They are not stored in the database.
+// It reads up to 4 uploaded images for a tweet and stores them, replacing the tweet's previous images.
+// Each image can be described by an "alt_text" form value, sent in the same order as the images.
+// If the authed user requires alt text, images without it are rejected.
 func (s *Server) handleUploadTweetImages(w http.ResponseWriter, r *http.Request) {
 	// Parse the tweet ID from the url.
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
@@ -202,6 +211,19 @@ func (s *Server) handleUploadTweetImages(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Read whether the author marks the tweet's media as sensitive. The optional form values
+	// "sensitive" ("true" or "false") and "content_warning" can be sent along with the images.
+	// They are only saved once the images have been stored, so a rejected upload changes nothing.
+	setSensitive := r.FormValue("sensitive") != ""
+	if setSensitive {
+		tweet.Sensitive, err = strconv.ParseBool(r.FormValue("sensitive"))
+		if err != nil {
+			errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid sensitive value."))
+			return
+		}
+		tweet.ContentWarning = r.FormValue("content_warning")
+	}
+
 	// Check if the image count is max 4.
 	files := r.MultipartForm.File["images"]
 	if len(files) > 4 {
@@ -209,18 +231,25 @@ func (s *Server) handleUploadTweetImages(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Delete all existing images of the tweet. Not necessary if the API call comes from
-	// the frontend app, since the GUI won't allow users to update existing tweets.
-	// It's to prevent potential non-GUI API calls from uploading infinite images.
-	err = s.is.DeleteAll(domain.OwnerTypeTweet, tweet.ID)
-	if err != nil {
-		errs.ReturnError(w, r, err)
+	// Match the alt texts with the images.
+	altTexts := r.MultipartForm.Value["alt_text"]
+	if len(altTexts) > len(files) {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "More alt texts than images."))
 		return
 	}
+	altTexts = append(altTexts, make([]string, len(files)-len(altTexts))...)
+	if user.RequireAltText {
+		for i, altText := range altTexts {
+			if strings.TrimSpace(altText) == "" {
+				errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Image %s has no alt text.", files[i].Filename))
+				return
+			}
+		}
+	}
 
-	// Process the images.
-	for _, fileHeader := range files {
-		// Open the image.
+	// Open the images.
+	images := make([]*domain.Image, len(files))
+	for i, fileHeader := range files {
 		file, err := fileHeader.Open()
 		if err != nil {
 			errs.ReturnError(w, r, err)
@@ -228,31 +257,164 @@ func (s *Server) handleUploadTweetImages(w http.ResponseWriter, r *http.Request)
 		}
 		defer file.Close()
 		// Parse it into an Image object.
-		img := &domain.Image{
-			OwnerType: domain.OwnerTypeTweet,
-			OwnerID:   id,
-			File:      file,
-			Filename:  fileHeader.Filename,
+		images[i] = &domain.Image{
+			Purpose:  domain.ImagePurposeTweet,
+			File:     file,
+			Filename: fileHeader.Filename,
+			AltText:  altTexts[i],
 		}
-		// Save the image to disk (includes validation / normalization).
-		err = s.is.Create(img)
-		if err != nil {
+	}
+
+	// Replace the existing images of the tweet. Not necessary if the API call comes from
+	// the frontend app, since the GUI won't allow users to update existing tweets.
+	// It's to prevent potential non-GUI API calls from uploading infinite images.
+	// The existing images are only deleted once all new ones have been stored
+	// (includes validation / normalization), so one bad image doesn't cost the tweet its images.
+	err = s.is.Replace(domain.OwnerTypeTweet, tweet.ID, images)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Mark the tweet's media as sensitive, or unmark it.
+	if setSensitive {
+		if err = s.ts.SetSensitive(tweet); err != nil {
 			errs.ReturnError(w, r, err)
 			return
 		}
 	}
 
 	// Fetch the tweet's images.
-	images, err := s.is.ByOwner(domain.OwnerTypeTweet, id)
+	tweet.Images, err = s.is.ByOwner(domain.OwnerTypeTweet, id)
 	if err != nil {
 		errs.ReturnError(w, r, err)
 		return
 	}
-	tweet.Images = images
+	s.SetTweetMediaVisibility(user, tweet)
 
 	// Return the tweet with its images.
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(tweet); err != nil {
+	if err := json.NewEncoder(w).Encode(newTweetView(tweet)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleUpdateImageAltText handles the route "PUT /image/:id/alt_text".
+// It reads the new alt text from the json body and saves it, if the image belongs to one of the authed
+// user's tweets. An empty alt text removes it, unless the user requires alt text. Returns the updated image.
+func (s *Server) handleUpdateImageAltText(w http.ResponseWriter, r *http.Request) {
+	// Parse the image ID from the url.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Parse the request's json body.
+	var body struct {
+		AltText string `json:"alt_text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid alt text data."))
+		return
+	}
+
+	// Fetch the image from the database. Only tweet images have alt text.
+	img, err := s.is.ByID(id)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	if img.OwnerType != domain.OwnerTypeTweet {
+		errs.ReturnError(w, r, errs.Errorf(errs.ENOTFOUND, "The image does not exist."))
+		return
+	}
+
+	// Check if the image's tweet belongs to the authed user.
+	tweet, err := s.ts.ByID(img.OwnerID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	user := s.getUserFromContext(r.Context())
+	if tweet.UserID != user.ID {
+		errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "You are not allowed to edit this image."))
+		return
+	}
+	if user.RequireAltText && strings.TrimSpace(body.AltText) == "" {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Alt text is required."))
+		return
+	}
+
+	// Save the alt text.
+	img.AltText = body.AltText
+	if err = s.is.UpdateAltText(img); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return the updated image.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newImageViews([]domain.Image{*img})[0]); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleServeImage handles the route "GET /images/:owner_type/:owner_id/:filename".
+// If the image storage hands out signed URLs, it redirects there, so the image is downloaded
+// from the storage directly. Otherwise, it reads the image from the storage and returns it.
+func (s *Server) handleServeImage(w http.ResponseWriter, r *http.Request) {
+	// Parse the image from the url.
+	vars := mux.Vars(r)
+	ownerType := vars["owner_type"]
+	if ownerType != domain.OwnerTypeTweet && ownerType != domain.OwnerTypeUser {
+		errs.ReturnError(w, r, errs.Errorf(errs.ENOTFOUND, "Image not found."))
+		return
+	}
+	ownerId, err := strconv.Atoi(vars["owner_id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+	img := &domain.Image{
+		OwnerType: ownerType,
+		OwnerID:   ownerId,
+		Filename:  vars["filename"],
+	}
+
+	// Redirect to the storage, if it hands out signed URLs. The redirect may be cached
+	// for a while, but not for longer than the signed URL remains valid.
+	url, err := s.is.SignedURL(img)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	if url != "" {
+		w.Header().Del("Content-Type")
+		w.Header().Set("Cache-Control", "private, max-age=1800")
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	// Otherwise, read the image from the storage.
+	file, err := s.is.Open(img)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	defer file.Close()
+
+	// Return the image. Filenames are unique, so the image never changes.
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(img.Filename)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, file); err != nil {
 		errs.LogError(r, err)
 		return
 	}
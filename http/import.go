@@ -0,0 +1,71 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// registerImportRoutes is a helper for registering all routes of Twitter archive imports.
+func (s *Server) registerImportRoutes(r *mux.Router) {
+	// Get the status and report of the authed user's latest import.
+	r.HandleFunc("/account/import", s.requireAuth(s.handleGetImport)).Methods("GET")
+
+	// Upload an official Twitter archive to be imported for the authed user.
+	r.HandleFunc("/account/import", s.requireAuth(s.handleCreateImport)).Methods("POST")
+}
+
+// handleGetImport handles the route "GET /account/import".
+func (s *Server) handleGetImport(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+	imp, err := s.im.LatestByUserID(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newImportView(imp)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleCreateImport handles the route "POST /account/import".
+// It stores the uploaded archive, which is imported in the background. The client
+// polls "GET /account/import" to find out when it's done and what was skipped.
+func (s *Server) handleCreateImport(w http.ResponseWriter, r *http.Request) {
+	// Parse the uploaded archive. Large archives are buffered on disk, not in memory.
+	r.Body = http.MaxBytesReader(w, r.Body, domain.MaxImportSize+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "The archive must be a zip file of at most 1GB."))
+		return
+	}
+	files := r.MultipartForm.File["archive"]
+	if len(files) == 0 {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Please upload your Twitter archive."))
+		return
+	}
+	archive, err := files[0].Open()
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	defer archive.Close()
+
+	// Queue the import.
+	user := s.getUserFromContext(r.Context())
+	imp := domain.Import{
+		UserID: user.ID,
+	}
+	if err := s.im.Create(&imp, archive); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(newImportView(&imp)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
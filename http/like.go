@@ -12,10 +12,10 @@ import (
 // registerLikeRoutes is a helper for registering all Like routes.
 func (s *Server) registerLikeRoutes(r *mux.Router) {
 	// Create a new like for a tweet.
-	r.HandleFunc("/like", s.requireAuth(s.handleCreateLike)).Methods("POST")
+	r.HandleFunc("/like", s.requireScope(domain.ScopeTweetsWrite, s.handleCreateLike)).Methods("POST")
 
 	// Delete an existing like of a tweet.
-	r.HandleFunc("/like/delete/{id:[0-9]+}", s.requireAuth(s.handleDeleteLike)).Methods("DELETE")
+	r.HandleFunc("/like/delete/{id:[0-9]+}", s.requireScope(domain.ScopeTweetsWrite, s.handleDeleteLike)).Methods("DELETE")
 }
 
 // handleCreateLike handles the route "POST /like".
@@ -42,7 +42,7 @@ func (s *Server) handleCreateLike(w http.ResponseWriter, r *http.Request) {
 
 	// Return the created Like.
 	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(like); err != nil {
+	if err := json.NewEncoder(w).Encode(newLikeView(&like)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
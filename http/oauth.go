@@ -1,181 +1,297 @@
 package http
 
 import (
-	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"github.com/google/go-github/v32/github"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
-	"golang.org/x/oauth2"
 	"gorm.io/gorm"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
+	"unicode/utf8"
 	"wtfTwitter/domain"
 	"wtfTwitter/errs"
+	"wtfTwitter/oauth"
 )
 
-const providerGithub = "github"
 const cookieOAuthState = "oauth_state"
+const cookieOAuthNonce = "oauth_nonce"
+const cookieOAuthLink = "oauth_link"
+
+// cookieLoginChallenge holds the login challenge of a user who signed in with oauth and has
+// two-factor authentication enabled, until they complete it through "POST /login/2fa".
+const cookieLoginChallenge = "login_challenge"
 
 // registerOAuthRoutes is a helper for registering all oauth routes.
 func (s *Server) registerOAuthRoutes(r *mux.Router) {
-	// Set a user up for authentication with Github.
-	r.HandleFunc("/oauth/github/connect", s.handleOAuthGithub).Methods("GET")
+	// List the names of the configured providers, so the client can show a button for each.
+	r.HandleFunc("/oauth/providers", s.handleOAuthProviders).Methods("GET")
+
+	// Set a user up for authentication with a provider.
+	r.HandleFunc("/oauth/{provider}/connect", s.handleOAuthConnect).Methods("GET")
+
+	// Set the authed user up for linking an account at a provider to their account here.
+	r.HandleFunc("/oauth/{provider}/link", s.requireAuth(s.handleOAuthLink)).Methods("GET")
 
-	// Handle the user coming back from Github. Finish the oauth authentication process.
-	r.HandleFunc("/oauth/github/callback", s.handleOAuthGithubCallback).Methods("GET")
+	// Handle the user coming back from a provider. Finish the oauth authentication process.
+	r.HandleFunc("/oauth/{provider}/callback", s.handleOAuthCallback).Methods("GET")
 }
 
-// handleOAuthGithub handles the route "GET /oauth/github/connect".
-// It creates a state token, gives it to the user via cookie and sends them over to
-// Github, where they can authorize this app to access their Github account.
-func (s *Server) handleOAuthGithub(w http.ResponseWriter, r *http.Request) {
-	// Generate a CSRF token called "state".
-	state := csrf.Token(r)
+// handleOAuthProviders handles the route "GET /oauth/providers".
+// It returns the names of all configured oauth providers.
+func (s *Server) handleOAuthProviders(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(s.providers.Names()); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+}
+
+// handleOAuthConnect handles the route "GET /oauth/{provider}/connect".
+// It sends the user over to the provider, where they can authorize this app to access
+// their account. When they come back, they are signed in.
+func (s *Server) handleOAuthConnect(w http.ResponseWriter, r *http.Request) {
+	s.redirectToProvider(w, r, 0)
+}
+
+// handleOAuthLink handles the route "GET /oauth/{provider}/link".
+// It sends the authed user over to the provider, just like handleOAuthConnect. When they
+// come back, the account at the provider is linked to their account instead of signing in.
+// The authed user's ID is put into a cookie, so the callback knows who started the linking.
+func (s *Server) handleOAuthLink(w http.ResponseWriter, r *http.Request) {
+	authedUser := s.getUserFromContext(r.Context())
+	s.redirectToProvider(w, r, authedUser.ID)
+}
 
-	// Put it into a cookie, so we can verify it's the same when the user comes back.
-	cookie := http.Cookie{
-		Name:     cookieOAuthState,
-		Value:    state,
-		HttpOnly: true,
+// redirectToProvider creates a state token and a nonce, gives them to the user via cookie and
+// sends them over to the provider named in the url. If linkUserId isn't 0, it's given to the
+// user via cookie as well.
+func (s *Server) redirectToProvider(w http.ResponseWriter, r *http.Request, linkUserId int) {
+	// Find the provider.
+	provider, err := s.getProvider(r)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
 	}
 
-	// Set the cookie on the user.
-	http.SetCookie(w, &cookie)
+	// Generate a CSRF token called "state", and a nonce that the provider puts into the
+	// ID token. The nonce ties the ID token to this sign-in attempt, so it can't be replayed.
+	state := csrf.Token(r)
+	nonce, err := oauthNonce()
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Put both into cookies, so we can verify them when the user comes back.
+	http.SetCookie(w, &http.Cookie{Name: cookieOAuthState, Value: state, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{Name: cookieOAuthNonce, Value: nonce, HttpOnly: true})
+	link := http.Cookie{Name: cookieOAuthLink, Value: strconv.Itoa(linkUserId), HttpOnly: true}
+	if linkUserId == 0 {
+		link.Value, link.Expires = "", time.Now()
+	}
+	http.SetCookie(w, &link)
 
 	// Build the url to redirect the user to the OAuth provider.
-	url := s.github.AuthCodeURL(state)
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
 
 	// Redirect the user to the provider.
-	http.Redirect(w, r, url, http.StatusFound)
+	http.Redirect(w, r, authURL, http.StatusFound)
 }
 
-// handleOAuthGithubCallback handles the route "GET /oauth/github/callback".
-// After authorization at Github, the user gets redirected here. Github will attach
-// multiple parameters to this url. This method parses those parameters, verifies
-// the state from the user's state cookie, creates an oauth object, determines what
-// to do with it, and identifies an existing user or creates a new one in our database.
+// handleOAuthCallback handles the route "GET /oauth/{provider}/callback".
+// After authorization at the provider, the user gets redirected here. The provider will
+// attach multiple parameters to this url. This method parses those parameters, verifies
+// the state from the user's state cookie, creates an oauth object, determines what to do
+// with it, and identifies an existing user or creates a new one in our database.
 // On success, it signs them in through the regular auth system (remember token + cookie).
-func (s *Server) handleOAuthGithubCallback(w http.ResponseWriter, r *http.Request) {
-	// By now the user has been over at Github and authorized our app's access to
-	// their Github account. Github then sends them back here, to the callback
-	// route /oauth/github/callback, and attaches a bunch of url parameters to it.
-	// Parse those url parameters first.
+// If the user came from "GET /oauth/{provider}/link", the provider's account is linked to
+// the authed user's account instead.
+func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	// Find the provider.
+	provider, err := s.getProvider(r)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// By now the user has been over at the provider and authorized our app's access to
+	// their account. The provider then sends them back here, to the callback route, and
+	// attaches a bunch of url parameters to it. Parse those url parameters first.
 	if err := r.ParseForm(); err != nil {
 		errs.ReturnError(w, r, err)
 		return
 	}
 
-	// Extract the state parameter sent back by Github.
+	// Extract the state parameter sent back by the provider.
 	state := r.FormValue("state")
 
-	// Get the state from the user's cookie.
-	cookie, err := r.Cookie(cookieOAuthState)
-
-	// Verify that the state sent back by Github is the same I've set in the user's cookie.
+	// Get the state and the nonce from the user's cookies.
+	stateCookie, err := r.Cookie(cookieOAuthState)
 	if err != nil {
 		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Something went wrong."))
 		return
-	} else if cookie == nil || cookie.Value != state {
-		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid state provided."))
-		return
+	}
+	var nonce string
+	if nonceCookie, err := r.Cookie(cookieOAuthNonce); err == nil {
+		nonce = nonceCookie.Value
 	}
 
-	// Delete the cookie.
-	cookie.Value = ""
-	cookie.Expires = time.Now()
-
-	// Set the cookie on the user.
-	http.SetCookie(w, cookie)
+	// Get the ID of the user who wants to link the provider's account, if any.
+	var linkUserId int
+	if linkCookie, err := r.Cookie(cookieOAuthLink); err == nil {
+		linkUserId, _ = strconv.Atoi(linkCookie.Value)
+	}
 
-	// Grab the authorization code that Github has sent back as a url param.
-	code := r.FormValue("code")
+	// Delete the cookies.
+	for _, name := range []string{cookieOAuthState, cookieOAuthNonce, cookieOAuthLink} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Expires: time.Now(), HttpOnly: true})
+	}
 
-	// Exchange it for a token.
-	token, err := s.github.Exchange(context.TODO(), code)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Verify that the state sent back by the provider is the same I've set in the user's cookie.
+	if stateCookie.Value != state {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid state provided."))
 		return
 	}
 
-	// Create a new GitHub API client.
-	client := github.NewClient(oauth2.NewClient(r.Context(), oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token.AccessToken},
-	)))
-
-	// Fetch information about the user that's currently authenticated at Github.
-	// Require that we at least receive a user ID from them.
-	githubUser, _, err := client.Users.Get(r.Context(), "")
-	if err != nil {
-		errs.ReturnError(w, r, fmt.Errorf("cannot fetch github user: %s", err))
-		return
-	} else if githubUser.ID == nil {
-		errs.ReturnError(w, r, fmt.Errorf("user ID not returned by GitHub, cannot authenticate user"))
+	// If the user declined access, the provider sends an error instead of a code.
+	if r.FormValue("error") != "" {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Signing in with %s was cancelled.", provider.Name()))
 		return
 	}
 
-	// If Github provides the user's name and email, store it to be able to
-	// link together multiple OAuth providers in the future (Facebook, Google, etc).
-	var name string
-	if githubUser.Name != nil {
-		name = *githubUser.Name
-	} else if githubUser.Login != nil {
-		name = *githubUser.Login
-	}
-	var email string
-	if githubUser.Email != nil {
-		email = *githubUser.Email
+	// Exchange the authorization code that the provider has sent back as a url param
+	// for a token and the identity of the user that's currently authenticated there.
+	identity, token, err := provider.Exchange(r.Context(), r.FormValue("code"), nonce)
+	if err != nil {
+		errs.LogError(r, err)
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Failed to sign you in with %s.", provider.Name()))
+		return
 	}
 
-	// Create an OAuth object with an associated user.
+	// Create an OAuth object with an associated user. The name and handle given by
+	// the provider are shortened to fit our limits.
 	oauth := &domain.OAuth{
-		Provider:       providerGithub,
-		ProviderUserID: strconv.FormatInt(*githubUser.ID, 10),
+		Provider:       provider.Name(),
+		ProviderUserID: identity.ID,
 		TokenType:      token.TokenType,
 		AccessToken:    token.AccessToken,
 		RefreshToken:   token.RefreshToken,
 		User: domain.User{
-			Name:  name,
-			Email: email,
+			Name:   truncateRunes(identity.Name, 15),
+			Handle: truncateRunes(identity.Username, 15),
+			Email:  identity.Email,
 		},
 	}
 	if !token.Expiry.IsZero() {
 		oauth.Expiry = token.Expiry
 	}
 
+	// If the user wants to link the provider's account, make sure they are still signed in as the
+	// user who started the linking. Then attach the oauth object to them and send them back to
+	// the client app.
+	if linkUserId != 0 {
+		authedUser := s.getUserFromContext(r.Context())
+		if authedUser == nil || authedUser.ID != linkUserId {
+			errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "Please sign in again to link your %s account.", provider.Name()))
+			return
+		}
+		if err := s.oauthLink(authedUser, oauth); err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, s.clientUrl, http.StatusFound)
+		return
+	}
+
 	// Take the oauth object, find or create an associated user for it,
 	// and sign that user in through the regular auth system.
-	if err := s.oauthSignIn(w, r, oauth); err != nil {
+	challenge, err := s.oauthSignIn(w, r, oauth, identity.EmailVerified)
+	if err != nil {
 		errs.ReturnError(w, r, err)
 		return
 	}
 
+	// If the user has two-factor authentication enabled, send them to the client's
+	// page for entering a code instead. The challenge is handed over in a short-lived cookie
+	// rather than in the url, where it would end up in the browser history and in logs.
+	if challenge != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieLoginChallenge,
+			Value:    challenge,
+			Expires:  time.Now().Add(domain.LoginChallengeLifetime),
+			HttpOnly: true,
+			Secure:   s.isProd,
+			SameSite: http.SameSiteLaxMode,
+			Path:     "/",
+		})
+		http.Redirect(w, r, s.clientUrl+"/login/2fa", http.StatusFound)
+		return
+	}
+
 	// Redirect them to the client app.
 	http.Redirect(w, r, s.clientUrl, http.StatusFound)
 }
 
+// getProvider returns the provider named in the url, or an error ENOTFOUND if there is none.
+func (s *Server) getProvider(r *http.Request) (oauth.Provider, error) {
+	provider, ok := s.providers.Get(mux.Vars(r)["provider"])
+	if !ok {
+		return nil, errs.Errorf(errs.ENOTFOUND, "Signing in with that provider is not supported.")
+	}
+	return provider, nil
+}
+
+// oauthNonce returns a random nonce for an OpenID Connect sign-in.
+func oauthNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// truncateRunes shortens s to at most n runes.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
 // oauthSignIn takes in a pointer to an oauth object, finds or creates an associated
 // user for it, and signs that user in through the regular auth system. How it works:
 // 1. First check if an oauth record with that provider_user_id and that provider exists.
-// If yes, we have a user in our database who has previously signed in with Github.
-// Update their Github oauth record with the new token and sign the user in.
-// 2. If such an oauth record doesn't exist, the user either didn't sign in with Github
+// If yes, we have a user in our database who has previously signed in with that provider.
+// Update their oauth record with the new token and sign the user in.
+// 2. If such an oauth record doesn't exist, the user either didn't sign in with that provider
 // before, or they don't exist in our database at all. Look for a user with the email
 // from the oauth object to find out.
-// 3. If such a user exists, they haven't signed in with Github before. Create a new
-// oauth record and associate it with the user. Then sign them in.
+// 3. If such a user exists, they haven't signed in with that provider before. If the provider
+// has verified that the email address belongs to the user, create a new oauth record and
+// associate it with the user. Then sign them in. Otherwise, anybody who registers an email
+// address at the provider could take over the account, so they have to sign in some other way
+// and link the provider's account explicitly, see oauthLink.
 // 4. If such a user doesn't exit, this is a new account registration. Create a new
-// user record and a new Github oauth record, and associate them with each other.
+// user record and a new oauth record, and associate them with each other.
 // Then sign the user in.
-func (s *Server) oauthSignIn(w http.ResponseWriter, r *http.Request, oauth *domain.OAuth) error {
+// If the user has two-factor authentication enabled, they aren't signed in yet. Instead,
+// the token of a login challenge is returned, see signInOrChallenge.
+func (s *Server) oauthSignIn(w http.ResponseWriter, r *http.Request, oauth *domain.OAuth, emailVerified bool) (string, error) {
 	// The user who will eventually be signed in with the oauth.
 	var authedUser *domain.User
 
 	// Check if there is an oauth record having that Provider and that ProviderUserID.
 	existingOAuth, err := s.os.ByProviderUserId(oauth.Provider, oauth.ProviderUserID)
 
-	// If yes, that means a user exists in our database, and they have previously signed in with Github.
+	// If yes, that means a user exists in our database, and they have previously signed in with that provider.
 	if existingOAuth != nil && err == nil {
 
 		// Update the oauth record's token data.
@@ -184,13 +300,13 @@ func (s *Server) oauthSignIn(w http.ResponseWriter, r *http.Request, oauth *doma
 		existingOAuth.RefreshToken = oauth.RefreshToken
 		existingOAuth.Expiry = oauth.Expiry
 		if err := s.os.Update(existingOAuth); err != nil {
-			return err
+			return "", err
 		}
 
 		// Get the user by ID, using the UserID of the existing oauth record.
-		existingUser, err := s.us.ByID(existingOAuth.UserID)
+		existingUser, err := s.us.ByIDForSignIn(existingOAuth.UserID)
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		// Set the found user to be the one that will be signed in.
@@ -199,18 +315,23 @@ func (s *Server) oauthSignIn(w http.ResponseWriter, r *http.Request, oauth *doma
 		// If there's no oauth record with that Provider and that ProviderUserID...
 	} else if existingOAuth == nil && err == gorm.ErrRecordNotFound {
 
-		// ...look for a user with the email address returned by Github.
-		existingUser, err := s.us.ByEmail(oauth.User.Email)
+		// ...look for a user with the email address returned by the provider.
+		existingUser, err := s.us.ByEmailForSignIn(oauth.User.Email)
 
-		// If a user was found, that means they have previously signed in, but not with Github.
+		// If a user was found, that means they have previously signed in, but not with that provider.
 		if existingUser != nil && err == nil {
 
+			// Unless the provider vouches for the email address, don't link the accounts.
+			if !emailVerified {
+				return "", errs.Errorf(errs.ECONFLICT, "An account with this email address already exists. "+
+					"Please sign in and link your %s account in your settings.", oauth.Provider)
+			}
+
 			// Attach the found user to the oauth object and create the oauth record in the database.
-			// TODO: Implement oauth for another provider in order to test this properly.
 			oauth.User = *existingUser
 			oauth.UserID = existingUser.ID
 			if err := s.os.Create(oauth); err != nil {
-				return fmt.Errorf("cannot create oauth: %s", err)
+				return "", fmt.Errorf("cannot create oauth: %s", err)
 			}
 
 			// Set the found user to be the one that will be signed in.
@@ -222,16 +343,30 @@ func (s *Server) oauthSignIn(w http.ResponseWriter, r *http.Request, oauth *doma
 			// ...and the error is RecordNotFound, that means they are here for the first time.
 			if err == gorm.ErrRecordNotFound {
 
-				// Create a new user with the info from Github and NoPasswordNeeded (more on that below).
+				// Create a new user with the info from the provider and NoPasswordNeeded (more on that below).
+				// If the provider vouches for the email address, it counts as verified right away.
 				oauth.User.NoPasswordNeeded = true
+				if emailVerified {
+					now := time.Now()
+					oauth.User.EmailVerifiedAt = &now
+				}
 				if err := s.us.Create(&oauth.User); err != nil {
-					return err
+					return "", err
 				}
 
 				// Attach their ID to the oauth object. Create a new oauth record in the database.
 				oauth.UserID = oauth.User.ID
 				if err := s.os.Create(oauth); err != nil {
-					return fmt.Errorf("cannot create oauth: %s", err)
+					return "", fmt.Errorf("cannot create oauth: %s", err)
+				}
+
+				// Send the new user a link to verify their email address, unless it's verified already.
+				// The user exists by now, so failing to send it must not keep them from signing in.
+				// They can request another link later.
+				if !oauth.User.IsVerified() {
+					if err := s.sendVerificationEmail(&oauth.User); err != nil {
+						log.Printf("[oauth] error: cannot send verification email: %s", err)
+					}
 				}
 
 				// Set the newly created user to be the one that will be signed in.
@@ -240,36 +375,74 @@ func (s *Server) oauthSignIn(w http.ResponseWriter, r *http.Request, oauth *doma
 				// If looking for a user with that email returns any other error...
 			} else {
 				// ...something went wrong internally.
-				return err
+				return "", err
 			}
 		}
 
 		// If looking for an oauth record with that Provider and ProviderUserID returns any other error...
 	} else {
 		// ...something went wrong internally.
-		return err
+		return "", err
 	}
 
 	// By now authedUser should hold an actual user from our database.
 	// If yes, sign them in. If not, return an error EINVALID with a message.
-	// Signing a user in requires updating the user's remember token in the database.
-	// The UserService runs password validations before every user-create or update.
-	// Because the user is being signed in with oauth, not with email and password,
-	// their Password field will be empty. That would normally cause the password
-	// validations to fail. Only the field NoPasswordNeeded set to true will make them pass.
-	// That is done inside a validation that runs before the password validations.
-	// It checks if there is an oauth record associated with the user, if no password
-	// hash is supplied, and sets NoPasswordNeeded to true if that's the case.
-	// The NoPasswordNeeded field is never stored in the user's database record.
+	// Signing a user in creates a new session for them. It doesn't touch the user's
+	// record, so no password validations are involved here.
 	if authedUser != nil {
-		err = s.signIn(w, r.Context(), authedUser)
+		challenge, err := s.signInOrChallenge(w, r, authedUser)
 		if err != nil {
-			return err
+			return "", err
+		}
+		if challenge != "" {
+			return challenge, nil
 		}
 	} else {
-		return errs.Errorf(errs.EINVALID, "Failed to sign you in with that method. Please try a different one.")
+		return "", errs.Errorf(errs.EINVALID, "Failed to sign you in with that method. Please try a different one.")
 	}
 
 	// Return the nil error upon successful signIn.
+	return "", nil
+}
+
+// oauthLink attaches an oauth object to the authed user, so they can sign in with the provider.
+// How it works:
+// 1. If an oauth record with that provider_user_id and that provider exists and belongs to
+// the authed user, the account is already linked. Just update the record's token data.
+// 2. If it belongs to another user, the provider's account can't be linked.
+// 3. If the authed user has linked a different account at that provider, they have to
+// unlink it first, since a user has only one oauth record per provider.
+// 4. Otherwise, create a new oauth record for the authed user.
+func (s *Server) oauthLink(authedUser *domain.User, oauth *domain.OAuth) error {
+	existingOAuth, err := s.os.ByProviderUserId(oauth.Provider, oauth.ProviderUserID)
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	if existingOAuth != nil {
+		if existingOAuth.UserID != authedUser.ID {
+			return errs.Errorf(errs.ECONFLICT, "This %s account is already linked to another user.", oauth.Provider)
+		}
+		existingOAuth.AccessToken = oauth.AccessToken
+		existingOAuth.TokenType = oauth.TokenType
+		existingOAuth.RefreshToken = oauth.RefreshToken
+		existingOAuth.Expiry = oauth.Expiry
+		return s.os.Update(existingOAuth)
+	}
+
+	oauths, err := s.os.ByUserID(authedUser.ID)
+	if err != nil {
+		return err
+	}
+	for _, o := range oauths {
+		if o.Provider == oauth.Provider {
+			return errs.Errorf(errs.ECONFLICT, "A different %s account is already linked. Please unlink it first.", oauth.Provider)
+		}
+	}
+
+	oauth.User = *authedUser
+	oauth.UserID = authedUser.ID
+	if err := s.os.Create(oauth); err != nil {
+		return fmt.Errorf("cannot create oauth: %s", err)
+	}
 	return nil
 }
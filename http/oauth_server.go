@@ -0,0 +1,373 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strings"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// Paths of the OAuth2 endpoints called by third-party apps instead of browsers.
+// They authenticate the app itself, never a user, so they are exempt from CSRF protection.
+var oauth2AppPaths = map[string]bool{
+	"/api/oauth2/token":      true,
+	"/api/oauth2/revoke":     true,
+	"/api/oauth2/introspect": true,
+}
+
+// registerOAuthServerRoutes is a helper for registering all routes of the OAuth2 authorization
+// server, which lets third-party apps sign users in and act on their behalf. The consent screen
+// is part of the client app, which uses the "/oauth2/authorize" routes as its API.
+func (s *Server) registerOAuthServerRoutes(r *mux.Router) {
+	// Get the apps the authed user has registered.
+	r.HandleFunc("/oauth2/clients", s.requireAuth(s.handleGetOAuthClients)).Methods("GET")
+
+	// Register a new app.
+	r.HandleFunc("/oauth2/clients", s.requireAuth(s.handleCreateOAuthClient)).Methods("POST")
+
+	// Delete one of the authed user's apps, revoking all tokens users have given it.
+	r.HandleFunc("/oauth2/clients/{client_id}", s.requireAuth(s.handleDeleteOAuthClient)).Methods("DELETE")
+
+	// Check an app's authorization request and get what the consent screen shows.
+	r.HandleFunc("/oauth2/authorize", s.requireAuth(s.handleGetAuthorization)).Methods("GET")
+
+	// Approve or deny an app's authorization request.
+	r.HandleFunc("/oauth2/authorize", s.requireAuth(s.handleAuthorize)).Methods("POST")
+
+	// Exchange an authorization code or a refresh token for tokens. Called by apps.
+	r.HandleFunc("/oauth2/token", s.handleOAuthToken).Methods("POST")
+
+	// Revoke an access token or a refresh token. Called by apps.
+	r.HandleFunc("/oauth2/revoke", s.handleOAuthRevoke).Methods("POST")
+
+	// Get the state of an access token or a refresh token. Called by apps.
+	r.HandleFunc("/oauth2/introspect", s.handleOAuthIntrospect).Methods("POST")
+
+	// Get the apps the authed user has authorized.
+	r.HandleFunc("/account/apps", s.requireAuth(s.handleGetAuthorizedApps)).Methods("GET")
+
+	// Revoke the authorization of an app, along with all its tokens.
+	r.HandleFunc("/account/apps/{client_id}", s.requireAuth(s.handleRevokeAuthorizedApp)).Methods("DELETE")
+}
+
+// handleGetOAuthClients handles the route "GET /oauth2/clients".
+func (s *Server) handleGetOAuthClients(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+	clients, err := s.oa.ClientsByOwnerID(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newOAuthClientViews(clients)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleCreateOAuthClient handles the route "POST /oauth2/clients".
+// It returns the new app including its secret, which is never shown again.
+func (s *Server) handleCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body.
+	var body struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Register the app. Redirect urls can't contain spaces, so one containing a space is rejected
+	// as invalid once they are joined.
+	user := s.getUserFromContext(r.Context())
+	client := domain.OAuthClient{
+		OwnerID:      user.ID,
+		Name:         body.Name,
+		Confidential: body.Confidential,
+	}
+	for _, uri := range body.RedirectURIs {
+		if uri == "" || strings.ContainsAny(uri, " \t\r\n") {
+			errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "The redirect url %q is invalid.", uri))
+			return
+		}
+		client.RedirectURIs += uri + " "
+	}
+	if err := s.oa.CreateClient(&client); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(newOAuthClientView(&client)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleDeleteOAuthClient handles the route "DELETE /oauth2/clients/{client_id}".
+func (s *Server) handleDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	// Fetch the app and make sure the authed user has registered it.
+	client, err := s.oa.ClientByClientID(mux.Vars(r)["client_id"])
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	user := s.getUserFromContext(r.Context())
+	if client.OwnerID != user.ID {
+		errs.ReturnError(w, r, errs.Errorf(errs.ENOTFOUND, "The app does not exist."))
+		return
+	}
+
+	// Delete it.
+	if err := s.oa.DeleteClient(client); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGetAuthorization handles the route "GET /oauth2/authorize".
+// An app sends the user to the client app's consent screen with the parameters of its
+// authorization request in the url. The consent screen passes them on to this route, which
+// checks them and returns the app's name and the requested scopes. If the user has granted
+// those scopes to the app before, granted is true, and the consent screen can approve
+// the request right away.
+func (s *Server) handleGetAuthorization(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := domain.AuthorizationRequest{
+		ResponseType:        query.Get("response_type"),
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	}
+	client, err := s.oa.ValidateAuthorization(&req)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Check if the user has granted the requested scopes before.
+	user := s.getUserFromContext(r.Context())
+	granted := false
+	grant, err := s.oa.GrantByUserAndClient(user.ID, client.ID)
+	if err == nil {
+		granted = domain.ScopeIncludes(grant.Scope, req.Scope)
+	} else if errs.ErrorCode(err) != errs.ENOTFOUND {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newAuthorizationView(client, &req, granted)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleAuthorize handles the route "POST /oauth2/authorize".
+// The consent screen sends the authorization request along with the user's decision.
+// If the user approves, an authorization code is issued. Either way, the route returns
+// the url of the app the consent screen sends the user back to.
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body.
+	var body struct {
+		domain.AuthorizationRequest
+		Approve bool `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+	req := body.AuthorizationRequest
+
+	// Build the parameters the user is sent back to the app with.
+	params := url.Values{}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	if body.Approve {
+		// Record the user's consent and issue an authorization code.
+		user := s.getUserFromContext(r.Context())
+		code, err := s.oa.CreateCode(user.ID, &req)
+		if err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+		params.Set("code", code.Code)
+	} else {
+		// Make sure the redirect url belongs to the app, before sending the user there.
+		if _, err := s.oa.ValidateAuthorization(&req); err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+		params.Set("error", "access_denied")
+	}
+
+	// Append the parameters to the app's redirect url.
+	redirect, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	query := redirect.Query()
+	for key := range params {
+		query.Set(key, params.Get(key))
+	}
+	redirect.RawQuery = query.Encode()
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]string{"redirect_to": redirect.String()}); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleOAuthToken handles the route "POST /oauth2/token" (RFC 6749 §3.2).
+// It supports the grant types "authorization_code" and "refresh_token".
+func (s *Server) handleOAuthToken(w http.ResponseWriter, r *http.Request) {
+	// Responses contain tokens and must not be cached.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	// Authenticate the app.
+	client, err := s.authenticateOAuthClient(r)
+	if err != nil {
+		returnOAuth2Error(w, r, err)
+		return
+	}
+
+	// Issue tokens according to the grant type.
+	var tokens *domain.OAuthTokens
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		tokens, err = s.oa.ExchangeCode(client, r.PostFormValue("code"), r.PostFormValue("redirect_uri"), r.PostFormValue("code_verifier"))
+	case "refresh_token":
+		tokens, err = s.oa.Refresh(client, r.PostFormValue("refresh_token"), r.PostFormValue("scope"))
+	default:
+		err = &domain.OAuth2Error{Code: domain.OAuth2UnsupportedGrantType}
+	}
+	if err != nil {
+		returnOAuth2Error(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleOAuthRevoke handles the route "POST /oauth2/revoke" (RFC 7009).
+func (s *Server) handleOAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	client, err := s.authenticateOAuthClient(r)
+	if err != nil {
+		returnOAuth2Error(w, r, err)
+		return
+	}
+	if err := s.oa.Revoke(client, r.PostFormValue("token")); err != nil {
+		returnOAuth2Error(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleOAuthIntrospect handles the route "POST /oauth2/introspect" (RFC 7662).
+func (s *Server) handleOAuthIntrospect(w http.ResponseWriter, r *http.Request) {
+	client, err := s.authenticateOAuthClient(r)
+	if err != nil {
+		returnOAuth2Error(w, r, err)
+		return
+	}
+	introspection, err := s.oa.Introspect(client, r.PostFormValue("token"))
+	if err != nil {
+		returnOAuth2Error(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(introspection); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleGetAuthorizedApps handles the route "GET /account/apps".
+func (s *Server) handleGetAuthorizedApps(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+	grants, err := s.oa.GrantsByUserID(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newAuthorizedAppViews(grants)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleRevokeAuthorizedApp handles the route "DELETE /account/apps/{client_id}".
+func (s *Server) handleRevokeAuthorizedApp(w http.ResponseWriter, r *http.Request) {
+	client, err := s.oa.ClientByClientID(mux.Vars(r)["client_id"])
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	user := s.getUserFromContext(r.Context())
+	if err := s.oa.RevokeGrant(user.ID, client.ID); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticateOAuthClient reads the app's credentials from the request's basic auth header, or
+// from the form parameters client_id and client_secret, and authenticates the app (RFC 6749 §2.3.1).
+func (s *Server) authenticateOAuthClient(r *http.Request) (*domain.OAuthClient, error) {
+	clientId, secret, ok := r.BasicAuth()
+	if ok {
+		// Credentials in the basic auth header are form-urlencoded first.
+		var err error
+		if clientId, err = url.QueryUnescape(clientId); err != nil {
+			return nil, &domain.OAuth2Error{Code: domain.OAuth2InvalidClient}
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, &domain.OAuth2Error{Code: domain.OAuth2InvalidClient}
+		}
+	} else {
+		clientId, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientId == "" {
+		return nil, &domain.OAuth2Error{Code: domain.OAuth2InvalidClient, Description: "Client authentication is required."}
+	}
+	return s.oa.AuthenticateClient(clientId, secret)
+}
+
+// returnOAuth2Error writes an error of the token, revocation or introspection endpoints in the
+// format of RFC 6749 §5.2. Other errors are returned as usual.
+func returnOAuth2Error(w http.ResponseWriter, r *http.Request, err error) {
+	var e *domain.OAuth2Error
+	if !errors.As(err, &e) {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	status := http.StatusBadRequest
+	if e.Code == domain.OAuth2InvalidClient {
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth2"`)
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		errs.LogError(r, err)
+	}
+}
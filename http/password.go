@@ -0,0 +1,165 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"net/url"
+	"strings"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// registerPasswordRoutes is a helper for registering all password routes.
+func (s *Server) registerPasswordRoutes(r *mux.Router) {
+	// Change the authed user's password.
+	r.HandleFunc("/account/password", s.requireAuth(s.handleChangePassword)).Methods("PUT")
+
+	// Send a password reset link to a user who forgot their password.
+	r.HandleFunc("/password/forgot", s.handleForgotPassword).Methods("POST")
+
+	// Set a new password using the token from a password reset link.
+	r.HandleFunc("/password/reset", s.handleResetPassword).Methods("POST")
+}
+
+// handleChangePassword handles the route "PUT /account/password".
+// It checks the authed user's current password, replaces it with the new one and
+// signs the user out on all other devices.
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body.
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Change the authed user's password.
+	user := s.getUserFromContext(r.Context())
+	if err := s.us.ChangePassword(user, body.CurrentPassword, body.NewPassword); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Sign the user out everywhere but on the current device.
+	session := s.getSessionFromContext(r.Context())
+	if err := s.ss.DeleteByUserID(user.ID, session.ID); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleForgotPassword handles the route "POST /password/forgot".
+// It creates a password reset for the user with the submitted email address and emails
+// them a link to the client's reset page. It always responds with 200, whether the
+// address belongs to a user or not, so it can't be used to find out who has an account.
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body (the email address).
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Limit the number of reset emails a client can trigger.
+	ipKey := "password:ip:" + clientIP(r)
+	if err := s.th.Check(ipKey); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	s.throttleHit(r, ipKey, domain.PasswordResetIPPolicy)
+
+	// Look for the user with that email address, normalized like it is on signup. Users who deactivated
+	// their account can still reset their password within the grace period, since signing in restores it.
+	// If there is no such user, pretend that everything went fine.
+	user, err := s.us.ByEmailForSignIn(strings.TrimSpace(strings.ToLower(body.Email)))
+	if err == gorm.ErrRecordNotFound {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Create a new password reset for the user.
+	reset := domain.PasswordReset{UserID: user.ID}
+	if err := s.ps.Create(&reset); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Email the reset link in the background, so the response time doesn't reveal
+	// whether the address belongs to a user.
+	email := domain.Email{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nsomeone requested to reset the password of your account. "+
+			"If that was you, follow the link below to choose a new password. It's valid for one hour.\n\n%s\n\n"+
+			"If you didn't request a password reset, you can ignore this email.\n",
+			user.Name, s.clientUrl+"/password/reset?token="+url.QueryEscape(reset.Token)),
+	}
+	s.sendEmail(email)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleResetPassword handles the route "POST /password/reset".
+// It redeems a password reset token, sets the user's new password and signs them out on all devices.
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body.
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Refuse the attempt if the client has tried too many invalid tokens.
+	ipKey := "password:ip:" + clientIP(r)
+	if err := s.th.Check(ipKey); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Look up the password reset. It must be unused and unexpired.
+	reset, err := s.ps.ByToken(body.Token)
+	if err != nil {
+		if errs.ErrorCode(err) == errs.EINVALID {
+			s.throttleHit(r, ipKey, domain.PasswordResetIPPolicy)
+		}
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Fetch the user the reset belongs to, even if they deactivated their account, see handleForgotPassword.
+	user, err := s.us.ByIDForSignIn(reset.UserID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Redeem the reset and set the new password at once, so the link can't be used again.
+	// If the password is invalid, the reset can still be used for another attempt.
+	if err := s.us.RedeemPasswordReset(user, reset, body.Password); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Sign the user out on all devices. Whoever knew the old password isn't signed in anymore.
+	if err := s.ss.DeleteByUserID(user.ID, 0); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
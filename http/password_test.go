@@ -0,0 +1,68 @@
+package http
+
+import (
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"wtfTwitter/domain"
+)
+
+func TestForgotPassword(t *testing.T) {
+	deactivatedAt := time.Now().Add(-time.Hour)
+	users := []domain.User{
+		{ID: 1, Name: "Alice", Email: "alice@example.com"},
+		{ID: 2, Name: "Bob", Email: "bob@example.com", DeletedAt: gorm.DeletedAt{Time: deactivatedAt, Valid: true}},
+	}
+	tests := []struct {
+		email  string
+		wantTo string
+	}{
+		{"alice@example.com", "alice@example.com"},
+		{"  Alice@Example.COM ", "alice@example.com"},
+		{"bob@example.com", "bob@example.com"},
+		{"carol@example.com", ""},
+	}
+	for _, tt := range tests {
+		mailer := make(fakeMailer, 1)
+		resets := &fakePasswordResetService{}
+		s := &Server{
+			clientUrl: "https://example.com",
+			mailer:    mailer,
+			us:        &fakeUserService{users: users},
+			th:        newFakeThrottleService(),
+			ps:        resets,
+		}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/password/forgot", strings.NewReader(`{"email": "`+tt.email+`"}`))
+		s.handleForgotPassword(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: status %d, want %d", tt.email, w.Code, http.StatusOK)
+			continue
+		}
+		if tt.wantTo == "" {
+			if len(resets.created) != 0 {
+				t.Errorf("%q: created a reset for an unknown address", tt.email)
+			}
+			continue
+		}
+		if len(resets.created) != 1 {
+			t.Errorf("%q: created %d resets, want 1", tt.email, len(resets.created))
+			continue
+		}
+		select {
+		case email := <-mailer:
+			if email.To != tt.wantTo {
+				t.Errorf("%q: sent the reset email to %q, want %q", tt.email, email.To, tt.wantTo)
+			}
+			if !strings.Contains(email.Body, "https://example.com/password/reset?token=reset-token") {
+				t.Errorf("%q: the reset email lacks the reset link: %s", tt.email, email.Body)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q: no reset email sent", tt.email)
+		}
+	}
+}
@@ -1,15 +1,20 @@
 package http
 
 import (
+	"context"
 	"crypto/rand"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
-	"golang.org/x/oauth2"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 	"wtfTwitter/crud"
 	"wtfTwitter/domain"
+	"wtfTwitter/oauth"
 )
 
 // Server provides routing, request handling and middleware. It contains all the route
@@ -19,7 +24,8 @@ type Server struct {
 	isProd    bool
 	clientUrl string
 	router    *mux.Router
-	github    *oauth2.Config
+	providers *oauth.Registry
+	mailer    domain.Mailer
 	// A single field for every service isn't necessary here, since the services could be
 	// accessed through the passed in crud.Services object like so: s.service.User.Create(...).
 	// However, having those single fields nicely shortens the call: s.us.Create(...).
@@ -29,6 +35,16 @@ type Server struct {
 	fs domain.FollowService
 	ls domain.LikeService
 	is domain.ImageService
+	as domain.AnalyticsService
+	ss domain.SessionService
+	ps domain.PasswordResetService
+	tf domain.TwoFactorService
+	cs domain.CredentialService
+	th domain.ThrottleService
+	at domain.AccessTokenService
+	oa domain.OAuthServerService
+	es domain.ExportService
+	im domain.ImportService
 }
 
 // NewServer returns a new instance of the server, registers all necessary
@@ -36,7 +52,8 @@ type Server struct {
 func NewServer(
 	isProd bool,
 	clientUrl string,
-	github *oauth2.Config,
+	providers *oauth.Registry,
+	mailer domain.Mailer,
 	services *crud.Services,
 ) *Server {
 
@@ -45,20 +62,45 @@ func NewServer(
 		isProd:    isProd,
 		clientUrl: clientUrl,
 		router:    mux.NewRouter(),
-		github:    github,
+		providers: providers,
+		mailer:    mailer,
 		us:        services.User,
 		os:        services.OAuth,
 		ts:        services.Tweet,
 		fs:        services.Follow,
 		ls:        services.Like,
 		is:        services.Image,
+		as:        services.Analytics,
+		ss:        services.Session,
+		ps:        services.PasswordReset,
+		tf:        services.TwoFactor,
+		cs:        services.Credential,
+		th:        services.Throttle,
+		at:        services.AccessToken,
+		oa:        services.OAuthServer,
+		es:        services.Export,
+		im:        services.Import,
 	}
 
+	// Let the export service's background worker notify users about their exports.
+	s.es.OnFinished(s.notifyExportFinished)
+
 	r := s.router.PathPrefix("/api").Subrouter()
 
 	// Register routes of the auth system.
 	s.registerAuthRoutes(r)
 	s.registerOAuthRoutes(r)
+	s.registerSessionRoutes(r)
+	s.registerPasswordRoutes(r)
+	s.registerEmailRoutes(r)
+	s.registerTwoFactorRoutes(r)
+	s.registerCredentialRoutes(r)
+	s.registerIdentityRoutes(r)
+	s.registerAccessTokenRoutes(r)
+	s.registerOAuthServerRoutes(r)
+	s.registerAccountRoutes(r)
+	s.registerExportRoutes(r)
+	s.registerImportRoutes(r)
 
 	// Register routes of the crud system.
 	s.registerUserRoutes(r)
@@ -66,10 +108,10 @@ func NewServer(
 	s.registerFollowRoutes(r)
 	s.registerLikeRoutes(r)
 	s.registerImageRoutes(r)
+	s.registerAnalyticsRoutes(r)
 
 	// Set up routes for serving images.
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	s.router.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	s.router.HandleFunc("/images/{owner_type}/{owner_id:[0-9]+}/{filename}", s.handleServeImage).Methods("GET", "HEAD")
 
 	// Construct the CSRF protection middleware.
 	// A new CSRF tokens is issued when the client makes a GET request to /csrf.
@@ -82,7 +124,7 @@ func NewServer(
 	csrfMw := csrf.Protect(csrfAuthKey, csrf.Secure(s.isProd), csrf.Path("/"), csrf.SameSite(csrf.SameSiteStrictMode))
 
 	// Set up middleware that needs to run on every request.
-	s.router.Use(csrfMw, setContentTypeJSON, s.checkUser)
+	s.router.Use(skipCSRF, csrfMw, setContentTypeJSON, s.checkUser)
 
 	// Return the pointer to the Server object.
 	return s
@@ -96,8 +138,30 @@ func setContentTypeJSON(next http.Handler) http.Handler {
 	})
 }
 
-// Run starts to listen and serve on the specified port.
+// Run starts to listen and serve on the specified port. It blocks until the process
+// receives an interrupt or terminate signal, and then shuts the server down gracefully,
+// so that the caller gets to clean up (like flushing pending analytics events).
 func (s *Server) Run(port int) {
 	// 0.0.0.0 instead of localhost, so the proxy for the Angular SPA works properly.
-	log.Fatal(http.ListenAndServe("0.0.0.0:"+strconv.Itoa(port), s.router))
+	srv := &http.Server{
+		Addr:    "0.0.0.0:" + strconv.Itoa(port),
+		Handler: s.router,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a signal to shut down.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	// Give in-flight requests some time to finish.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("[http] error: shutdown: %s", err)
+	}
 }
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"wtfTwitter/errs"
+)
+
+// registerSessionRoutes is a helper for registering all Session routes.
+func (s *Server) registerSessionRoutes(r *mux.Router) {
+	// Get all devices the authed user is signed in on.
+	r.HandleFunc("/account/sessions", s.requireAuth(s.handleGetSessions)).Methods("GET")
+
+	// Sign the authed user out on all devices, including the current one.
+	r.HandleFunc("/account/sessions", s.requireAuth(s.handleDeleteSessions)).Methods("DELETE")
+
+	// Sign the authed user out on a single device.
+	r.HandleFunc("/account/sessions/{id:[0-9]+}", s.requireAuth(s.handleDeleteSession)).Methods("DELETE")
+}
+
+// handleGetSessions handles the route "GET /account/sessions".
+// It returns the authed user's unexpired sessions, most recently used first.
+func (s *Server) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	// Get the authed user and their current session from the request's context.
+	user := s.getUserFromContext(r.Context())
+	current := s.getSessionFromContext(r.Context())
+
+	// Fetch the user's sessions from the database.
+	sessions, err := s.ss.ByUserID(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return the sessions.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newSessionViews(sessions, current.ID)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleDeleteSession handles the route "DELETE /account/sessions/{id}".
+// It signs the authed user out on the device the session belongs to.
+func (s *Server) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	// Parse the session's ID from the url.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Fetch the session from the database.
+	session, err := s.ss.ByID(id)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Check if the session belongs to the authed user.
+	user := s.getUserFromContext(r.Context())
+	if session.UserID != user.ID {
+		errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "You are not allowed to delete this session."))
+		return
+	}
+
+	// Delete the session.
+	if err := s.ss.Delete(session); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// If that was the current session, the client's cookie is useless now.
+	if current := s.getSessionFromContext(r.Context()); current.ID == session.ID {
+		s.clearRememberCookie(w)
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDeleteSessions handles the route "DELETE /account/sessions".
+// It signs the authed user out on all devices, including the current one.
+func (s *Server) handleDeleteSessions(w http.ResponseWriter, r *http.Request) {
+	// Get the authed user from the request's context.
+	user := s.getUserFromContext(r.Context())
+
+	// Delete all of the user's sessions.
+	if err := s.ss.DeleteByUserID(user.ID, 0); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Invalidate the client's cookie and regenerate its CSRF token.
+	s.clearRememberCookie(w)
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -12,22 +12,49 @@ import (
 //registerTweetRoutes is a helper for registering all tweet routes.
 func (s *Server) registerTweetRoutes(r *mux.Router) {
 	// Get the authed user's feed.
-	r.HandleFunc("/feed/{offset:[0-9]+}", s.requireAuth(s.handleGetFeed)).Methods("GET")
+	r.HandleFunc("/feed/{offset:[0-9]+}", s.requireScope(domain.ScopeRead, s.handleGetFeed)).Methods("GET")
 
 	// Get a specific tweet by id, with its associated user and replies.
-	r.HandleFunc("/tweet/{id:[0-9]+}", s.requireAuth(s.handleGetTweet)).Methods("GET")
+	r.HandleFunc("/tweet/{id:[0-9]+}", s.requireScope(domain.ScopeRead, s.handleGetTweet)).Methods("GET")
 
 	// Get one of the three possible subsets of tweets to be displayed on a user's profile.
 	// The subsets are: all tweets of the user, the user's original tweets (not a retweet or reply),
 	// or tweets of other users that the user has liked.
-	r.HandleFunc("/tweets/{subset}/{user_id:[0-9]+}/{offset}", s.requireAuth(s.handleGetTweets)).Methods("GET")
+	r.HandleFunc("/tweets/{subset}/{user_id:[0-9]+}/{offset}", s.requireScope(domain.ScopeRead, s.handleGetTweets)).Methods("GET")
+
+	// Search for tweets whose images' alt text contains a term.
+	r.HandleFunc("/search/media/{term}/{offset:[0-9]+}", s.requireScope(domain.ScopeRead, s.handleSearchMedia)).Methods("GET")
 
 	// Create a new tweet / retweet / reply. Which one it is, is determined implicitly
 	// by the value of tweet's retweets_id / replies_to_id fields.
-	r.HandleFunc("/tweet", s.requireAuth(s.handleCreateTweet)).Methods("POST")
+	r.HandleFunc("/tweet", s.requireScope(domain.ScopeTweetsWrite, s.handleCreateTweet)).Methods("POST")
 
 	// Delete a tweet.
-	r.HandleFunc("/tweet/{id:[0-9]+}", s.requireAuth(s.handleDeleteTweet)).Methods("DELETE")
+	r.HandleFunc("/tweet/{id:[0-9]+}", s.requireScope(domain.ScopeTweetsWrite, s.handleDeleteTweet)).Methods("DELETE")
+
+	// Get the users who like a specific tweet.
+	r.HandleFunc("/tweet/{id:[0-9]+}/likes/{offset:[0-9]+}", s.requireScope(domain.ScopeRead, s.handleGetTweetLikers)).Methods("GET")
+
+	// Get the users who retweeted a specific tweet.
+	r.HandleFunc("/tweet/{id:[0-9]+}/retweets/{offset:[0-9]+}", s.requireScope(domain.ScopeRead, s.handleGetTweetRetweeters)).Methods("GET")
+
+	// Get the replies to a specific tweet that have been hidden by the tweet's author.
+	r.HandleFunc("/tweet/{id:[0-9]+}/replies/hidden", s.requireScope(domain.ScopeRead, s.handleGetHiddenReplies)).Methods("GET")
+
+	// Hide a reply to one of the authed user's tweets.
+	r.HandleFunc("/tweet/{id:[0-9]+}/hide", s.requireScope(domain.ScopeTweetsWrite, s.handleHideReply)).Methods("POST")
+
+	// Un-hide a previously hidden reply to one of the authed user's tweets.
+	r.HandleFunc("/tweet/{id:[0-9]+}/hide", s.requireScope(domain.ScopeTweetsWrite, s.handleUnhideReply)).Methods("DELETE")
+
+	// Mark the media of one of the authed user's tweets as sensitive, or unmark it.
+	r.HandleFunc("/tweet/{id:[0-9]+}/sensitive", s.requireScope(domain.ScopeTweetsWrite, s.handleUpdateTweetSensitive)).Methods("PUT")
+
+	// Pin one of the authed user's original tweets to their profile.
+	r.HandleFunc("/tweet/{id:[0-9]+}/pin", s.requireScope(domain.ScopeTweetsWrite, s.handlePinTweet)).Methods("POST")
+
+	// Unpin the authed user's pinned tweet.
+	r.HandleFunc("/tweet/{id:[0-9]+}/pin", s.requireScope(domain.ScopeTweetsWrite, s.handleUnpinTweet)).Methods("DELETE")
 }
 
 // handleGetFeed loads a limited number of tweets to be displayed in the home feed.
@@ -57,11 +84,13 @@ func (s *Server) handleGetFeed(w http.ResponseWriter, r *http.Request) {
 
 	// Loop over those tweets and get their images and associations with the user.
 	for i, _ := range feed {
-		// Get the retrieved feed' images from the filesystem.
+		// Get the retrieved feed's images from the media table.
 		if err = s.SetTweetImages(&feed[i]); err != nil {
 			errs.ReturnError(w, r, err)
 			return
 		}
+		// Flag or hide the tweet's sensitive media according to the authed user's setting.
+		s.SetTweetMediaVisibility(authedUser, &feed[i])
 		// Get the counts of replies, retweets and likes of the tweet.
 		if err = s.SetTweetAssociationCounts(&feed[i]); err != nil {
 			errs.ReturnError(w, r, err)
@@ -74,9 +103,12 @@ func (s *Server) handleGetFeed(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Record an impression of each of the tweets.
+	s.RecordTweetImpressions(authedUser.ID, tweetPointers(feed)...)
+
 	// Return the ten tweets.
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(feed); err != nil {
+	if err := json.NewEncoder(w).Encode(newTweetViews(feed)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
@@ -112,24 +144,43 @@ func (s *Server) handleGetTweets(w http.ResponseWriter, r *http.Request) {
 	var tweets []domain.Tweet
 	switch subset {
 	case "original":
+		// Get the user's pinned tweet. It's the first item of the first page, and it's excluded
+		// from the list of originals. So when loading further pages, the frontend's offset
+		// includes the pinned tweet, and needs to be reduced by one.
+		pinned, err := s.ts.PinnedByUserID(userId)
+		if err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+		firstPage := offset == 0
+		if pinned != nil && !firstPage {
+			offset--
+		}
 		tweets, err = s.ts.OriginalsByUserID(userId, offset)
 		if err != nil {
 			errs.ReturnError(w, r, err)
+			return
+		}
+		if pinned != nil && firstPage {
+			tweets = append([]domain.Tweet{*pinned}, tweets...)
 		}
 	case "all":
 		tweets, err = s.ts.ByUserID(userId, offset)
 		if err != nil {
 			errs.ReturnError(w, r, err)
+			return
 		}
 	case "with_images":
 		tweets, err = s.ts.ImageTweetsByUserID(userId, offset)
 		if err != nil {
 			errs.ReturnError(w, r, err)
+			return
 		}
 	case "liked":
 		tweets, err = s.ts.LikedTweetsByUserID(userId, offset)
 		if err != nil {
 			errs.ReturnError(w, r, err)
+			return
 		}
 	default:
 		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid tweet subset."))
@@ -138,11 +189,13 @@ func (s *Server) handleGetTweets(w http.ResponseWriter, r *http.Request) {
 
 	// Get the tweets' images and association data.
 	for i, _ := range tweets {
-		// Get the retrieved tweets' images from the filesystem.
+		// Get the retrieved tweets' images from the media table.
 		if err = s.SetTweetImages(&tweets[i]); err != nil {
 			errs.ReturnError(w, r, err)
 			return
 		}
+		// Flag or hide the tweet's sensitive media according to the authed user's setting.
+		s.SetTweetMediaVisibility(authedUser, &tweets[i])
 		// Get the counts of replies, retweets and likes of the tweet.
 		if err = s.SetTweetAssociationCounts(&tweets[i]); err != nil {
 			errs.ReturnError(w, r, err)
@@ -155,9 +208,63 @@ func (s *Server) handleGetTweets(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Record an impression of each of the tweets.
+	s.RecordTweetImpressions(authedUser.ID, tweetPointers(tweets)...)
+
 	// Return the tweets.
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(tweets); err != nil {
+	if err := json.NewEncoder(w).Encode(newTweetViews(tweets)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleSearchMedia handles the route "GET /search/media/{term}/{offset}".
+// It finds the tweets with images whose alt text contains the search term, so that images can be
+// found by what they show. The results are loaded using infinite scroll, see handleGetFeed.
+func (s *Server) handleSearchMedia(w http.ResponseWriter, r *http.Request) {
+	// Parse the search term and the offset from the url.
+	searchTerm := mux.Vars(r)["term"]
+	offset, err := strconv.Atoi(mux.Vars(r)["offset"])
+	if offset < 0 || err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid offset value."))
+		return
+	}
+
+	// Get the authenticated user.
+	authedUser := s.getUserFromContext(r.Context())
+
+	// Search the database for tweets with matching images.
+	tweets, err := s.ts.SearchByAltText(searchTerm, offset)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Get the tweets' images and association data.
+	for i, _ := range tweets {
+		// Get the retrieved tweets' images from the media table.
+		if err = s.SetTweetImages(&tweets[i]); err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+		// Flag or hide the tweet's sensitive media according to the authed user's setting.
+		s.SetTweetMediaVisibility(authedUser, &tweets[i])
+		// Get the counts of replies, retweets and likes of the tweet.
+		if err = s.SetTweetAssociationCounts(&tweets[i]); err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+		// Determine if the authenticated user has retweeted / replied to / liked the tweet or not.
+		if err = s.SetUserTweetAssociationData(authedUser.ID, &tweets[i]); err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+	}
+
+	// Return the tweets.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newTweetViews(tweets)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
@@ -188,11 +295,13 @@ func (s *Server) handleGetTweet(w http.ResponseWriter, r *http.Request) {
 		errs.ReturnError(w, r, err)
 		return
 	}
-	// Get the retrieved tweets' images from the filesystem.
+	// Get the retrieved tweets' images from the media table.
 	if err = s.SetTweetImages(tweet); err != nil {
 		errs.ReturnError(w, r, err)
 		return
 	}
+	// Flag or hide the tweet's sensitive media according to the authed user's setting.
+	s.SetTweetMediaVisibility(authedUser, tweet)
 	// Determine if the authenticated user has retweeted / replied to / liked the tweet or not.
 	if err = s.SetUserTweetAssociationData(authedUser.ID, tweet); err != nil {
 		errs.ReturnError(w, r, err)
@@ -201,11 +310,13 @@ func (s *Server) handleGetTweet(w http.ResponseWriter, r *http.Request) {
 
 	// Get the tweet's replies' images and association data.
 	for i, _ := range tweet.Replies {
-		// Get the retrieved tweets' replies' images from the filesystem.
+		// Get the retrieved tweets' replies' images from the media table.
 		if err = s.SetTweetImages(&tweet.Replies[i]); err != nil {
 			errs.ReturnError(w, r, err)
 			return
 		}
+		// Flag or hide the tweet's sensitive media according to the authed user's setting.
+		s.SetTweetMediaVisibility(authedUser, &tweet.Replies[i])
 		// Get the counts of replies, retweets and likes of the tweet's replies.
 		if err = s.SetTweetAssociationCounts(&tweet.Replies[i]); err != nil {
 			errs.ReturnError(w, r, err)
@@ -218,9 +329,12 @@ func (s *Server) handleGetTweet(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Record an impression of the tweet and its replies.
+	s.RecordTweetImpressions(authedUser.ID, append([]*domain.Tweet{tweet}, tweetPointers(tweet.Replies)...)...)
+
 	// Return the tweet.
 	w.WriteHeader(http.StatusOK)
-	if err = json.NewEncoder(w).Encode(tweet); err != nil {
+	if err = json.NewEncoder(w).Encode(newTweetView(tweet)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
@@ -249,9 +363,11 @@ func (s *Server) handleCreateTweet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.SetTweetMediaVisibility(user, &tweet)
+
 	// Return the created Tweet.
 	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(tweet); err != nil {
+	if err := json.NewEncoder(w).Encode(newTweetView(&tweet)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
@@ -259,7 +375,7 @@ func (s *Server) handleCreateTweet(w http.ResponseWriter, r *http.Request) {
 
 // handleDeleteTweet handles the route "DELETE /tweet/:id".
 // It soft-deletes a tweet and all it's direct replies and retweets, not cascading further.
-// It permanently deletes the tweet's and the tweet's replies' images from the filesystem.
+// It permanently deletes the tweet's and the tweet's replies' images from the image store.
 func (s *Server) handleDeleteTweet(w http.ResponseWriter, r *http.Request) {
 	// Parse the tweet ID from the url.
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
@@ -289,14 +405,14 @@ func (s *Server) handleDeleteTweet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Permanently delete the tweet's images from disk.
+	// Permanently delete the tweet's images from the image store.
 	err = s.is.DeleteAll(domain.OwnerTypeTweet, tweet.ID)
 	if err != nil {
 		errs.ReturnError(w, r, err)
 		return
 	}
 
-	// Permanently delete the tweet's replies' images from disk.
+	// Permanently delete the tweet's replies' images from the image store.
 	for _, reply := range tweet.Replies {
 		if err := s.is.DeleteAll(domain.OwnerTypeTweet, reply.ID); err != nil {
 			errs.ReturnError(w, r, err)
@@ -304,7 +420,7 @@ func (s *Server) handleDeleteTweet(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Permanently delete the tweet's retweets' images from disk.
+	// Permanently delete the tweet's retweets' images from the image store.
 	for _, retweet := range tweet.Retweets {
 		if err := s.is.DeleteAll(domain.OwnerTypeTweet, retweet.ID); err != nil {
 			errs.ReturnError(w, r, err)
@@ -316,8 +432,295 @@ func (s *Server) handleDeleteTweet(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handleGetTweetLikers handles the route "GET /tweet/:id/likes/:offset".
+// It returns 10 users who like the tweet, with the authed user's follow state on each.
+// The offset works like the offset of the home feed.
+func (s *Server) handleGetTweetLikers(w http.ResponseWriter, r *http.Request) {
+	s.handleGetTweetUsers(w, r, s.us.LikersByTweetID)
+}
+
+// handleGetTweetRetweeters handles the route "GET /tweet/:id/retweets/:offset".
+// It returns 10 users who retweeted the tweet, with the authed user's follow state on each.
+// The offset works like the offset of the home feed.
+func (s *Server) handleGetTweetRetweeters(w http.ResponseWriter, r *http.Request) {
+	s.handleGetTweetUsers(w, r, s.us.RetweetersByTweetID)
+}
+
+// handleGetTweetUsers does the work for handleGetTweetLikers and handleGetTweetRetweeters.
+// It parses the tweet ID and the offset, makes sure the tweet exists, finds the users
+// using the passed in function, and attaches the authed user's follow to each of them.
+func (s *Server) handleGetTweetUsers(w http.ResponseWriter, r *http.Request, find func(tweetId, offset int) ([]domain.User, error)) {
+	// Parse the tweet ID from the url.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Parse the offset from the url.
+	offset, err := strconv.Atoi(mux.Vars(r)["offset"])
+	if offset < 0 || err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid offset value."))
+		return
+	}
+
+	// Make sure the tweet exists.
+	if _, err = s.ts.ByID(id); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Find the users.
+	users, err := find(id, offset)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Check if the authed user is following each of those users.
+	authedUser := s.getUserFromContext(r.Context())
+	for i := range users {
+		if users[i].ID == authedUser.ID {
+			continue
+		}
+		authFollow, err := s.us.GetAuthFollow(authedUser.ID, users[i].ID)
+		if err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+		users[i].AuthFollow = authFollow
+	}
+
+	// Return the users.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newUserViews(users)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleGetHiddenReplies handles the route "GET /tweet/:id/replies/hidden".
+// It returns the replies to the tweet that its author has hidden, along with their
+// images and relevant association data.
+func (s *Server) handleGetHiddenReplies(w http.ResponseWriter, r *http.Request) {
+	// Parse the tweet ID from the url.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Make sure the tweet exists.
+	if _, err = s.ts.ByID(id); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Fetch the hidden replies from the database.
+	replies, err := s.ts.HiddenRepliesByID(id)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Get the replies' images and association data.
+	authedUser := s.getUserFromContext(r.Context())
+	for i := range replies {
+		if err = s.SetTweetImages(&replies[i]); err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+		s.SetTweetMediaVisibility(authedUser, &replies[i])
+		if err = s.SetTweetAssociationCounts(&replies[i]); err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+		if err = s.SetUserTweetAssociationData(authedUser.ID, &replies[i]); err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+	}
+
+	// Record an impression of each of the hidden replies.
+	s.RecordTweetImpressions(authedUser.ID, tweetPointers(replies)...)
+
+	// Return the hidden replies.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newTweetViews(replies)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleHideReply handles the route "POST /tweet/:id/hide".
+// It hides a reply to one of the authed user's tweets.
+func (s *Server) handleHideReply(w http.ResponseWriter, r *http.Request) {
+	s.handleSetReplyHidden(w, r, true)
+}
+
+// handleUnhideReply handles the route "DELETE /tweet/:id/hide".
+// It un-hides a previously hidden reply to one of the authed user's tweets.
+func (s *Server) handleUnhideReply(w http.ResponseWriter, r *http.Request) {
+	s.handleSetReplyHidden(w, r, false)
+}
+
+// handleSetReplyHidden does the work for handleHideReply and handleUnhideReply.
+// Only the author of the replied-to tweet is allowed to hide or un-hide a reply.
+func (s *Server) handleSetReplyHidden(w http.ResponseWriter, r *http.Request, hidden bool) {
+	// Parse the reply's ID from the url.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Fetch the reply from the database.
+	reply, err := s.ts.ByID(id)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	if reply.RepliesToID == nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Only replies can be hidden."))
+		return
+	}
+
+	// Check if the replied-to tweet belongs to the authed user.
+	repliedTo, err := s.ts.ByID(*reply.RepliesToID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	user := s.getUserFromContext(r.Context())
+	if repliedTo.UserID != user.ID {
+		errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "You can only hide replies to your own tweets."))
+		return
+	}
+
+	// Hide or un-hide the reply.
+	if err = s.ts.SetReplyHidden(reply, hidden); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return Http Status 204 to indicate success.
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUpdateTweetSensitive handles the route "PUT /tweet/:id/sensitive".
+// It reads the sensitive flag and the content warning from the json body and updates
+// the tweet accordingly. Only the author of the tweet is allowed to do that.
+func (s *Server) handleUpdateTweetSensitive(w http.ResponseWriter, r *http.Request) {
+	// Parse the tweet ID from the url.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Parse the request's json body. It only contains sensitive and content_warning.
+	var input domain.Tweet
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	// Fetch the tweet from the database.
+	tweet, err := s.ts.ByID(id)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Check if the tweet belongs to the authed user.
+	user := s.getUserFromContext(r.Context())
+	if tweet.UserID != user.ID {
+		errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "You are not allowed to edit this tweet."))
+		return
+	}
+
+	// Update the tweet (includes validation of the content warning).
+	tweet.Sensitive = input.Sensitive
+	tweet.ContentWarning = input.ContentWarning
+	if err = s.ts.SetSensitive(tweet); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return Http Status 204 to indicate success.
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePinTweet handles the route "POST /tweet/:id/pin".
+// It pins one of the authed user's original tweets to their profile, replacing
+// any previously pinned tweet. On success, it returns the updated user.
+func (s *Server) handlePinTweet(w http.ResponseWriter, r *http.Request) {
+	// Parse the tweet ID from the url.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Fetch the tweet from the database.
+	tweet, err := s.ts.ByID(id)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Check if the tweet belongs to the authed user.
+	user := s.getUserFromContext(r.Context())
+	if tweet.UserID != user.ID {
+		errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "You are not allowed to pin this tweet."))
+		return
+	}
+
+	// Pin the tweet and update the user record in the database (includes validation).
+	user.PinnedTweetID = &tweet.ID
+	if err = s.us.Update(user); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return the user.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newMeView(user)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleUnpinTweet handles the route "DELETE /tweet/:id/pin".
+// It removes the pinned tweet from the authed user's profile. The tweet itself stays untouched.
+func (s *Server) handleUnpinTweet(w http.ResponseWriter, r *http.Request) {
+	// Parse the tweet ID from the url.
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid Id format."))
+		return
+	}
+
+	// Check if the tweet is the one pinned to the authed user's profile.
+	user := s.getUserFromContext(r.Context())
+	if user.PinnedTweetID == nil || *user.PinnedTweetID != id {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "This tweet is not pinned to your profile."))
+		return
+	}
+
+	// Unpin the tweet and update the user record in the database.
+	user.PinnedTweetID = nil
+	if err = s.us.Update(user); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Return Http Status 204 to indicate successful removal.
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // SetTweetImages takes a pointer to a tweet, finds its images
-// in the filesystem and attaches the resulting Image slice to it.
+// in the media table and attaches the resulting Image slice to it.
 // If the tweet is a retweet or a reply and therefore has a "parent" tweet,
 // it recursively does the same to the tweet that it retweets / replies to.
 func (s *Server) SetTweetImages(tweet *domain.Tweet) error {
@@ -346,6 +749,35 @@ func (s *Server) SetTweetImages(tweet *domain.Tweet) error {
 	return nil
 }
 
+// SetTweetMediaVisibility takes a pointer to the authenticated user and a pointer to a tweet,
+// and determines how the tweet's media is displayed to the user. If the tweet's media is
+// sensitive, the user's SensitiveMedia setting applies. If it's set to hide sensitive media,
+// the tweet's images are removed. Users always see their own media. If the tweet is a retweet
+// or a reply, it recursively does the same to the tweet that it retweets / replies to.
+// It must be called after SetTweetImages.
+func (s *Server) SetTweetMediaVisibility(authedUser *domain.User, tweet *domain.Tweet) {
+	tweet.MediaVisibility = domain.MediaShow
+	if tweet.Sensitive && tweet.UserID != authedUser.ID {
+		tweet.MediaVisibility = authedUser.SensitiveMedia
+		if tweet.MediaVisibility == "" {
+			tweet.MediaVisibility = domain.MediaBlur
+		}
+		if tweet.MediaVisibility == domain.MediaHide {
+			tweet.Images = nil
+		}
+	}
+
+	// If the tweet is a Reply, repeat the above with the original tweet.
+	if tweet.RepliesTo != nil {
+		s.SetTweetMediaVisibility(authedUser, tweet.RepliesTo)
+	}
+
+	// If the tweet is a Retweet, repeat the above with the original tweet.
+	if tweet.RetweetsTweet != nil {
+		s.SetTweetMediaVisibility(authedUser, tweet.RetweetsTweet)
+	}
+}
+
 // SetTweetAssociationCounts takes a pointer to a tweet, counts its replies, retweets
 // and likes and sets those numbers to the according fields.
 // If the tweet is a retweet or a reply and therefore has a "parent" tweet,
@@ -435,3 +867,12 @@ func (s *Server) SetUserTweetAssociationData(authUserId int, tweet *domain.Tweet
 
 	return nil
 }
+
+// tweetPointers returns pointers to the elements of a tweet slice.
+func tweetPointers(tweets []domain.Tweet) []*domain.Tweet {
+	pointers := make([]*domain.Tweet, len(tweets))
+	for i := range tweets {
+		pointers[i] = &tweets[i]
+	}
+	return pointers
+}
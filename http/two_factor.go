@@ -0,0 +1,226 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+	"wtfTwitter/domain"
+	"wtfTwitter/errs"
+)
+
+// registerTwoFactorRoutes is a helper for registering all two-factor authentication routes.
+func (s *Server) registerTwoFactorRoutes(r *mux.Router) {
+	// Complete a login that requires a second factor.
+	r.HandleFunc("/login/2fa", s.handleLoginTwoFactor).Methods("POST")
+
+	// Get the authed user's two-factor authentication status.
+	r.HandleFunc("/account/2fa", s.requireAuth(s.handleGetTwoFactor)).Methods("GET")
+
+	// Start setting up two-factor authentication. Returns the secret for the authenticator app.
+	r.HandleFunc("/account/2fa/enroll", s.requireAuth(s.handleEnrollTwoFactor)).Methods("POST")
+
+	// Finish setting up two-factor authentication with a first code. Returns recovery codes.
+	r.HandleFunc("/account/2fa/confirm", s.requireAuth(s.handleConfirmTwoFactor)).Methods("POST")
+
+	// Replace the authed user's recovery codes with new ones.
+	r.HandleFunc("/account/2fa/recovery_codes", s.requireAuth(s.handleRegenerateRecoveryCodes)).Methods("POST")
+
+	// Turn two-factor authentication off.
+	r.HandleFunc("/account/2fa", s.requireAuth(s.handleDisableTwoFactor)).Methods("DELETE")
+}
+
+// twoFactorCodeBody is the json body of requests that must be confirmed with a code.
+// Code is either a TOTP code or a recovery code. Challenge is only needed to complete
+// a login challenge, and may be left out after signing in with oauth, see cookieLoginChallenge.
+type twoFactorCodeBody struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// handleLoginTwoFactor handles the route "POST /login/2fa".
+// It completes the login challenge returned by "POST /login", or set as a cookie by an oauth sign-in,
+// and signs the user in.
+func (s *Server) handleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body (challenge and code).
+	var body twoFactorCodeBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+	if cookie, err := r.Cookie(cookieLoginChallenge); err == nil && body.Challenge == "" {
+		body.Challenge = cookie.Value
+	}
+
+	// Refuse the attempt if the client is locked after too many failed logins.
+	ipKey := "login:ip:" + clientIP(r)
+	if err := s.th.Check(ipKey); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Look up the challenge, and refuse the attempt if its account is locked after too many wrong codes.
+	challenge, err := s.tf.ChallengeByToken(body.Challenge)
+	if err != nil {
+		if errs.ErrorCode(err) == errs.EINVALID {
+			s.throttleHit(r, ipKey, domain.LoginIPPolicy)
+		}
+		errs.ReturnError(w, r, err)
+		return
+	}
+	accountKey := twoFactorAccountKey(challenge.UserID)
+	if err := s.th.Check(accountKey); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Complete the challenge. Count wrong codes against the client, like wrong passwords,
+	// and against the account, since the client can change its IP address.
+	if err := s.tf.CompleteChallenge(challenge, body.Code); err != nil {
+		if errs.ErrorCode(err) == errs.EINVALID {
+			s.throttleHit(r, ipKey, domain.LoginIPPolicy)
+			s.throttleHit(r, accountKey, domain.TwoFactorAccountPolicy)
+		}
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	// Fetch the user and sign them in.
+	user, err := s.us.ByIDForSignIn(challenge.UserID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	if err := s.signIn(w, r, user); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	s.resetLoginFailures(r, user)
+	http.SetCookie(w, &http.Cookie{Name: cookieLoginChallenge, Value: "", Expires: time.Now(), HttpOnly: true, Path: "/"})
+
+	// Return the logged-in user.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newMeView(user)); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleGetTwoFactor handles the route "GET /account/2fa".
+func (s *Server) handleGetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+
+	// Look up the user's second factor and count their remaining recovery codes.
+	tf, err := s.tf.ByUserID(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	view := twoFactorView{Enabled: tf.Enabled()}
+	if view.Enabled {
+		if view.RecoveryCodesLeft, err = s.tf.CountRecoveryCodes(user.ID); err != nil {
+			errs.ReturnError(w, r, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(view); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleEnrollTwoFactor handles the route "POST /account/2fa/enroll".
+// It generates a new secret for the authed user. Two-factor authentication
+// isn't enabled until the user confirms it with a first code.
+func (s *Server) handleEnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := s.getUserFromContext(r.Context())
+
+	tf, uri, err := s.tf.Enroll(user)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(twoFactorEnrollView{Secret: tf.Secret, URI: uri}); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleConfirmTwoFactor handles the route "POST /account/2fa/confirm".
+// It enables two-factor authentication and returns the user's recovery codes.
+func (s *Server) handleConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body (the code).
+	var body twoFactorCodeBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	user := s.getUserFromContext(r.Context())
+	codes, err := s.tf.Confirm(user.ID, body.Code)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(recoveryCodesView{RecoveryCodes: codes}); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleRegenerateRecoveryCodes handles the route "POST /account/2fa/recovery_codes".
+// It requires a valid code, so a hijacked session alone can't be used to obtain recovery codes.
+func (s *Server) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body (the code).
+	var body twoFactorCodeBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	user := s.getUserFromContext(r.Context())
+	if err := s.tf.Verify(user.ID, body.Code); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	codes, err := s.tf.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(recoveryCodesView{RecoveryCodes: codes}); err != nil {
+		errs.LogError(r, err)
+		return
+	}
+}
+
+// handleDisableTwoFactor handles the route "DELETE /account/2fa".
+// Like regenerating recovery codes, it requires a valid code.
+func (s *Server) handleDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Parse the request's json body (the code).
+	var body twoFactorCodeBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid json body."))
+		return
+	}
+
+	user := s.getUserFromContext(r.Context())
+	if err := s.tf.Verify(user.ID, body.Code); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+	if err := s.tf.Disable(user.ID); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,125 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"wtfTwitter/domain"
+)
+
+// newTwoFactorTestServer returns a server with a single user, who has two-factor authentication
+// enabled with the code 123456.
+func newTwoFactorTestServer() (*Server, *fakeThrottleService) {
+	th := newFakeThrottleService()
+	return &Server{
+		us: &fakeUserService{users: []domain.User{{ID: 1, Email: "alice@example.com", Password: "correct horse"}}},
+		ss: &fakeSessionService{},
+		tf: newFakeTwoFactorService("123456"),
+		th: th,
+	}, th
+}
+
+// login submits the password from the given IP address and returns the response and the challenge.
+func login(s *Server, ip, password string) (*httptest.ResponseRecorder, string) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"email": "alice@example.com", "password": "`+password+`"}`))
+	r.RemoteAddr = ip + ":4711"
+	s.handleLogin(w, r)
+	var view twoFactorChallengeView
+	_ = json.Unmarshal(w.Body.Bytes(), &view)
+	return w, view.Challenge
+}
+
+// loginTwoFactor submits a code for a challenge from the given IP address.
+func loginTwoFactor(s *Server, ip, challenge, code string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/login/2fa", strings.NewReader(`{"challenge": "`+challenge+`", "code": "`+code+`"}`))
+	r.RemoteAddr = ip + ":4711"
+	s.handleLoginTwoFactor(w, r)
+	return w
+}
+
+// TestLoginTwoFactorLocksAccount brute-forces the second factor of a user whose password is known,
+// with a new client IP address for every request, and expects the account to be locked anyway.
+func TestLoginTwoFactorLocksAccount(t *testing.T) {
+	s, th := newTwoFactorTestServer()
+	requests := 0
+	nextIP := func() string {
+		requests++
+		return fmt.Sprintf("198.51.%d.%d", requests/256, requests%256)
+	}
+
+	// Guess codes until the account is locked, getting a new challenge whenever one runs out of attempts.
+	wrongCodes := 0
+	var challenge string
+	for locked := false; !locked; {
+		if wrongCodes > domain.TwoFactorAccountPolicy.Threshold+1 {
+			t.Fatalf("still not locked after %d wrong codes", wrongCodes)
+		}
+		if challenge == "" || wrongCodes%domain.LoginChallengeMaxAttempts == 0 {
+			w, c := login(s, nextIP(), "correct horse")
+			if w.Code != http.StatusOK || c == "" {
+				t.Fatalf("login after %d wrong codes: status %d, %s", wrongCodes, w.Code, w.Body)
+			}
+			challenge = c
+		}
+		w := loginTwoFactor(s, nextIP(), challenge, fmt.Sprintf("%06d", wrongCodes))
+		switch w.Code {
+		case http.StatusBadRequest:
+			wrongCodes++
+		case http.StatusTooManyRequests:
+			locked = true
+		default:
+			t.Fatalf("wrong code: status %d, %s", w.Code, w.Body)
+		}
+	}
+	if wrongCodes != domain.TwoFactorAccountPolicy.Threshold+1 {
+		t.Errorf("locked after %d wrong codes, want %d", wrongCodes, domain.TwoFactorAccountPolicy.Threshold+1)
+	}
+
+	// No client got close to being locked itself.
+	for i := 1; i <= requests; i++ {
+		ip := fmt.Sprintf("198.51.%d.%d", i/256, i%256)
+		if n := th.count("login:ip:" + ip); n > 1 {
+			t.Errorf("%d failures recorded for %s", n, ip)
+		}
+	}
+
+	// From a new IP address, neither the correct code nor a new challenge get through.
+	if w := loginTwoFactor(s, nextIP(), challenge, "123456"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("correct code while locked: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w, c := login(s, nextIP(), "correct horse"); w.Code != http.StatusTooManyRequests || c != "" {
+		t.Errorf("login while locked: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+// TestLoginResetsFailuresAfterSecondFactor makes sure that the account's failures are only
+// forgotten once the second factor has been checked, not when the password is correct.
+func TestLoginResetsFailuresAfterSecondFactor(t *testing.T) {
+	s, th := newTwoFactorTestServer()
+	accountKey := "login:account:alice@example.com"
+	if w, _ := login(s, "203.0.113.1", "wrong"); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong password: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	w, challenge := login(s, "203.0.113.1", "correct horse")
+	if w.Code != http.StatusOK || challenge == "" {
+		t.Fatalf("login: status %d, %s", w.Code, w.Body)
+	}
+	if w := loginTwoFactor(s, "203.0.113.1", challenge, "000000"); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong code: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if th.count(accountKey) != 1 || th.count(twoFactorAccountKey(1)) != 1 {
+		t.Fatalf("failures forgotten before the second factor: %d, %d", th.count(accountKey), th.count(twoFactorAccountKey(1)))
+	}
+
+	if w := loginTwoFactor(s, "203.0.113.1", challenge, "123456"); w.Code != http.StatusOK {
+		t.Fatalf("correct code: status %d, %s", w.Code, w.Body)
+	}
+	if th.count(accountKey) != 0 || th.count(twoFactorAccountKey(1)) != 0 {
+		t.Errorf("failures not forgotten after signing in: %d, %d", th.count(accountKey), th.count(twoFactorAccountKey(1)))
+	}
+}
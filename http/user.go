@@ -11,13 +11,13 @@ import (
 
 func (s *Server) registerUserRoutes(r *mux.Router) {
 	// Get the profile data of a specific user.
-	r.HandleFunc("/profile/{user_id:[0-9]+}", s.requireAuth(s.handleGetProfile)).Methods("GET")
+	r.HandleFunc("/profile/{user_id:[0-9]+}", s.requireScope(domain.ScopeRead, s.handleGetProfile)).Methods("GET")
 
 	// Update the user's data.
 	r.HandleFunc("/profile/update", s.requireAuth(s.handleUpdateProfile)).Methods("PUT")
 
 	// Search for users.
-	r.HandleFunc("/search/profiles/{term}", s.requireAuth(s.handleSearchProfiles)).Methods("GET")
+	r.HandleFunc("/search/profiles/{term}", s.requireScope(domain.ScopeRead, s.handleSearchProfiles)).Methods("GET")
 }
 
 // handleSearchProfiles handles the route "GET /search/profiles/{term}".
@@ -35,7 +35,7 @@ func (s *Server) handleSearchProfiles(w http.ResponseWriter, r *http.Request) {
 
 	// Return the result.
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(profiles); err != nil {
+	if err := json.NewEncoder(w).Encode(newUserViews(profiles)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
@@ -75,37 +75,76 @@ func (s *Server) handleGetProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Get the tweet the user has pinned to their profile, if any.
+	if err = s.SetPinnedTweet(authedUser, user); err != nil {
+		errs.ReturnError(w, r, err)
+		return
+	}
+
 	// Return the user.
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(&user); err != nil {
+	if err := json.NewEncoder(w).Encode(newUserView(user)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
 }
 
 // handleUpdateProfile handles the route "PUT /profile/update".
-// It reads user data from the json body and updates the user record in the database.
+// It reads profile data from the json body and updates the authed user's record in the database.
+// Only the fields below can be changed this way. Fields that are missing in the body stay as they are.
+// Passwords are changed through "PUT /account/password", images and the pinned tweet have their own routes too.
 func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
-	// Parse the request's json body into a User object.
-	var user domain.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	// Parse the request's json body.
+	var body struct {
+		ID             int     `json:"id"`
+		Email          *string `json:"email"`
+		Name           *string `json:"name"`
+		Handle         *string `json:"handle"`
+		Bio            *string `json:"bio"`
+		SensitiveMedia *string `json:"sensitive_media"`
+		RequireAltText *bool   `json:"require_alt_text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		errs.ReturnError(w, r, errs.Errorf(errs.EINVALID, "Invalid update data."))
 		return
 	}
 
 	// Check if the authed user is allowed to update that user record.
 	authedUser := s.getUserFromContext(r.Context())
-	if authedUser.ID != user.ID {
+	if body.ID != 0 && authedUser.ID != body.ID {
 		errs.ReturnError(w, r, errs.Errorf(errs.EUNAUTHORIZED, "You are not allowed to updated this user."))
 		return
 	}
 
-	// Update the authenticated user with the data in the User object.
-	err := s.us.Update(&user)
+	// Apply the submitted changes to a copy of the authed user.
+	// The email address is only changed once the new one has been confirmed, see below.
+	user := *authedUser
+	if body.Name != nil {
+		user.Name = *body.Name
+	}
+	if body.Handle != nil {
+		user.Handle = *body.Handle
+	}
+	if body.Bio != nil {
+		user.Bio = *body.Bio
+	}
+	if body.SensitiveMedia != nil {
+		user.SensitiveMedia = *body.SensitiveMedia
+	}
+	if body.RequireAltText != nil {
+		user.RequireAltText = *body.RequireAltText
+	}
+
+	// Update the authenticated user's record. If a new email address was submitted, it's stored
+	// as pending along with the other changes, and a confirmation link is sent to it.
+	token, err := s.us.UpdateProfile(&user, body.Email)
 	if err != nil {
 		errs.ReturnError(w, r, err)
 		return
 	}
+	if token != "" {
+		s.sendEmailChangeEmails(&user, token)
+	}
 
 	// Get the number of tweets, followers and followeds of the user.
 	if err = s.SetUserAssociationCounts(&user); err != nil {
@@ -115,7 +154,7 @@ func (s *Server) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
 
 	// Return the updated User.
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(user); err != nil {
+	if err := json.NewEncoder(w).Encode(newMeView(&user)); err != nil {
 		errs.LogError(r, err)
 		return
 	}
@@ -147,3 +186,26 @@ func (s *Server) SetUserAssociationCounts(user *domain.User) error {
 
 	return nil
 }
+
+// SetPinnedTweet takes pointers to the authenticated user and to a user object.
+// It fetches the tweet that the user has pinned to their profile, along with its images
+// and association data, and attaches it to the user. If there is none, it does nothing.
+func (s *Server) SetPinnedTweet(authedUser *domain.User, user *domain.User) error {
+	pinned, err := s.ts.PinnedByUserID(user.ID)
+	if err != nil || pinned == nil {
+		return err
+	}
+	if err = s.SetTweetImages(pinned); err != nil {
+		return err
+	}
+	s.SetTweetMediaVisibility(authedUser, pinned)
+	if err = s.SetTweetAssociationCounts(pinned); err != nil {
+		return err
+	}
+	if err = s.SetUserTweetAssociationData(authedUser.ID, pinned); err != nil {
+		return err
+	}
+	s.RecordTweetImpressions(authedUser.ID, pinned)
+	user.PinnedTweet = pinned
+	return nil
+}
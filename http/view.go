@@ -0,0 +1,552 @@
+package http
+
+import (
+	"strings"
+	"time"
+	"wtfTwitter/domain"
+)
+
+// This file contains the API representation of the domain models. Handlers never encode
+// domain models directly, since those carry data that must never leave the server, like
+// password and remember hashes or oauth tokens. Instead, every response is built from
+// the views below, which only contain what the client is supposed to see. When adding
+// a field to a domain model, it only shows up in responses once it's added here.
+
+// userView is the public representation of a User, used whenever a user is displayed
+// to other users: as the author of a tweet, in follows, search results and profiles.
+type userView struct {
+	ID            int         `json:"id"`
+	Name          string      `json:"name"`
+	Handle        string      `json:"handle"`
+	Bio           string      `json:"bio"`
+	Avatar        string      `json:"avatar"`
+	Header        string      `json:"header"`
+	PinnedTweetID *int        `json:"pinned_tweet_id"`
+	PinnedTweet   *tweetView  `json:"pinned_tweet,omitempty"`
+	AuthFollow    *followView `json:"auth_follow,omitempty"`
+	TweetCount    int         `json:"tweet_count"`
+	FollowerCount int         `json:"follower_count"`
+	FollowedCount int         `json:"followed_count"`
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+// meView is the private representation of a User, used only when the authenticated
+// user requests their own account. In addition to the public data, it contains
+// the user's email address and settings.
+type meView struct {
+	userView
+	Email          string `json:"email"`
+	EmailVerified  bool   `json:"email_verified"`
+	PendingEmail   string `json:"pending_email"`
+	SensitiveMedia string `json:"sensitive_media"`
+	RequireAltText bool   `json:"require_alt_text"`
+	HasPassword    bool   `json:"has_password"`
+}
+
+// tweetView is the representation of a Tweet.
+type tweetView struct {
+	ID      int      `json:"id"`
+	UserID  int      `json:"user_id"`
+	User    userView `json:"user"`
+	Content string   `json:"content"`
+
+	RepliesToID    *int        `json:"replies_to_id,omitempty"`
+	RepliesTo      *tweetView  `json:"replies_to,omitempty"`
+	Replies        []tweetView `json:"replies"`
+	RepliesCount   int         `json:"replies_count"`
+	AuthReplied    bool        `json:"auth_replied"`
+	ReplyToDeleted bool        `json:"reply_to_deleted"`
+	ReplyPolicy    string      `json:"reply_policy"`
+	ReplyHidden    bool        `json:"reply_hidden"`
+
+	RetweetsID    *int        `json:"retweets_id,omitempty"`
+	RetweetsTweet *tweetView  `json:"retweets_tweet,omitempty"`
+	Retweets      []tweetView `json:"retweets"`
+	RetweetsCount int         `json:"retweets_count"`
+	AuthRetweet   *tweetView  `json:"auth_retweet,omitempty"`
+
+	Likes      []likeView `json:"likes"`
+	LikesCount int        `json:"likes_count"`
+	AuthLike   *likeView  `json:"auth_like,omitempty"`
+
+	Images          []imageView `json:"images"`
+	Sensitive       bool        `json:"sensitive"`
+	ContentWarning  string      `json:"content_warning"`
+	MediaVisibility string      `json:"media_visibility"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+// followView is the representation of a Follow.
+type followView struct {
+	ID         int       `json:"id"`
+	FollowerID int       `json:"follower_id"`
+	Follower   userView  `json:"follower"`
+	FollowedID int       `json:"followed_id"`
+	Followed   userView  `json:"followed"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// likeView is the representation of a Like.
+type likeView struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	TweetID   int       `json:"tweet_id"`
+	Tweet     tweetView `json:"tweet"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// imageView is the representation of an Image.
+type imageView struct {
+	ID       int                         `json:"id"`
+	URL      string                      `json:"url"`
+	AltText  string                      `json:"alt_text"`
+	Width    int                         `json:"width"`
+	Height   int                         `json:"height"`
+	Animated bool                        `json:"animated"`
+	Duration int                         `json:"duration"`
+	Variants map[string]imageVariantView `json:"variants"`
+}
+
+// imageVariantView is the representation of an ImageVariant. Variants are keyed by their name.
+type imageVariantView struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// sessionView is the representation of a Session. Current is true for the session
+// of the device the request comes from.
+type sessionView struct {
+	ID         int       `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// newUserView builds the public representation of a user.
+func newUserView(user *domain.User) userView {
+	v := userView{
+		ID:            user.ID,
+		Name:          user.Name,
+		Handle:        user.Handle,
+		Bio:           user.Bio,
+		Avatar:        user.Avatar,
+		Header:        user.Header,
+		PinnedTweetID: user.PinnedTweetID,
+		TweetCount:    user.TweetCount,
+		FollowerCount: user.FollowerCount,
+		FollowedCount: user.FollowedCount,
+		CreatedAt:     user.CreatedAt,
+	}
+	if user.PinnedTweet != nil {
+		pinned := newTweetView(user.PinnedTweet)
+		v.PinnedTweet = &pinned
+	}
+	if user.AuthFollow != nil {
+		authFollow := newFollowView(user.AuthFollow)
+		v.AuthFollow = &authFollow
+	}
+	return v
+}
+
+// newUserViews builds the public representations of a slice of users.
+func newUserViews(users []domain.User) []userView {
+	if users == nil {
+		return nil
+	}
+	views := make([]userView, len(users))
+	for i := range users {
+		views[i] = newUserView(&users[i])
+	}
+	return views
+}
+
+// newMeView builds the private representation of the authenticated user's account.
+func newMeView(user *domain.User) meView {
+	return meView{
+		userView:       newUserView(user),
+		Email:          user.Email,
+		EmailVerified:  user.IsVerified(),
+		PendingEmail:   user.PendingEmail,
+		SensitiveMedia: user.SensitiveMedia,
+		RequireAltText: user.RequireAltText,
+		HasPassword:    user.PasswordHash != "",
+	}
+}
+
+// newTweetView builds the representation of a tweet, including its loaded associations.
+func newTweetView(tweet *domain.Tweet) tweetView {
+	v := tweetView{
+		ID:              tweet.ID,
+		UserID:          tweet.UserID,
+		User:            newUserView(&tweet.User),
+		Content:         tweet.Content,
+		RepliesToID:     tweet.RepliesToID,
+		Replies:         newTweetViews(tweet.Replies),
+		RepliesCount:    tweet.RepliesCount,
+		AuthReplied:     tweet.AuthReplied,
+		ReplyToDeleted:  tweet.ReplyToDeleted,
+		ReplyPolicy:     tweet.ReplyPolicy,
+		ReplyHidden:     tweet.ReplyHidden,
+		RetweetsID:      tweet.RetweetsID,
+		Retweets:        newTweetViews(tweet.Retweets),
+		RetweetsCount:   tweet.RetweetsCount,
+		LikesCount:      tweet.LikesCount,
+		Images:          newImageViews(tweet.Images),
+		Sensitive:       tweet.Sensitive,
+		ContentWarning:  tweet.ContentWarning,
+		MediaVisibility: tweet.MediaVisibility,
+		CreatedAt:       tweet.CreatedAt,
+		UpdatedAt:       tweet.UpdatedAt,
+	}
+	if tweet.RepliesTo != nil {
+		repliesTo := newTweetView(tweet.RepliesTo)
+		v.RepliesTo = &repliesTo
+	}
+	if tweet.RetweetsTweet != nil {
+		retweetsTweet := newTweetView(tweet.RetweetsTweet)
+		v.RetweetsTweet = &retweetsTweet
+	}
+	if tweet.AuthRetweet != nil {
+		authRetweet := newTweetView(tweet.AuthRetweet)
+		v.AuthRetweet = &authRetweet
+	}
+	if tweet.Likes != nil {
+		v.Likes = make([]likeView, len(tweet.Likes))
+		for i := range tweet.Likes {
+			v.Likes[i] = newLikeView(&tweet.Likes[i])
+		}
+	}
+	if tweet.AuthLike != nil {
+		authLike := newLikeView(tweet.AuthLike)
+		v.AuthLike = &authLike
+	}
+	if tweet.DeletedAt.Valid {
+		v.DeletedAt = &tweet.DeletedAt.Time
+	}
+	return v
+}
+
+// newTweetViews builds the representations of a slice of tweets.
+func newTweetViews(tweets []domain.Tweet) []tweetView {
+	if tweets == nil {
+		return nil
+	}
+	views := make([]tweetView, len(tweets))
+	for i := range tweets {
+		views[i] = newTweetView(&tweets[i])
+	}
+	return views
+}
+
+// newFollowView builds the representation of a follow.
+func newFollowView(follow *domain.Follow) followView {
+	return followView{
+		ID:         follow.ID,
+		FollowerID: follow.FollowerID,
+		Follower:   newUserView(&follow.Follower),
+		FollowedID: follow.FollowedID,
+		Followed:   newUserView(&follow.Followed),
+		CreatedAt:  follow.CreatedAt,
+		UpdatedAt:  follow.UpdatedAt,
+	}
+}
+
+// newLikeView builds the representation of a like.
+func newLikeView(like *domain.Like) likeView {
+	return likeView{
+		ID:        like.ID,
+		UserID:    like.UserID,
+		TweetID:   like.TweetID,
+		Tweet:     newTweetView(&like.Tweet),
+		CreatedAt: like.CreatedAt,
+		UpdatedAt: like.UpdatedAt,
+	}
+}
+
+// newImageViews builds the representations of a slice of images.
+func newImageViews(images []domain.Image) []imageView {
+	if images == nil {
+		return nil
+	}
+	views := make([]imageView, len(images))
+	for i := range images {
+		variants := make(map[string]imageVariantView, len(images[i].Variants))
+		for _, v := range images[i].Variants {
+			variants[v.Name] = imageVariantView{URL: v.URL, Width: v.Width, Height: v.Height}
+		}
+		views[i] = imageView{
+			ID:       images[i].ID,
+			URL:      images[i].URL,
+			AltText:  images[i].AltText,
+			Width:    images[i].Width,
+			Height:   images[i].Height,
+			Animated: images[i].IsAnimated(),
+			Duration: images[i].Duration,
+			Variants: variants,
+		}
+	}
+	return views
+}
+
+// newSessionViews builds the representations of a slice of sessions,
+// marking the one with the ID currentId as the current one.
+func newSessionViews(sessions []domain.Session, currentId int) []sessionView {
+	views := make([]sessionView, len(sessions))
+	for i, session := range sessions {
+		views[i] = sessionView{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			Current:    session.ID == currentId,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+		}
+	}
+	return views
+}
+
+// twoFactorChallengeView is returned instead of the user when a password login
+// requires a second factor. The challenge must be passed to "POST /login/2fa".
+type twoFactorChallengeView struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	Challenge         string `json:"challenge"`
+}
+
+// newTwoFactorChallengeView builds the representation of a login challenge.
+func newTwoFactorChallengeView(challenge string) twoFactorChallengeView {
+	return twoFactorChallengeView{
+		TwoFactorRequired: true,
+		Challenge:         challenge,
+	}
+}
+
+// twoFactorView is the representation of the authed user's two-factor authentication status.
+type twoFactorView struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// twoFactorEnrollView contains what a user needs to set up their authenticator app.
+// URI is the otpauth:// provisioning URI, usually displayed as a QR code.
+type twoFactorEnrollView struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// recoveryCodesView contains newly generated recovery codes. They are only ever returned once.
+type recoveryCodesView struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// credentialView is the representation of a passkey. The public key isn't included,
+// since the client has no use for it.
+type credentialView struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// newCredentialView builds the representation of a passkey.
+func newCredentialView(credential *domain.Credential) credentialView {
+	return credentialView{
+		ID:         credential.ID,
+		Name:       credential.Name,
+		CreatedAt:  credential.CreatedAt,
+		LastUsedAt: credential.LastUsedAt,
+	}
+}
+
+// newCredentialViews builds the representations of a slice of passkeys.
+func newCredentialViews(credentials []domain.Credential) []credentialView {
+	views := make([]credentialView, len(credentials))
+	for i := range credentials {
+		views[i] = newCredentialView(&credentials[i])
+	}
+	return views
+}
+
+// identityView is the representation of an account at an oauth provider linked to the user.
+// The provider's tokens aren't included.
+type identityView struct {
+	Provider  string    `json:"provider"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// newIdentityViews builds the representations of a slice of oauth records.
+func newIdentityViews(oauths []domain.OAuth) []identityView {
+	views := make([]identityView, len(oauths))
+	for i, oauth := range oauths {
+		views[i] = identityView{
+			Provider:  oauth.Provider,
+			CreatedAt: oauth.CreatedAt,
+		}
+	}
+	return views
+}
+
+// accessTokenView is the representation of a personal access token. Token is only
+// included right after the access token has been created.
+type accessTokenView struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// newAccessTokenView builds the representation of a personal access token.
+func newAccessTokenView(accessToken *domain.AccessToken) accessTokenView {
+	return accessTokenView{
+		ID:         accessToken.ID,
+		Name:       accessToken.Name,
+		Token:      accessToken.Token,
+		Scopes:     accessToken.Scopes(),
+		ExpiresAt:  accessToken.ExpiresAt,
+		LastUsedAt: accessToken.LastUsedAt,
+		CreatedAt:  accessToken.CreatedAt,
+	}
+}
+
+// newAccessTokenViews builds the representations of a slice of personal access tokens.
+func newAccessTokenViews(accessTokens []domain.AccessToken) []accessTokenView {
+	views := make([]accessTokenView, len(accessTokens))
+	for i := range accessTokens {
+		views[i] = newAccessTokenView(&accessTokens[i])
+	}
+	return views
+}
+
+// oauthClientView is the representation of an app registered by the user. Secret is only
+// included right after the app has been registered.
+type oauthClientView struct {
+	ClientID     string    `json:"client_id"`
+	Secret       string    `json:"secret,omitempty"`
+	Name         string    `json:"name"`
+	Confidential bool      `json:"confidential"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// newOAuthClientView builds the representation of an app registered by the user.
+func newOAuthClientView(client *domain.OAuthClient) oauthClientView {
+	return oauthClientView{
+		ClientID:     client.ClientID,
+		Secret:       client.Secret,
+		Name:         client.Name,
+		Confidential: client.Confidential,
+		RedirectURIs: client.RedirectURIList(),
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// newOAuthClientViews builds the representations of a slice of apps registered by the user.
+func newOAuthClientViews(clients []domain.OAuthClient) []oauthClientView {
+	views := make([]oauthClientView, len(clients))
+	for i := range clients {
+		views[i] = newOAuthClientView(&clients[i])
+	}
+	return views
+}
+
+// authorizationView is what the consent screen shows: the app asking for authorization and the
+// requested scopes. Granted reports whether the user has granted those scopes to the app before.
+type authorizationView struct {
+	ClientID    string   `json:"client_id"`
+	Name        string   `json:"name"`
+	RedirectURI string   `json:"redirect_uri"`
+	Scopes      []string `json:"scopes"`
+	Granted     bool     `json:"granted"`
+}
+
+// newAuthorizationView builds what the consent screen shows.
+func newAuthorizationView(client *domain.OAuthClient, req *domain.AuthorizationRequest, granted bool) authorizationView {
+	return authorizationView{
+		ClientID:    client.ClientID,
+		Name:        client.Name,
+		RedirectURI: req.RedirectURI,
+		Scopes:      strings.Fields(req.Scope),
+		Granted:     granted,
+	}
+}
+
+// authorizedAppView is the representation of an app the user has authorized.
+type authorizedAppView struct {
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	Scopes       []string  `json:"scopes"`
+	AuthorizedAt time.Time `json:"authorized_at"`
+}
+
+// newAuthorizedAppViews builds the representations of a slice of grants.
+func newAuthorizedAppViews(grants []domain.OAuthGrant) []authorizedAppView {
+	views := make([]authorizedAppView, 0, len(grants))
+	for _, grant := range grants {
+		if grant.Client == nil {
+			continue
+		}
+		views = append(views, authorizedAppView{
+			ClientID:     grant.Client.ClientID,
+			Name:         grant.Client.Name,
+			Scopes:       strings.Fields(grant.Scope),
+			AuthorizedAt: grant.CreatedAt,
+		})
+	}
+	return views
+}
+
+// exportView is the representation of a personal data export. The download link is only sent by email.
+type exportView struct {
+	ID          int        `json:"id"`
+	Status      string     `json:"status"`
+	Size        int64      `json:"size"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// newExportView builds the representation of a personal data export.
+func newExportView(export *domain.Export) exportView {
+	return exportView{
+		ID:          export.ID,
+		Status:      export.Status,
+		Size:        export.Size,
+		CompletedAt: export.CompletedAt,
+		ExpiresAt:   export.ExpiresAt,
+		CreatedAt:   export.CreatedAt,
+	}
+}
+
+// importView is the representation of a Twitter archive import. Report is only set once the import is done.
+type importView struct {
+	ID          int                  `json:"id"`
+	Status      string               `json:"status"`
+	Error       string               `json:"error,omitempty"`
+	Report      *domain.ImportReport `json:"report"`
+	CompletedAt *time.Time           `json:"completed_at"`
+	CreatedAt   time.Time            `json:"created_at"`
+}
+
+// newImportView builds the representation of a Twitter archive import.
+func newImportView(imp *domain.Import) importView {
+	return importView{
+		ID:          imp.ID,
+		Status:      imp.Status,
+		Error:       imp.Error,
+		Report:      imp.Report,
+		CompletedAt: imp.CompletedAt,
+		CreatedAt:   imp.CreatedAt,
+	}
+}
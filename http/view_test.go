@@ -0,0 +1,215 @@
+package http
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"wtfTwitter/domain"
+)
+
+// secret is put into every field of the domain models that must never leave the server.
+const secret = "leaked-secret"
+
+// secretKeys are json keys that must never show up in a response.
+var secretKeys = []string{
+	"password", "password_hash", "remember_hash", "token_hash", "secret_hash", "secret_encrypted",
+	"code_hash", "access_token", "refresh_token", "public_key", "token", "secret", "recovery_codes",
+}
+
+// oneTimeKeys lists the views that show a secret to its owner once, right after it has been created.
+// Those keys are allowed in them, and nowhere else.
+var oneTimeKeys = map[string][]string{
+	"accessTokenView":     {"token"},
+	"oauthClientView":     {"secret"},
+	"twoFactorEnrollView": {"secret"},
+	"recoveryCodesView":   {"recovery_codes"},
+}
+
+// viewTypes lists every view type declared in view.go. TestViewTypesListed makes sure it's complete.
+var viewTypes = []interface{}{
+	userView{}, meView{}, tweetView{}, followView{}, likeView{}, imageView{}, imageVariantView{},
+	sessionView{}, twoFactorChallengeView{}, twoFactorView{}, twoFactorEnrollView{}, recoveryCodesView{},
+	credentialView{}, identityView{}, accessTokenView{}, oauthClientView{}, authorizationView{},
+	authorizedAppView{}, exportView{}, importView{},
+}
+
+// TestViewTypesListed fails if a view type has been added to view.go without being added to viewTypes.
+func TestViewTypesListed(t *testing.T) {
+	listed := map[string]bool{}
+	for _, v := range viewTypes {
+		listed[reflect.TypeOf(v).Name()] = true
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), "view.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			name := spec.(*ast.TypeSpec).Name.Name
+			if strings.HasSuffix(name, "View") && !listed[name] {
+				t.Errorf("%s is missing in viewTypes", name)
+			}
+		}
+	}
+}
+
+// TestViewTypesHaveNoSecretKeys walks the fields of every view type, including the types it
+// nests, and fails if one of them is encoded under a secret key.
+func TestViewTypesHaveNoSecretKeys(t *testing.T) {
+	for _, v := range viewTypes {
+		typ := reflect.TypeOf(v)
+		allowed := map[string]bool{}
+		for _, key := range oneTimeKeys[typ.Name()] {
+			allowed[key] = true
+		}
+		for _, key := range jsonKeys(typ, map[reflect.Type]bool{}) {
+			if isSecretKey(key) && !allowed[key] {
+				t.Errorf("%s encodes the secret key %q", typ.Name(), key)
+			}
+		}
+	}
+}
+
+// TestViewsDoNotLeakSecrets builds every view from domain models whose secret fields are set,
+// as they are when loaded from the database, and fails if a secret shows up in the encoded view.
+func TestViewsDoNotLeakSecrets(t *testing.T) {
+	user := secretUser(1)
+	follower := secretUser(2)
+	tweet := domain.Tweet{
+		ID:     1,
+		UserID: user.ID,
+		User:   user,
+		Images: []domain.Image{{ID: 1, Key: "tweet/1/a.png", URL: "images/tweet/1/a.png"}},
+	}
+	parent := tweet
+	reply := domain.Tweet{ID: 2, UserID: follower.ID, User: follower, RepliesTo: &parent}
+	tweet.Replies = []domain.Tweet{reply}
+	retweet := domain.Tweet{ID: 3, UserID: follower.ID, User: follower, RetweetsTweet: &tweet}
+	pinned := parent
+	user.PinnedTweet = &pinned
+	user.AuthFollow = &domain.Follow{ID: 1, Follower: follower, Followed: user}
+	client := &domain.OAuthClient{ID: 1, ClientID: "client", SecretHash: secret, OwnerID: 1}
+	accessToken := &domain.AccessToken{ID: 1, Name: "script", TokenHash: secret, Scope: domain.ScopeRead}
+	export := &domain.Export{ID: 1, Token: secret, Filename: secret}
+
+	views := map[string]interface{}{
+		"userView":          newUserView(&user),
+		"userViews":         newUserViews([]domain.User{user, follower}),
+		"meView":            newMeView(&user),
+		"tweetView":         newTweetView(&retweet),
+		"tweetViews":        newTweetViews([]domain.Tweet{tweet, reply, retweet}),
+		"followView":        newFollowView(&domain.Follow{ID: 1, Follower: follower, Followed: user}),
+		"likeView":          newLikeView(&domain.Like{ID: 1, Tweet: tweet}),
+		"imageViews":        newImageViews(tweet.Images),
+		"sessionViews":      newSessionViews([]domain.Session{{ID: 1, TokenHash: secret}}, 1),
+		"credentialViews":   newCredentialViews([]domain.Credential{{ID: 1, CredentialID: secret, PublicKey: []byte(secret)}}),
+		"identityViews":     newIdentityViews(user.OAuths),
+		"accessTokenViews":  newAccessTokenViews([]domain.AccessToken{*accessToken}),
+		"oauthClientViews":  newOAuthClientViews([]domain.OAuthClient{*client}),
+		"authorizationView": newAuthorizationView(client, &domain.AuthorizationRequest{CodeChallenge: secret}, true),
+		"authorizedApps":    newAuthorizedAppViews([]domain.OAuthGrant{{ID: 1, Client: client, Scope: domain.ScopeRead}}),
+		"exportView":        newExportView(export),
+		"importView":        newImportView(&domain.Import{ID: 1, Status: domain.ImportStatusDone}),
+		"twoFactorView":     twoFactorView{Enabled: true},
+	}
+	for name, view := range views {
+		data, err := json.Marshal(view)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if strings.Contains(string(data), secret) {
+			t.Errorf("%s leaks a secret: %s", name, data)
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range decodedKeys(decoded) {
+			if isSecretKey(key) {
+				t.Errorf("%s contains the secret key %q: %s", name, key, data)
+			}
+		}
+	}
+}
+
+// secretUser returns a user loaded from the database, with a password hash and an oauth account.
+func secretUser(id int) domain.User {
+	return domain.User{
+		ID:           id,
+		Email:        "user@example.com",
+		Name:         "User",
+		Handle:       "user",
+		Password:     secret,
+		PasswordHash: secret,
+		OAuths: []domain.OAuth{{
+			ID:           id,
+			Provider:     "github",
+			AccessToken:  secret,
+			RefreshToken: secret,
+			CreatedAt:    time.Now(),
+		}},
+	}
+}
+
+// isSecretKey reports whether a json key is one of secretKeys.
+func isSecretKey(key string) bool {
+	for _, k := range secretKeys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonKeys returns the json keys of a type and of the types it nests.
+func jsonKeys(typ reflect.Type, seen map[reflect.Type]bool) []string {
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Map {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct || seen[typ] || typ == reflect.TypeOf(time.Time{}) {
+		return nil
+	}
+	seen[typ] = true
+	var keys []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || (!field.Anonymous && !field.IsExported()) {
+			continue
+		}
+		if !field.Anonymous {
+			if name == "" {
+				name = field.Name
+			}
+			keys = append(keys, name)
+		}
+		keys = append(keys, jsonKeys(field.Type, seen)...)
+	}
+	return keys
+}
+
+// decodedKeys returns the keys of all objects within a decoded json value.
+func decodedKeys(v interface{}) []string {
+	var keys []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			keys = append(keys, key)
+			keys = append(keys, decodedKeys(value)...)
+		}
+	case []interface{}:
+		for _, value := range v {
+			keys = append(keys, decodedKeys(value)...)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,92 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Orientations as stored in the EXIF orientation tag. They describe how the stored pixels
+// must be transformed to display the image upright.
+const (
+	OrientationNormal     = 1
+	OrientationFlipH      = 2
+	OrientationRotate180  = 3
+	OrientationFlipV      = 4
+	OrientationTranspose  = 5
+	OrientationRotate90   = 6
+	OrientationTransverse = 7
+	OrientationRotate270  = 8
+)
+
+// maxJPEGHeaderSize limits how much of a JPEG file is searched for EXIF data.
+// The EXIF segment comes right after the start of the file, and can't be larger than 64KB.
+const maxJPEGHeaderSize = 256 << 10
+
+// Orientation reads the EXIF orientation of a JPEG image. It returns OrientationNormal
+// if the image isn't a JPEG, has no EXIF data or the data can't be parsed.
+func Orientation(r io.Reader) int {
+	data, err := io.ReadAll(io.LimitReader(r, maxJPEGHeaderSize))
+	if err != nil || len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return OrientationNormal
+	}
+	// Walk the segments of the JPEG header until the image data starts.
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return OrientationNormal
+		}
+		marker := data[pos+1]
+		if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos += 2
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return OrientationNormal
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return OrientationNormal
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && len(segment) >= 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return OrientationNormal
+}
+
+// tiffOrientation finds the orientation tag in the first image file directory of EXIF's TIFF structure.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return OrientationNormal
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return OrientationNormal
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return OrientationNormal
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return OrientationNormal
+		}
+		// The orientation is a single SHORT, stored at the start of the entry's value field.
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < OrientationNormal || o > OrientationRotate270 {
+				return OrientationNormal
+			}
+			return o
+		}
+	}
+	return OrientationNormal
+}
@@ -0,0 +1,95 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// tiffEntry is an entry of a TIFF image file directory.
+type tiffEntry struct {
+	tag, typ uint16
+	value    uint16
+}
+
+// exifSegment builds an APP1 segment holding EXIF data with a single image file directory.
+func exifSegment(order binary.ByteOrder, entries ...tiffEntry) []byte {
+	tiff := make([]byte, 10, 10+12*len(entries))
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], uint16(len(entries)))
+	for _, e := range entries {
+		entry := make([]byte, 12)
+		order.PutUint16(entry, e.tag)
+		order.PutUint16(entry[2:], e.typ)
+		order.PutUint32(entry[4:], 1)
+		order.PutUint16(entry[8:], e.value)
+		tiff = append(tiff, entry...)
+	}
+	return segment(0xE1, append([]byte("Exif\x00\x00"), tiff...))
+}
+
+// segment builds a JPEG segment with the marker and payload.
+func segment(marker byte, payload []byte) []byte {
+	s := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(s[2:], uint16(len(payload)+2))
+	return append(s, payload...)
+}
+
+// jpegHeader builds the start of a JPEG file from segments, followed by the start of the image data.
+func jpegHeader(segments ...[]byte) []byte {
+	b := []byte{0xFF, 0xD8}
+	for _, s := range segments {
+		b = append(b, s...)
+	}
+	return append(b, segment(0xDA, []byte{1, 2, 3})...)
+}
+
+func TestOrientation(t *testing.T) {
+	jfif := segment(0xE0, []byte("JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00"))
+	orientation := func(order binary.ByteOrder, o uint16) []byte {
+		return exifSegment(order, tiffEntry{0x0112, 3, o})
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n"), OrientationNormal},
+		{"empty", nil, OrientationNormal},
+		{"no exif", jpegHeader(jfif), OrientationNormal},
+		{"little endian", jpegHeader(orientation(binary.LittleEndian, 6)), OrientationRotate90},
+		{"big endian", jpegHeader(orientation(binary.BigEndian, 8)), OrientationRotate270},
+		{"after jfif", jpegHeader(jfif, orientation(binary.BigEndian, 3)), OrientationRotate180},
+		{"after other entries", jpegHeader(exifSegment(binary.LittleEndian,
+			tiffEntry{0x010F, 2, 0}, tiffEntry{0x0110, 2, 0}, tiffEntry{0x0112, 3, 5})), OrientationTranspose},
+		{"after the image data", append(jpegHeader(jfif), orientation(binary.BigEndian, 6)...), OrientationNormal},
+		{"zero", jpegHeader(orientation(binary.BigEndian, 0)), OrientationNormal},
+		{"out of range", jpegHeader(orientation(binary.BigEndian, 9)), OrientationNormal},
+		{"wrong type", jpegHeader(exifSegment(binary.BigEndian, tiffEntry{0x0112, 4, 6})), OrientationNormal},
+		{"no orientation", jpegHeader(exifSegment(binary.BigEndian, tiffEntry{0x010F, 2, 0})), OrientationNormal},
+		{"unknown byte order", jpegHeader(segment(0xE1, []byte("Exif\x00\x00XX\x00\x2a\x00\x00\x00\x08\x00\x00"))), OrientationNormal},
+		{"ifd out of range", jpegHeader(segment(0xE1, []byte("Exif\x00\x00MM\x00\x2a\x00\x00\xff\xff"))), OrientationNormal},
+		{"too many entries", jpegHeader(segment(0xE1, []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\xff\xff"))), OrientationNormal},
+		{"segment longer than file", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 'E', 'x'}, OrientationNormal},
+		{"segment length too short", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01, 0xFF, 0xDA}, OrientationNormal},
+		{"garbage instead of a marker", []byte{0xFF, 0xD8, 0x00, 0x00, 0x00, 0x00}, OrientationNormal},
+	}
+	for o := OrientationNormal; o <= OrientationRotate270; o++ {
+		tests = append(tests, struct {
+			name string
+			data []byte
+			want int
+		}{"orientation", jpegHeader(orientation(binary.LittleEndian, uint16(o))), o})
+	}
+	for _, tt := range tests {
+		if got := Orientation(bytes.NewReader(tt.data)); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.org/x/image/draw"
+	"image"
+	"image/gif"
+	"time"
+)
+
+// ErrMalformed is returned for files whose structure can't be parsed.
+var ErrMalformed = errors.New("imaging: malformed file")
+
+// GIFInfo describes a GIF. Width and Height are those of its logical screen, which all frames are drawn onto.
+// Duration is the sum of the delays of all frames.
+type GIFInfo struct {
+	Width    int
+	Height   int
+	Frames   int
+	Duration time.Duration
+}
+
+// ScanGIF walks the blocks of a GIF to count its frames and sum up their delays, without decoding
+// any of them. This way the cost of decoding a GIF can be checked before it's decoded.
+func ScanGIF(data []byte) (GIFInfo, error) {
+	var info GIFInfo
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return info, ErrMalformed
+	}
+	info.Width = int(binary.LittleEndian.Uint16(data[6:]))
+	info.Height = int(binary.LittleEndian.Uint16(data[8:]))
+	pos := 13 + colorTableSize(data[10])
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // Extension, its sub-blocks follow the label.
+			if pos+2 > len(data) {
+				return info, ErrMalformed
+			}
+			label := data[pos+1]
+			pos += 2
+			// A graphic control extension holds the delay of the next frame in hundredths of a second.
+			if label == 0xF9 && pos+4 <= len(data) && data[pos] >= 4 {
+				delay := binary.LittleEndian.Uint16(data[pos+2:])
+				info.Duration += time.Duration(delay) * 10 * time.Millisecond
+			}
+		case 0x2C: // Image descriptor, followed by a local color table and the image data.
+			if pos+10 > len(data) {
+				return info, ErrMalformed
+			}
+			info.Frames++
+			pos += 10 + colorTableSize(data[pos+9]) + 1
+		case 0x3B: // Trailer.
+			return info, nil
+		default:
+			return info, ErrMalformed
+		}
+		var err error
+		if pos, err = skipSubBlocks(data, pos); err != nil {
+			return info, err
+		}
+	}
+	return info, ErrMalformed
+}
+
+// colorTableSize returns the size in bytes of the color table that a GIF's flags announce.
+func colorTableSize(flags byte) int {
+	if flags&0x80 == 0 {
+		return 0
+	}
+	return 3 * (1 << (flags&0x07 + 1))
+}
+
+// skipSubBlocks returns the position after the sub-blocks starting at pos.
+// Every sub-block starts with its size, and a sub-block of size 0 ends them.
+func skipSubBlocks(data []byte, pos int) (int, error) {
+	for {
+		if pos >= len(data) {
+			return pos, ErrMalformed
+		}
+		n := int(data[pos])
+		pos++
+		if n == 0 {
+			return pos, nil
+		}
+		pos += n
+	}
+}
+
+// Poster draws the first frame of a GIF onto its logical screen, to be shown as a still image.
+func Poster(g *gif.GIF) *image.NRGBA {
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if len(g.Image) == 0 {
+		return image.NewNRGBA(screen)
+	}
+	if screen.Empty() {
+		screen = g.Image[0].Bounds()
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, screen.Dx(), screen.Dy()))
+	frame := g.Image[0]
+	draw.Draw(dst, frame.Bounds().Sub(screen.Min), frame, frame.Bounds().Min, draw.Over)
+	return dst
+}
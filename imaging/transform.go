@@ -0,0 +1,134 @@
+package imaging
+
+import (
+	"errors"
+	"golang.org/x/image/draw"
+	"image"
+	"io"
+)
+
+// ErrTooLarge is returned by Decode for images with more pixels than allowed.
+var ErrTooLarge = errors.New("imaging: image has too many pixels")
+
+// Decode decodes an image, but only after its header says that it has no more than maxPixels pixels.
+// This keeps small files that claim huge dimensions (decompression bombs) from exhausting memory.
+func Decode(r io.ReadSeeker, maxPixels int) (image.Image, string, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxPixels/cfg.Height {
+		return nil, "", ErrTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(r)
+}
+
+// Orient transforms an image according to its EXIF orientation, so that it's displayed upright
+// without the orientation. Images that are upright already are returned as they are.
+func Orient(src image.Image, orientation int) image.Image {
+	if orientation <= OrientationNormal || orientation > OrientationRotate270 {
+		return src
+	}
+	img, ok := src.(*image.NRGBA)
+	if !ok || img.Bounds().Min != (image.Point{}) {
+		img = toNRGBA(src)
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	// Orientations 5 to 8 swap width and height.
+	dw, dh := w, h
+	if orientation >= OrientationTranspose {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case OrientationFlipH:
+				sx, sy = w-1-x, y
+			case OrientationRotate180:
+				sx, sy = w-1-x, h-1-y
+			case OrientationFlipV:
+				sx, sy = x, h-1-y
+			case OrientationTranspose:
+				sx, sy = y, x
+			case OrientationRotate90:
+				sx, sy = y, h-1-x
+			case OrientationTransverse:
+				sx, sy = w-1-y, h-1-x
+			case OrientationRotate270:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], img.Pix[img.PixOffset(sx, sy):img.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// Fit scales an image down to fit into a box of width x height pixels, keeping its aspect ratio.
+// Images that fit into the box already are returned as they are, they are never scaled up.
+func Fit(src image.Image, width, height int) image.Image {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= width && h <= height {
+		return src
+	}
+	dw, dh := width, h*width/w
+	if dh > height {
+		dw, dh = w*height/h, height
+	}
+	return scale(src, src.Bounds(), max(dw, 1), max(dh, 1))
+}
+
+// Fill scales an image to cover a box of exactly width x height pixels, keeping its aspect ratio,
+// and crops whatever overflows the box on both sides equally.
+func Fill(src image.Image, width, height int) *image.NRGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Crop the source to the aspect ratio of the box first.
+	crop := b
+	if w*height > h*width {
+		cw := h * width / height
+		crop.Min.X += (w - cw) / 2
+		crop.Max.X = crop.Min.X + cw
+	} else {
+		ch := w * height / width
+		crop.Min.Y += (h - ch) / 2
+		crop.Max.Y = crop.Min.Y + ch
+	}
+	return scale(src, crop, width, height)
+}
+
+// scale scales the part r of an image to width x height pixels.
+func scale(src image.Image, r image.Rectangle, width, height int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, r, draw.Src, nil)
+	return dst
+}
+
+// toNRGBA copies an image into an NRGBA image whose bounds start at 0, 0.
+func toNRGBA(src image.Image) *image.NRGBA {
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// max returns the larger of two ints.
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Opaque reports whether an image has no transparent pixels.
+// Images that can't tell are treated as if they had some.
+func Opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// grid is an image as a grid of pixel values, indexed by row and then column.
+type grid [][]uint8
+
+// testImage returns an NRGBA image of 3x2 pixels whose red values are all different.
+func testImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(10*y + x), A: 255})
+		}
+	}
+	return img
+}
+
+// toGrid returns the red values of an image's pixels.
+func toGrid(img image.Image) grid {
+	b := img.Bounds()
+	g := make(grid, b.Dy())
+	for y := range g {
+		g[y] = make([]uint8, b.Dx())
+		for x := range g[y] {
+			r, _, _, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			g[y][x] = uint8(r >> 8)
+		}
+	}
+	return g
+}
+
+// flipH mirrors a grid horizontally.
+func flipH(g grid) grid {
+	out := make(grid, len(g))
+	for y := range g {
+		out[y] = make([]uint8, len(g[y]))
+		for x := range g[y] {
+			out[y][x] = g[y][len(g[y])-1-x]
+		}
+	}
+	return out
+}
+
+// rotateCW rotates a grid clockwise by 90 degrees.
+func rotateCW(g grid) grid {
+	out := make(grid, len(g[0]))
+	for y := range out {
+		out[y] = make([]uint8, len(g))
+		for x := range out[y] {
+			out[y][x] = g[len(g)-1-x][y]
+		}
+	}
+	return out
+}
+
+// upright applies the transformation the EXIF specification describes for an orientation to a grid.
+func upright(g grid, orientation int) grid {
+	switch orientation {
+	case OrientationFlipH:
+		return flipH(g)
+	case OrientationRotate180:
+		return rotateCW(rotateCW(g))
+	case OrientationFlipV:
+		return flipH(rotateCW(rotateCW(g)))
+	case OrientationTranspose:
+		return rotateCW(rotateCW(rotateCW(flipH(g))))
+	case OrientationRotate90:
+		return rotateCW(g)
+	case OrientationTransverse:
+		return rotateCW(flipH(g))
+	case OrientationRotate270:
+		return rotateCW(rotateCW(rotateCW(g)))
+	}
+	return g
+}
+
+func equal(a, b grid) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for y := range a {
+		if string(a[y]) != string(b[y]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOrient(t *testing.T) {
+	src := testImage()
+	for o := OrientationNormal; o <= OrientationRotate270; o++ {
+		got := Orient(src, o)
+		if want := upright(toGrid(src), o); !equal(toGrid(got), want) {
+			t.Errorf("orientation %d: got %v, want %v", o, toGrid(got), want)
+		}
+		if got.Bounds().Min != (image.Point{}) {
+			t.Errorf("orientation %d: got bounds %v", o, got.Bounds())
+		}
+	}
+	if !equal(toGrid(src), toGrid(testImage())) {
+		t.Error("the source image was modified")
+	}
+}
+
+// TestOrientUpright makes sure images that are upright already aren't copied.
+func TestOrientUpright(t *testing.T) {
+	src := testImage()
+	for _, o := range []int{0, OrientationNormal, 9} {
+		if got := Orient(src, o); got != image.Image(src) {
+			t.Errorf("orientation %d: the image was copied", o)
+		}
+	}
+}
+
+// TestOrientConverts makes sure images of other types, and with bounds that don't start at 0, 0,
+// are turned upright as well.
+func TestOrientConverts(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 4, 3))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i)
+	}
+	sub := testImage().SubImage(image.Rect(1, 0, 3, 2))
+	for _, src := range []image.Image{gray, sub} {
+		for o := OrientationFlipH; o <= OrientationRotate270; o++ {
+			if got, want := toGrid(Orient(src, o)), upright(toGrid(src), o); !equal(got, want) {
+				t.Errorf("%T, orientation %d: got %v, want %v", src, o, got, want)
+			}
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	if got := Fit(src, 400, 400); got != image.Image(src) {
+		t.Error("an image that fits was copied")
+	}
+	tests := []struct {
+		width, height int
+		wantW, wantH  int
+	}{
+		{200, 200, 200, 100},
+		{400, 100, 200, 100},
+		{100, 1000, 100, 50},
+		{1000, 1, 2, 1},
+	}
+	for _, tt := range tests {
+		b := Fit(src, tt.width, tt.height).Bounds()
+		if b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+			t.Errorf("fit into %dx%d: got %dx%d, want %dx%d", tt.width, tt.height, b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	for _, src := range []image.Image{image.NewNRGBA(image.Rect(0, 0, 400, 200)), image.NewNRGBA(image.Rect(0, 0, 30, 90))} {
+		b := Fill(src, 48, 48).Bounds()
+		if b.Dx() != 48 || b.Dy() != 48 {
+			t.Errorf("fill %v: got %v", src.Bounds(), b)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrAnimatedWebP is returned by StripWebPMetadata for animated WebP images, which can't be decoded.
+var ErrAnimatedWebP = errors.New("imaging: animated webp images are not supported")
+
+// Flags of a WebP file's VP8X chunk, which announce the chunks that follow.
+const (
+	webpFlagXMP       = 0x04
+	webpFlagEXIF      = 0x08
+	webpFlagAnimation = 0x02
+)
+
+// StripWebPMetadata removes the EXIF and XMP chunks from a WebP file, keeping the image data
+// as it is, since there's no encoder for WebP. The color profile is kept as well.
+func StripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrMalformed
+	}
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	for pos := 12; pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, ErrMalformed
+		}
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		// Chunks are padded to an even size.
+		end := pos + 8 + size + size%2
+		if size < 0 || end > len(data) {
+			return nil, ErrMalformed
+		}
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			if size < 1 {
+				return nil, ErrMalformed
+			}
+			if data[pos+8]&webpFlagAnimation != 0 {
+				return nil, ErrAnimatedWebP
+			}
+			chunk := append([]byte{}, data[pos:end]...)
+			chunk[8] &^= webpFlagEXIF | webpFlagXMP
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
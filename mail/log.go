@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"wtfTwitter/domain"
+)
+
+// LogMailer is a domain.Mailer for development and tests. It doesn't deliver any emails.
+// If a directory is configured, it writes every email into its own file there, otherwise
+// it prints the email to the log. Either way, links in emails can be followed by hand.
+type LogMailer struct {
+	dir string
+}
+
+// NewLogMailer returns an instance of LogMailer. Pass the empty string as dir to log emails
+// instead of writing them to files.
+func NewLogMailer(dir string) *LogMailer {
+	return &LogMailer{
+		dir: dir,
+	}
+}
+
+// Ensure the LogMailer struct properly implements the domain.Mailer interface.
+var _ domain.Mailer = &LogMailer{}
+
+// Send logs the email or writes it to a file in the mailer's directory.
+func (m *LogMailer) Send(email domain.Email) error {
+	message := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", email.To, email.Subject, email.Body)
+	if m.dir == "" {
+		log.Printf("[mail] %s", message)
+		return nil
+	}
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(email.To))
+	return os.WriteFile(filepath.Join(m.dir, name), []byte(message), 0644)
+}
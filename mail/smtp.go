@@ -0,0 +1,56 @@
+package mail
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+	"wtfTwitter/domain"
+)
+
+// SMTPMailer is a domain.Mailer that delivers emails through an SMTP server.
+// If a username is configured, it authenticates with PLAIN auth, which net/smtp
+// only allows over TLS (or to localhost).
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer returns an instance of SMTPMailer. from is the address emails are sent from.
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		from: from,
+	}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Ensure the SMTPMailer struct properly implements the domain.Mailer interface.
+var _ domain.Mailer = &SMTPMailer{}
+
+// Send delivers the email as a plain text message.
+func (m *SMTPMailer) Send(email domain.Email) error {
+	// Header values must not contain line breaks, otherwise they could inject headers.
+	if strings.ContainsAny(email.To+email.Subject, "\r\n") {
+		return fmt.Errorf("invalid email header value")
+	}
+	headers := []string{
+		"From: " + m.from,
+		"To: " + email.To,
+		"Subject: " + mime.QEncoding.Encode("utf-8", email.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: 8bit",
+	}
+	body := strings.ReplaceAll(email.Body, "\n", "\r\n")
+	message := strings.Join(headers, "\r\n") + "\r\n\r\n" + body + "\r\n"
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{email.To}, []byte(message))
+}
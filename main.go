@@ -1,17 +1,31 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/github"
+	"fmt"
+	"os"
+	"strings"
+	"wtfTwitter/blob"
 	"wtfTwitter/crud"
+	"wtfTwitter/domain"
 	"wtfTwitter/http"
+	"wtfTwitter/mail"
+	"wtfTwitter/oauth"
 )
 
 // main is the app's entry point.
 func main() {
 	// Check if the flag "-prod" to has been provided. It means that we're running in production.
 	productionBool := flag.Bool("prod", false, "Provide this flag in production to ensure that a .config.json file is provided before the application starts.")
+	// Instead of serving the app, an official Twitter archive can be imported for a user.
+	importPath := flag.String("import", "", "Path of an official Twitter archive (zip) to import for the user given by -user, instead of serving the app.")
+	importUser := flag.String("user", "", "Email address of the user to import the Twitter archive given by -import for.")
+	// Or the images stored in the local images directory can be copied into the configured storage.
+	migrateImages := flag.Bool("migrate-images", false, "Copy the images stored in the local images directory into the configured storage, instead of serving the app.")
+	// Or the media table can be checked against the stored images, and optionally be fixed.
+	checkMedia := flag.Bool("check-media", false, "Report stored images without a media record and media records without a stored image, instead of serving the app.")
+	fixMedia := flag.Bool("fix", false, "Together with -check-media, create the missing media records and delete those without a stored image.")
 	flag.Parse()
 
 	// Load configuration from a .config.json file if present, otherwise use the default dev setup.
@@ -25,36 +39,134 @@ func main() {
 	err := Open(db, config.IsProd())
 	must(err)
 	defer Close(db)
+	// Images were only stored as files before the media table was introduced. Once it has been
+	// created, records for the existing files are created from the files themselves.
+	adoptImages := !db.Gorm.Migrator().HasTable(&domain.Image{})
 	err = AutoMigrate(db)
 	must(err)
 
+	// Set up the storage for images. Without an S3-compatible storage, they are stored in the filesystem.
+	var store domain.BlobStore
+	switch sc := config.Storage; sc.Type {
+	case "", "fs":
+		store = blob.NewFSStore(sc.ImagesDir())
+	case "s3":
+		store, err = blob.NewS3Store(sc.Endpoint, sc.Region, sc.Bucket, sc.AccessKey, sc.SecretKey, sc.PathStyle)
+		must(err)
+	default:
+		must(fmt.Errorf("unknown storage type %q, must be \"fs\" or \"s3\"", sc.Type))
+	}
+
+	// Copy the images and exit, if that's what we're here for.
+	if *migrateImages {
+		must(runImageMigration(store, config.Storage))
+		return
+	}
+
 	// Start the crud services.
 	services, err := crud.NewServices(
 		db.Gorm,
 		crud.WithUser(config.Pepper, config.HMACKey),
+		crud.WithSession(config.HMACKey),
+		crud.WithPasswordReset(config.HMACKey),
+		crud.WithTwoFactor(config.HMACKey, config.EncryptionKey),
+		crud.WithCredential(config.WebAuthn.RPID, config.WebAuthn.RPName, config.WebAuthn.Origin),
+		crud.WithThrottle(),
+		crud.WithAccessToken(config.HMACKey),
+		crud.WithOAuthServer(config.HMACKey),
 		crud.WithOAuth(),
+		crud.WithImage(store),
 		crud.WithTweet(),
 		crud.WithFollow(),
 		crud.WithLike(),
-		crud.WithImage(),
+		crud.WithAnalytics(),
+		crud.WithExport(config.HMACKey),
+		crud.WithImport(),
+		crud.WithPurge(),
 	)
 	must(err)
+	defer services.Analytics.Close()
+	defer services.Export.Close()
+	defer services.Import.Close()
+	defer services.Purge.Close()
 
-	// Create an oauth config object for doing oauth with Github.
-	githubOAuth := &oauth2.Config{
-		ClientID:     config.Github.ID,
-		ClientSecret: config.Github.Secret,
-		RedirectURL:  config.Github.RedirectURL,
-		Endpoint:     github.Endpoint,
+	// Describe the images stored before the media table existed.
+	if adoptImages {
+		report, err := services.Image.Check(true)
+		must(err)
+		fmt.Printf("Created media records for %d stored images\n", len(report.FilesWithoutRows))
+	}
+
+	// Check the media table and exit, if that's what we're here for.
+	if *checkMedia {
+		must(runMediaCheck(services, *fixMedia))
+		return
+	}
+
+	// Run the import and exit, if that's what we're here for.
+	if *importPath != "" {
+		must(runImport(services, *importUser, *importPath))
+		return
+	}
+
+	// Set up the OAuth providers users can sign in with.
+	providers, err := oauth.NewRegistry(nil, config.OAuthProviders()...)
+	must(err)
+
+	// Set up the mailer. Without an SMTP server, emails are only written to files or the log.
+	var mailer domain.Mailer
+	if mc := config.Mailer; mc.Host != "" {
+		mailer = mail.NewSMTPMailer(mc.Host, mc.Port, mc.Username, mc.Password, mc.From)
+	} else {
+		mailer = mail.NewLogMailer(mc.Dir)
 	}
 
 	// Set up a webserver.
-	server := http.NewServer(config.IsProd(), config.ClientUrl, githubOAuth, services)
+	server := http.NewServer(config.IsProd(), config.ClientUrl, providers, mailer, services)
 
 	// Serve the app.
 	server.Run(config.Port)
 }
 
+// runImport imports the Twitter archive at archivePath for the user with the given email address,
+// and prints the report of what was imported and what was skipped.
+func runImport(services *crud.Services, email, archivePath string) error {
+	user, err := services.User.ByEmail(strings.ToLower(strings.TrimSpace(email)))
+	if err != nil {
+		return fmt.Errorf("cannot find the user %q: %w", email, err)
+	}
+	report, err := services.Import.Run(user.ID, archivePath)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// runMediaCheck compares the media table with the stored images, fixes the differences if told to,
+// and prints the report.
+func runMediaCheck(services *crud.Services, fix bool) error {
+	report, err := services.Image.Check(fix)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// runImageMigration copies the images stored in the local images directory into the configured storage.
+// It can be run again if it was interrupted, images that have been copied already are overwritten.
+func runImageMigration(store domain.BlobStore, sc StorageConfig) error {
+	if sc.Type == "" || sc.Type == "fs" {
+		return fmt.Errorf("images are already stored in %s, configure an s3 storage to migrate them to", sc.ImagesDir())
+	}
+	n, err := blob.CopyDir(store, sc.ImagesDir())
+	fmt.Printf("Copied %d images from %s\n", n, sc.ImagesDir())
+	return err
+}
+
 // must is a little helper for shortening the panic instruction.
 func must(err error) {
 	if err != nil {
@@ -0,0 +1,91 @@
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-github/v32/github"
+	"golang.org/x/oauth2"
+	githubEndpoint "golang.org/x/oauth2/github"
+	"net/http"
+	"strconv"
+)
+
+// githubProvider signs users in with GitHub. GitHub doesn't support OpenID Connect,
+// so the user's identity is fetched from the GitHub API.
+type githubProvider struct {
+	name   string
+	config *oauth2.Config
+	client *http.Client
+}
+
+// newGithub creates a GitHub provider. By default it requests the "user:email" scope,
+// which allows reading the user's verified email addresses.
+func newGithub(c Config, client *http.Client) *githubProvider {
+	scopes := c.Scopes
+	if scopes == nil {
+		scopes = []string{"user:email"}
+	}
+	return &githubProvider{
+		name: c.Name,
+		config: &oauth2.Config{
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			RedirectURL:  c.RedirectURL,
+			Endpoint:     githubEndpoint.Endpoint,
+			Scopes:       scopes,
+		},
+		client: client,
+	}
+}
+
+// Name returns the name the provider is registered under.
+func (p *githubProvider) Name() string {
+	return p.name
+}
+
+// AuthCodeURL returns the url of GitHub's consent page. GitHub has no use for the nonce.
+func (p *githubProvider) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	return p.config.AuthCodeURL(state), nil
+}
+
+// Exchange trades the code for a token and fetches the user from the GitHub API.
+func (p *githubProvider) Exchange(ctx context.Context, code, nonce string) (*Identity, *oauth2.Token, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+	token, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return nil, nil, fmt.Errorf("github: cannot exchange code: %w", err)
+	}
+	client := github.NewClient(p.config.Client(ctx, token))
+
+	// Fetch information about the user that's currently authenticated at GitHub.
+	// Require that we at least receive a user ID from them.
+	user, _, err := client.Users.Get(ctx, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("github: cannot fetch user: %w", err)
+	} else if user.ID == nil {
+		return nil, nil, fmt.Errorf("github: user ID not returned")
+	}
+	identity := Identity{
+		ID:       strconv.FormatInt(user.GetID(), 10),
+		Name:     user.GetName(),
+		Username: user.GetLogin(),
+		Email:    user.GetEmail(),
+	}
+	if identity.Name == "" {
+		identity.Name = identity.Username
+	}
+
+	// Prefer the user's primary email address, if GitHub has verified it. Without the
+	// "user:email" scope, this fails, and the user's public email address is used instead.
+	// GitHub only allows verified addresses to be public.
+	emails, _, err := client.Users.ListEmails(ctx, nil)
+	if err == nil {
+		for _, email := range emails {
+			if email.GetPrimary() && email.GetVerified() {
+				identity.Email = email.GetEmail()
+			}
+		}
+	}
+	identity.EmailVerified = identity.Email != ""
+	return &identity, token, nil
+}
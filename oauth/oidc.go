@@ -0,0 +1,376 @@
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockSkew is the tolerance for the time claims of ID tokens.
+const clockSkew = time.Minute
+
+// jwksRefreshInterval is the minimum time between two fetches of a provider's signing keys.
+// Keys are refetched when a token is signed with an unknown key, which happens after the
+// provider rotates its keys. The interval keeps forged tokens from triggering endless fetches.
+const jwksRefreshInterval = 5 * time.Minute
+
+// oidcProvider signs users in with an OpenID Connect provider. Its endpoints are discovered
+// from the issuer's /.well-known/openid-configuration on first use, so the app starts even if
+// the provider is unreachable. The user's identity is taken from the verified ID token.
+type oidcProvider struct {
+	name   string
+	issuer string
+	config Config
+	client *http.Client
+
+	mu         sync.Mutex
+	discovered *oidcDiscovery
+	oauth2     *oauth2.Config
+	keys       map[string]crypto.PublicKey
+	keysAt     time.Time
+}
+
+// oidcDiscovery is the part of the provider's metadata document the app needs.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// idTokenClaims are the claims of an ID token the app needs. Audience can be a string or an array.
+type idTokenClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	Expiry            int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	Name              string          `json:"name"`
+	PreferredUsername string          `json:"preferred_username"`
+	Nickname          string          `json:"nickname"`
+	Email             string          `json:"email"`
+	EmailVerified     interface{}     `json:"email_verified"`
+}
+
+// newOIDC creates an OpenID Connect provider. By default it requests the scopes
+// "openid", "profile" and "email".
+func newOIDC(c Config, client *http.Client) *oidcProvider {
+	if c.Scopes == nil {
+		c.Scopes = []string{"openid", "profile", "email"}
+	}
+	return &oidcProvider{
+		name:   c.Name,
+		issuer: strings.TrimSuffix(c.Issuer, "/"),
+		config: c,
+		client: client,
+	}
+}
+
+// Name returns the name the provider is registered under.
+func (p *oidcProvider) Name() string {
+	return p.name
+}
+
+// AuthCodeURL returns the url of the provider's consent page. It discovers the provider's
+// endpoints on first use, and returns the error if discovery fails.
+func (p *oidcProvider) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	config, err := p.oauth2Config(ctx)
+	if err != nil {
+		return "", err
+	}
+	return config.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce)), nil
+}
+
+// Exchange trades the code for tokens and verifies the ID token.
+func (p *oidcProvider) Exchange(ctx context.Context, code, nonce string) (*Identity, *oauth2.Token, error) {
+	config, err := p.oauth2Config(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := config.Exchange(context.WithValue(ctx, oauth2.HTTPClient, p.client), code)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc %s: cannot exchange code: %w", p.name, err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, nil, fmt.Errorf("oidc %s: no id token returned", p.name)
+	}
+	claims, err := p.verifyIDToken(ctx, rawIDToken, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	identity := Identity{
+		ID:            claims.Subject,
+		Name:          claims.Name,
+		Username:      claims.PreferredUsername,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified == true || claims.EmailVerified == "true",
+	}
+	if identity.Username == "" {
+		identity.Username = claims.Nickname
+	}
+	if identity.Name == "" {
+		identity.Name = identity.Username
+	}
+	return &identity, token, nil
+}
+
+// oauth2Config returns the provider's oauth2 config, discovering its endpoints if necessary.
+func (p *oidcProvider) oauth2Config(ctx context.Context) (*oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth2 != nil {
+		return p.oauth2, nil
+	}
+	var d oidcDiscovery
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("oidc %s: discovery failed: %w", p.name, err)
+	}
+	if d.Issuer != p.issuer {
+		return nil, fmt.Errorf("oidc %s: discovered issuer %q doesn't match %q", p.name, d.Issuer, p.issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc %s: discovery document is incomplete", p.name)
+	}
+	p.discovered = &d
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     oauth2.Endpoint{AuthURL: d.AuthorizationEndpoint, TokenURL: d.TokenEndpoint},
+		Scopes:       p.config.Scopes,
+	}
+	return p.oauth2, nil
+}
+
+// verifyIDToken checks the ID token's signature and claims (OpenID Connect Core §3.1.3.7).
+func (p *oidcProvider) verifyIDToken(ctx context.Context, rawIDToken, nonce string) (*idTokenClaims, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("oidc %s: invalid id token: %s", p.name, reason)
+	}
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, invalid("malformed")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, invalid("malformed header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("malformed signature")
+	}
+	key, err := p.signingKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, invalid(err.Error())
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalid("malformed claims")
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != p.issuer:
+		return nil, invalid("wrong issuer")
+	case !audienceContains(claims.Audience, p.config.ClientID):
+		return nil, invalid("wrong audience")
+	case claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(clockSkew)):
+		return nil, invalid("expired")
+	case claims.IssuedAt != 0 && now.Add(clockSkew).Before(time.Unix(claims.IssuedAt, 0)):
+		return nil, invalid("issued in the future")
+	case nonce == "" || claims.Nonce != nonce:
+		return nil, invalid("wrong nonce")
+	case claims.Subject == "":
+		return nil, invalid("no subject")
+	}
+	return &claims, nil
+}
+
+// signingKey returns the provider's public key with the given key ID. The keys are fetched from
+// the provider's JWKS endpoint, and refetched if the key is unknown (after a key rotation).
+func (p *oidcProvider) signingKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("oidc %s: unknown signing key %q", p.name, kid)
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.discovered.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("oidc %s: cannot fetch signing keys: %w", p.name, err)
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	p.keysAt = time.Now()
+	for _, jwk := range jwks.Keys {
+		if key, err := jwk.publicKey(); err == nil && (jwk.Use == "" || jwk.Use == "sig") {
+			p.keys[jwk.Kid] = key
+		}
+	}
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("oidc %s: unknown signing key %q", p.name, kid)
+}
+
+// lookupKey finds a cached key. Tokens without a key ID are accepted if the provider has a single key.
+func (p *oidcProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// getJSON fetches a url and decodes the json response into dst.
+func (p *oidcProvider) getJSON(ctx context.Context, url string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(dst)
+}
+
+// jsonWebKey is a public key in JWK format (RFC 7517). Only RSA and P-256 keys are supported.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey converts the JWK into a public key.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("invalid ec point")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+// verifyJWS checks the signature of a JWS with the RS256 or ES256 algorithm.
+// The algorithm must match the type of the key, so a token can't pick a weaker one.
+func verifyJWS(alg string, key crypto.PublicKey, signingInput, signature []byte) error {
+	digest := sha256.Sum256(signingInput)
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("algorithm doesn't match key")
+		}
+		if rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return errors.New("bad signature")
+		}
+		return nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("algorithm doesn't match key")
+		}
+		if len(signature) != 64 {
+			return errors.New("bad signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// decodeSegment decodes a base64url encoded json segment of a JWT.
+func decodeSegment(segment string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// audienceContains reports whether the aud claim, a string or an array of strings, contains the client ID.
+func audienceContains(aud json.RawMessage, clientId string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == clientId
+	}
+	var multiple []string
+	if json.Unmarshal(aud, &multiple) == nil {
+		for _, a := range multiple {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,377 @@
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests in this file sign users in with mockIssuer, an OpenID Connect provider served by
+// httptest, which issues ID tokens signed with its own keys.
+
+const (
+	testClientID = "client-id"
+	testNonce    = "nonce"
+)
+
+// mockIssuer is an OpenID Connect provider. Its token endpoint returns idToken, whatever
+// the code is, and its JWKS endpoint publishes the public keys of keys. Its discovery document
+// names issuer, or the server's url if that's empty.
+type mockIssuer struct {
+	*httptest.Server
+	mu          sync.Mutex
+	keys        map[string]crypto.Signer
+	idToken     string
+	issuer      string
+	discoveryOK bool
+	jwksFetches int
+}
+
+// newMockIssuer starts an issuer with an RSA key "rsa" and a P-256 key "ec".
+func newMockIssuer(t *testing.T) *mockIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{keys: map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey}, discoveryOK: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if !m.discoveryOK {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		issuer := m.issuer
+		if issuer == "" {
+			issuer = m.URL
+		}
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                issuer,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.jwksFetches++
+		var keys []jsonWebKey
+		for kid, key := range m.keys {
+			keys = append(keys, publicJWK(kid, key.Public()))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     m.idToken,
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// provider returns a provider for the issuer, as NewRegistry creates it.
+func (m *mockIssuer) provider() *oidcProvider {
+	return newOIDC(Config{
+		Name:         "mock",
+		Type:         TypeOIDC,
+		ClientID:     testClientID,
+		ClientSecret: "client-secret",
+		RedirectURL:  "http://localhost:1111/oauth/mock/callback",
+		Issuer:       m.URL + "/",
+	}, m.Client())
+}
+
+// claims returns valid claims of an ID token for testClientID and testNonce.
+func (m *mockIssuer) claims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":                m.URL,
+		"sub":                "user-1",
+		"aud":                testClientID,
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              testNonce,
+		"name":               "Jane Doe",
+		"preferred_username": "jane",
+		"email":              "jane@example.com",
+		"email_verified":     true,
+	}
+}
+
+// sign returns an ID token with the claims, signed with the key kid using alg.
+func (m *mockIssuer) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch key := m.keys[kid].(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// publicJWK encodes a public key as a JWK.
+func publicJWK(kid string, key crypto.PublicKey) jsonWebKey {
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return jsonWebKey{Kty: "RSA", Kid: kid, Use: "sig", N: encode(key.N), E: encode(big.NewInt(int64(key.E)))}
+	case *ecdsa.PublicKey:
+		return jsonWebKey{Kty: "EC", Kid: kid, Use: "sig", Crv: "P-256", X: encode(key.X), Y: encode(key.Y)}
+	}
+	panic("publicJWK: unsupported key")
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	m := newMockIssuer(t)
+	authURL, err := m.provider().AuthCodeURL(context.Background(), "state", testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme+"://"+u.Host+u.Path != m.URL+"/authorize" {
+		t.Errorf("got auth url %s", authURL)
+	}
+	if q.Get("state") != "state" || q.Get("nonce") != testNonce || q.Get("client_id") != testClientID {
+		t.Errorf("got query %v", q)
+	}
+	if q.Get("scope") != "openid profile email" {
+		t.Errorf("got scope %q", q.Get("scope"))
+	}
+}
+
+func TestOIDCAuthCodeURLDiscoveryFailure(t *testing.T) {
+	m := newMockIssuer(t)
+	m.discoveryOK = false
+	p := m.provider()
+	if authURL, err := p.AuthCodeURL(context.Background(), "state", testNonce); err == nil || authURL != "" {
+		t.Fatalf("got %q, %v, want an error", authURL, err)
+	}
+
+	// The failure isn't cached: once the issuer is back, discovery succeeds.
+	m.mu.Lock()
+	m.discoveryOK = true
+	m.mu.Unlock()
+	if _, err := p.AuthCodeURL(context.Background(), "state", testNonce); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockIssuer(t)
+	m.issuer = "https://evil.example.com"
+	if _, err := m.provider().AuthCodeURL(context.Background(), "state", testNonce); err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Fatalf("got %v, want an issuer mismatch", err)
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	for _, kid := range []string{"rsa", "ec"} {
+		m := newMockIssuer(t)
+		alg := map[string]string{"rsa": "RS256", "ec": "ES256"}[kid]
+		m.idToken = m.sign(t, alg, kid, m.claims())
+		identity, token, err := m.provider().Exchange(context.Background(), "code", testNonce)
+		if err != nil {
+			t.Fatalf("%s: %s", alg, err)
+		}
+		want := Identity{ID: "user-1", Name: "Jane Doe", Username: "jane", Email: "jane@example.com", EmailVerified: true}
+		if *identity != want {
+			t.Errorf("%s: got %+v, want %+v", alg, *identity, want)
+		}
+		if token.AccessToken != "access-token" {
+			t.Errorf("%s: got access token %q", alg, token.AccessToken)
+		}
+	}
+}
+
+func TestOIDCExchangeWithoutIDToken(t *testing.T) {
+	m := newMockIssuer(t)
+	if _, _, err := m.provider().Exchange(context.Background(), "code", testNonce); err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestOIDCRejectsInvalidIDTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		// token returns the ID token the issuer hands out.
+		token func(t *testing.T, m *mockIssuer) string
+	}{
+		{"bad signature", func(t *testing.T, m *mockIssuer) string {
+			token := m.sign(t, "RS256", "rsa", m.claims())
+			return token[:len(token)-4] + "AAAA"
+		}},
+		{"modified claims", func(t *testing.T, m *mockIssuer) string {
+			parts := strings.Split(m.sign(t, "RS256", "rsa", m.claims()), ".")
+			claims := m.claims()
+			claims["sub"] = "admin"
+			payload, _ := json.Marshal(claims)
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		}},
+		{"signed by another key", func(t *testing.T, m *mockIssuer) string {
+			// Sign with another key under the key ID of the issuer's EC key.
+			key := m.keys["ec"]
+			m.keys["ec"], _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			token := m.sign(t, "ES256", "ec", m.claims())
+			m.keys["ec"] = key
+			return token
+		}},
+		{"unknown key", func(t *testing.T, m *mockIssuer) string {
+			other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			m.keys["other"] = other
+			token := m.sign(t, "ES256", "other", m.claims())
+			delete(m.keys, "other")
+			return token
+		}},
+		{"algorithm doesn't match key", func(t *testing.T, m *mockIssuer) string {
+			token := m.sign(t, "ES256", "ec", m.claims())
+			header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "ec"})
+			return base64.RawURLEncoding.EncodeToString(header) + token[strings.Index(token, "."):]
+		}},
+		{"alg none", func(t *testing.T, m *mockIssuer) string {
+			header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa"})
+			payload, _ := json.Marshal(m.claims())
+			return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+		}},
+		{"wrong issuer", func(t *testing.T, m *mockIssuer) string {
+			claims := m.claims()
+			claims["iss"] = "https://evil.example.com"
+			return m.sign(t, "RS256", "rsa", claims)
+		}},
+		{"wrong audience", func(t *testing.T, m *mockIssuer) string {
+			claims := m.claims()
+			claims["aud"] = []string{"other-client"}
+			return m.sign(t, "RS256", "rsa", claims)
+		}},
+		{"expired", func(t *testing.T, m *mockIssuer) string {
+			claims := m.claims()
+			claims["exp"] = time.Now().Add(-2 * clockSkew).Unix()
+			return m.sign(t, "RS256", "rsa", claims)
+		}},
+		{"no expiry", func(t *testing.T, m *mockIssuer) string {
+			claims := m.claims()
+			delete(claims, "exp")
+			return m.sign(t, "RS256", "rsa", claims)
+		}},
+		{"issued in the future", func(t *testing.T, m *mockIssuer) string {
+			claims := m.claims()
+			claims["iat"] = time.Now().Add(2 * clockSkew).Unix()
+			return m.sign(t, "RS256", "rsa", claims)
+		}},
+		{"wrong nonce", func(t *testing.T, m *mockIssuer) string {
+			claims := m.claims()
+			claims["nonce"] = "other-nonce"
+			return m.sign(t, "RS256", "rsa", claims)
+		}},
+		{"no nonce", func(t *testing.T, m *mockIssuer) string {
+			claims := m.claims()
+			delete(claims, "nonce")
+			return m.sign(t, "RS256", "rsa", claims)
+		}},
+		{"no subject", func(t *testing.T, m *mockIssuer) string {
+			claims := m.claims()
+			delete(claims, "sub")
+			return m.sign(t, "RS256", "rsa", claims)
+		}},
+		{"malformed", func(t *testing.T, m *mockIssuer) string {
+			return "not-a-token"
+		}},
+	}
+	for _, tt := range tests {
+		m := newMockIssuer(t)
+		m.idToken = tt.token(t, m)
+		if identity, _, err := m.provider().Exchange(context.Background(), "code", testNonce); err == nil {
+			t.Errorf("%s: accepted, got %+v", tt.name, *identity)
+		}
+	}
+}
+
+// TestOIDCAudienceArray makes sure an ID token for several audiences, including the client, is accepted.
+func TestOIDCAudienceArray(t *testing.T) {
+	m := newMockIssuer(t)
+	claims := m.claims()
+	claims["aud"] = []string{"other-client", testClientID}
+	m.idToken = m.sign(t, "RS256", "rsa", claims)
+	if _, _, err := m.provider().Exchange(context.Background(), "code", testNonce); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOIDCKeyRotation makes sure keys are refetched for an unknown key ID, but not more
+// often than jwksRefreshInterval.
+func TestOIDCKeyRotation(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider()
+	m.idToken = m.sign(t, "RS256", "rsa", m.claims())
+	if _, _, err := p.Exchange(context.Background(), "code", testNonce); err != nil {
+		t.Fatal(err)
+	}
+
+	// A token signed with a new key is rejected while the keys were fetched recently.
+	rotated, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	m.mu.Lock()
+	m.keys["rotated"] = rotated
+	m.mu.Unlock()
+	m.idToken = m.sign(t, "ES256", "rotated", m.claims())
+	if _, _, err := p.Exchange(context.Background(), "code", testNonce); err == nil {
+		t.Fatal("token with an unknown key accepted")
+	}
+	if m.jwksFetches != 1 {
+		t.Fatalf("got %d fetches of the keys, want 1", m.jwksFetches)
+	}
+
+	// Once the interval has passed, the keys are refetched and the new key is found.
+	p.keysAt = time.Now().Add(-jwksRefreshInterval)
+	if _, _, err := p.Exchange(context.Background(), "code", testNonce); err != nil {
+		t.Fatal(err)
+	}
+	if m.jwksFetches != 2 {
+		t.Fatalf("got %d fetches of the keys, want 2", m.jwksFetches)
+	}
+}
@@ -0,0 +1,122 @@
+// Package oauth implements signing in with external identity providers. Every provider
+// is configured in the app's config file and registered under its name, which is part of
+// the provider's routes: /oauth/{provider}/connect and /oauth/{provider}/callback.
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/oauth2"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Provider types that can be configured. "gitlab" and "google" are OpenID Connect
+// providers with a preset issuer. "oidc" works with any OpenID Connect provider.
+const (
+	TypeGithub = "github"
+	TypeGitlab = "gitlab"
+	TypeGoogle = "google"
+	TypeOIDC   = "oidc"
+)
+
+// Config represents the configuration of a single provider.
+// Name defaults to Type. Issuer is required for the type "oidc" only.
+// Scopes replace the default scopes of the provider type if set.
+type Config struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	ClientID     string   `json:"id"`
+	ClientSecret string   `json:"secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Issuer       string   `json:"issuer"`
+	Scopes       []string `json:"scopes"`
+}
+
+// Identity is the user as identified by a provider. ID is the user's stable, unique
+// identifier in the provider's system. EmailVerified reports whether the provider
+// vouches that the user owns the email address.
+type Identity struct {
+	ID            string
+	Name          string
+	Username      string
+	Email         string
+	EmailVerified bool
+}
+
+// Provider is an external identity provider users can sign in with.
+// AuthCodeURL returns the url of the provider's consent page, or an error if the provider can't
+// be reached to find out what that url is. The provider sends the user
+// back to the callback with the state and a code, which Exchange trades for the user's
+// identity and the provider's token. The nonce binds the identity to the sign-in attempt,
+// for providers that support it (OpenID Connect).
+type Provider interface {
+	Name() string
+	AuthCodeURL(ctx context.Context, state, nonce string) (string, error)
+	Exchange(ctx context.Context, code, nonce string) (*Identity, *oauth2.Token, error)
+}
+
+// Registry holds all configured providers by name.
+type Registry struct {
+	providers map[string]Provider
+}
+
+// NewRegistry creates a provider for every config and returns the registry holding them.
+// Providers talk to their identity provider through client, or a default client if it's nil.
+func NewRegistry(client *http.Client, configs ...Config) (*Registry, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	r := &Registry{
+		providers: make(map[string]Provider),
+	}
+	for _, c := range configs {
+		if c.Name == "" {
+			c.Name = c.Type
+		}
+		if _, exists := r.providers[c.Name]; exists {
+			return nil, fmt.Errorf("oauth: provider %q is configured twice", c.Name)
+		}
+		var p Provider
+		switch c.Type {
+		case TypeGithub:
+			p = newGithub(c, client)
+		case TypeGitlab:
+			if c.Issuer == "" {
+				c.Issuer = "https://gitlab.com"
+			}
+			p = newOIDC(c, client)
+		case TypeGoogle:
+			if c.Issuer == "" {
+				c.Issuer = "https://accounts.google.com"
+			}
+			p = newOIDC(c, client)
+		case TypeOIDC:
+			if c.Issuer == "" {
+				return nil, fmt.Errorf("oauth: provider %q has no issuer", c.Name)
+			}
+			p = newOIDC(c, client)
+		default:
+			return nil, fmt.Errorf("oauth: provider %q has unknown type %q", c.Name, c.Type)
+		}
+		r.providers[c.Name] = p
+	}
+	return r, nil
+}
+
+// Get returns the provider with the given name.
+func (r *Registry) Get(name string) (Provider, bool) {
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+// Names returns the names of all configured providers in alphabetical order.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
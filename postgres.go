@@ -3,6 +3,7 @@ package main
 import (
 	//"context"
 	"fmt"
+	"log"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -46,13 +47,60 @@ func Open(db *DB, isProd bool) (err error) {
 
 // AutoMigrate runs database migrations for all tables.
 func AutoMigrate(db *DB) error {
-	return db.Gorm.AutoMigrate(
+	// Remember tokens moved from the users table to the sessions table. The old column
+	// must go, since it's "not null" and new user records would no longer satisfy that.
+	if db.Gorm.Migrator().HasColumn(&domain.User{}, "remember_hash") {
+		if err := db.Gorm.Migrator().DropColumn(&domain.User{}, "remember_hash"); err != nil {
+			return err
+		}
+	}
+	// Email verification was introduced after the first users signed up. They are grandfathered
+	// in as verified once the column is added, so their capabilities aren't restricted.
+	grandfatherVerified := !db.Gorm.Migrator().HasColumn(&domain.User{}, "email_verified_at")
+	err := db.Gorm.AutoMigrate(
 		domain.User{},
 		domain.OAuth{},
 		domain.Tweet{},
 		domain.Follow{},
 		domain.Like{},
+		domain.TweetStat{},
+		domain.Session{},
+		domain.PasswordReset{},
+		domain.TwoFactor{},
+		domain.RecoveryCode{},
+		domain.LoginChallenge{},
+		domain.Credential{},
+		domain.WebAuthnChallenge{},
+		domain.Throttle{},
+		domain.AccessToken{},
+		domain.OAuthClient{},
+		domain.OAuthGrant{},
+		domain.OAuthCode{},
+		domain.OAuthRefreshToken{},
+		domain.Export{},
+		domain.Import{},
+		domain.ImportedTweet{},
+		domain.Image{},
 	)
+	if err != nil {
+		return err
+	}
+	if grandfatherVerified {
+		if err := db.Gorm.Exec("UPDATE users SET email_verified_at = created_at").Error; err != nil {
+			return err
+		}
+	}
+	// Searching images by alt text matches substrings with ILIKE, which a plain btree index
+	// can't serve. A trigram index can, if the database role may create the pg_trgm extension.
+	// Otherwise, the search still works, just without an index.
+	err = db.Gorm.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error
+	if err == nil {
+		err = db.Gorm.Exec("CREATE INDEX IF NOT EXISTS idx_media_alt_text_trgm ON media USING gin (alt_text gin_trgm_ops)").Error
+	}
+	if err != nil {
+		log.Printf("[postgres] warning: cannot index alt texts for search, it will be slower: %s", err)
+	}
+	return nil
 }
 
 // DestructiveReset drops all tables and rebuilds them.
@@ -63,6 +111,24 @@ func DestructiveReset(db *DB) error {
 		domain.Tweet{},
 		domain.Follow{},
 		domain.Like{},
+		domain.TweetStat{},
+		domain.Session{},
+		domain.PasswordReset{},
+		domain.TwoFactor{},
+		domain.RecoveryCode{},
+		domain.LoginChallenge{},
+		domain.Credential{},
+		domain.WebAuthnChallenge{},
+		domain.Throttle{},
+		domain.AccessToken{},
+		domain.OAuthClient{},
+		domain.OAuthGrant{},
+		domain.OAuthCode{},
+		domain.OAuthRefreshToken{},
+		domain.Export{},
+		domain.Import{},
+		domain.ImportedTweet{},
+		domain.Image{},
 	)
 	if err != nil {
 		return err